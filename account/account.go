@@ -0,0 +1,177 @@
+package account
+
+import (
+	"errors"
+	"github.com/Akvicor/glog"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"sms/apikey"
+	"sms/config"
+	"sms/db"
+	"sync"
+)
+
+// Roles of a user. An admin manages everything, an operator sends and reads history, a viewer
+// only reads history.
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+var Roles = []string{RoleAdmin, RoleOperator, RoleViewer}
+
+// roleScopes are the API key scopes a role is granted
+var roleScopes = map[string]string{
+	RoleAdmin:    apikey.ScopeAdmin,
+	RoleOperator: apikey.ScopeSend + "," + apikey.ScopeHistory + "," + apikey.ScopeOTP,
+	RoleViewer:   apikey.ScopeHistory,
+}
+
+var (
+	ErrInvalid  = errors.New("invalid username or password")
+	ErrUsername = errors.New("username must be 1 to 64 letters, digits or ._@-")
+	ErrPassword = errors.New("password must be 8 to 72 bytes")
+	ErrRole     = errors.New("role must be admin, operator or viewer")
+	ErrExists   = errors.New("username is taken")
+	ErrFailed   = errors.New("saving the user failed")
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dummyHash is compared against when a username does not exist, so a login takes as long
+// for unknown users as for wrong passwords
+var dummyHash struct {
+	sync.Once
+	hash []byte
+}
+
+// ValidRole reports whether r is a known role
+func ValidRole(r string) bool {
+	_, ok := roleScopes[r]
+	return ok
+}
+
+// HashPassword returns the bcrypt hash of a password, bcrypt ignores what is past 72 bytes so
+// longer passwords are refused
+func HashPassword(password string) (string, error) {
+	if len(password) < 8 || len(password) > 72 {
+		return "", ErrPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Authenticate checks the password of an enabled user
+func Authenticate(username, password string) (*db.UserModel, error) {
+	u := db.GetUserByName(username)
+	if u == nil {
+		dummyHash.Do(func() {
+			dummyHash.hash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(password))
+		return nil, ErrInvalid
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil || u.Disabled {
+		return nil, ErrInvalid
+	}
+	return u, nil
+}
+
+// Resolve returns the enabled user of a login session, nil when it was deleted or disabled
+func Resolve(username string) *db.UserModel {
+	if username == "" {
+		return nil
+	}
+	u := db.GetUserByName(username)
+	if u == nil || u.Disabled {
+		return nil
+	}
+	return u
+}
+
+// Create adds a user, devices must already be normalized
+func Create(username, password, role, devices string) (*db.UserModel, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrUsername
+	}
+	if !ValidRole(role) {
+		return nil, ErrRole
+	}
+	if db.GetUserByName(username) != nil {
+		return nil, ErrExists
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	u := &db.UserModel{Username: username, PasswordHash: hash, Role: role, Devices: devices}
+	if db.InsertUser(u) < 0 {
+		return nil, ErrFailed
+	}
+	return u, nil
+}
+
+// SetPassword replaces the password of a user
+func SetPassword(id int64, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if !db.UpdateUserPassword(id, hash) {
+		return ErrFailed
+	}
+	return nil
+}
+
+// SetAdmin creates an admin, an existing user becomes an enabled admin of all devices with
+// the new password so a locked out install can be recovered
+func SetAdmin(username, password string) (*db.UserModel, error) {
+	u := db.GetUserByName(username)
+	if u == nil {
+		return Create(username, password, RoleAdmin, "")
+	}
+	if err := SetPassword(u.ID, password); err != nil {
+		return nil, err
+	}
+	u.Role, u.Devices, u.Disabled = RoleAdmin, "", false
+	if !db.UpdateUser(u) {
+		return nil, ErrFailed
+	}
+	return u, nil
+}
+
+// LastAdmin reports whether u is the only enabled admin, it may not be removed, disabled or
+// lose the role
+func LastAdmin(u *db.UserModel) bool {
+	return u.Role == RoleAdmin && !u.Disabled && db.CountUsers(RoleAdmin) <= 1
+}
+
+// Access is what a user may do as an API key: the scopes of the role and the devices of the
+// user. It has no ID, so key quotas do not apply.
+func Access(u *db.UserModel) *db.APIKeyModel {
+	return &db.APIKeyModel{Name: "user:" + u.Username, Scopes: roleScopes[u.Role], Devices: u.Devices}
+}
+
+// EnableAccounts creates an admin from the [security] login of config.ini while there are no
+// users yet, so an existing install keeps its login
+func EnableAccounts() {
+	if db.CountUsers("") != 0 {
+		return
+	}
+	sec := config.Global.Security
+	if sec.Username == "" || sec.Password == "" {
+		glog.Warning("no users, create an admin with -admin <username>")
+		return
+	}
+	// the config password is kept even when it is shorter than HashPassword allows
+	hash, err := bcrypt.GenerateFromPassword([]byte(sec.Password), bcrypt.DefaultCost)
+	if err != nil || db.InsertUser(&db.UserModel{Username: sec.Username, PasswordHash: string(hash), Role: RoleAdmin}) < 0 {
+		glog.Warning("create admin [%s] from config failed [%v], create one with -admin <username>", sec.Username, err)
+		return
+	}
+	glog.Warning("created admin [%s] from [security] of config, change its password on the users page and remove it from config", sec.Username)
+}
@@ -29,6 +29,7 @@ ENCRYPT_NONE = 0
 TAG_SMS_RECEIVED = 1
 TAG_SMS_SEND = 2
 TAG_SMS_ACK = 3
+TAG_TELEMETRY = 4
 
 -- 处理接收到的通用消息
 --   data:string 通用消息
@@ -351,6 +352,24 @@ sys.timerLoopStart(check_connection, 60000)
 -- 每8s发送一次心跳信号
 --sys.timerLoopStart(heartbeat_send, 8000)
 
+----------------------------------------------------------------
+-- TELEMETRY
+
+-- 上报信号状态，网关用于设备状态和MQTT
+function telemetry_send()
+  local body = json.encode({
+    csq=mobile.csq(),
+    rssi=mobile.rssi(),
+    rsrp=mobile.rsrp(),
+    rsrq=mobile.rsrq(),
+    snr=mobile.snr()
+  })
+  msg_send(TAG_TELEMETRY, body)
+end
+
+-- 每60s上报一次信号状态
+sys.timerLoopStart(telemetry_send, 60000)
+
 ----------------------------------------------------------------
 -- UTIL
 
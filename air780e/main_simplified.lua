@@ -21,6 +21,7 @@ ENCRYPT_NONE = 0
 TAG_SMS_RECEIVED = 1
 TAG_SMS_SEND = 2
 TAG_SMS_ACK = 3
+TAG_TELEMETRY = 4
 
 ----------------------------------------------------------------
 -- Message handling
@@ -177,6 +178,22 @@ end
 
 sms.setNewSmsCb(sms_handler)
 
+----------------------------------------------------------------
+-- Telemetry (radio status for the gateway)
+
+function telemetry_send()
+  local body = json.encode({
+    csq=mobile.csq(),
+    rssi=mobile.rssi(),
+    rsrp=mobile.rsrp(),
+    rsrq=mobile.rsrq(),
+    snr=mobile.snr()
+  })
+  msg_send(TAG_TELEMETRY, body)
+end
+
+sys.timerLoopStart(telemetry_send, 60000)
+
 ----------------------------------------------------------------
 -- Utility Functions
 
@@ -0,0 +1,257 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sms/config"
+	"sms/db"
+	"strings"
+	"time"
+)
+
+// Scopes of an API key, admin includes the others
+const (
+	ScopeSend    = "send"
+	ScopeHistory = "history"
+	ScopeOTP     = "otp"
+	ScopeAdmin   = "admin"
+)
+
+var Scopes = []string{ScopeSend, ScopeHistory, ScopeOTP, ScopeAdmin}
+
+var (
+	ErrInvalid      = errors.New("invalid api key")
+	ErrRevoked      = errors.New("api key revoked")
+	ErrExpired      = errors.New("api key expired")
+	ErrIPNotAllowed = errors.New("api key not allowed from this address")
+	ErrQuota        = errors.New("api key send quota exceeded")
+)
+
+const (
+	secretPrefix = "sk_"
+	// prefixLen is how much of a secret is kept to recognize the key
+	prefixLen = len(secretPrefix) + 8
+	// touchInterval limits the writes of last-used tracking
+	touchInterval = time.Minute
+)
+
+// Generate returns a new secret, its display prefix and the hash stored in the database
+func Generate() (secret, prefix, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	secret = secretPrefix + hex.EncodeToString(b)
+	return secret, secret[:prefixLen], Hash(secret), nil
+}
+
+// Hash is the stored form of a secret, keys are random so a plain SHA-256 is enough
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// legacy is the access_key of config.ini, it has every scope and no limits
+func legacy() *db.APIKeyModel {
+	return &db.APIKeyModel{Name: "access_key", Scopes: ScopeAdmin}
+}
+
+// IsLegacy reports whether k is the access_key of config.ini
+func IsLegacy(k *db.APIKeyModel) bool {
+	return k.ID == 0
+}
+
+// Verify resolves a secret used from ip to its key
+func Verify(secret, ip string) (*db.APIKeyModel, error) {
+	if secret == "" {
+		return nil, ErrInvalid
+	}
+	access := config.Global.Security.AccessKey
+	if access != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(access)) == 1 {
+		return legacy(), nil
+	}
+	if !strings.HasPrefix(secret, secretPrefix) {
+		return nil, ErrInvalid
+	}
+	k := db.GetAPIKeyByHash(Hash(secret))
+	if k == nil {
+		return nil, ErrInvalid
+	}
+	if err := check(k, ip, time.Now()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// check applies the revocation, expiry and address limits of a stored key and tracks its use
+func check(k *db.APIKeyModel, ip string, now time.Time) error {
+	if IsLegacy(k) {
+		return nil
+	}
+	switch {
+	case k.RevokedAt != 0:
+		return ErrRevoked
+	case k.ExpiresAt != 0 && now.Unix() >= k.ExpiresAt:
+		return ErrExpired
+	case !AllowsIP(k, ip):
+		return ErrIPNotAllowed
+	}
+	if now.Sub(time.Unix(k.LastUsedAt, 0)) >= touchInterval || k.LastUsedIP != ip {
+		db.TouchAPIKey(k.ID, ip)
+	}
+	return nil
+}
+
+// HasScope reports whether k grants scope
+func HasScope(k *db.APIKeyModel, scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted reports whether k is limited to some devices
+func Restricted(k *db.APIKeyModel) bool {
+	return len(k.DeviceList()) > 0
+}
+
+// AllowsDevice reports whether k may use a device or pool, a pool in the list allows its devices
+func AllowsDevice(k *db.APIKeyModel, device string) bool {
+	list := k.DeviceList()
+	if len(list) == 0 {
+		return true
+	}
+	for _, name := range list {
+		if name == device {
+			return true
+		}
+		for _, pool := range config.Global.Pools {
+			if pool.Name != name {
+				continue
+			}
+			for _, member := range pool.Devices {
+				if member == device {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// DeviceNames returns the devices k may use with its pools expanded, empty for all
+func DeviceNames(k *db.APIKeyModel) []string {
+	names := make([]string, 0)
+	for _, name := range k.DeviceList() {
+		names = append(names, name)
+		for _, pool := range config.Global.Pools {
+			if pool.Name == name {
+				names = append(names, pool.Devices...)
+			}
+		}
+	}
+	return names
+}
+
+// AllowsIP reports whether k may be used from ip, the list holds addresses and CIDRs
+func AllowsIP(k *db.APIKeyModel, ip string) bool {
+	list := k.IPList()
+	if len(list) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, entry := range list {
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			if n.Contains(parsed) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Consume counts n messages against the quotas of k
+func Consume(k *db.APIKeyModel, n int) error {
+	if IsLegacy(k) || (k.DailyQuota <= 0 && k.MonthlyQuota <= 0) {
+		return nil
+	}
+	if !db.ConsumeAPIKeyQuota(k.ID, n) {
+		return ErrQuota
+	}
+	return nil
+}
+
+// Refund gives back messages counted by Consume that were not sent
+func Refund(k *db.APIKeyModel, n int) {
+	if IsLegacy(k) || (k.DailyQuota <= 0 && k.MonthlyQuota <= 0) {
+		return
+	}
+	db.ConsumeAPIKeyQuota(k.ID, -n)
+}
+
+// ConsumeID counts n messages a campaign or schedule sends on behalf of the key id, it fails
+// when the key was revoked or expired since
+func ConsumeID(id int64, n int) error {
+	k := db.GetAPIKey(id)
+	switch {
+	case k == nil || k.RevokedAt != 0:
+		return ErrRevoked
+	case k.ExpiresAt != 0 && time.Now().Unix() >= k.ExpiresAt:
+		return ErrExpired
+	}
+	return Consume(k, n)
+}
+
+// RefundID gives back messages counted by ConsumeID that were not sent
+func RefundID(id int64, n int) {
+	if k := db.GetAPIKey(id); k != nil {
+		Refund(k, n)
+	}
+}
+
+// Normalize cleans a comma separated list of a key setting and checks its entries
+func Normalize(list string, valid func(string) bool) (string, bool) {
+	items := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || seen[item] {
+			continue
+		}
+		if !valid(item) {
+			return item, false
+		}
+		seen[item] = true
+		items = append(items, item)
+	}
+	return strings.Join(items, ","), true
+}
+
+// ValidScope reports whether s is a known scope
+func ValidScope(s string) bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidIP reports whether s is an address or CIDR
+func ValidIP(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
@@ -0,0 +1,159 @@
+package apikey
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/Akvicor/glog"
+	"os"
+	"path/filepath"
+	"sms/config"
+	"sms/db"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed request
+const (
+	HeaderKeyID     = "X-SMS-Key-ID"
+	HeaderTimestamp = "X-SMS-Timestamp"
+	HeaderNonce     = "X-SMS-Nonce"
+	HeaderSignature = "X-SMS-Signature"
+)
+
+var (
+	ErrSignature = errors.New("invalid request signature")
+	ErrTimestamp = errors.New("request timestamp outside the allowed clock skew")
+	ErrNonce     = errors.New("request nonce already used")
+	// ErrUnsigned refuses a plain key when [api] require_signature is set
+	ErrUnsigned = errors.New("api key must be sent as a signed request")
+)
+
+const (
+	signaturePrefix = "sha256="
+	minNonceLen     = 16
+	maxNonceLen     = 64
+)
+
+// nonces remembers when expired nonces were last dropped from the database
+var nonces = struct {
+	sync.Mutex
+	prune int64
+}{}
+
+// pepper is the server-side secret signing keys are derived with, see Pepper
+var pepper struct {
+	sync.Once
+	value []byte
+}
+
+// Skew is how far the timestamp of a signed request may be from the clock of the gateway
+func Skew() time.Duration {
+	if config.Global.API.SignatureSkew > 0 {
+		return time.Duration(config.Global.API.SignatureSkew) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// Pepper is [api] signing_pepper, or when it is empty a random pepper kept in signing.pepper
+// next to the database. It is created on first use.
+func Pepper() []byte {
+	pepper.Do(func() {
+		if config.Global.API.SigningPepper != "" {
+			pepper.value = []byte(config.Global.API.SigningPepper)
+			return
+		}
+		path := filepath.Join(filepath.Dir(config.Global.Database.Path), "signing.pepper")
+		if data, err := os.ReadFile(path); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			pepper.value = bytes.TrimSpace(data)
+			return
+		}
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			glog.Fatal("generate signing pepper failed [%s]", err.Error())
+		}
+		pepper.value = []byte(hex.EncodeToString(buf))
+		if err := os.WriteFile(path, pepper.value, 0600); err != nil {
+			glog.Fatal("save signing pepper [%s] failed [%s]", path, err.Error())
+		}
+		glog.Info("created signing pepper [%s]", path)
+	})
+	return pepper.value
+}
+
+// SigningKey is the HMAC key of a stored key, derived from the hash the database keeps with
+// the pepper so the database alone is not enough to sign. It is handed out with the secret.
+func SigningKey(hash string) string {
+	mac := hmac.New(sha256.New, Pepper())
+	mac.Write([]byte("sign:" + hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// StringToSign joins the signed parts of a request, uri is the path with its query string
+func StringToSign(method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{strings.ToUpper(method), uri, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n")
+}
+
+// Sign returns the signature header value of a request, clients compute the same
+func Sign(signingKey, method, uri, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(StringToSign(method, uri, timestamp, nonce, body)))
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySigned resolves a signed request to its key. keyID is the id of a stored key, the
+// access_key of config.ini cannot sign. The nonce is remembered only once the signature is
+// valid, so a forged request cannot burn the nonce of a real one.
+func VerifySigned(keyID, timestamp, nonce, signature, method, uri string, body []byte, ip string) (*db.APIKeyModel, error) {
+	id, err := strconv.ParseInt(keyID, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, ErrInvalid
+	}
+	if len(nonce) < minNonceLen || len(nonce) > maxNonceLen {
+		return nil, ErrSignature
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > Skew() || d < -Skew() {
+		return nil, ErrTimestamp
+	}
+
+	k := db.GetAPIKey(id)
+	if k == nil {
+		return nil, ErrInvalid
+	}
+	expected := Sign(SigningKey(k.Hash), method, uri, timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrSignature
+	}
+	if err = check(k, ip, now); err != nil {
+		return nil, err
+	}
+	if !useNonce(strconv.FormatInt(id, 10)+":"+nonce, ts, now) {
+		return nil, ErrNonce
+	}
+	return k, nil
+}
+
+// useNonce records a nonce in the database, it returns false when the nonce was seen within
+// the window
+func useNonce(nonce string, ts int64, now time.Time) bool {
+	window := int64(Skew() / time.Second)
+	nonces.Lock()
+	if now.Unix()-nonces.prune > window {
+		// a nonce older than the window is refused by its timestamp, so it can be forgotten
+		db.DeleteNoncesBefore(now.Unix() - window)
+		nonces.prune = now.Unix()
+	}
+	nonces.Unlock()
+	return db.InsertNonce(nonce, ts)
+}
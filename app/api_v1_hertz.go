@@ -0,0 +1,370 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"sms/apikey"
+	"sms/audit"
+	"sms/callback"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sendRequest struct {
+	Device  string `json:"device"`
+	Sender  string `json:"sender"`
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+	// SendAt holds the message until then, unix seconds or RFC3339
+	SendAt json.RawMessage `json:"send_at,omitempty"`
+	// IdempotencyKey may also be sent as the Idempotency-Key header
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// StatusCallback receives a POST on every state change of the message
+	StatusCallback string `json:"status_callback,omitempty"`
+}
+
+// sendResponse identifies the logical message by MessageID, IDs are its segments
+type sendResponse struct {
+	Device    string  `json:"device"`
+	Route     string  `json:"route"`
+	MessageID int64   `json:"message_id"`
+	IDs       []int64 `json:"ids"`
+}
+
+type messageResponse struct {
+	db.HistoryModel
+	Status   string             `json:"status"`
+	Segments []*messageResponse `json:"segments,omitempty"`
+}
+
+type deviceResponse struct {
+	Name       string           `json:"name"`
+	Region     string           `json:"region"`
+	SelfPhone  string           `json:"self_phone"`
+	DevicePath string           `json:"device_path"`
+	Online     bool             `json:"online"`
+	Health     string           `json:"health"`
+	Telemetry  *model.Telemetry `json:"telemetry"`
+}
+
+type commandResponse struct {
+	Name           string   `json:"name"`
+	Keyword        string   `json:"keyword"`
+	Regex          string   `json:"regex"`
+	Description    string   `json:"description"`
+	AllowedSenders []string `json:"allowed_senders"`
+	Action         string   `json:"action"`
+}
+
+// sendMessage validates req and queues it on its device, routing by phone when no device
+// is given. On failure the error response is already written and nil is returned.
+func sendMessage(c *app.RequestContext, req *sendRequest) *sendResponse {
+	if len(req.Phone) < 1 {
+		writeHTTPRespAPIInvalidInput(c, "invalid phone number")
+		return nil
+	}
+	if len(req.Message) < 1 {
+		writeHTTPRespAPIInvalidInput(c, "invalid message")
+		return nil
+	}
+
+	if req.StatusCallback != "" {
+		if err := callback.Validate(req.StatusCallback); err != nil {
+			writeHTTPRespAPIInvalidInput(c, err.Error())
+			return nil
+		}
+	}
+
+	device, pinned, ok := sendDevice(c, req.Device, req.Phone)
+	if !ok || !consumeQuota(c, 1) {
+		return nil
+	}
+	device, route, ids, err := serial.SendTo(device, req.Sender, req.Phone, req.Message)
+	auditSend(c, &audit.Message{Device: device, Route: route, Sender: req.Sender, Phone: req.Phone, Message: req.Message, IDs: ids}, err)
+	if err != nil {
+		refundQuota(c, 1)
+		glog.Warning("send to [%s] via [%s] failed [%v]", req.Phone, req.Device, err)
+		switch {
+		case errors.Is(err, serial.ErrNoRoute):
+			writeHTTPRespAPIError(c, consts.StatusBadRequest, codeNoRoute, err.Error())
+		case errors.Is(err, serial.ErrDeviceNotFound):
+			writeHTTPRespAPIError(c, consts.StatusNotFound, codeDeviceNotFound, err.Error())
+		default:
+			writeHTTPRespAPIError(c, consts.StatusServiceUnavailable, codeDeviceOffline, err.Error())
+		}
+		return nil
+	}
+	if pinned != "" && route == serial.RouteExplicit {
+		route = pinned
+	}
+	res := &sendResponse{Device: device, Route: route, IDs: ids}
+	if len(ids) > 0 {
+		res.MessageID = ids[0]
+		if req.StatusCallback != "" {
+			if err = callback.Register(res.MessageID, req.StatusCallback); err != nil {
+				glog.Warning("register status callback for [%d] failed [%v]", res.MessageID, err)
+			}
+		}
+	}
+	return res
+}
+
+func apiV1SendMessage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/messages", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeSend) {
+		return
+	}
+
+	req := &sendRequest{}
+	if err := json.Unmarshal(c.Request.Body(), req); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid request: "+err.Error())
+		return
+	}
+	if req.Sender == "" {
+		req.Sender = "api"
+	}
+	sendAt, ok := parseSendAt(strings.Trim(string(req.SendAt), `"`))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid send_at, use unix seconds or RFC3339")
+		return
+	}
+	idempotent(c, idempotencyKey(c, req.IdempotencyKey), req, sendAt)
+}
+
+// newMessageResponse adds the segments and the overall status when his is the first segment of a logical message
+func newMessageResponse(his *db.HistoryModel) *messageResponse {
+	res := &messageResponse{HistoryModel: *his, Status: his.Status()}
+	if his.MessageID != his.ID {
+		return res
+	}
+	segments := db.GetMessageSegments(his.ID)
+	if len(segments) < 2 && (len(segments) == 0 || segments[0].ID == his.ID) {
+		return res
+	}
+	res.Status = db.MessageStatus(segments)
+	for i := range segments {
+		res.Segments = append(res.Segments, &messageResponse{HistoryModel: segments[i], Status: segments[i].Status()})
+	}
+	return res
+}
+
+func apiV1GetMessage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/messages/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid message id")
+		return
+	}
+	his := db.GetHistory(id)
+	if his == nil || !keyAllowsDevice(c, his.Device) {
+		writeHTTPRespAPINotFound(c, "message not found")
+		return
+	}
+
+	writeHTTPRespAPIOk(c, newMessageResponse(his))
+}
+
+func apiV1History(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/history", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	search := &db.HistorySearch{
+		Device:    string(c.Query("device")),
+		Direction: string(c.Query("direction")),
+		Phone:     string(c.Query("phone")),
+		Keyword:   string(c.Query("q")),
+		Devices:   keyDevices(c),
+	}
+	var ok bool
+	if search.Since, ok = parseUnixOrRFC3339(string(c.Query("since"))); !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid since, use unix seconds or RFC3339")
+		return
+	}
+	if search.Until, ok = parseUnixOrRFC3339(string(c.Query("until"))); !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid until, use unix seconds or RFC3339")
+		return
+	}
+	if search.Direction != "" && search.Direction != db.HistoryDirectionIn && search.Direction != db.HistoryDirectionOut {
+		writeHTTPRespAPIInvalidInput(c, "invalid direction, use in or out")
+		return
+	}
+	spam := false
+	if s := string(c.Query("spam")); s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			writeHTTPRespAPIInvalidInput(c, "invalid spam, use true or false")
+			return
+		}
+		spam = v
+	}
+	search.Spam = &spam
+
+	cursor := int64(queryInt(c, "cursor", 0))
+	limit := queryInt(c, "limit", 50)
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	histories := db.SearchHistories(search, cursor, limit)
+	if histories == nil {
+		writeHTTPRespAPIFailed(c, "search history failed")
+		return
+	}
+	items := make([]messageResponse, 0, len(histories))
+	for i := range histories {
+		items = append(items, messageResponse{HistoryModel: histories[i], Status: histories[i].Status()})
+	}
+	var next int64
+	if len(histories) == limit {
+		next = histories[len(histories)-1].ID
+	}
+
+	writeHTTPRespAPIOk(c, map[string]interface{}{
+		"items":       items,
+		"next_cursor": next,
+	})
+}
+
+func apiV1Devices(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/devices", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	devices := make([]deviceResponse, 0, len(config.Global.SerialDevices))
+	for _, dev := range config.Global.SerialDevices {
+		if !keyAllowsDevice(c, dev.Name) {
+			continue
+		}
+		d := deviceResponse{
+			Name:       dev.Name,
+			Region:     dev.Region,
+			SelfPhone:  dev.SelfPhone,
+			DevicePath: dev.DevicePath,
+		}
+		if handler := serial.Manager.GetHandler(dev.Name); handler != nil {
+			d.Online = handler.IsAlive()
+			d.Health = handler.Health()
+			d.Telemetry = handler.GetTelemetry()
+		}
+		devices = append(devices, d)
+	}
+
+	writeHTTPRespAPIOk(c, devices)
+}
+
+func apiV1Pools(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/pools", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	pools := serial.GetPoolStatus()
+	if keyDevices(c) != nil {
+		allowed := pools[:0]
+		for _, p := range pools {
+			if keyAllowsDevice(c, p.Name) {
+				allowed = append(allowed, p)
+			}
+		}
+		pools = allowed
+	}
+
+	writeHTTPRespAPIOk(c, pools)
+}
+
+func apiV1Config(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/config", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, map[string]interface{}{
+		"rules":    db.GetAllRules(false),
+		"filters":  db.GetAllFilterEntries(),
+		"commands": commandList(),
+	})
+}
+
+func apiV1ConfigCommands(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/config/commands", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, commandList())
+}
+
+func apiV1ConfigRule(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/config/rules/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid rule id")
+		return
+	}
+	r := db.GetRule(id)
+	if r == nil {
+		writeHTTPRespAPINotFound(c, "rule not found")
+		return
+	}
+
+	writeHTTPRespAPIOk(c, r)
+}
+
+// commandList returns the configured SMS commands without their secrets, commands are
+// defined in config.ini and are read only over the API
+func commandList() []commandResponse {
+	commands := make([]commandResponse, 0, len(config.Global.Commands))
+	for _, cmd := range config.Global.Commands {
+		commands = append(commands, commandResponse{
+			Name:           cmd.Name,
+			Keyword:        cmd.Keyword,
+			Regex:          cmd.Regex,
+			Description:    cmd.Description,
+			AllowedSenders: cmd.AllowedSenders,
+			Action:         strings.ToLower(cmd.Action),
+		})
+	}
+	return commands
+}
+
+// parseUnixOrRFC3339 accepts unix seconds or an RFC3339 time, an empty string is 0
+func parseUnixOrRFC3339(s string) (int64, bool) {
+	if s == "" {
+		return 0, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), true
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,260 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/apikey"
+	"sms/db"
+	"sms/serial"
+	"sms/static"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type keyRequest struct {
+	Name string `json:"name"`
+	// Scopes, Devices and AllowedIPs are comma separated, empty Devices and AllowedIPs allow all
+	Scopes       string `json:"scopes"`
+	Devices      string `json:"devices"`
+	AllowedIPs   string `json:"allowed_ips"`
+	DailyQuota   int    `json:"daily_quota"`
+	MonthlyQuota int    `json:"monthly_quota"`
+	// ExpiresAt is unix seconds or RFC3339, empty or 0 never expires
+	ExpiresAt json.RawMessage `json:"expires_at,omitempty"`
+}
+
+// keySecretResponse carries the secret of a created or rotated key and the HMAC key to sign
+// requests with, they are not shown again
+type keySecretResponse struct {
+	db.APIKeyModel
+	Secret        string `json:"secret"`
+	SigningSecret string `json:"signing_secret"`
+}
+
+// keyView adds readable times for the keys page
+type keyView struct {
+	db.APIKeyModel
+	Expires  string
+	LastUsed string
+}
+
+// bindKey reads the settings of a key from the JSON body into k
+func bindKey(c *app.RequestContext, k *db.APIKeyModel) bool {
+	req := &keyRequest{}
+	if err := json.Unmarshal(c.Request.Body(), req); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid request: "+err.Error())
+		return false
+	}
+	k.Name = strings.TrimSpace(req.Name)
+	if k.Name == "" {
+		writeHTTPRespAPIInvalidInput(c, "name is required")
+		return false
+	}
+	scopes, ok := apikey.Normalize(req.Scopes, apikey.ValidScope)
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid scope ["+scopes+"], use "+strings.Join(apikey.Scopes, ", "))
+		return false
+	}
+	if scopes == "" {
+		writeHTTPRespAPIInvalidInput(c, "at least one scope is required")
+		return false
+	}
+	devices, ok := apikey.Normalize(req.Devices, serial.Exists)
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "unknown device or pool ["+devices+"]")
+		return false
+	}
+	ips, ok := apikey.Normalize(req.AllowedIPs, apikey.ValidIP)
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid address or CIDR ["+ips+"]")
+		return false
+	}
+	if req.DailyQuota < 0 || req.MonthlyQuota < 0 {
+		writeHTTPRespAPIInvalidInput(c, "quotas must not be negative, 0 is unlimited")
+		return false
+	}
+	expires, ok := parseUnixOrRFC3339(strings.Trim(string(req.ExpiresAt), `"`))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid expires_at, use unix seconds or RFC3339")
+		return false
+	}
+	k.Scopes, k.Devices, k.AllowedIPs = scopes, devices, ips
+	k.DailyQuota, k.MonthlyQuota, k.ExpiresAt = req.DailyQuota, req.MonthlyQuota, expires
+	return true
+}
+
+// getKey loads the key of the id parameter, on failure the error response is already written
+func getKey(c *app.RequestContext) *db.APIKeyModel {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid key id")
+		return nil
+	}
+	k := db.GetAPIKey(id)
+	if k == nil {
+		writeHTTPRespAPINotFound(c, "key not found")
+		return nil
+	}
+	return k
+}
+
+func keyList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/keys", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	keys := db.GetAllAPIKeys()
+	if keys == nil {
+		writeHTTPRespAPIFailed(c, "get keys failed")
+		return
+	}
+
+	writeHTTPRespAPIOk(c, keys)
+}
+
+// keyCreate returns the secret of the new key once, only its hash is stored
+func keyCreate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/keys", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	k := &db.APIKeyModel{}
+	if !bindKey(c, k) {
+		return
+	}
+	secret, prefix, hash, err := apikey.Generate()
+	if err != nil {
+		writeHTTPRespAPIFailed(c, "generate key failed: "+err.Error())
+		return
+	}
+	k.Prefix, k.Hash = prefix, hash
+	if db.InsertAPIKey(k) < 0 {
+		writeHTTPRespAPIFailed(c, "insert key failed")
+		return
+	}
+	glog.Info("api key [%d] %s created with scopes [%s]", k.ID, k.Name, k.Scopes)
+	auditRecord(c, "key.create", auditTarget("key", k.ID), nil, k)
+
+	writeHTTPRespAPIOk(c, &keySecretResponse{APIKeyModel: *k, Secret: secret, SigningSecret: apikey.SigningKey(k.Hash)})
+}
+
+func keyUpdate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/keys/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	k := getKey(c)
+	if k == nil {
+		return
+	}
+	before := *k
+	if !bindKey(c, k) {
+		return
+	}
+	if !db.UpdateAPIKey(k) {
+		writeHTTPRespAPIFailed(c, "update key failed")
+		return
+	}
+	after := db.GetAPIKey(k.ID)
+	auditRecord(c, "key.update", auditTarget("key", k.ID), &before, after)
+
+	writeHTTPRespAPIOk(c, after)
+}
+
+// keyRotate replaces the secret of a key, the old secret stops working at once
+func keyRotate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/keys/:id/rotate", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	k := getKey(c)
+	if k == nil {
+		return
+	}
+	if k.RevokedAt != 0 {
+		writeHTTPRespAPIInvalidInput(c, "key is revoked")
+		return
+	}
+	secret, prefix, hash, err := apikey.Generate()
+	if err != nil {
+		writeHTTPRespAPIFailed(c, "generate key failed: "+err.Error())
+		return
+	}
+	if !db.RotateAPIKey(k.ID, prefix, hash) {
+		writeHTTPRespAPIFailed(c, "rotate key failed")
+		return
+	}
+	glog.Info("api key [%d] %s rotated", k.ID, k.Name)
+	after := db.GetAPIKey(k.ID)
+	auditRecord(c, "key.rotate", auditTarget("key", k.ID), k, after)
+
+	writeHTTPRespAPIOk(c, &keySecretResponse{APIKeyModel: *after, Secret: secret, SigningSecret: apikey.SigningKey(after.Hash)})
+}
+
+// keyRevoke disables a key for good, it stays listed with its usage
+func keyRevoke(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/keys/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	k := getKey(c)
+	if k == nil {
+		return
+	}
+	if k.RevokedAt != 0 {
+		writeHTTPRespAPIInvalidInput(c, "key is already revoked")
+		return
+	}
+	if !db.RevokeAPIKey(k.ID) {
+		writeHTTPRespAPIFailed(c, "revoke key failed")
+		return
+	}
+	glog.Info("api key [%d] %s revoked", k.ID, k.Name)
+	after := db.GetAPIKey(k.ID)
+	auditRecord(c, "key.revoke", auditTarget("key", k.ID), k, after)
+
+	writeHTTPRespAPIOk(c, after)
+}
+
+func keysPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/keys", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		keys := db.GetAllAPIKeys()
+		list := make([]*keyView, 0, len(keys))
+		for _, k := range keys {
+			v := &keyView{APIKeyModel: k, Expires: "never", LastUsed: "never"}
+			if k.ExpiresAt > 0 {
+				v.Expires = time.Unix(k.ExpiresAt, 0).Format("2006-01-02 15:04")
+			}
+			if k.LastUsedAt > 0 {
+				v.LastUsed = time.Unix(k.LastUsedAt, 0).Format("2006-01-02 15:04") + " from " + k.LastUsedIP
+			}
+			list = append(list, v)
+		}
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Keys.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":   "API Keys",
+			"keys":    list,
+			"scopes":  apikey.Scopes,
+			"devices": deviceNames(),
+			"pools":   poolNames(),
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/apikey"
+	"sms/audit"
+	"sms/db"
+	"sms/static"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditExportBatch is how many entries an export reads at once
+const auditExportBatch = 500
+
+// auditActor names the API key or login user of a request and where it came from
+func auditActor(c *app.RequestContext) audit.Actor {
+	actor := audit.Actor{IP: c.ClientIP(), UserAgent: string(c.UserAgent())}
+	switch k := requestKey(c); {
+	case requestUser(c) != nil:
+		actor.Name = "user:" + requestUser(c).Username
+	case k != nil && apikey.IsLegacy(k):
+		actor.Name = "access_key"
+	case k != nil:
+		actor.Name = fmt.Sprintf("key:%d %s", k.ID, k.Name)
+	default:
+		actor.Name = "anonymous"
+	}
+	return actor
+}
+
+// auditRecord records an action of the request's actor, before and after are nil for a
+// creation or deletion
+func auditRecord(c *app.RequestContext, action, target string, before, after interface{}) {
+	audit.Record(auditActor(c), action, target, before, after)
+}
+
+// auditSend records a send request, m.Via is set to the path it came in through
+func auditSend(c *app.RequestContext, m *audit.Message, err error) {
+	m.Via = string(c.Path())
+	if err != nil {
+		m.Error = err.Error()
+	}
+	audit.RecordSend(auditActor(c), m)
+}
+
+// auditTarget names an object of the log as kind:id
+func auditTarget(kind string, id int64) string {
+	return kind + ":" + strconv.FormatInt(id, 10)
+}
+
+// controlAction is the action of a control route, its last path segment or delete
+func controlAction(c *app.RequestContext) string {
+	if string(c.Method()) == "DELETE" {
+		return "delete"
+	}
+	p := string(c.Path())
+	return p[strings.LastIndexByte(p, '/')+1:]
+}
+
+// auditSearch reads the filters of the audit list, page and export
+func auditSearch(c *app.RequestContext) (*db.AuditSearch, bool) {
+	since, ok := parseUnixOrRFC3339(string(c.Query("since")))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid since, use unix seconds or RFC3339")
+		return nil, false
+	}
+	until, ok := parseUnixOrRFC3339(string(c.Query("until")))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid until, use unix seconds or RFC3339")
+		return nil, false
+	}
+	return &db.AuditSearch{
+		Actor:  string(c.Query("actor")),
+		Action: string(c.Query("action")),
+		Since:  since,
+		Until:  until,
+	}, true
+}
+
+func auditList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/audit", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	search, ok := auditSearch(c)
+	if !ok {
+		return
+	}
+	page := queryInt(c, "page", 1)
+	size := queryInt(c, "size", 50)
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 500 {
+		size = 50
+	}
+
+	entries, total := db.GetAudits(search, page, size)
+	writeHTTPRespAPIOk(c, &auditListResponse{Total: total, Page: page, Size: size, Entries: entries})
+}
+
+func auditVerify(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/audit/verify", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, audit.Verify())
+}
+
+// auditExport downloads the whole log oldest first with its hashes, as JSON lines that can be
+// verified elsewhere or as CSV
+func auditExport(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/audit/export", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	format := string(c.Query("format"))
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" {
+		writeHTTPRespAPIInvalidInput(c, "invalid format, use jsonl or csv")
+		return
+	}
+	name := "audit-" + time.Now().Format("20060102-150405") + "." + format
+	c.Response.Header.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	w := c.Response.BodyWriter()
+	var write func(m *db.AuditModel) error
+	if format == "csv" {
+		c.Response.Header.Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		defer cw.Flush()
+		_ = cw.Write([]string{"id", "time", "actor", "action", "target", "ip", "user_agent", "before", "after", "prev_hash", "hash"})
+		write = func(m *db.AuditModel) error {
+			return cw.Write([]string{strconv.FormatInt(m.ID, 10), time.Unix(m.CreatedAt, 0).Format(time.RFC3339),
+				m.Actor, m.Action, m.Target, m.IP, m.UserAgent, m.Before, m.After, m.PrevHash, m.Hash})
+		}
+	} else {
+		c.Response.Header.Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(m *db.AuditModel) error {
+			return enc.Encode(m)
+		}
+	}
+
+	var after int64
+	for {
+		list := db.GetAuditsAfter(after, auditExportBatch)
+		for i := range list {
+			if err := write(&list[i]); err != nil {
+				glog.Warning("export audit log failed [%v]", err)
+				return
+			}
+			after = list[i].ID
+		}
+		if len(list) < auditExportBatch {
+			return
+		}
+	}
+}
+
+// auditView adds readable fields for the audit page
+type auditView struct {
+	db.AuditModel
+	Time string
+}
+
+func auditPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/audit", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		search := &db.AuditSearch{Actor: string(c.Query("actor")), Action: string(c.Query("action"))}
+		page := queryInt(c, "page", 1)
+		if page < 1 {
+			page = 1
+		}
+		const size = 20
+		entries, total := db.GetAudits(search, page, size)
+		list := make([]*auditView, 0, len(entries))
+		for _, m := range entries {
+			list = append(list, &auditView{AuditModel: m, Time: time.Unix(m.CreatedAt, 0).Format("2006-01-02 15:04:05")})
+		}
+
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Audit.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":   "Audit Log",
+			"actor":   search.Actor,
+			"action":  search.Action,
+			"entries": list,
+			"page":    page,
+			"prev":    page - 1,
+			"next":    page + 1,
+			"hasNext": int64(page*size) < total,
+			"total":   total,
+		})
+	}
+}
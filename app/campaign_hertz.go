@@ -0,0 +1,219 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"io"
+	"sms/apikey"
+	"sms/campaign"
+	"sms/db"
+	"sms/static"
+	"strconv"
+)
+
+type campaignResponse struct {
+	db.CampaignModel
+	Progress map[string]int64 `json:"progress"`
+}
+
+func campaignWithProgress(c *db.CampaignModel) *campaignResponse {
+	return &campaignResponse{CampaignModel: *c, Progress: db.GetCampaignProgress(c.ID)}
+}
+
+func campaignList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/campaigns", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	campaigns := db.GetAllCampaigns(string(c.Query("status")))
+	list := make([]*campaignResponse, 0, len(campaigns))
+	for i := range campaigns {
+		if keyAllowsDevice(c, campaigns[i].Device) {
+			list = append(list, campaignWithProgress(&campaigns[i]))
+		}
+	}
+	writeHTTPRespAPIOk(c, list)
+}
+
+// campaignCreate takes a multipart form, the recipients come from the file field or the csv field
+func campaignCreate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/campaigns", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeSend) {
+		return
+	}
+
+	startAt, ok := parseUnixOrRFC3339(string(c.FormValue("start_at")))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid start_at, use unix seconds or RFC3339")
+		return
+	}
+	rate, _ := strconv.Atoi(string(c.FormValue("rate_per_minute")))
+	req := &campaign.Campaign{
+		Name:          string(c.FormValue("name")),
+		Template:      string(c.FormValue("template")),
+		Device:        string(c.FormValue("device")),
+		RatePerMinute: rate,
+		WindowStart:   string(c.FormValue("window_start")),
+		WindowEnd:     string(c.FormValue("window_end")),
+		StartAt:       startAt,
+		CSV:           c.FormValue("csv"),
+		APIKeyID:      requestKeyID(c),
+	}
+	if !authorizeDevice(c, req.Device) {
+		return
+	}
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			writeHTTPRespAPIInvalidInput(c, "invalid file: "+err.Error())
+			return
+		}
+		req.CSV, err = io.ReadAll(io.LimitReader(f, 8<<20))
+		_ = f.Close()
+		if err != nil {
+			writeHTTPRespAPIInvalidInput(c, "invalid file: "+err.Error())
+			return
+		}
+	}
+	if len(req.CSV) == 0 {
+		writeHTTPRespAPIInvalidInput(c, "file or csv is required")
+		return
+	}
+
+	id, err := campaign.Create(req)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	cp := db.GetCampaign(id)
+	auditRecord(c, "campaign.create", auditTarget("campaign", id), nil, cp)
+
+	writeHTTPRespAPIOk(c, campaignWithProgress(cp))
+}
+
+// getCampaign loads the campaign of the id parameter, a key limited to some devices only sees
+// the campaigns of its devices. On failure the error response is already written.
+func getCampaign(c *app.RequestContext) *db.CampaignModel {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid campaign id")
+		return nil
+	}
+	cp := db.GetCampaign(id)
+	if cp == nil || !keyAllowsDevice(c, cp.Device) {
+		writeHTTPRespAPINotFound(c, "campaign not found")
+		return nil
+	}
+	return cp
+}
+
+func campaignGet(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/campaigns/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	cp := getCampaign(c)
+	if cp == nil {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, campaignWithProgress(cp))
+}
+
+func campaignRecipients(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/campaigns/:id/recipients", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	cp := getCampaign(c)
+	if cp == nil {
+		return
+	}
+	var status []string
+	if s := string(c.Query("status")); s != "" {
+		status = append(status, s)
+	}
+
+	writeHTTPRespAPIOk(c, db.GetCampaignRecipients(cp.ID, status...))
+}
+
+// campaignResults downloads the per-recipient results as CSV
+func campaignResults(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/campaigns/:id/results", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	cp := getCampaign(c)
+	if cp == nil {
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := campaign.Results(cp.ID, buf); err != nil {
+		writeHTTPRespAPINotFound(c, err.Error())
+		return
+	}
+
+	c.Response.Header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"campaign-%d.csv\"", cp.ID))
+	c.Data(consts.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// campaignControl serves pause, resume and cancel
+func campaignControl(action func(int64) error) app.HandlerFunc {
+	return func(ctx context.Context, c *app.RequestContext) {
+		glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/campaigns/:id/:action", c.Path())
+
+		if !authorize(ctx, c, apikey.ScopeSend) {
+			return
+		}
+
+		cp := getCampaign(c)
+		if cp == nil {
+			return
+		}
+		if err := action(cp.ID); err != nil {
+			writeHTTPRespAPIInvalidInput(c, err.Error())
+			return
+		}
+		after := db.GetCampaign(cp.ID)
+		auditRecord(c, "campaign."+controlAction(c), auditTarget("campaign", cp.ID), cp, after)
+
+		writeHTTPRespAPIOk(c, campaignWithProgress(after))
+	}
+}
+
+func campaignPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/campaigns", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		campaigns := db.GetAllCampaigns("")
+		list := make([]*campaignResponse, 0, len(campaigns))
+		for i := range campaigns {
+			if keyAllowsDevice(c, campaigns[i].Device) {
+				list = append(list, campaignWithProgress(&campaigns[i]))
+			}
+		}
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Campaigns.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":     "Campaigns",
+			"campaigns": list,
+			"devices":   allowedDevices(c, deviceNames()),
+			"pools":     allowedDevices(c, poolNames()),
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"github.com/cloudwego/hertz/pkg/protocol/http1/resp"
+	"sms/apikey"
+	"sms/event"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const eventKeepAlive = 15 * time.Second
+
+// eventSubscription reads the filters and the resume point shared by the SSE and WebSocket streams:
+// ?device=cn,us&type=message,telemetry&last_event_id=N, the Last-Event-ID header wins over the query.
+// A key limited to some devices only gets their events. On failure the error response is already written.
+func eventSubscription(c *app.RequestContext) *event.Subscription {
+	filter := event.Filter{}
+	if devices := string(c.Query("device")); devices != "" {
+		filter.Devices = strings.Split(devices, ",")
+		for _, device := range filter.Devices {
+			if !authorizeDevice(c, device) {
+				return nil
+			}
+		}
+	} else {
+		filter.Devices = keyDevices(c)
+	}
+	if types := string(c.Query("type")); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+	last := string(c.GetHeader("Last-Event-ID"))
+	if last == "" {
+		last = string(c.Query("last_event_id"))
+	}
+	lastID, _ := strconv.ParseInt(last, 10, 64)
+	return event.Subscribe(filter, lastID)
+}
+
+// apiV1Events streams events as Server-Sent Events, EventSource reconnects with Last-Event-ID by itself
+func apiV1Events(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/events", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	sub := eventSubscription(c)
+	if sub == nil {
+		return
+	}
+	defer event.Unsubscribe(sub)
+
+	c.SetStatusCode(consts.StatusOK)
+	c.Response.Header.Set("Content-Type", "text/event-stream; charset=utf-8")
+	c.Response.Header.Set("Cache-Control", "no-cache")
+	c.Response.Header.Set("X-Accel-Buffering", "no")
+	c.Response.HijackWriter(resp.NewChunkedBodyWriter(&c.Response, c.GetWriter()))
+
+	write := func(s string) bool {
+		if _, err := c.Write([]byte(s)); err != nil {
+			return false
+		}
+		return c.Flush() == nil
+	}
+	if !write("retry: 3000\n\n") {
+		return
+	}
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if !write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)) {
+				return
+			}
+		case <-keepAlive.C:
+			if !write(": keep-alive\n\n") {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apiV1EventsWebSocket streams the same events as JSON text messages, a client resumes with ?last_event_id=
+func apiV1EventsWebSocket(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/events/ws", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	sub := eventSubscription(c)
+	if sub == nil {
+		return
+	}
+	upgraded := wsUpgrade(c, func(ws *wsConn) {
+		defer event.Unsubscribe(sub)
+		defer ws.Close()
+
+		closed := make(chan struct{})
+		go func() {
+			_ = ws.ReadLoop()
+			close(closed)
+		}()
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case e, ok := <-sub.C:
+				if !ok {
+					_ = ws.writeFrame(wsOpClose, nil)
+					return
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				if ws.WriteText(data) != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if ws.writeFrame(wsOpPing, nil) != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	})
+	if !upgraded {
+		event.Unsubscribe(sub)
+		writeHTTPRespAPIInvalidInput(c, "websocket upgrade required")
+	}
+}
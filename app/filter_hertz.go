@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/apikey"
+	"sms/db"
+	"sms/filter"
+	"sms/static"
+	"strconv"
+)
+
+func filterList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/filters", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, db.GetAllFilterEntries())
+}
+
+func filterCreate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/filters", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	entry := &db.FilterEntryModel{}
+	if err := json.Unmarshal(c.Request.Body(), entry); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid filter entry: "+err.Error())
+		return
+	}
+	if err := filter.ValidateEntry(entry); err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	if db.InsertFilterEntry(entry) < 0 {
+		writeHTTPRespAPIFailed(c, "insert filter entry failed")
+		return
+	}
+	filter.Reload()
+	auditRecord(c, "filter.create", auditTarget("filter", entry.ID), nil, entry)
+
+	writeHTTPRespAPIOk(c, entry)
+}
+
+func filterDelete(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/filters/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid filter id")
+		return
+	}
+	var before *db.FilterEntryModel
+	for _, e := range db.GetAllFilterEntries() {
+		if e.ID == id {
+			e := e
+			before = &e
+		}
+	}
+	if !db.DeleteFilterEntry(id) {
+		writeHTTPRespAPIFailed(c, "delete filter entry failed")
+		return
+	}
+	filter.Reload()
+	auditRecord(c, "filter.delete", auditTarget("filter", id), before, nil)
+
+	writeHTTPRespAPIOk(c, nil)
+}
+
+func historyFlagSpam(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/history/:id/spam", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid message id")
+		return
+	}
+	spam, err := strconv.ParseBool(string(c.PostForm("spam")))
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid spam, use true or false")
+		return
+	}
+	if err = filter.Flag(id, spam); err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	auditRecord(c, "history.spam", auditTarget("message", id), nil, map[string]bool{"spam": spam})
+
+	writeHTTPRespAPIOk(c, map[string]interface{}{"id": id, "spam": spam})
+}
+
+func spamPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/spam", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		his := db.GetSpamHistories(500)
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Spam.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "Spam", "histories": his})
+	}
+}
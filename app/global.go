@@ -4,11 +4,17 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/server"
 	"github.com/cloudwego/hertz/pkg/common/config"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
+	"net"
+	"sms/campaign"
 	smsConfig "sms/config"
+	"sms/schedule"
+	"strings"
 )
 
 var Global *server.Hertz
@@ -37,9 +43,43 @@ func Generate() {
 	}
 
 	Global = server.Default(opts...)
+	// hertz believes forwarded headers from every peer by default
+	Global.SetClientIPFunc(app.ClientIPWithOption(app.ClientIPOptions{
+		RemoteIPHeaders: []string{"X-Forwarded-For", "X-Real-IP"},
+		TrustedCIDRs:    trustedProxies(),
+	}))
+	if initRateLimit() {
+		Global.Use(rateLimit)
+	}
 
 	// Register routes
 	registerRoutes()
+	checkOpenAPI()
+}
+
+// trustedProxies parses [server] trusted_proxies, a single address is a /32 or /128
+func trustedProxies() []*net.IPNet {
+	list := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(smsConfig.Global.Server.TrustedProxies, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			list = append(list, n)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			glog.Warning("invalid trusted proxy [%s]", entry)
+			continue
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return list
 }
 
 func registerRoutes() {
@@ -51,13 +91,102 @@ func registerRoutes() {
 	Global.GET("/login", loginGet)
 	Global.POST("/login", loginPost)
 	Global.GET("/random_key", randomKey)
-	Global.POST("/send_sms", sendSMSCN)
-	Global.GET("/history", historyCN)
-	Global.POST("/send_sms_cn", sendSMSCN)
-	Global.GET("/history_cn", historyCN)
-	Global.POST("/send_sms_us", sendSMSUS)
-	Global.GET("/history_us", historyUS)
+	Global.GET("/send_sms", sendSMS)
+	Global.POST("/send_sms", sendSMS)
+	Global.GET("/history", history)
+	for _, dev := range smsConfig.Global.SerialDevices {
+		Global.GET("/send_sms_"+dev.Name, sendSMSDevice(dev.Name))
+		Global.POST("/send_sms_"+dev.Name, sendSMSDevice(dev.Name))
+		Global.GET("/history_"+dev.Name, historyDevice(dev.Name))
+	}
+	Global.GET("/spam", spamPage)
+	Global.GET("/campaigns", campaignPage)
+	Global.GET("/schedules", schedulePage)
+	Global.GET("/keys", keysPage)
+	Global.GET("/audit", auditPage)
+	Global.GET("/users", usersPage)
 	Global.GET("/help", help)
+	Global.GET("/api/openapi.json", openAPIJSON)
+	Global.GET("/metrics", metricsHandler)
+
+	// Rule routes
+	Global.GET("/rules/test", ruleTestPage)
+	Global.GET("/rules/logs", ruleLogsPage)
+	Global.GET("/api/rules", ruleList)
+	Global.POST("/api/rules", ruleCreate)
+	Global.PUT("/api/rules/:id", ruleUpdate)
+	Global.DELETE("/api/rules/:id", ruleDelete)
+	Global.POST("/api/rules/:id/toggle", ruleToggle)
+	Global.POST("/api/rules/test", ruleTest)
+	Global.GET("/api/rules/logs", ruleLogs)
+	Global.GET("/api/rules/stats", ruleStats)
+
+	// Filter routes
+	Global.GET("/api/filters", filterList)
+	Global.POST("/api/filters", filterCreate)
+	Global.DELETE("/api/filters/:id", filterDelete)
+	Global.POST("/api/history/:id/spam", historyFlagSpam)
+
+	// OTP routes
+	Global.GET("/api/otp/latest", otpLatest)
+
+	// API v1, the routes above are kept for old clients
+	Global.POST("/api/v1/messages", apiV1SendMessage)
+	Global.GET("/api/v1/messages/:id", apiV1GetMessage)
+	Global.GET("/api/v1/history", apiV1History)
+	Global.POST("/api/v1/history/:id/spam", historyFlagSpam)
+	Global.GET("/api/v1/devices", apiV1Devices)
+	Global.GET("/api/v1/pools", apiV1Pools)
+	Global.GET("/api/v1/campaigns", campaignList)
+	Global.POST("/api/v1/campaigns", campaignCreate)
+	Global.GET("/api/v1/campaigns/:id", campaignGet)
+	Global.GET("/api/v1/campaigns/:id/recipients", campaignRecipients)
+	Global.GET("/api/v1/campaigns/:id/results", campaignResults)
+	Global.POST("/api/v1/campaigns/:id/pause", campaignControl(campaign.Pause))
+	Global.POST("/api/v1/campaigns/:id/resume", campaignControl(campaign.Resume))
+	Global.POST("/api/v1/campaigns/:id/cancel", campaignControl(campaign.Cancel))
+	Global.GET("/api/v1/events", apiV1Events)
+	Global.GET("/api/v1/events/ws", apiV1EventsWebSocket)
+	Global.GET("/api/v1/schedules", scheduleList)
+	Global.POST("/api/v1/schedules", scheduleCreate)
+	Global.GET("/api/v1/schedules/:id", scheduleGet)
+	Global.PUT("/api/v1/schedules/:id", scheduleUpdate)
+	Global.DELETE("/api/v1/schedules/:id", scheduleControl(schedule.Delete))
+	Global.GET("/api/v1/schedules/:id/runs", scheduleRuns)
+	Global.POST("/api/v1/schedules/:id/pause", scheduleControl(schedule.Pause))
+	Global.POST("/api/v1/schedules/:id/resume", scheduleControl(schedule.Resume))
+	Global.GET("/api/v1/otp/latest", otpLatest)
+	Global.GET("/api/v1/config", apiV1Config)
+	Global.GET("/api/v1/config/commands", apiV1ConfigCommands)
+	Global.GET("/api/v1/config/rules", ruleList)
+	Global.POST("/api/v1/config/rules", ruleCreate)
+	Global.GET("/api/v1/config/rules/:id", apiV1ConfigRule)
+	Global.PUT("/api/v1/config/rules/:id", ruleUpdate)
+	Global.DELETE("/api/v1/config/rules/:id", ruleDelete)
+	Global.POST("/api/v1/config/rules/:id/toggle", ruleToggle)
+	Global.POST("/api/v1/config/rules/test", ruleTest)
+	Global.GET("/api/v1/config/rules/logs", ruleLogs)
+	Global.GET("/api/v1/config/rules/stats", ruleStats)
+	Global.GET("/api/v1/config/filters", filterList)
+	Global.POST("/api/v1/config/filters", filterCreate)
+	Global.DELETE("/api/v1/config/filters/:id", filterDelete)
+	Global.GET("/api/v1/keys", keyList)
+	Global.POST("/api/v1/keys", keyCreate)
+	Global.PUT("/api/v1/keys/:id", keyUpdate)
+	Global.DELETE("/api/v1/keys/:id", keyRevoke)
+	Global.POST("/api/v1/keys/:id/rotate", keyRotate)
+	Global.GET("/api/v1/audit", auditList)
+	Global.GET("/api/v1/audit/verify", auditVerify)
+	Global.GET("/api/v1/audit/export", auditExport)
+	Global.GET("/api/v1/users", userList)
+	Global.POST("/api/v1/users", userCreate)
+	Global.PUT("/api/v1/users/:id", userUpdate)
+	Global.DELETE("/api/v1/users/:id", userDelete)
+
+	// Twilio-compatible facade
+	Global.POST(twilioMessagesPath+".json", twilioSendMessage)
+	Global.GET(twilioMessagesPath+".json", twilioListMessages)
+	Global.GET(twilioMessagesPath+"/:message", twilioGetMessage)
 }
 
 func StartServer() error {
@@ -6,12 +6,14 @@ import (
 	"github.com/Akvicor/util"
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"sms/account"
+	"sms/apikey"
+	"sms/audit"
 	"sms/config"
 	"sms/db"
-	"sms/model"
-	"sms/serial"
 	"sms/static"
 	"strconv"
+	"strings"
 )
 
 func staticFavicon(ctx context.Context, c *app.RequestContext) {
@@ -21,14 +23,21 @@ func staticFavicon(ctx context.Context, c *app.RequestContext) {
 
 func index(ctx context.Context, c *app.RequestContext) {
 	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/index", c.Path())
-	if !sessionVerify(ctx, c) {
-		loginGet(ctx, c)
+	if !pageVerify(ctx, c, "") {
 		return
 	}
 
 	if string(c.Method()) == "GET" {
+		k := requestKey(c)
 		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
-		_ = static.Index.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "SMS Pusher"})
+		_ = static.Index.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":   "SMS Pusher",
+			"user":    requestUser(c),
+			"devices": allowedDevices(c, deviceNames()),
+			"send":    apikey.HasScope(k, apikey.ScopeSend),
+			"history": apikey.HasScope(k, apikey.ScopeHistory),
+			"admin":   apikey.HasScope(k, apikey.ScopeAdmin),
+		})
 	}
 }
 
@@ -45,12 +54,17 @@ func loginPost(ctx context.Context, c *app.RequestContext) {
 	username := string(c.PostForm("username"))
 	password := string(c.PostForm("password"))
 
-	if username == config.Global.Security.Username && password == config.Global.Security.Password {
+	actor := auditActor(c)
+	actor.Name = "user:" + username
+	if u, err := account.Authenticate(username, password); err == nil {
 		glog.Info("Login successful [%s]", username)
-		sessionUpdate(ctx, c, config.Global.Security.Username)
+		audit.Record(actor, "login", username, nil, nil)
+		db.TouchUserLogin(u.ID, c.ClientIP())
+		sessionUpdate(ctx, c, u.Username)
 		c.Redirect(consts.StatusFound, []byte(string(c.URI().RequestURI())))
 	} else {
-		glog.Info("Login failed: [%s][%s]", username, password)
+		glog.Info("Login failed: [%s]", username)
+		audit.Record(actor, "login.failed", username, nil, nil)
 		c.Redirect(consts.StatusFound, []byte(string(c.URI().RequestURI())))
 	}
 }
@@ -58,8 +72,7 @@ func loginPost(ctx context.Context, c *app.RequestContext) {
 func randomKey(ctx context.Context, c *app.RequestContext) {
 	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/random_key", c.Path())
 
-	if !sessionVerify(ctx, c) && !keyVerify(ctx, c) {
-		writeHTTPRespAPINotAuthorized(c)
+	if !authorize(ctx, c, apikey.ScopeHistory) {
 		return
 	}
 
@@ -85,130 +98,190 @@ func randomKey(ctx context.Context, c *app.RequestContext) {
 	writeHTTPRespAPIOk(c, map[string]interface{}{"key": key})
 }
 
-func sendSMSCN(ctx context.Context, c *app.RequestContext) {
-	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/send_sms_cn", c.Path())
+func sendSMS(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/send_sms", c.Path())
+	sendSMSForm(ctx, c, "")
+}
 
-	if !sessionVerify(ctx, c) && !keyVerify(ctx, c) {
-		writeHTTPRespAPINotAuthorized(c)
-		return
+// sendSMSDevice serves /send_sms_<device>, which old clients use to pick a device
+func sendSMSDevice(device string) app.HandlerFunc {
+	return func(ctx context.Context, c *app.RequestContext) {
+		glog.Debug("[%-4s][%-32s] %s", c.Method(), "/send_sms_"+device, c.Path())
+		sendSMSForm(ctx, c, device)
 	}
+}
 
-	sender := string(c.PostForm("sender"))
-	phone := string(c.PostForm("phone"))
-	message := string(c.PostForm("message"))
-
-	if len(phone) < 1 {
-		writeHTTPRespAPIInvalidInput(c, "invalid phone number")
+// sendSMSForm is the form based send, it shares validation, routing and responses with /api/v1/messages.
+// device is fixed by the route, otherwise it is taken from the optional device field.
+func sendSMSForm(ctx context.Context, c *app.RequestContext, device string) {
+	if string(c.Method()) == "GET" {
+		if !pageVerify(ctx, c, apikey.ScopeSend) {
+			return
+		}
+		if device != "" && !keyAllowsDevice(c, device) {
+			c.String(consts.StatusForbidden, "user may not use device "+device)
+			return
+		}
+		data := map[string]interface{}{"title": "Send SMS", "url": string(c.Path())}
+		if device == "" {
+			data["devices"] = allowedDevices(c, deviceNames())
+		} else {
+			data["title"] = "Send SMS " + strings.ToUpper(device)
+		}
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.SendSMS.Execute(c.Response.BodyWriter(), data)
 		return
 	}
-	if len(message) < 1 {
-		writeHTTPRespAPIInvalidInput(c, "invalid message")
+
+	if !authorize(ctx, c, apikey.ScopeSend) {
 		return
 	}
-	if len(sender) < 1 {
+
+	req := &sendRequest{
+		Device:  device,
+		Sender:  string(c.PostForm("sender")),
+		Phone:   string(c.PostForm("phone")),
+		Message: string(c.PostForm("message")),
+		// optional, for scripts that post the form
+		StatusCallback: string(c.PostForm("status_callback")),
+	}
+	if req.Device == "" {
+		req.Device = string(c.PostForm("device"))
+	}
+	if len(req.Sender) < 1 {
 		writeHTTPRespAPIInvalidInput(c, "invalid sender")
 		return
 	}
-
-	serial.Send("cn", sender, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(phone, message)))
-
-	writeHTTPRespAPIOk(c, nil)
-}
-
-func historyCN(ctx context.Context, c *app.RequestContext) {
-	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/history_cn", c.Path())
-	if !sessionVerify(ctx, c) {
-		loginGet(ctx, c)
+	sendAt, ok := parseSendAt(string(c.PostForm("send_at")))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid send_at")
 		return
 	}
+	idempotent(c, idempotencyKey(c, string(c.PostForm("idempotency_key"))), req, sendAt)
+}
 
-	if string(c.Method()) == "GET" {
-		his := db.GetAllHistories("CN", true)
-		glog.Debug("%#v", his)
-		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
-		_ = static.History.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "History CN", "histories": his})
+func history(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/history", c.Path())
+	device := config.Global.Routing.DefaultDevice
+	if device == "" && len(config.Global.SerialDevices) > 0 {
+		device = config.Global.SerialDevices[0].Name
 	}
+	historyPage(ctx, c, device)
 }
 
-func sendSMSUS(ctx context.Context, c *app.RequestContext) {
-	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/send_sms_us", c.Path())
-
-	if !sessionVerify(ctx, c) && !keyVerify(ctx, c) {
-		writeHTTPRespAPINotAuthorized(c)
-		return
+// historyDevice serves /history_<device>
+func historyDevice(device string) app.HandlerFunc {
+	return func(ctx context.Context, c *app.RequestContext) {
+		glog.Debug("[%-4s][%-32s] %s", c.Method(), "/history_"+device, c.Path())
+		historyPage(ctx, c, device)
 	}
+}
 
-	sender := string(c.PostForm("sender"))
-	phone := string(c.PostForm("phone"))
-	message := string(c.PostForm("message"))
-
-	if len(phone) < 1 {
-		writeHTTPRespAPIInvalidInput(c, "invalid phone number")
+func historyPage(ctx context.Context, c *app.RequestContext, device string) {
+	if !pageVerify(ctx, c, apikey.ScopeHistory) {
 		return
 	}
-	if len(message) < 1 {
-		writeHTTPRespAPIInvalidInput(c, "invalid message")
-		return
-	}
-	if len(sender) < 1 {
-		writeHTTPRespAPIInvalidInput(c, "invalid sender")
+	if !keyAllowsDevice(c, device) {
+		c.String(consts.StatusForbidden, "user may not use device "+device)
 		return
 	}
 
-	serial.Send("us", sender, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(phone, message)))
-
-	writeHTTPRespAPIOk(c, nil)
+	if string(c.Method()) == "GET" {
+		region := device
+		for _, dev := range config.Global.SerialDevices {
+			if dev.Name == device {
+				region = dev.Region
+			}
+		}
+		his := db.GetAllHistories(device, region, true)
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.History.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "History " + strings.ToUpper(device), "histories": his})
+	}
 }
 
-func historyUS(ctx context.Context, c *app.RequestContext) {
-	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/history_us", c.Path())
-	if !sessionVerify(ctx, c) {
-		loginGet(ctx, c)
-		return
+// poolNames lists the configured device pools in config order
+func poolNames() []string {
+	names := make([]string, 0, len(config.Global.Pools))
+	for _, pool := range config.Global.Pools {
+		names = append(names, pool.Name)
 	}
+	return names
+}
 
-	if string(c.Method()) == "GET" {
-		his := db.GetAllHistories("US", true)
-		glog.Debug("%#v", his)
-		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
-		_ = static.History.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "History US", "histories": his})
+// allowedDevices keeps the names of devices or pools the request's API key or user may use
+func allowedDevices(c *app.RequestContext, names []string) []string {
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		if keyAllowsDevice(c, name) {
+			list = append(list, name)
+		}
 	}
+	return list
 }
 
-func help(ctx context.Context, c *app.RequestContext) {
-	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/help", c.Path())
-	if !sessionVerify(ctx, c) {
-		loginGet(ctx, c)
-		return
+// deviceNames lists the configured devices in config order
+func deviceNames() []string {
+	names := make([]string, 0, len(config.Global.SerialDevices))
+	for _, dev := range config.Global.SerialDevices {
+		names = append(names, dev.Name)
 	}
+	return names
+}
 
-	if string(c.Method()) == "GET" {
-		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
-		_ = static.Index.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "Help"})
+// queryInt parses an integer query argument, returning def when it is missing or invalid
+func queryInt(c *app.RequestContext, key string, def int) int {
+	val, err := strconv.Atoi(string(c.Query(key)))
+	if err != nil {
+		return def
 	}
+	return val
 }
 
+// API response codes, shared by every JSON endpoint
+const (
+	codeOk             = 0
+	codeInvalidInput   = 1
+	codeNotAuthorized  = 2
+	codeFailed         = 3
+	codeNotFound       = 4
+	codeDeviceNotFound = 5
+	codeDeviceOffline  = 6
+	codeNoRoute        = 7
+	codeIdempotencyKey = 8
+	codeForbidden      = 9
+	codeQuotaExceeded  = 10
+	codeRateLimited    = 11
+)
+
 // Helper functions for HTTP responses
 func writeHTTPRespAPIOk(c *app.RequestContext, data interface{}) {
 	c.JSON(consts.StatusOK, map[string]interface{}{
-		"code": 0,
+		"code": codeOk,
 		"msg":  "success",
 		"data": data,
 	})
 }
 
-func writeHTTPRespAPIInvalidInput(c *app.RequestContext, msg string) {
-	c.JSON(consts.StatusBadRequest, map[string]interface{}{
-		"code": 1,
+func writeHTTPRespAPIError(c *app.RequestContext, status int, code int, msg string) {
+	c.JSON(status, map[string]interface{}{
+		"code": code,
 		"msg":  msg,
 		"data": nil,
 	})
 }
 
+func writeHTTPRespAPIFailed(c *app.RequestContext, msg string) {
+	writeHTTPRespAPIError(c, consts.StatusInternalServerError, codeFailed, msg)
+}
+
+func writeHTTPRespAPIInvalidInput(c *app.RequestContext, msg string) {
+	writeHTTPRespAPIError(c, consts.StatusBadRequest, codeInvalidInput, msg)
+}
+
+func writeHTTPRespAPINotFound(c *app.RequestContext, msg string) {
+	writeHTTPRespAPIError(c, consts.StatusNotFound, codeNotFound, msg)
+}
+
 func writeHTTPRespAPINotAuthorized(c *app.RequestContext) {
-	c.JSON(consts.StatusUnauthorized, map[string]interface{}{
-		"code": 2,
-		"msg":  "not authorized",
-		"data": nil,
-	})
-}
\ No newline at end of file
+	writeHTTPRespAPIError(c, consts.StatusUnauthorized, codeNotAuthorized, "not authorized")
+}
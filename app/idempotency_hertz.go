@@ -0,0 +1,130 @@
+package app
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"sms/config"
+	"sms/db"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idempotencyLocks serializes the sends of one scoped key, so a retry racing the first request
+// waits for its response instead of sending again, sends with other keys do not wait
+var idempotencyLocks = struct {
+	sync.Mutex
+	keys map[string]*idempotencyLock
+}{keys: make(map[string]*idempotencyLock)}
+
+type idempotencyLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lockIdempotency locks key and returns its unlock, the lock is dropped when no send waits for it
+func lockIdempotency(key string) func() {
+	idempotencyLocks.Lock()
+	l := idempotencyLocks.keys[key]
+	if l == nil {
+		l = &idempotencyLock{}
+		idempotencyLocks.keys[key] = l
+	}
+	l.waiting++
+	idempotencyLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		idempotencyLocks.Lock()
+		if l.waiting--; l.waiting == 0 {
+			delete(idempotencyLocks.keys, key)
+		}
+		idempotencyLocks.Unlock()
+	}
+}
+
+// idempotencyKey prefers the Idempotency-Key header over the request field
+func idempotencyKey(c *app.RequestContext, field string) string {
+	if key := string(c.GetHeader("Idempotency-Key")); key != "" {
+		return key
+	}
+	return field
+}
+
+// idempotencyScope names the client a key belongs to, so two API keys or users cannot replay or
+// block each other's sends with the same key
+func idempotencyScope(c *app.RequestContext) string {
+	if u := requestUser(c); u != nil {
+		return "user:" + u.Username
+	}
+	if id := requestKeyID(c); id != 0 {
+		return "key:" + strconv.FormatInt(id, 10)
+	}
+	return "access_key"
+}
+
+func idempotencyRetention() time.Duration {
+	hours := config.Global.API.IdempotencyRetention
+	if hours <= 0 {
+		hours = 24
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// sendOrSchedule sends req now, or holds it until sendAt when that is set
+func sendOrSchedule(c *app.RequestContext, req *sendRequest, sendAt int64) (interface{}, bool) {
+	if sendAt > 0 {
+		res := scheduleMessage(c, req, sendAt)
+		return res, res != nil
+	}
+	res := sendMessage(c, req)
+	return res, res != nil
+}
+
+// idempotent sends req once per key of a client. The first successful response is stored and repeated
+// for the same request within the retention window, a failed send is not stored so it can be retried.
+func idempotent(c *app.RequestContext, key string, req *sendRequest, sendAt int64) {
+	if key == "" {
+		if res, ok := sendOrSchedule(c, req, sendAt); ok {
+			writeHTTPRespAPIOk(c, res)
+		}
+		return
+	}
+	if len(key) > 255 {
+		writeHTTPRespAPIInvalidInput(c, "idempotency key is longer than 255")
+		return
+	}
+
+	sum := md5.Sum([]byte(req.Device + "\x00" + req.Sender + "\x00" + req.Phone + "\x00" + req.Message + "\x00" + strconv.FormatInt(sendAt, 10)))
+	hash := hex.EncodeToString(sum[:])
+	since := time.Now().Add(-idempotencyRetention()).Unix()
+	key = idempotencyScope(c) + ":" + key
+
+	defer lockIdempotency(key)()
+
+	if m := db.GetIdempotency(key, since); m != nil {
+		if m.RequestHash != hash {
+			writeHTTPRespAPIError(c, consts.StatusConflict, codeIdempotencyKey, "idempotency key was used for a different request")
+			return
+		}
+		glog.Info("idempotency key [%s] replayed", key)
+		c.Response.Header.Set("Idempotent-Replayed", "true")
+		writeHTTPRespAPIOk(c, json.RawMessage(m.Response))
+		return
+	}
+
+	res, ok := sendOrSchedule(c, req, sendAt)
+	if !ok {
+		return
+	}
+	data, err := json.Marshal(res)
+	if err == nil {
+		db.InsertIdempotency(key, hash, string(data), since)
+	}
+	writeHTTPRespAPIOk(c, res)
+}
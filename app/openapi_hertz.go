@@ -0,0 +1,843 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"reflect"
+	"sms/apikey"
+	"sms/audit"
+	"sms/config"
+	"sms/db"
+	"sms/rule"
+	"sms/serial"
+	"sms/static"
+	"sms/twilio"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OpenAPI document is generated from apiOperations, request and response schemas are
+// reflected from the same types the handlers bind and return. checkOpenAPI compares the
+// operations with the registered routes at startup so the two do not drift apart.
+
+// apiParam is a path, query or header parameter, or a field of a form body
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Required    bool
+	Description string
+}
+
+// apiOneOf documents a response whose data is one of several types
+type apiOneOf []interface{}
+
+type apiOperation struct {
+	Method      string
+	Path        string
+	Tag         string
+	Summary     string
+	Description string
+	// Auth is "session" for pages that only accept a login session, "none" for public routes,
+	// "basic" for the Twilio facade, empty means a session or the access key
+	Auth   string
+	Params []apiParam
+	// Form fields are sent urlencoded, or as multipart when Multipart is set
+	Form      []apiParam
+	Multipart bool
+	// Body is the JSON request body
+	Body interface{}
+	// Data is the data of the JSON envelope, nil documents a null data
+	Data interface{}
+	// Produces replaces the JSON envelope of a successful response with another content type
+	Produces string
+	Status   int
+	// Plain responses are Data without the envelope and errors are Twilio errors
+	Plain bool
+	// Errors lists the HTTP statuses of the error responses, 401 and 403 are added for authenticated
+	// routes and 429 for every route when [ratelimit] is on
+	Errors []int
+	// Legacy are the older paths of the same operation, kept for old clients
+	Legacy []string
+}
+
+// Response shapes that the handlers build as maps
+type keyResponse struct {
+	Key string `json:"key"`
+}
+
+type historyResponse struct {
+	Items      []messageResponse `json:"items"`
+	NextCursor int64             `json:"next_cursor"`
+}
+
+type configResponse struct {
+	Rules    []db.RuleModel        `json:"rules"`
+	Filters  []db.FilterEntryModel `json:"filters"`
+	Commands []commandResponse     `json:"commands"`
+}
+
+type ruleToggleResponse struct {
+	ID      int64 `json:"id"`
+	Enabled bool  `json:"enabled"`
+}
+
+type ruleLogsResponse struct {
+	Total int64             `json:"total"`
+	Page  int               `json:"page"`
+	Size  int               `json:"size"`
+	Logs  []db.RuleLogModel `json:"logs"`
+}
+
+type auditListResponse struct {
+	Total   int64           `json:"total"`
+	Page    int             `json:"page"`
+	Size    int             `json:"size"`
+	Entries []db.AuditModel `json:"entries"`
+}
+
+type spamResponse struct {
+	ID   int64 `json:"id"`
+	Spam bool  `json:"spam"`
+}
+
+var apiErrorCodes = []struct {
+	Code        int
+	Description string
+}{
+	{codeOk, "success"},
+	{codeInvalidInput, "invalid input"},
+	{codeNotAuthorized, "not authorized"},
+	{codeFailed, "failed"},
+	{codeNotFound, "not found"},
+	{codeDeviceNotFound, "device not found"},
+	{codeDeviceOffline, "device offline"},
+	{codeNoRoute, "no route matches the phone number"},
+	{codeIdempotencyKey, "idempotency key reused with a different request"},
+	{codeForbidden, "the api key lacks the scope or device"},
+	{codeQuotaExceeded, "the api key send quota is exceeded"},
+	{codeRateLimited, "too many requests, see Retry-After"},
+}
+
+var apiErrorResponses = map[int]struct {
+	Name        string
+	Description string
+}{
+	consts.StatusBadRequest:          {"InvalidInput", "Invalid input (code 1), or no route for the phone number (code 7)"},
+	consts.StatusUnauthorized:        {"NotAuthorized", "Neither a login session nor a valid API key (code 2)"},
+	consts.StatusForbidden:           {"Forbidden", "The API key lacks the scope or may not use the device (code 9)"},
+	consts.StatusNotFound:            {"NotFound", "Not found (code 4), or unknown device (code 5)"},
+	consts.StatusConflict:            {"IdempotencyConflict", "Idempotency key reused with a different request (code 8)"},
+	consts.StatusTooManyRequests:     {"TooManyRequests", "The daily or monthly send quota of the API key is used up (code 10), or [ratelimit] refused the request (code 11, see Retry-After)"},
+	consts.StatusInternalServerError: {"Failed", "Failed (code 3)"},
+	consts.StatusServiceUnavailable:  {"DeviceOffline", "Device or pool offline (code 6)"},
+}
+
+func apiPathID(what string) apiParam {
+	return apiParam{Name: "id", In: "path", Type: "integer", Required: true, Description: what + " id"}
+}
+
+func apiQuery(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: "query", Type: typ, Description: description}
+}
+
+func apiField(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: "formData", Type: typ, Description: description}
+}
+
+var apiDeviceParam = apiParam{Name: "device", In: "path", Type: "string", Required: true, Description: "Configured device name"}
+
+var apiIdempotencyHeader = apiParam{Name: "Idempotency-Key", In: "header", Type: "string",
+	Description: "Replays the stored response when the same request is sent again within [api] idempotency_retention hours"}
+
+var apiSendFields = []apiParam{
+	apiField("device", "string", "Device or pool, routed by phone number when empty"),
+	{Name: "sender", In: "formData", Type: "string", Required: true, Description: "Name of the sending client"},
+	{Name: "phone", In: "formData", Type: "string", Required: true},
+	{Name: "message", In: "formData", Type: "string", Required: true},
+	apiField("send_at", "string", "Hold the message until then, unix seconds, RFC3339 or 2006-01-02T15:04"),
+	apiField("status_callback", "string", "URL that receives a POST on every state change of the message"),
+	apiField("idempotency_key", "string", "Same as the Idempotency-Key header"),
+}
+
+var apiTwilioSID = apiParam{Name: "sid", In: "path", Type: "string", Required: true, Description: "Account SID, must be [twilio] account_sid when it is set"}
+
+var apiSinceQuery = apiQuery("since", "string", "Unix seconds or RFC3339")
+
+// apiOperations lists every HTTP route of the gateway
+func apiOperations() []apiOperation {
+	return []apiOperation{
+		// Pages
+		{Method: "GET", Path: "/favicon.ico", Tag: "Pages", Summary: "Favicon", Auth: "none", Produces: "image/x-icon"},
+		{Method: "GET", Path: "/", Tag: "Pages", Summary: "Index page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/login", Tag: "Pages", Summary: "Login page", Auth: "none", Produces: "text/html"},
+		{Method: "POST", Path: "/login", Tag: "Pages", Summary: "Log in", Auth: "none", Status: consts.StatusFound,
+			Description: "Sets the session cookie on success and redirects back in both cases",
+			Form:        []apiParam{{Name: "username", In: "formData", Type: "string", Required: true}, {Name: "password", In: "formData", Type: "string", Required: true}}},
+		{Method: "GET", Path: "/send_sms", Tag: "Pages", Summary: "Send SMS page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/send_sms_:device", Tag: "Pages", Summary: "Send SMS page of a device", Auth: "session", Produces: "text/html", Params: []apiParam{apiDeviceParam}},
+		{Method: "GET", Path: "/history", Tag: "Pages", Summary: "History of the default device", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/history_:device", Tag: "Pages", Summary: "History of a device", Auth: "session", Produces: "text/html", Params: []apiParam{apiDeviceParam}},
+		{Method: "GET", Path: "/spam", Tag: "Pages", Summary: "Spam folder", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/campaigns", Tag: "Pages", Summary: "Campaigns page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/schedules", Tag: "Pages", Summary: "Schedules page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/rules/test", Tag: "Pages", Summary: "Rule test page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/rules/logs", Tag: "Pages", Summary: "Rule logs page", Auth: "session", Produces: "text/html",
+			Params: []apiParam{apiQuery("rule_id", "integer", "0 for all rules"), apiQuery("page", "integer", "")}},
+		{Method: "GET", Path: "/keys", Tag: "Pages", Summary: "API keys page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/users", Tag: "Pages", Summary: "Users page", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/audit", Tag: "Pages", Summary: "Audit log page", Auth: "session", Produces: "text/html",
+			Params: []apiParam{apiQuery("actor", "string", ""), apiQuery("action", "string", ""), apiQuery("page", "integer", "")}},
+		{Method: "GET", Path: "/help", Tag: "Pages", Summary: "API documentation viewer", Auth: "session", Produces: "text/html"},
+		{Method: "GET", Path: "/api/openapi.json", Tag: "Pages", Summary: "This OpenAPI document", Auth: "none", Produces: "application/json"},
+
+		// Messages
+		{Method: "POST", Path: "/api/v1/messages", Tag: "Messages", Summary: "Send or schedule a message",
+			Description: "Routes by phone number when device is empty. With send_at the message is scheduled and the schedule is returned instead.",
+			Params:      []apiParam{apiIdempotencyHeader}, Body: sendRequest{}, Data: apiOneOf{sendResponse{}, scheduledResponse{}},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusConflict, consts.StatusTooManyRequests, consts.StatusInternalServerError, consts.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/send_sms", Tag: "Messages", Summary: "Send or schedule a message from a form",
+			Params: []apiParam{apiIdempotencyHeader}, Form: apiSendFields, Data: apiOneOf{sendResponse{}, scheduledResponse{}},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusConflict, consts.StatusTooManyRequests, consts.StatusInternalServerError, consts.StatusServiceUnavailable}},
+		{Method: "POST", Path: "/send_sms_:device", Tag: "Messages", Summary: "Send or schedule a message on a device from a form",
+			Params: []apiParam{apiDeviceParam, apiIdempotencyHeader}, Form: apiSendFields[1:], Data: apiOneOf{sendResponse{}, scheduledResponse{}},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusConflict, consts.StatusTooManyRequests, consts.StatusInternalServerError, consts.StatusServiceUnavailable}},
+		{Method: "GET", Path: "/api/v1/messages/:id", Tag: "Messages", Summary: "Get a message and the status of its segments",
+			Params: []apiParam{apiPathID("Message or segment")}, Data: messageResponse{},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "GET", Path: "/api/v1/history", Tag: "Messages", Summary: "Search the history",
+			Description: "Newest first, pass next_cursor as cursor to get the next page, 0 means there are no more",
+			Params: []apiParam{
+				apiQuery("device", "string", ""),
+				apiQuery("direction", "string", "in or out"),
+				apiQuery("phone", "string", ""),
+				apiQuery("q", "string", "Keyword in the message"),
+				apiSinceQuery,
+				apiQuery("until", "string", "Unix seconds or RFC3339"),
+				apiQuery("spam", "boolean", "Search the spam folder"),
+				apiQuery("cursor", "integer", ""),
+				apiQuery("limit", "integer", "1 to 500, default 50"),
+			}, Data: historyResponse{}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/v1/history/:id/spam", Tag: "Messages", Summary: "Flag or unflag a message as spam", Legacy: []string{"/api/history/:id/spam"},
+			Params: []apiParam{apiPathID("History")}, Form: []apiParam{{Name: "spam", In: "formData", Type: "boolean", Required: true}},
+			Data: spamResponse{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/otp/latest", Tag: "Messages", Summary: "Wait for the latest verification code", Legacy: []string{"/api/otp/latest"},
+			Description: "Long polls until a code received after since arrives or the timeout passes",
+			Params: []apiParam{
+				apiQuery("device", "string", ""),
+				apiQuery("sender", "string", "Phone number of the sender"),
+				apiSinceQuery,
+				apiQuery("timeout", "integer", "Seconds to wait, default 30, at most [otp] max_poll_timeout"),
+			}, Data: db.OTPModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "GET", Path: "/random_key", Tag: "Messages", Summary: "Generate a random numeric key",
+			Params: []apiParam{apiQuery("range", "integer", "Upper bound, default 100000000"), apiQuery("length", "integer", "Digits, default 8")}, Data: keyResponse{}},
+
+		// Devices
+		{Method: "GET", Path: "/api/v1/devices", Tag: "Devices", Summary: "List devices with health and telemetry", Data: []deviceResponse{}},
+		{Method: "GET", Path: "/api/v1/pools", Tag: "Devices", Summary: "List device pools and their health", Data: []serial.PoolStatus{}},
+
+		// Events
+		{Method: "GET", Path: "/api/v1/events", Tag: "Events", Summary: "Stream events as Server-Sent Events", Produces: "text/event-stream",
+			Description: "Event types are message.received, message.status, device.online, device.offline and telemetry, a type of message matches every message.* type",
+			Params: []apiParam{
+				apiQuery("device", "string", "Comma separated devices"),
+				apiQuery("type", "string", "Comma separated event types"),
+				apiQuery("last_event_id", "integer", "Resume after this event"),
+				{Name: "Last-Event-ID", In: "header", Type: "integer", Description: "Resume after this event, wins over last_event_id"},
+			}},
+		{Method: "GET", Path: "/api/v1/events/ws", Tag: "Events", Summary: "Stream events over WebSocket", Status: consts.StatusSwitchingProtocols,
+			Description: "The same events as /api/v1/events, one JSON text message each",
+			Params: []apiParam{
+				apiQuery("device", "string", "Comma separated devices"),
+				apiQuery("type", "string", "Comma separated event types"),
+				apiQuery("last_event_id", "integer", "Resume after this event"),
+			}, Errors: []int{consts.StatusBadRequest}},
+
+		// Campaigns
+		{Method: "GET", Path: "/api/v1/campaigns", Tag: "Campaigns", Summary: "List campaigns", Params: []apiParam{apiQuery("status", "string", "")}, Data: []campaignResponse{}},
+		{Method: "POST", Path: "/api/v1/campaigns", Tag: "Campaigns", Summary: "Create a campaign from a CSV", Multipart: true,
+			Description: "The CSV needs a header row with a phone column, every column is a template variable",
+			Form: []apiParam{
+				{Name: "name", In: "formData", Type: "string", Required: true},
+				{Name: "template", In: "formData", Type: "string", Required: true, Description: "Go text/template, e.g. Hi {{.name}}"},
+				{Name: "device", In: "formData", Type: "string", Required: true, Description: "Device or pool"},
+				apiField("rate_per_minute", "integer", "Default [campaign] rate_per_minute"),
+				apiField("window_start", "string", "HH:MM"),
+				apiField("window_end", "string", "HH:MM"),
+				apiField("start_at", "string", "Unix seconds or RFC3339"),
+				apiField("csv", "string", "CSV text, or upload file"),
+				apiField("file", "file", "CSV file"),
+			}, Data: campaignResponse{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/campaigns/:id", Tag: "Campaigns", Summary: "Get a campaign", Params: []apiParam{apiPathID("Campaign")}, Data: campaignResponse{},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "GET", Path: "/api/v1/campaigns/:id/recipients", Tag: "Campaigns", Summary: "List the recipients of a campaign",
+			Params: []apiParam{apiPathID("Campaign"), apiQuery("status", "string", "Comma separated statuses")}, Data: []db.CampaignRecipientModel{},
+			Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/campaigns/:id/results", Tag: "Campaigns", Summary: "Download the results as CSV", Produces: "text/csv",
+			Params: []apiParam{apiPathID("Campaign")}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "POST", Path: "/api/v1/campaigns/:id/pause", Tag: "Campaigns", Summary: "Pause a campaign", Params: []apiParam{apiPathID("Campaign")}, Data: campaignResponse{},
+			Errors: []int{consts.StatusBadRequest}},
+		{Method: "POST", Path: "/api/v1/campaigns/:id/resume", Tag: "Campaigns", Summary: "Resume a campaign", Params: []apiParam{apiPathID("Campaign")}, Data: campaignResponse{},
+			Errors: []int{consts.StatusBadRequest}},
+		{Method: "POST", Path: "/api/v1/campaigns/:id/cancel", Tag: "Campaigns", Summary: "Cancel a campaign", Params: []apiParam{apiPathID("Campaign")}, Data: campaignResponse{},
+			Errors: []int{consts.StatusBadRequest}},
+
+		// Schedules
+		{Method: "GET", Path: "/api/v1/schedules", Tag: "Schedules", Summary: "List schedules", Params: []apiParam{apiQuery("status", "string", "active, paused or done")}, Data: []db.ScheduleModel{}},
+		{Method: "POST", Path: "/api/v1/schedules", Tag: "Schedules", Summary: "Create a schedule",
+			Description: "cron repeats the message, send_at sends it once", Body: scheduleRequest{}, Data: db.ScheduleModel{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/schedules/:id", Tag: "Schedules", Summary: "Get a schedule", Params: []apiParam{apiPathID("Schedule")}, Data: db.ScheduleModel{},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "PUT", Path: "/api/v1/schedules/:id", Tag: "Schedules", Summary: "Update a schedule", Params: []apiParam{apiPathID("Schedule")}, Body: scheduleRequest{}, Data: db.ScheduleModel{},
+			Errors: []int{consts.StatusBadRequest}},
+		{Method: "DELETE", Path: "/api/v1/schedules/:id", Tag: "Schedules", Summary: "Delete a schedule", Params: []apiParam{apiPathID("Schedule")}, Data: db.ScheduleModel{},
+			Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/schedules/:id/runs", Tag: "Schedules", Summary: "List the runs of a schedule",
+			Params: []apiParam{apiPathID("Schedule"), apiQuery("limit", "integer", "Default 50")}, Data: []scheduleRunResponse{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "POST", Path: "/api/v1/schedules/:id/pause", Tag: "Schedules", Summary: "Pause a schedule", Params: []apiParam{apiPathID("Schedule")}, Data: db.ScheduleModel{},
+			Errors: []int{consts.StatusBadRequest}},
+		{Method: "POST", Path: "/api/v1/schedules/:id/resume", Tag: "Schedules", Summary: "Resume a schedule, missed runs are skipped", Params: []apiParam{apiPathID("Schedule")}, Data: db.ScheduleModel{},
+			Errors: []int{consts.StatusBadRequest}},
+
+		// Config
+		{Method: "GET", Path: "/api/v1/config", Tag: "Config", Summary: "Rules, filters and commands", Data: configResponse{},
+			Description: "Read only, there is no PUT. Rules and filters are changed through their own operations, commands only in the [command-N] sections of config.ini and take effect after a restart."},
+		{Method: "GET", Path: "/api/v1/config/commands", Tag: "Config", Summary: "List the SMS commands", Data: []commandResponse{},
+			Description: "Read only, commands are the [command-N] sections of config.ini and are loaded at startup"},
+		{Method: "GET", Path: "/api/v1/config/rules", Tag: "Config", Summary: "List forwarding rules", Legacy: []string{"/api/rules"}, Data: []db.RuleModel{}},
+		{Method: "POST", Path: "/api/v1/config/rules", Tag: "Config", Summary: "Create a forwarding rule", Legacy: []string{"/api/rules"}, Body: db.RuleModel{}, Data: db.RuleModel{},
+			Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "GET", Path: "/api/v1/config/rules/:id", Tag: "Config", Summary: "Get a forwarding rule", Params: []apiParam{apiPathID("Rule")}, Data: db.RuleModel{},
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "PUT", Path: "/api/v1/config/rules/:id", Tag: "Config", Summary: "Replace a forwarding rule", Legacy: []string{"/api/rules/:id"},
+			Params: []apiParam{apiPathID("Rule")}, Body: db.RuleModel{}, Data: db.RuleModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "DELETE", Path: "/api/v1/config/rules/:id", Tag: "Config", Summary: "Delete a forwarding rule", Legacy: []string{"/api/rules/:id"},
+			Params: []apiParam{apiPathID("Rule")}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/v1/config/rules/:id/toggle", Tag: "Config", Summary: "Enable or disable a forwarding rule", Legacy: []string{"/api/rules/:id/toggle"},
+			Params: []apiParam{apiPathID("Rule")}, Data: ruleToggleResponse{}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/v1/config/rules/test", Tag: "Config", Summary: "Dry run rules against a message", Legacy: []string{"/api/rules/test"},
+			Description: "Tests message, or the last history inbound messages when history is set, nothing is sent",
+			Body:        ruleTestRequest{}, Data: []rule.TestResult{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/config/rules/logs", Tag: "Config", Summary: "Rule evaluation logs", Legacy: []string{"/api/rules/logs"},
+			Params: []apiParam{
+				apiQuery("rule_id", "integer", "0 for all rules"),
+				apiQuery("page", "integer", ""),
+				apiQuery("size", "integer", "1 to 200, default 20"),
+				apiQuery("matched", "boolean", ""),
+			}, Data: ruleLogsResponse{}},
+		{Method: "GET", Path: "/api/v1/config/rules/stats", Tag: "Config", Summary: "Rule statistics", Legacy: []string{"/api/rules/stats"},
+			Params: []apiParam{
+				apiQuery("rule_id", "integer", "0 for all rules"),
+				apiQuery("since", "integer", "Unix seconds, default 30 days ago"),
+				apiQuery("interval", "string", "hour, day or none"),
+			}, Data: []db.RuleStatModel{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/config/filters", Tag: "Config", Summary: "List spam filter entries", Legacy: []string{"/api/filters"}, Data: []db.FilterEntryModel{}},
+		{Method: "POST", Path: "/api/v1/config/filters", Tag: "Config", Summary: "Add a spam filter entry", Legacy: []string{"/api/filters"},
+			Body: db.FilterEntryModel{}, Data: db.FilterEntryModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "DELETE", Path: "/api/v1/config/filters/:id", Tag: "Config", Summary: "Delete a spam filter entry", Legacy: []string{"/api/filters/:id"},
+			Params: []apiParam{apiPathID("Filter")}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+
+		// Keys
+		{Method: "GET", Path: "/api/v1/keys", Tag: "Keys", Summary: "List API keys", Description: "Revoked keys come last, secrets are never listed",
+			Data: []db.APIKeyModel{}, Errors: []int{consts.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/v1/keys", Tag: "Keys", Summary: "Create an API key", Description: "The secret and signing_secret are only returned here, the gateway keeps a hash",
+			Body: keyRequest{}, Data: keySecretResponse{}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "PUT", Path: "/api/v1/keys/:id", Tag: "Keys", Summary: "Change the settings of an API key", Params: []apiParam{apiPathID("Key")},
+			Body: keyRequest{}, Data: db.APIKeyModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusInternalServerError}},
+		{Method: "DELETE", Path: "/api/v1/keys/:id", Tag: "Keys", Summary: "Revoke an API key", Params: []apiParam{apiPathID("Key")},
+			Data: db.APIKeyModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/v1/keys/:id/rotate", Tag: "Keys", Summary: "Replace the secret of an API key", Description: "The old secret stops working at once",
+			Params: []apiParam{apiPathID("Key")}, Data: keySecretResponse{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusInternalServerError}},
+
+		// Users
+		{Method: "GET", Path: "/api/v1/users", Tag: "Users", Summary: "List users", Description: "Password hashes are never listed",
+			Data: []db.UserModel{}, Errors: []int{consts.StatusInternalServerError}},
+		{Method: "POST", Path: "/api/v1/users", Tag: "Users", Summary: "Create a user", Description: "role is admin, operator (send and history) or viewer (history)",
+			Body: userRequest{}, Data: db.UserModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusInternalServerError}},
+		{Method: "PUT", Path: "/api/v1/users/:id", Tag: "Users", Summary: "Change the role, devices or password of a user",
+			Description: "An empty password keeps it, the last enabled admin cannot lose its role", Params: []apiParam{apiPathID("User")},
+			Body: userRequest{}, Data: db.UserModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusInternalServerError}},
+		{Method: "DELETE", Path: "/api/v1/users/:id", Tag: "Users", Summary: "Delete a user", Description: "The last enabled admin cannot be deleted",
+			Params: []apiParam{apiPathID("User")}, Data: db.UserModel{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusInternalServerError}},
+
+		// Audit
+		{Method: "GET", Path: "/api/v1/audit", Tag: "Audit", Summary: "List audit entries", Description: "Newest first, before and after hold the changed fields",
+			Params: []apiParam{
+				apiQuery("actor", "string", "Part of the actor, e.g. user:admin or key:3"),
+				apiQuery("action", "string", "Action prefix, e.g. rule or message.send"),
+				apiQuery("since", "string", "Unix seconds or RFC3339"),
+				apiQuery("until", "string", "Unix seconds or RFC3339"),
+				apiQuery("page", "integer", ""),
+				apiQuery("size", "integer", "1 to 500, default 50"),
+			}, Data: auditListResponse{}, Errors: []int{consts.StatusBadRequest}},
+		{Method: "GET", Path: "/api/v1/audit/verify", Tag: "Audit", Summary: "Check the hash chain of the audit log",
+			Description: "broken_id is the first entry that was edited or follows deleted entries, 0 when intact. head is the hash of the newest entry",
+			Data:        audit.Report{}},
+		{Method: "GET", Path: "/api/v1/audit/export", Tag: "Audit", Summary: "Download the audit log with its hashes", Produces: "application/x-ndjson",
+			Description: "Oldest first, format=csv for CSV",
+			Params:      []apiParam{apiQuery("format", "string", "jsonl (default) or csv")}, Errors: []int{consts.StatusBadRequest}},
+
+		// Metrics
+		{Method: "GET", Path: "/metrics", Tag: "Metrics", Summary: "Counters in the Prometheus text format", Produces: "text/plain",
+			Description: "Requests refused by [ratelimit] are counted in sms_http_rate_limited_total"},
+
+		// Twilio
+		{Method: "POST", Path: twilioMessagesPath + ".json", Tag: "Twilio", Summary: "Send a message like Twilio's Messages resource", Auth: "basic", Plain: true,
+			Description: "A device, pool or device number in MessagingServiceSid or From picks the device, otherwise the message is routed by To",
+			Params:      []apiParam{apiTwilioSID},
+			Form: []apiParam{
+				{Name: "To", In: "formData", Type: "string", Required: true},
+				{Name: "Body", In: "formData", Type: "string", Required: true},
+				apiField("From", "string", "Device, pool or device number"),
+				apiField("MessagingServiceSid", "string", "Device or pool"),
+				apiField("StatusCallback", "string", "URL that receives Twilio status callbacks"),
+			}, Data: twilio.Message{}, Status: consts.StatusCreated,
+			Errors: []int{consts.StatusBadRequest, consts.StatusNotFound, consts.StatusTooManyRequests, consts.StatusServiceUnavailable}},
+		{Method: "GET", Path: twilioMessagesPath + ".json", Tag: "Twilio", Summary: "List messages", Auth: "basic", Plain: true,
+			Description: "A device number in To lists inbound messages, in From outbound ones, any other number is the remote side",
+			Params: []apiParam{
+				apiTwilioSID,
+				apiQuery("To", "string", ""),
+				apiQuery("From", "string", ""),
+				apiQuery("PageSize", "integer", "1 to 1000, default 50"),
+				apiQuery("PageToken", "string", "From next_page_uri"),
+			}, Data: twilio.MessagePage{}, Errors: []int{consts.StatusBadRequest, consts.StatusNotFound}},
+		{Method: "GET", Path: twilioMessagesPath + "/:message", Tag: "Twilio", Summary: "Get a message", Auth: "basic", Plain: true,
+			Params: []apiParam{apiTwilioSID, {Name: "message", In: "path", Type: "string", Required: true, Description: "Message SID, with or without .json"}},
+			Data:   twilio.Message{}, Errors: []int{consts.StatusNotFound}},
+	}
+}
+
+// openAPIPath converts a hertz route path to an OpenAPI path, /send_sms_cn becomes /send_sms_{device}
+// for every configured device so the per device routes match one documented operation
+func openAPIPath(path string) string {
+	for _, dev := range config.Global.SerialDevices {
+		for _, prefix := range []string{"/send_sms_", "/history_"} {
+			if path == prefix+dev.Name {
+				return prefix + "{device}"
+			}
+		}
+	}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			parts[i] = "{" + part[1:] + "}"
+		} else if j := strings.Index(part, ":"); j > 0 {
+			parts[i] = part[:j] + "{" + part[j+1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// openAPISchemas reflects Go types into components/schemas, named structs are referenced by name
+type openAPISchemas struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	timeType       = reflect.TypeOf(time.Time{})
+)
+
+func (s *openAPISchemas) name(t reflect.Type) string {
+	if name, ok := s.names[t]; ok {
+		return name
+	}
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	if _, taken := s.schemas[name]; taken {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	s.names[t] = name
+	return name
+}
+
+func (s *openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := s.name(t)
+		if _, ok := s.schemas[name]; !ok {
+			// reserve the name first so recursive types terminate
+			s.schemas[name] = nil
+			s.schemas[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object follows encoding/json: embedded structs without a tag are flattened, "-" is skipped
+func (s *openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	s.fields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (s *openAPISchemas) fields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.fields(ft, properties)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = s.schema(f.Type)
+	}
+}
+
+func (s *openAPISchemas) data(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case nil:
+		return map[string]interface{}{"nullable": true}
+	case apiOneOf:
+		list := make([]interface{}, 0, len(v))
+		for _, one := range v {
+			list = append(list, s.schema(reflect.TypeOf(one)))
+		}
+		return map[string]interface{}{"oneOf": list}
+	}
+	return s.schema(reflect.TypeOf(v))
+}
+
+func openAPIParameters(params []apiParam) []interface{} {
+	list := make([]interface{}, 0, len(params))
+	for _, p := range params {
+		param := map[string]interface{}{
+			"name":     p.Name,
+			"in":       p.In,
+			"required": p.Required || p.In == "path",
+			"schema":   map[string]interface{}{"type": p.Type},
+		}
+		if p.Description != "" {
+			param["description"] = p.Description
+		}
+		if p == apiDeviceParam && len(config.Global.SerialDevices) > 0 {
+			param["schema"] = map[string]interface{}{"type": "string", "enum": deviceNames()}
+		}
+		list = append(list, param)
+	}
+	return list
+}
+
+func openAPIForm(fields []apiParam, multipart bool) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	for _, f := range fields {
+		prop := map[string]interface{}{"type": f.Type}
+		if f.Type == "file" {
+			prop = map[string]interface{}{"type": "string", "format": "binary"}
+		}
+		if f.Description != "" {
+			prop["description"] = f.Description
+		}
+		properties[f.Name] = prop
+		if f.Required {
+			required = append(required, f.Name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	contentType := "application/x-www-form-urlencoded"
+	if multipart {
+		contentType = "multipart/form-data"
+	}
+	return map[string]interface{}{
+		"required": true,
+		"content":  map[string]interface{}{contentType: map[string]interface{}{"schema": schema}},
+	}
+}
+
+func openAPIOperationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '_' || r == '.' || r == ':' || r == '{' || r == '}' }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func (s *openAPISchemas) operation(op *apiOperation, path string, deprecated bool) map[string]interface{} {
+	res := map[string]interface{}{
+		"tags":        []string{op.Tag},
+		"summary":     op.Summary,
+		"operationId": openAPIOperationID(op.Method, path),
+	}
+	if op.Description != "" {
+		res["description"] = op.Description
+	}
+	if deprecated {
+		res["deprecated"] = true
+		res["description"] = "Legacy path of " + op.Method + " " + openAPIPath(op.Path)
+	}
+	if len(op.Params) > 0 {
+		res["parameters"] = openAPIParameters(op.Params)
+	}
+	switch {
+	case op.Body != nil:
+		res["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(op.Body))}},
+		}
+	case op.Form != nil:
+		res["requestBody"] = openAPIForm(op.Form, op.Multipart)
+	}
+
+	responses := make(map[string]interface{})
+	status := op.Status
+	if status == 0 {
+		status = consts.StatusOK
+	}
+	success := map[string]interface{}{"description": consts.StatusMessage(status)}
+	switch {
+	case op.Produces == "application/json":
+		success["content"] = map[string]interface{}{op.Produces: map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}}
+	case op.Produces != "":
+		success["content"] = map[string]interface{}{op.Produces: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	case op.Plain:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": s.data(op.Data)}}
+	case status == consts.StatusOK:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+			"allOf": []interface{}{
+				map[string]interface{}{"$ref": "#/components/schemas/Response"},
+				map[string]interface{}{"type": "object", "properties": map[string]interface{}{"data": s.data(op.Data)}},
+			},
+		}}}
+	}
+	responses[fmt.Sprint(status)] = success
+	errors := op.Errors
+	switch op.Auth {
+	case "none":
+		res["security"] = []interface{}{}
+	case "session":
+		res["security"] = []interface{}{map[string]interface{}{"session": []string{}}}
+	case "basic":
+		res["security"] = []interface{}{map[string]interface{}{"basic": []string{}}}
+		errors = append([]int{consts.StatusUnauthorized, consts.StatusForbidden}, errors...)
+	default:
+		errors = append([]int{consts.StatusUnauthorized, consts.StatusForbidden}, errors...)
+	}
+	if config.Global.RateLimit.Enable {
+		errors = append(errors, consts.StatusTooManyRequests)
+	}
+	for _, code := range errors {
+		if op.Plain {
+			responses[fmt.Sprint(code)] = map[string]interface{}{
+				"description": consts.StatusMessage(code),
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(twilio.Error{}))}},
+			}
+			continue
+		}
+		responses[fmt.Sprint(code)] = map[string]interface{}{"$ref": "#/components/responses/" + apiErrorResponses[code].Name}
+	}
+	res["responses"] = responses
+	return res
+}
+
+// openAPIDocument builds the OpenAPI 3 document of every operation
+func openAPIDocument() map[string]interface{} {
+	s := &openAPISchemas{schemas: make(map[string]interface{}), names: make(map[reflect.Type]string)}
+
+	codes := make([]int, 0, len(apiErrorCodes))
+	descriptions := make([]string, 0, len(apiErrorCodes))
+	for _, code := range apiErrorCodes {
+		codes = append(codes, code.Code)
+		descriptions = append(descriptions, fmt.Sprintf("%d: %s", code.Code, code.Description))
+	}
+	s.schemas["ErrorCode"] = map[string]interface{}{"type": "integer", "enum": codes, "description": strings.Join(descriptions, "\n")}
+	s.schemas["Response"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code", "msg", "data"},
+		"properties": map[string]interface{}{
+			"code": map[string]interface{}{"$ref": "#/components/schemas/ErrorCode"},
+			"msg":  map[string]interface{}{"type": "string"},
+			"data": map[string]interface{}{},
+		},
+	}
+	responses := make(map[string]interface{})
+	for _, res := range apiErrorResponses {
+		responses[res.Name] = map[string]interface{}{
+			"description": res.Description,
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Response"}}},
+		}
+	}
+
+	paths := make(map[string]map[string]interface{})
+	tags := make([]interface{}, 0)
+	seen := make(map[string]bool)
+	operations := apiOperations()
+	for i := range operations {
+		op := &operations[i]
+		if !seen[op.Tag] {
+			seen[op.Tag] = true
+			tags = append(tags, map[string]interface{}{"name": op.Tag})
+		}
+		for j, path := range append([]string{op.Path}, op.Legacy...) {
+			p := openAPIPath(path)
+			if paths[p] == nil {
+				paths[p] = make(map[string]interface{})
+			}
+			paths[p][strings.ToLower(op.Method)] = s.operation(op, path, j > 0)
+		}
+	}
+
+	sessionName := config.Global.Session.Name
+	if sessionName == "" {
+		sessionName = "session"
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "SMS Gateway",
+			"version":     "1",
+			"description": "Every JSON response is wrapped in {code, msg, data}, see ErrorCode for the codes",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/"}},
+		"tags":    tags,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas":   s.schemas,
+			"responses": responses,
+			"securitySchemes": map[string]interface{}{
+				"session":   map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionName, "description": "Login session from POST /login, the role of the user decides the routes it may use like the scopes of a key"},
+				"key":       map[string]interface{}{"type": "apiKey", "in": "query", "name": "key", "description": "An API key of /keys or [security] access_key, may also be sent as a form field. The scopes of the key (send, history, otp, admin) decide the routes it may use"},
+				"signature": map[string]interface{}{"type": "apiKey", "in": "header", "name": apikey.HeaderSignature, "description": signatureDescription},
+				"basic":     map[string]interface{}{"type": "http", "scheme": "basic", "description": "Twilio facade: any username (account or API key SID), an API key as password"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"session": []string{}},
+			map[string]interface{}{"key": []string{}},
+			map[string]interface{}{"signature": []string{}},
+		},
+	}
+}
+
+// signatureDescription explains the headers of a signed request, see [api] of config.ini
+var signatureDescription = "A request signed with an API key instead of sending it. " +
+	apikey.HeaderKeyID + " is the key id (access_key cannot sign), " + apikey.HeaderTimestamp + " unix seconds, " +
+	apikey.HeaderNonce + " 16 to 64 characters never reused and " + apikey.HeaderSignature +
+	` sha256=hex(hmac_sha256(signing_secret, method + "\n" + path?query + "\n" + timestamp + "\n" + nonce + "\n" + hex(sha256(body)))),` +
+	" signing_secret is returned with the secret when the key is created or rotated"
+
+var openAPIOnce = struct {
+	sync.Once
+	data []byte
+}{}
+
+func openAPIJSON(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/openapi.json", c.Path())
+
+	openAPIOnce.Do(func() {
+		data, err := json.Marshal(openAPIDocument())
+		if err != nil {
+			glog.Warning("[openapi] marshal document failed [%v]", err)
+		}
+		openAPIOnce.data = data
+	})
+	c.Response.Header.Set("Access-Control-Allow-Origin", "*")
+	c.Data(consts.StatusOK, "application/json; charset=utf-8", openAPIOnce.data)
+}
+
+// checkOpenAPI warns about registered routes missing from the document and documented
+// operations without a route, run after registerRoutes
+func checkOpenAPI() {
+	for _, drift := range openAPIDrift() {
+		glog.Warning("[openapi] %s", drift)
+	}
+}
+
+// openAPIDrift compares the routes of Global with apiOperations, one line per mismatch
+func openAPIDrift() []string {
+	documented := make(map[string]bool)
+	operations := apiOperations()
+	for _, op := range operations {
+		for _, path := range append([]string{op.Path}, op.Legacy...) {
+			documented[op.Method+" "+openAPIPath(path)] = false
+		}
+	}
+	drift := make([]string, 0)
+	for _, route := range Global.Routes() {
+		key := route.Method + " " + openAPIPath(route.Path)
+		if _, ok := documented[key]; !ok {
+			drift = append(drift, "route "+route.Method+" "+route.Path+" is not documented")
+			continue
+		}
+		documented[key] = true
+	}
+	missing := make([]string, 0)
+	for key, registered := range documented {
+		if !registered && !(len(config.Global.SerialDevices) == 0 && strings.Contains(key, "{device}")) {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		drift = append(drift, "operation "+key+" has no route")
+	}
+	return drift
+}
+
+func help(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/help", c.Path())
+	if !pageVerify(ctx, c, "") {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Help.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "API"})
+	}
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"sms/config"
+	"testing"
+)
+
+// TestOpenAPIRoutes fails when a route is registered without an operation in apiOperations or an
+// operation is documented without a route
+func TestOpenAPIRoutes(t *testing.T) {
+	config.Global = &config.Model{SerialDevices: []config.SerialDevice{{Name: "cn"}}}
+	Global = server.Default(server.WithHostPorts("127.0.0.1:0"))
+	registerRoutes()
+
+	drift := openAPIDrift()
+	for _, d := range drift {
+		t.Error(d)
+	}
+	if len(Global.Routes()) == 0 {
+		t.Fatal("no routes registered")
+	}
+}
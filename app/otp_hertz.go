@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/apikey"
+	"sms/config"
+	"sms/otp"
+	"time"
+)
+
+func otpLatest(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/otp/latest", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeOTP) {
+		return
+	}
+
+	device := string(c.Query("device"))
+	sender := string(c.Query("sender"))
+	if !authorizeDevice(c, device) {
+		return
+	}
+
+	since, ok := parseUnixOrRFC3339(string(c.Query("since")))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid since, use unix seconds or RFC3339")
+		return
+	}
+
+	maxTimeout := config.Global.OTP.MaxPollTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = 120
+	}
+	timeout := queryInt(c, "timeout", 30)
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+	code := otp.Wait(waitCtx, device, sender, since)
+	if code == nil {
+		writeHTTPRespAPINotFound(c, "no matching code received")
+		return
+	}
+
+	writeHTTPRespAPIOk(c, code)
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"math"
+	"sms/apikey"
+	"sms/config"
+	"sms/db"
+	"sms/metrics"
+	"sms/ratelimit"
+	"sms/twilio"
+	"strconv"
+	"strings"
+)
+
+const metricRateLimited = "sms_http_rate_limited_total"
+
+// limiters of [ratelimit], clients are API keys or login users
+var limiters struct {
+	clientSend, clientRead *ratelimit.Limiter
+	ipSend, ipRead         *ratelimit.Limiter
+}
+
+// sendRoutes are the endpoints that put messages on the modems, the others are read limits
+var sendRoutes = map[string]bool{
+	"POST /api/v1/messages":                true,
+	"POST /api/v1/campaigns":               true,
+	"POST /api/v1/schedules":               true,
+	"POST " + twilioMessagesPath + ".json": true,
+}
+
+// initRateLimit builds the limiters, it returns false when rate limiting is off
+func initRateLimit() bool {
+	cfg := config.Global.RateLimit
+	if !cfg.Enable {
+		return false
+	}
+	limiters.clientSend = ratelimit.New(cfg.SendPerMinute, cfg.SendBurst)
+	limiters.clientRead = ratelimit.New(cfg.ReadPerMinute, cfg.ReadBurst)
+	limiters.ipSend = ratelimit.New(cfg.IPSendPerMinute, cfg.SendBurst)
+	limiters.ipRead = ratelimit.New(cfg.IPReadPerMinute, cfg.ReadBurst)
+	metrics.Describe(metricRateLimited, "HTTP requests refused by [ratelimit], by endpoint class and limit")
+	return true
+}
+
+// isSendRoute reports whether the matched route of a request sends messages
+func isSendRoute(c *app.RequestContext) bool {
+	route := c.FullPath()
+	return strings.HasPrefix(route, "/send_sms") || sendRoutes[string(c.Method())+" "+route]
+}
+
+// rateClient names the verified client of a request for its buckets. A key that does not
+// verify gets no bucket of its own, the request is only held by the address limit. Stored keys
+// are named by their id so the plain, signed and Basic forms of a key share buckets.
+func rateClient(ctx context.Context, c *app.RequestContext) (string, string) {
+	var k *db.APIKeyModel
+	var err error
+	switch {
+	case hasKeyCredentials(c):
+		k, err = keyVerify(ctx, c)
+	case basicPassword(c) != "":
+		k, err = apikey.Verify(basicPassword(c), c.ClientIP())
+	default:
+		if u := sessionAccount(c); u != nil {
+			return "user", u.Username
+		}
+		return "", ""
+	}
+	if err != nil {
+		return "", ""
+	}
+	if apikey.IsLegacy(k) {
+		return "key", "access_key"
+	}
+	return "key", strconv.FormatInt(k.ID, 10)
+}
+
+// rateLimit is the middleware of [ratelimit], a refused request gets 429 with Retry-After
+func rateLimit(ctx context.Context, c *app.RequestContext) {
+	class, client, ip := "read", limiters.clientRead, limiters.ipRead
+	if isSendRoute(c) {
+		class, client, ip = "send", limiters.clientSend, limiters.ipSend
+	}
+	limit := "ip"
+	ok, wait := ip.Allow(c.ClientIP())
+	if ok {
+		if kind, name := rateClient(ctx, c); kind != "" {
+			limit = kind
+			ok, wait = client.Allow(kind + ":" + name)
+		}
+	}
+	if ok {
+		c.Next(ctx)
+		return
+	}
+
+	metrics.Inc(metricRateLimited, "class", class, "limit", limit)
+	glog.Debug("rate limit [%s/%s] refused %s %s from %s", class, limit, c.Method(), c.Path(), c.ClientIP())
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response.Header.Set("Retry-After", strconv.Itoa(seconds))
+	if strings.HasPrefix(c.FullPath(), "/"+twilio.APIVersion+"/") {
+		writeTwilioError(c, consts.StatusTooManyRequests, twilio.ErrTooManyRequests, "Too many requests, retry in "+strconv.Itoa(seconds)+" seconds.")
+	} else {
+		writeHTTPRespAPIError(c, consts.StatusTooManyRequests, codeRateLimited, "rate limit exceeded, retry in "+strconv.Itoa(seconds)+" seconds")
+	}
+	c.Abort()
+}
+
+func metricsHandler(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/metrics", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	c.Response.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.Write(c.Response.BodyWriter()); err != nil {
+		glog.Warning("write metrics failed: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/apikey"
+	"sms/db"
+	"sms/rule"
+	"sms/static"
+	"strconv"
+	"time"
+)
+
+func ruleList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, db.GetAllRules(false))
+}
+
+func ruleCreate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	r := &db.RuleModel{}
+	if err := json.Unmarshal(c.Request.Body(), r); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid rule: "+err.Error())
+		return
+	}
+	if err := rule.Validate(r); err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	id := db.InsertRule(r)
+	if id < 0 {
+		writeHTTPRespAPIFailed(c, "insert rule failed")
+		return
+	}
+	after := db.GetRule(id)
+	auditRecord(c, "rule.create", auditTarget("rule", id), nil, after)
+
+	writeHTTPRespAPIOk(c, after)
+}
+
+func ruleUpdate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid rule id")
+		return
+	}
+	r := &db.RuleModel{}
+	if err = json.Unmarshal(c.Request.Body(), r); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid rule: "+err.Error())
+		return
+	}
+	r.ID = id
+	if err = rule.Validate(r); err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	before := db.GetRule(id)
+	if !db.UpdateRule(r) {
+		writeHTTPRespAPIFailed(c, "update rule failed")
+		return
+	}
+	after := db.GetRule(id)
+	auditRecord(c, "rule.update", auditTarget("rule", id), before, after)
+
+	writeHTTPRespAPIOk(c, after)
+}
+
+func ruleDelete(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid rule id")
+		return
+	}
+	before := db.GetRule(id)
+	if !db.DeleteRule(id) {
+		writeHTTPRespAPIFailed(c, "delete rule failed")
+		return
+	}
+	auditRecord(c, "rule.delete", auditTarget("rule", id), before, nil)
+
+	writeHTTPRespAPIOk(c, nil)
+}
+
+func ruleToggle(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules/:id/toggle", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid rule id")
+		return
+	}
+	r := db.GetRule(id)
+	if r == nil {
+		writeHTTPRespAPIInvalidInput(c, "rule not found")
+		return
+	}
+	if !db.UpdateRuleEnabled(id, !r.Enabled) {
+		writeHTTPRespAPIFailed(c, "toggle rule failed")
+		return
+	}
+	auditRecord(c, "rule.toggle", auditTarget("rule", id), map[string]bool{"enabled": r.Enabled}, map[string]bool{"enabled": !r.Enabled})
+
+	writeHTTPRespAPIOk(c, map[string]interface{}{"id": id, "enabled": !r.Enabled})
+}
+
+type ruleTestRequest struct {
+	RuleID  int64 `json:"rule_id"`
+	Message *struct {
+		Device     string `json:"device"`
+		Phone      string `json:"phone"`
+		Content    string `json:"content"`
+		Time       string `json:"time"`
+		ReceivedAt string `json:"received_at"`
+	} `json:"message"`
+	History int `json:"history"`
+}
+
+func ruleTest(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules/test", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	req := &ruleTestRequest{}
+	if err := json.Unmarshal(c.Request.Body(), req); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid request: "+err.Error())
+		return
+	}
+
+	var msgs []*rule.Message
+	if req.Message != nil && req.Message.Content != "" {
+		receivedAt := time.Now()
+		if req.Message.ReceivedAt != "" {
+			t, err := time.Parse(time.RFC3339, req.Message.ReceivedAt)
+			if err != nil {
+				writeHTTPRespAPIInvalidInput(c, "invalid received_at")
+				return
+			}
+			receivedAt = t
+		}
+		msgs = []*rule.Message{{
+			Device:     req.Message.Device,
+			Phone:      req.Message.Phone,
+			Content:    req.Message.Content,
+			Time:       req.Message.Time,
+			ReceivedAt: receivedAt,
+		}}
+	} else if req.History > 0 {
+		if req.History > 500 {
+			req.History = 500
+		}
+		msgs = rule.HistoryMessages(req.History)
+	} else {
+		writeHTTPRespAPIInvalidInput(c, "message or history is required")
+		return
+	}
+
+	results, err := rule.TestRule(req.RuleID, msgs)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+
+	writeHTTPRespAPIOk(c, results)
+}
+
+func ruleTestPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/rules/test", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.RuleTest.Execute(c.Response.BodyWriter(), map[string]interface{}{"title": "Rule Test", "rules": db.GetAllRules(false)})
+	}
+}
+
+func ruleLogs(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules/logs", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	ruleID := int64(queryInt(c, "rule_id", 0))
+	page := queryInt(c, "page", 1)
+	size := queryInt(c, "size", 20)
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 || size > 200 {
+		size = 20
+	}
+	var matched *bool
+	if m := string(c.Query("matched")); m != "" {
+		v := m == "true" || m == "1"
+		matched = &v
+	}
+
+	logs, total := db.GetRuleLogs(ruleID, matched, page, size)
+	writeHTTPRespAPIOk(c, map[string]interface{}{
+		"total": total,
+		"page":  page,
+		"size":  size,
+		"logs":  logs,
+	})
+}
+
+func ruleStats(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/rules/stats", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	ruleID := int64(queryInt(c, "rule_id", 0))
+	since := int64(queryInt(c, "since", 0))
+	if since == 0 {
+		since = time.Now().AddDate(0, 0, -30).Unix()
+	}
+	var bucket int64
+	switch string(c.Query("interval")) {
+	case "hour":
+		bucket = 3600
+	case "day":
+		bucket = 86400
+	case "", "none":
+		bucket = 0
+	default:
+		writeHTTPRespAPIInvalidInput(c, "invalid interval, use hour, day or none")
+		return
+	}
+
+	writeHTTPRespAPIOk(c, db.GetRuleStats(ruleID, since, bucket))
+}
+
+func ruleLogsPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/rules/logs", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		ruleID := int64(queryInt(c, "rule_id", 0))
+		page := queryInt(c, "page", 1)
+		if page < 1 {
+			page = 1
+		}
+		const size = 20
+		logs, total := db.GetRuleLogs(ruleID, nil, page, size)
+		stats := db.GetRuleStats(ruleID, time.Now().AddDate(0, 0, -30).Unix(), 0)
+
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.RuleLogs.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":   "Rule Logs",
+			"rule_id": ruleID,
+			"logs":    logs,
+			"stats":   stats,
+			"page":    page,
+			"prev":    page - 1,
+			"next":    page + 1,
+			"hasNext": int64(page*size) < total,
+			"total":   total,
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/apikey"
+	"sms/db"
+	"sms/schedule"
+	"sms/static"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type scheduleRequest struct {
+	Name    string          `json:"name"`
+	Device  string          `json:"device"`
+	Sender  string          `json:"sender"`
+	Phone   string          `json:"phone"`
+	Message string          `json:"message"`
+	Cron    string          `json:"cron"`
+	SendAt  json.RawMessage `json:"send_at,omitempty"`
+	// StatusCallback receives the state changes of every message the schedule sends
+	StatusCallback string `json:"status_callback,omitempty"`
+}
+
+type scheduledResponse struct {
+	ScheduleID int64 `json:"schedule_id"`
+	SendAt     int64 `json:"send_at"`
+}
+
+// scheduleView adds readable run times for the schedules page
+type scheduleView struct {
+	db.ScheduleModel
+	Next string
+	Last string
+}
+
+type scheduleRunResponse struct {
+	db.ScheduleRunModel
+	Messages []*messageResponse `json:"messages"`
+}
+
+// parseSendAt also accepts the local "2006-01-02T15:04" of a datetime-local input
+func parseSendAt(s string) (int64, bool) {
+	if v, ok := parseUnixOrRFC3339(s); ok {
+		return v, true
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local); err == nil {
+		return t.Unix(), true
+	}
+	return 0, false
+}
+
+// scheduleMessage holds req as a one-off schedule instead of sending it now
+func scheduleMessage(c *app.RequestContext, req *sendRequest, sendAt int64) *scheduledResponse {
+	device, _, ok := sendDevice(c, req.Device, req.Phone)
+	if !ok {
+		return nil
+	}
+	id, err := schedule.Create(&schedule.Schedule{
+		Device:         device,
+		Sender:         req.Sender,
+		Phone:          req.Phone,
+		Message:        req.Message,
+		SendAt:         sendAt,
+		StatusCallback: req.StatusCallback,
+		APIKeyID:       requestKeyID(c),
+	})
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return nil
+	}
+	auditRecord(c, "schedule.create", auditTarget("schedule", id), nil, db.GetSchedule(id))
+	return &scheduledResponse{ScheduleID: id, SendAt: sendAt}
+}
+
+// bindSchedule reads a schedule from the JSON body, the device is checked against the API key
+func bindSchedule(c *app.RequestContext) *schedule.Schedule {
+	req := &scheduleRequest{}
+	if err := json.Unmarshal(c.Request.Body(), req); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid request: "+err.Error())
+		return nil
+	}
+	sendAt, ok := parseSendAt(strings.Trim(string(req.SendAt), `"`))
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "invalid send_at, use unix seconds or RFC3339")
+		return nil
+	}
+	device, _, ok := sendDevice(c, req.Device, req.Phone)
+	if !ok {
+		return nil
+	}
+	return &schedule.Schedule{
+		Name:           req.Name,
+		Device:         device,
+		Sender:         req.Sender,
+		Phone:          req.Phone,
+		Message:        req.Message,
+		Cron:           strings.TrimSpace(req.Cron),
+		SendAt:         sendAt,
+		StatusCallback: req.StatusCallback,
+		APIKeyID:       requestKeyID(c),
+	}
+}
+
+// getSchedule loads the schedule of the id parameter, a key limited to some devices only sees
+// the schedules of its devices. On failure the error response is already written.
+func getSchedule(c *app.RequestContext) *db.ScheduleModel {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid schedule id")
+		return nil
+	}
+	s := db.GetSchedule(id)
+	if s == nil || !keyAllowsDevice(c, s.Device) {
+		writeHTTPRespAPINotFound(c, "schedule not found")
+		return nil
+	}
+	return s
+}
+
+func scheduleList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/schedules", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	schedules := db.GetAllSchedules(string(c.Query("status")))
+	list := make([]db.ScheduleModel, 0, len(schedules))
+	for _, s := range schedules {
+		if keyAllowsDevice(c, s.Device) {
+			list = append(list, s)
+		}
+	}
+
+	writeHTTPRespAPIOk(c, list)
+}
+
+func scheduleCreate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/schedules", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeSend) {
+		return
+	}
+
+	req := bindSchedule(c)
+	if req == nil {
+		return
+	}
+	id, err := schedule.Create(req)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	s := db.GetSchedule(id)
+	auditRecord(c, "schedule.create", auditTarget("schedule", id), nil, s)
+
+	writeHTTPRespAPIOk(c, s)
+}
+
+func scheduleGet(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/schedules/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	s := getSchedule(c)
+	if s == nil {
+		return
+	}
+
+	writeHTTPRespAPIOk(c, s)
+}
+
+func scheduleUpdate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/schedules/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeSend) {
+		return
+	}
+
+	s := getSchedule(c)
+	if s == nil {
+		return
+	}
+	req := bindSchedule(c)
+	if req == nil {
+		return
+	}
+	if err := schedule.Update(s.ID, req); err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	after := db.GetSchedule(s.ID)
+	auditRecord(c, "schedule.update", auditTarget("schedule", s.ID), s, after)
+
+	writeHTTPRespAPIOk(c, after)
+}
+
+// scheduleRuns lists the latest runs of a schedule with the messages each run sent
+func scheduleRuns(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/schedules/:id/runs", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	s := getSchedule(c)
+	if s == nil {
+		return
+	}
+	runs := db.GetScheduleRuns(s.ID, queryInt(c, "limit", 50))
+	list := make([]*scheduleRunResponse, 0, len(runs))
+	for _, run := range runs {
+		res := &scheduleRunResponse{ScheduleRunModel: run, Messages: make([]*messageResponse, 0)}
+		for _, his := range db.GetHistories(db.SplitIDs(run.HistoryIDs)) {
+			his := his
+			res.Messages = append(res.Messages, &messageResponse{HistoryModel: his, Status: his.Status()})
+		}
+		list = append(list, res)
+	}
+
+	writeHTTPRespAPIOk(c, list)
+}
+
+// scheduleControl serves pause, resume and delete
+func scheduleControl(action func(int64) error) app.HandlerFunc {
+	return func(ctx context.Context, c *app.RequestContext) {
+		glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/schedules/:id/:action", c.Path())
+
+		if !authorize(ctx, c, apikey.ScopeSend) {
+			return
+		}
+
+		s := getSchedule(c)
+		if s == nil {
+			return
+		}
+		if err := action(s.ID); err != nil {
+			writeHTTPRespAPIInvalidInput(c, err.Error())
+			return
+		}
+		after := db.GetSchedule(s.ID)
+		auditRecord(c, "schedule."+controlAction(c), auditTarget("schedule", s.ID), s, after)
+
+		writeHTTPRespAPIOk(c, after)
+	}
+}
+
+func schedulePage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/schedules", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeHistory) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		schedules := db.GetAllSchedules("")
+		list := make([]*scheduleView, 0, len(schedules))
+		for _, s := range schedules {
+			if !keyAllowsDevice(c, s.Device) {
+				continue
+			}
+			v := &scheduleView{ScheduleModel: s, Next: "-", Last: "-"}
+			if s.Status != db.ScheduleDone {
+				v.Next = time.Unix(s.NextRun, 0).Format("2006-01-02 15:04")
+			}
+			if s.LastRun > 0 {
+				v.Last = time.Unix(s.LastRun, 0).Format("2006-01-02 15:04")
+			}
+			list = append(list, v)
+		}
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Schedules.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":     "Schedules",
+			"schedules": list,
+			"devices":   allowedDevices(c, deviceNames()),
+			"pools":     allowedDevices(c, poolNames()),
+		})
+	}
+}
@@ -2,13 +2,50 @@ package app
 
 import (
 	"context"
+	"errors"
 	"github.com/Akvicor/glog"
 	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"net/http"
+	"sms/account"
+	"sms/apikey"
 	"sms/config"
+	"sms/db"
+	"sms/serial"
 )
 
+// userContextKey holds the user of a request's login session once it was resolved
+const userContextKey = "user"
+
+// sessionVerify reports whether the request has the login session of an enabled user
 func sessionVerify(ctx context.Context, c *app.RequestContext) bool {
+	return sessionAccount(c) != nil
+}
+
+// sessionAccount resolves the login session to its user, nil when there is none or the user
+// was deleted or disabled since. The user is kept on the request.
+func sessionAccount(c *app.RequestContext) *db.UserModel {
+	if u, ok := c.Get(userContextKey); ok {
+		return u.(*db.UserModel)
+	}
+	u := account.Resolve(sessionUser(c))
+	if u != nil {
+		c.Set(userContextKey, u)
+	}
+	return u
+}
+
+// requestUser is the user of the request's login session, nil when it has none or it was not
+// resolved yet
+func requestUser(c *app.RequestContext) *db.UserModel {
+	if u, ok := c.Get(userContextKey); ok {
+		return u.(*db.UserModel)
+	}
+	return nil
+}
+
+// sessionUser returns the username of the login session, empty when there is none
+func sessionUser(c *app.RequestContext) string {
 	// Convert Hertz request context to standard HTTP request for session compatibility
 	req := &http.Request{
 		Header: make(http.Header),
@@ -23,22 +60,22 @@ func sessionVerify(ctx context.Context, c *app.RequestContext) bool {
 	session, err := SessionStore.Get(req, config.Global.Session.Name)
 	if err != nil {
 		glog.Debug("Session error: %v", err)
-		return false
+		return ""
 	}
 
 	username, ok := session.Values["username"]
 	if !ok {
 		glog.Debug("No username in session")
-		return false
+		return ""
 	}
 
 	usernameStr, ok := username.(string)
 	if !ok {
 		glog.Debug("Username is not string")
-		return false
+		return ""
 	}
 
-	return usernameStr == config.Global.Security.Username
+	return usernameStr
 }
 
 func sessionUpdate(ctx context.Context, c *app.RequestContext, username string) {
@@ -78,12 +115,192 @@ func sessionUpdate(ctx context.Context, c *app.RequestContext, username string)
 	}
 }
 
-func keyVerify(ctx context.Context, c *app.RequestContext) bool {
-	key := string(c.Query("key"))
-	if key == "" {
-		key = string(c.PostForm("key"))
+// apiKeyContextKey holds the API key a request was authorized with
+const apiKeyContextKey = "api_key"
+
+// keyResultContextKey holds the outcome of keyVerify, a signed request may only be verified
+// once because its nonce is used up
+const keyResultContextKey = "api_key_result"
+
+type keyResult struct {
+	key *db.APIKeyModel
+	err error
+}
+
+// hasKeyCredentials reports whether the request carries signature headers or a key query or
+// form value for keyVerify
+func hasKeyCredentials(c *app.RequestContext) bool {
+	return len(c.GetHeader(apikey.HeaderSignature)) > 0 || len(c.Query("key")) > 0 || len(c.PostForm("key")) > 0
+}
+
+// keyVerify resolves the signature headers or the key query or form value, the key is kept on
+// the request for the device and quota checks. The outcome is kept too, so the rate limit and
+// the handler verify a request once.
+func keyVerify(ctx context.Context, c *app.RequestContext) (*db.APIKeyModel, error) {
+	if r, ok := c.Get(keyResultContextKey); ok {
+		return r.(*keyResult).key, r.(*keyResult).err
+	}
+	k, err := verifyKeyCredentials(c)
+	c.Set(keyResultContextKey, &keyResult{key: k, err: err})
+	if err != nil {
+		return nil, err
+	}
+	c.Set(apiKeyContextKey, k)
+	return k, nil
+}
+
+// verifyKeyCredentials is keyVerify without keeping the outcome
+func verifyKeyCredentials(c *app.RequestContext) (*db.APIKeyModel, error) {
+	var k *db.APIKeyModel
+	var err error
+	if signature := string(c.GetHeader(apikey.HeaderSignature)); signature != "" {
+		k, err = apikey.VerifySigned(
+			string(c.GetHeader(apikey.HeaderKeyID)),
+			string(c.GetHeader(apikey.HeaderTimestamp)),
+			string(c.GetHeader(apikey.HeaderNonce)),
+			signature, string(c.Method()), string(c.Request.RequestURI()), c.Request.Body(), c.ClientIP())
+	} else {
+		key := string(c.Query("key"))
+		if key == "" {
+			key = string(c.PostForm("key"))
+		}
+		if key != "" && config.Global.API.RequireSignature {
+			return nil, apikey.ErrUnsigned
+		}
+		k, err = apikey.Verify(key, c.ClientIP())
+	}
+	return k, err
+}
+
+// requestKey is the API key the request was authorized with, for a login session the access
+// of the user's role and devices
+func requestKey(c *app.RequestContext) *db.APIKeyModel {
+	if k, ok := c.Get(apiKeyContextKey); ok {
+		return k.(*db.APIKeyModel)
+	}
+	return nil
+}
+
+// requestKeyID is the id of the stored API key the request was authorized with, 0 for a login
+// session and the access_key of config.ini
+func requestKeyID(c *app.RequestContext) int64 {
+	if k := requestKey(c); k != nil {
+		return k.ID
+	}
+	return 0
+}
+
+// authorize accepts a login session or an API key with scope. It writes 401 when there is
+// neither and 403 when the key or the user's role lacks the scope.
+func authorize(ctx context.Context, c *app.RequestContext, scope string) bool {
+	if u := sessionAccount(c); u != nil {
+		k := account.Access(u)
+		c.Set(apiKeyContextKey, k)
+		if !apikey.HasScope(k, scope) {
+			writeHTTPRespAPIError(c, consts.StatusForbidden, codeForbidden, "role "+u.Role+" has no "+scope+" scope")
+			return false
+		}
+		return true
+	}
+	k, err := keyVerify(ctx, c)
+	if errors.Is(err, apikey.ErrInvalid) {
+		writeHTTPRespAPINotAuthorized(c)
+		return false
+	}
+	if err != nil {
+		writeHTTPRespAPIError(c, consts.StatusUnauthorized, codeNotAuthorized, err.Error())
+		return false
+	}
+	if !apikey.HasScope(k, scope) {
+		writeHTTPRespAPIError(c, consts.StatusForbidden, codeForbidden, "api key has no "+scope+" scope")
+		return false
+	}
+	return true
+}
+
+// pageVerify is authorize for the pages, without a login session it shows the login page and
+// it writes 403 when the user's role lacks scope, an empty scope allows every role
+func pageVerify(ctx context.Context, c *app.RequestContext, scope string) bool {
+	u := sessionAccount(c)
+	if u == nil {
+		loginGet(ctx, c)
+		return false
+	}
+	k := account.Access(u)
+	c.Set(apiKeyContextKey, k)
+	if scope != "" && !apikey.HasScope(k, scope) {
+		c.String(consts.StatusForbidden, "role "+u.Role+" may not open this page")
+		return false
+	}
+	return true
+}
+
+// authorizeDevice checks the devices of the request's API key, device is a device or pool.
+// It writes 403 when the key may not use it.
+func authorizeDevice(c *app.RequestContext, device string) bool {
+	k := requestKey(c)
+	if k == nil || apikey.AllowsDevice(k, device) {
+		return true
+	}
+	if device == "" {
+		writeHTTPRespAPIError(c, consts.StatusForbidden, codeForbidden, "api key is limited to devices "+k.Devices+", name one")
+	} else {
+		writeHTTPRespAPIError(c, consts.StatusForbidden, codeForbidden, "api key may not use device "+device)
+	}
+	return false
+}
+
+// keyAllowsDevice reports without a response whether the request's API key may use device
+func keyAllowsDevice(c *app.RequestContext, device string) bool {
+	k := requestKey(c)
+	return k == nil || apikey.AllowsDevice(k, device)
+}
+
+// keyDevices returns the devices the request's API key is limited to, nil when it may use all
+func keyDevices(c *app.RequestContext) []string {
+	if k := requestKey(c); k != nil && apikey.Restricted(k) {
+		return apikey.DeviceNames(k)
+	}
+	return nil
+}
+
+// sendDevice returns the device a send to phone goes through. A key limited to some devices
+// is pinned to the routed device when none is given, route then tells how it was picked.
+// It writes the error response and returns false when the key may not use the device.
+func sendDevice(c *app.RequestContext, device, phone string) (string, string, bool) {
+	route := ""
+	if k := requestKey(c); k != nil && apikey.Restricted(k) && device == "" {
+		var err error
+		if device, route, err = serial.Route(phone); err != nil {
+			writeHTTPRespAPIError(c, consts.StatusBadRequest, codeNoRoute, err.Error())
+			return "", "", false
+		}
+	}
+	if !authorizeDevice(c, device) {
+		return "", "", false
+	}
+	return device, route, true
+}
+
+// consumeQuota counts n messages against the send quotas of the request's API key, it writes
+// 429 when they are used up
+func consumeQuota(c *app.RequestContext, n int) bool {
+	k := requestKey(c)
+	if k == nil {
+		return true
+	}
+	if err := apikey.Consume(k, n); err != nil {
+		writeHTTPRespAPIError(c, consts.StatusTooManyRequests, codeQuotaExceeded, err.Error())
+		return false
+	}
+	return true
+}
+
+// refundQuota gives back messages counted by consumeQuota that were not sent
+func refundQuota(c *app.RequestContext, n int) {
+	if k := requestKey(c); k != nil {
+		apikey.Refund(k, n)
 	}
-	return key == config.Global.Security.AccessKey
 }
 
 // mockResponseWriter implements http.ResponseWriter for session compatibility
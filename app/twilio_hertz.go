@@ -0,0 +1,255 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"net/url"
+	"sms/apikey"
+	"sms/audit"
+	"sms/callback"
+	"sms/config"
+	"sms/db"
+	"sms/serial"
+	"sms/twilio"
+	"strconv"
+	"strings"
+)
+
+const twilioMessagesPath = "/" + twilio.APIVersion + "/Accounts/:sid/Messages"
+
+func writeTwilioError(c *app.RequestContext, status, code int, msg string) {
+	c.JSON(status, twilio.NewError(status, code, msg))
+}
+
+// twilioVerify checks the Basic auth of a Twilio client, the password is a gateway API key with
+// scope and the username is ignored so both the account SID and API key SIDs work. The account
+// SID of the path must match [twilio] account_sid when it is set.
+func twilioVerify(c *app.RequestContext, scope string) bool {
+	if !config.Global.Twilio.Enable {
+		writeTwilioError(c, consts.StatusNotFound, twilio.ErrNotFound, "The requested resource was not found")
+		return false
+	}
+	k, err := apikey.Verify(basicPassword(c), c.ClientIP())
+	if err != nil {
+		c.Response.Header.Set("WWW-Authenticate", `Basic realm="Twilio API"`)
+		writeTwilioError(c, consts.StatusUnauthorized, twilio.ErrAuthenticate, "Authenticate")
+		return false
+	}
+	if !apikey.HasScope(k, scope) {
+		writeTwilioError(c, consts.StatusForbidden, twilio.ErrAuthenticate, "The API key has no "+scope+" scope")
+		return false
+	}
+	c.Set(apiKeyContextKey, k)
+	if config.Global.Twilio.AccountSID != "" && c.Param("sid") != config.Global.Twilio.AccountSID {
+		writeTwilioError(c, consts.StatusNotFound, twilio.ErrNotFound, "The requested resource "+string(c.Path())+" was not found")
+		return false
+	}
+	return true
+}
+
+// basicPassword returns the password of the Basic Authorization header, empty without one
+func basicPassword(c *app.RequestContext) string {
+	auth := string(c.GetHeader("Authorization"))
+	if !strings.HasPrefix(auth, "Basic ") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return ""
+	}
+	if i := strings.IndexByte(string(decoded), ':'); i >= 0 {
+		return string(decoded[i+1:])
+	}
+	return ""
+}
+
+func twilioSendMessage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), twilioMessagesPath+".json", c.Path())
+
+	if !twilioVerify(c, apikey.ScopeSend) {
+		return
+	}
+
+	to := string(c.PostForm("To"))
+	body := string(c.PostForm("Body"))
+	from := string(c.PostForm("From"))
+	service := string(c.PostForm("MessagingServiceSid"))
+	statusCallback := string(c.PostForm("StatusCallback"))
+	if to == "" {
+		writeTwilioError(c, consts.StatusBadRequest, twilio.ErrToRequired, "A 'To' phone number is required.")
+		return
+	}
+	if body == "" {
+		writeTwilioError(c, consts.StatusBadRequest, twilio.ErrBodyRequired, "Message body is required.")
+		return
+	}
+	if len(c.PostForm("MediaUrl")) > 0 {
+		writeTwilioError(c, consts.StatusBadRequest, twilio.ErrInvalidParameter, "MediaUrl is not supported, the gateway sends SMS only.")
+		return
+	}
+	if statusCallback != "" {
+		if err := callback.ValidateFormat(statusCallback, twilio.CallbackFormat); err != nil {
+			writeTwilioError(c, consts.StatusBadRequest, twilio.ErrInvalidCallback, "The StatusCallback URL "+statusCallback+" is not a valid URL.")
+			return
+		}
+	}
+
+	// MessagingServiceSid or From may name a device, a pool or the number of a device,
+	// otherwise the message is routed by the To number
+	device := twilio.DeviceOf(service)
+	if device == "" {
+		device = twilio.DeviceOf(from)
+	}
+	// a key limited to some devices sends on the routed device so it cannot fall back to others
+	k := requestKey(c)
+	if apikey.Restricted(k) && device == "" {
+		routed, _, err := serial.Route(to)
+		if err != nil {
+			writeTwilioError(c, consts.StatusBadRequest, twilio.ErrUnreachable, "The 'To' phone number: "+to+", is not currently reachable via SMS.")
+			return
+		}
+		device = routed
+	}
+	if !apikey.AllowsDevice(k, device) {
+		writeTwilioError(c, consts.StatusForbidden, twilio.ErrInvalidFrom, "The From phone number "+from+" may not be used with this API key.")
+		return
+	}
+	if apikey.Consume(k, 1) != nil {
+		writeTwilioError(c, consts.StatusTooManyRequests, twilio.ErrTooManyRequests, "The send quota of the API key is exceeded.")
+		return
+	}
+
+	sent, route, ids, err := serial.SendTo(device, "twilio", to, body)
+	auditSend(c, &audit.Message{Device: sent, Route: route, Sender: "twilio", Phone: to, Message: body, IDs: ids}, err)
+	if err != nil {
+		refundQuota(c, 1)
+		glog.Warning("[twilio] send to [%s] via [%s] failed [%v]", to, device, err)
+		switch {
+		case errors.Is(err, serial.ErrNoRoute):
+			writeTwilioError(c, consts.StatusBadRequest, twilio.ErrUnreachable, "The 'To' phone number: "+to+", is not currently reachable using the 'From' phone number via SMS.")
+		case errors.Is(err, serial.ErrDeviceNotFound):
+			writeTwilioError(c, consts.StatusBadRequest, twilio.ErrInvalidFrom, "The From phone number "+from+" is not a valid device of this gateway.")
+		default:
+			writeTwilioError(c, consts.StatusServiceUnavailable, twilio.ErrUnavailable, "Service unavailable: "+err.Error())
+		}
+		return
+	}
+	if len(ids) == 0 {
+		writeTwilioError(c, consts.StatusInternalServerError, twilio.ErrUnknown, "Message was not queued")
+		return
+	}
+	if statusCallback != "" {
+		if err = callback.RegisterFormat(ids[0], statusCallback, twilio.CallbackFormat); err != nil {
+			glog.Warning("[twilio] register status callback for [%d] failed [%v]", ids[0], err)
+		}
+	}
+	his := db.GetHistory(ids[0])
+	if his == nil {
+		writeTwilioError(c, consts.StatusInternalServerError, twilio.ErrUnknown, "Message was not queued")
+		return
+	}
+	c.JSON(consts.StatusCreated, twilio.NewMessage(c.Param("sid"), his))
+}
+
+func twilioGetMessage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), twilioMessagesPath+"/:message", c.Path())
+
+	if !twilioVerify(c, apikey.ScopeHistory) {
+		return
+	}
+
+	id, ok := twilio.ParseMessageSID(c.Param("message"))
+	var his *db.HistoryModel
+	if ok {
+		his = db.GetHistory(id)
+	}
+	if his == nil || (his.MessageID != 0 && his.MessageID != his.ID) || !keyAllowsDevice(c, his.Device) {
+		writeTwilioError(c, consts.StatusNotFound, twilio.ErrNotFound, "The requested resource "+string(c.Path())+" was not found")
+		return
+	}
+	c.JSON(consts.StatusOK, twilio.NewMessage(c.Param("sid"), his))
+}
+
+// twilioListMessages lists messages newest first. To and From select the direction: the number
+// of a device is the gateway side, any other number the remote side. PageToken is the id the
+// next page starts below.
+func twilioListMessages(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), twilioMessagesPath+".json", c.Path())
+
+	if !twilioVerify(c, apikey.ScopeHistory) {
+		return
+	}
+
+	search := &db.HistorySearch{Devices: keyDevices(c)}
+	for _, param := range []string{"To", "From"} {
+		number := string(c.Query(param))
+		if number == "" {
+			continue
+		}
+		if device := twilio.DeviceOf(number); device != "" {
+			search.Device = device
+			search.Direction = map[string]string{"To": db.HistoryDirectionIn, "From": db.HistoryDirectionOut}[param]
+		} else {
+			search.Phone = number
+			search.Direction = map[string]string{"To": db.HistoryDirectionOut, "From": db.HistoryDirectionIn}[param]
+		}
+	}
+	size := 50
+	if s := string(c.Query("PageSize")); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil || size < 1 || size > 1000 {
+			writeTwilioError(c, consts.StatusBadRequest, twilio.ErrInvalidParameter, "PageSize must be between 1 and 1000")
+			return
+		}
+	}
+	page, _ := strconv.Atoi(string(c.Query("Page")))
+	cursor := int64(0)
+	if token := string(c.Query("PageToken")); token != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(strings.TrimPrefix(token, "PA"), 10, 64); err != nil || cursor < 0 {
+			writeTwilioError(c, consts.StatusBadRequest, twilio.ErrInvalidParameter, "Invalid PageToken")
+			return
+		}
+	}
+
+	sid := c.Param("sid")
+	base := "/" + twilio.APIVersion + "/Accounts/" + sid + "/Messages.json"
+	query := url.Values{"PageSize": {strconv.Itoa(size)}}
+	for _, param := range []string{"To", "From"} {
+		if v := string(c.Query(param)); v != "" {
+			query.Set(param, v)
+		}
+	}
+	res := &twilio.MessagePage{
+		Messages:     make([]*twilio.Message, 0, size),
+		FirstPageURI: base + "?" + query.Encode() + "&Page=0",
+		Page:         page,
+		PageSize:     size,
+		Start:        page * size,
+		URI:          string(c.URI().RequestURI()),
+	}
+	histories := db.SearchHistories(search, cursor, size)
+	for i := range histories {
+		// later segments are part of the message of their first segment
+		if histories[i].MessageID != 0 && histories[i].MessageID != histories[i].ID {
+			continue
+		}
+		res.Messages = append(res.Messages, twilio.NewMessage(sid, &histories[i]))
+	}
+	res.End = res.Start + len(res.Messages) - 1
+	if res.End < res.Start {
+		res.End = res.Start
+	}
+	if len(histories) == size {
+		query.Set("Page", strconv.Itoa(page+1))
+		query.Set("PageToken", fmt.Sprintf("PA%d", histories[len(histories)-1].ID))
+		next := base + "?" + query.Encode()
+		res.NextPageURI = &next
+	}
+	c.JSON(consts.StatusOK, res)
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Akvicor/glog"
+	"github.com/cloudwego/hertz/pkg/app"
+	"sms/account"
+	"sms/apikey"
+	"sms/db"
+	"sms/serial"
+	"sms/static"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type userRequest struct {
+	// Username is only read on creation
+	Username string `json:"username"`
+	// Password is required on creation, empty keeps it on update
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	// Devices is comma separated devices or pools, empty allows all
+	Devices string `json:"devices"`
+	// Disabled is only read on update, a disabled user cannot log in
+	Disabled bool `json:"disabled"`
+}
+
+// userView adds the readable last login for the users page
+type userView struct {
+	db.UserModel
+	LastLogin string
+}
+
+// bindUser reads the settings of a user from the JSON body into u and returns the request for
+// the username and password
+func bindUser(c *app.RequestContext, u *db.UserModel) *userRequest {
+	req := &userRequest{}
+	if err := json.Unmarshal(c.Request.Body(), req); err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid request: "+err.Error())
+		return nil
+	}
+	if !account.ValidRole(req.Role) {
+		writeHTTPRespAPIInvalidInput(c, "invalid role ["+req.Role+"], use "+strings.Join(account.Roles, ", "))
+		return nil
+	}
+	devices, ok := apikey.Normalize(req.Devices, serial.Exists)
+	if !ok {
+		writeHTTPRespAPIInvalidInput(c, "unknown device or pool ["+devices+"]")
+		return nil
+	}
+	u.Role, u.Devices, u.Disabled = req.Role, devices, req.Disabled
+	return req
+}
+
+// getUser loads the user of the id parameter, on failure the error response is already written
+func getUser(c *app.RequestContext) *db.UserModel {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, "invalid user id")
+		return nil
+	}
+	u := db.GetUser(id)
+	if u == nil {
+		writeHTTPRespAPINotFound(c, "user not found")
+		return nil
+	}
+	return u
+}
+
+func userList(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/users", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	users := db.GetAllUsers()
+	if users == nil {
+		writeHTTPRespAPIFailed(c, "get users failed")
+		return
+	}
+
+	writeHTTPRespAPIOk(c, users)
+}
+
+func userCreate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/users", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	u := &db.UserModel{}
+	req := bindUser(c, u)
+	if req == nil {
+		return
+	}
+	created, err := account.Create(strings.TrimSpace(req.Username), req.Password, u.Role, u.Devices)
+	if errors.Is(err, account.ErrFailed) {
+		writeHTTPRespAPIFailed(c, "insert user failed")
+		return
+	}
+	if err != nil {
+		writeHTTPRespAPIInvalidInput(c, err.Error())
+		return
+	}
+	glog.Info("user [%d] %s created with role [%s]", created.ID, created.Username, created.Role)
+	auditRecord(c, "user.create", auditTarget("user", created.ID), nil, created)
+
+	writeHTTPRespAPIOk(c, created)
+}
+
+// userUpdate changes the role, devices and disabled flag of a user and its password when one
+// is given. The last enabled admin keeps its role.
+func userUpdate(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/users/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	u := getUser(c)
+	if u == nil {
+		return
+	}
+	before := *u
+	req := bindUser(c, u)
+	if req == nil {
+		return
+	}
+	if (u.Role != account.RoleAdmin || u.Disabled) && account.LastAdmin(&before) {
+		writeHTTPRespAPIInvalidInput(c, "the last admin must stay an enabled admin")
+		return
+	}
+	if req.Password != "" {
+		if err := account.SetPassword(u.ID, req.Password); err != nil {
+			writeHTTPRespAPIInvalidInput(c, err.Error())
+			return
+		}
+		glog.Info("password of user [%d] %s changed", u.ID, u.Username)
+		auditRecord(c, "user.password", auditTarget("user", u.ID), nil, nil)
+	}
+	if !db.UpdateUser(u) {
+		writeHTTPRespAPIFailed(c, "update user failed")
+		return
+	}
+	after := db.GetUser(u.ID)
+	auditRecord(c, "user.update", auditTarget("user", u.ID), &before, after)
+
+	writeHTTPRespAPIOk(c, after)
+}
+
+// userDelete removes a user, its login sessions stop working at once
+func userDelete(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/api/v1/users/:id", c.Path())
+
+	if !authorize(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	u := getUser(c)
+	if u == nil {
+		return
+	}
+	if account.LastAdmin(u) {
+		writeHTTPRespAPIInvalidInput(c, "the last admin cannot be deleted")
+		return
+	}
+	if !db.DeleteUser(u.ID) {
+		writeHTTPRespAPIFailed(c, "delete user failed")
+		return
+	}
+	glog.Info("user [%d] %s deleted", u.ID, u.Username)
+	auditRecord(c, "user.delete", auditTarget("user", u.ID), u, nil)
+
+	writeHTTPRespAPIOk(c, u)
+}
+
+func usersPage(ctx context.Context, c *app.RequestContext) {
+	glog.Debug("[%-4s][%-32s] %s", c.Method(), "/users", c.Path())
+	if !pageVerify(ctx, c, apikey.ScopeAdmin) {
+		return
+	}
+
+	if string(c.Method()) == "GET" {
+		users := db.GetAllUsers()
+		list := make([]*userView, 0, len(users))
+		for _, u := range users {
+			v := &userView{UserModel: u, LastLogin: "never"}
+			if u.LastLoginAt > 0 {
+				v.LastLogin = time.Unix(u.LastLoginAt, 0).Format("2006-01-02 15:04") + " from " + u.LastLoginIP
+			}
+			list = append(list, v)
+		}
+		c.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+		_ = static.Users.Execute(c.Response.BodyWriter(), map[string]interface{}{
+			"title":   "Users",
+			"users":   list,
+			"roles":   account.Roles,
+			"devices": deviceNames(),
+			"pools":   poolNames(),
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/network"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 server side, enough for pushing text messages to browsers and scripts
+
+const (
+	wsOpText   = 0x1
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xA
+	wsMaxFrame = 1 << 16
+)
+
+var wsGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+// wsUpgrade answers the handshake, handler runs on the hijacked connection once the 101 response is written
+func wsUpgrade(c *app.RequestContext, handler func(ws *wsConn)) bool {
+	key := string(c.GetHeader("Sec-WebSocket-Key"))
+	if !strings.EqualFold(string(c.GetHeader("Upgrade")), "websocket") ||
+		!strings.Contains(strings.ToLower(string(c.GetHeader("Connection"))), "upgrade") ||
+		string(c.GetHeader("Sec-WebSocket-Version")) != "13" || key == "" {
+		return false
+	}
+	sum := sha1.Sum(append([]byte(key), wsGUID...))
+	c.SetStatusCode(consts.StatusSwitchingProtocols)
+	c.Response.Header.Set("Upgrade", "websocket")
+	c.Response.Header.Set("Connection", "Upgrade")
+	c.Response.Header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	c.Response.Header.SetNoDefaultContentType(true)
+	c.Hijack(func(conn network.Conn) {
+		handler(&wsConn{conn: conn, reader: bufio.NewReader(conn)})
+	})
+	return true
+}
+
+func (ws *wsConn) writeFrame(op byte, payload []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | op
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends one text message
+func (ws *wsConn) WriteText(data []byte) error {
+	return ws.writeFrame(wsOpText, data)
+}
+
+// ReadLoop answers pings and returns when the client closes the connection or it breaks,
+// messages from the client are discarded
+func (ws *wsConn) ReadLoop() error {
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case wsOpClose:
+			_ = ws.writeFrame(wsOpClose, nil)
+			return io.EOF
+		case wsOpPing:
+			if err = ws.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(ws.reader, head); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.reader, ext); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext)
+	}
+	if !masked {
+		return 0, nil, errors.New("websocket client frame is not masked")
+	}
+	if n > wsMaxFrame {
+		return 0, nil, errors.New("websocket frame too large")
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.reader, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+func (ws *wsConn) Close() error {
+	return ws.conn.Close()
+}
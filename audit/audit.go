@@ -0,0 +1,180 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"reflect"
+	"sms/db"
+	"sync"
+	"time"
+)
+
+// Actor is who did something and from where, Name is "user:<name>", "key:<id> <name>",
+// "access_key" or a module like "smpp:<system_id>"
+type Actor struct {
+	Name      string
+	IP        string
+	UserAgent string
+}
+
+// System is the actor of what the gateway does by itself, e.g. starting devices
+var System = Actor{Name: "system"}
+
+// Message is what the log keeps of a send request, Via is the interface it came in through
+type Message struct {
+	Via     string  `json:"via"`
+	Device  string  `json:"device"`
+	Route   string  `json:"route,omitempty"`
+	Sender  string  `json:"sender"`
+	Phone   string  `json:"phone"`
+	Message string  `json:"message"`
+	IDs     []int64 `json:"ids,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// RecordSend records a send request as message.send of the phone number
+func RecordSend(actor Actor, m *Message) {
+	Record(actor, "message.send", m.Phone, nil, m)
+}
+
+// verifyBatch is how many entries Verify reads at once
+const verifyBatch = 500
+
+// head is the last entry of the chain, loaded on the first Record
+var head = struct {
+	sync.Mutex
+	loaded bool
+	id     int64
+	hash   string
+}{}
+
+// Report is the result of Verify. BrokenID is the first entry that does not match the chain,
+// 0 when the chain is intact; Head is the hash of the last entry, comparing it with an
+// earlier export shows whether newest entries were removed.
+type Report struct {
+	Entries  int64  `json:"entries"`
+	Head     string `json:"head"`
+	BrokenID int64  `json:"broken_id"`
+	Reason   string `json:"reason"`
+}
+
+// Record appends an entry to the log. before and after are the object before and after the
+// change, nil for a creation or deletion; only the fields that differ are kept.
+func Record(actor Actor, action, target string, before, after interface{}) {
+	b, a := diff(before, after)
+
+	head.Lock()
+	defer head.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if !head.loaded || attempt > 0 {
+			head.id, head.hash = 0, ""
+			if last := db.GetLastAudit(); last != nil {
+				head.id, head.hash = last.ID, last.Hash
+			}
+			head.loaded = true
+		}
+		m := &db.AuditModel{
+			ID:        head.id + 1,
+			CreatedAt: time.Now().Unix(),
+			Actor:     actor.Name,
+			Action:    action,
+			Target:    target,
+			IP:        actor.IP,
+			UserAgent: actor.UserAgent,
+			Before:    b,
+			After:     a,
+			PrevHash:  head.hash,
+		}
+		m.Hash = Hash(m)
+		if db.InsertAudit(m) {
+			head.id, head.hash = m.ID, m.Hash
+			return
+		}
+	}
+	glog.Error("audit entry [%s] %s by %s was not recorded", action, target, actor.Name)
+}
+
+// Hash is the chain hash of an entry, it covers every field but Hash itself
+func Hash(m *db.AuditModel) string {
+	data, _ := json.Marshal([]interface{}{m.ID, m.CreatedAt, m.Actor, m.Action, m.Target, m.IP, m.UserAgent, m.Before, m.After, m.PrevHash})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify walks the chain from the first entry. Entry IDs are consecutive and start at 1, so a
+// deleted entry shows as a gap even where the hashes were recomputed around it.
+func Verify() *Report {
+	r := &Report{}
+	var prevID int64
+	prevHash := ""
+	for {
+		list := db.GetAuditsAfter(prevID, verifyBatch)
+		for i := range list {
+			m := &list[i]
+			switch {
+			case m.ID == prevID+2:
+				r.BrokenID, r.Reason = m.ID, fmt.Sprintf("entry %d is missing", prevID+1)
+			case m.ID != prevID+1:
+				r.BrokenID, r.Reason = m.ID, fmt.Sprintf("entries %d to %d are missing", prevID+1, m.ID-1)
+			case m.PrevHash != prevHash:
+				r.BrokenID, r.Reason = m.ID, "previous hash does not match the entry before"
+			case m.Hash != Hash(m):
+				r.BrokenID, r.Reason = m.ID, "entry was modified"
+			}
+			if r.BrokenID != 0 {
+				return r
+			}
+			r.Entries++
+			prevID, prevHash = m.ID, m.Hash
+		}
+		if len(list) < verifyBatch {
+			r.Head = prevHash
+			return r
+		}
+	}
+}
+
+// diff returns the JSON of the fields that differ between before and after, a missing side
+// keeps every field of the other
+func diff(before, after interface{}) (string, string) {
+	b, a := fields(before), fields(after)
+	if b != nil && a != nil {
+		for k, v := range b {
+			if w, ok := a[k]; ok && reflect.DeepEqual(v, w) {
+				delete(b, k)
+				delete(a, k)
+			}
+		}
+	}
+	return encode(b), encode(a)
+}
+
+// fields turns a value into its JSON fields, a value that is not an object is kept as "value"
+func fields(v interface{}) map[string]interface{} {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return map[string]interface{}{"value": fmt.Sprint(v)}
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(data, &m) != nil {
+		var value interface{}
+		_ = json.Unmarshal(data, &value)
+		return map[string]interface{}{"value": value}
+	}
+	return m
+}
+
+// encode writes fields as JSON with sorted keys, empty for none
+func encode(m map[string]interface{}) string {
+	if len(m) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(m)
+	return string(data)
+}
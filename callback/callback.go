@@ -0,0 +1,338 @@
+package callback
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"net"
+	"net/http"
+	"net/url"
+	"sms/config"
+	"sms/db"
+	"sms/serial"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// client refuses to connect to private addresses unless [api] callback_allow_private is set,
+// checked on the resolved address so a hostname or redirect cannot point it inside
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: dialControl}).DialContext,
+	},
+}
+
+// ErrPrivate refuses a callback to a loopback, private or link-local address
+var ErrPrivate = errors.New("status_callback may not point to a private address")
+
+// dialControl checks the address a callback connects to
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && privateIP(ip) && !config.Global.API.CallbackAllowPrivate {
+		return ErrPrivate
+	}
+	return nil
+}
+
+// privateIP reports whether ip is not a public unicast address
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// deliveryLocks serializes the state checks and posts of one message, so its events are posted
+// in order and a later state waits while an earlier one is being retried
+var deliveryLocks = struct {
+	sync.Mutex
+	messages map[int64]*deliveryLock
+}{messages: make(map[int64]*deliveryLock)}
+
+type deliveryLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lockMessage locks the deliveries of a message and returns its unlock, the lock is dropped when
+// no check waits for it
+func lockMessage(messageID int64) func() {
+	deliveryLocks.Lock()
+	l := deliveryLocks.messages[messageID]
+	if l == nil {
+		l = &deliveryLock{}
+		deliveryLocks.messages[messageID] = l
+	}
+	l.waiting++
+	deliveryLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		deliveryLocks.Lock()
+		if l.waiting--; l.waiting == 0 {
+			delete(deliveryLocks.messages, messageID)
+		}
+		deliveryLocks.Unlock()
+	}
+}
+
+// Segment is the state of one part of a long message
+type Segment struct {
+	ID     int64  `json:"id"`
+	Device string `json:"device"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Event is the JSON body posted to a status callback
+type Event struct {
+	MessageID int64     `json:"message_id"`
+	Status    string    `json:"status"`
+	Phone     string    `json:"phone"`
+	Segments  []Segment `json:"segments"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+// Payload is an encoded event as it is posted
+type Payload struct {
+	ContentType string
+	Body        []byte
+	Header      map[string]string
+}
+
+// ErrNoSecret refuses a status callback in the gateway's format while there is no secret to
+// sign it with
+var ErrNoSecret = errors.New("status_callback needs [api] callback_secret to be set")
+
+// Formatter encodes an event for callbacks registered with a format other than the gateway's
+// JSON, it is called for every attempt and returns nil to skip the event
+type Formatter func(u string, e *Event) *Payload
+
+var formatters = make(map[string]Formatter)
+
+// SetFormatter registers the encoder of a callback format
+func SetFormatter(format string, f Formatter) {
+	formatters[format] = f
+}
+
+// EnableCallbacks follows state changes of outbound messages and posts them to their callbacks
+func EnableCallbacks() {
+	serial.OnStatus(func(device string, historyID int64, status string) {
+		his := db.GetHistory(historyID)
+		if his == nil || his.MessageID == 0 {
+			return
+		}
+		check(his.MessageID)
+	})
+}
+
+// ValidateURL checks that u is an absolute http or https URL
+func ValidateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid status_callback [%s]", u)
+	}
+	return nil
+}
+
+// Validate checks that u can be used as a status callback in the gateway's format
+func Validate(u string) error {
+	return ValidateFormat(u, "")
+}
+
+// ValidateFormat checks that u can be used as a status callback in format. Loopback and
+// private targets are refused unless [api] callback_allow_private is set; a hostname is
+// checked again when the callback connects.
+func ValidateFormat(u, format string) error {
+	if err := ValidateURL(u); err != nil {
+		return err
+	}
+	if format == "" && config.Global.API.CallbackSecret == "" {
+		return ErrNoSecret
+	}
+	if config.Global.API.CallbackAllowPrivate {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(mustHostname(u), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivate
+	}
+	if ip := net.ParseIP(host); ip != nil && privateIP(ip) {
+		return ErrPrivate
+	}
+	return nil
+}
+
+// mustHostname is the host of a URL that passed ValidateURL
+func mustHostname(u string) string {
+	parsed, _ := url.Parse(u)
+	return parsed.Hostname()
+}
+
+// Register posts every state change of a logical message to u, starting with queued
+func Register(messageID int64, u string) error {
+	return RegisterFormat(messageID, u, "")
+}
+
+// RegisterFormat is Register for a callback that expects the events in a format set with SetFormatter
+func RegisterFormat(messageID int64, u, format string) error {
+	if err := ValidateFormat(u, format); err != nil {
+		return err
+	}
+	if _, ok := formatters[format]; format != "" && !ok {
+		return fmt.Errorf("unknown callback format [%s]", format)
+	}
+	if db.InsertStatusCallback(messageID, u, format, db.MessageQueued) < 0 {
+		return fmt.Errorf("insert status callback failed")
+	}
+	go func() {
+		unlock := lockMessage(messageID)
+		defer unlock()
+		post(u, format, newEvent(messageID, db.MessageQueued, db.GetMessageSegments(messageID)))
+		update(messageID)
+	}()
+	return nil
+}
+
+// check posts the current state of a message if it differs from the last one posted
+func check(messageID int64) {
+	unlock := lockMessage(messageID)
+	defer unlock()
+	update(messageID)
+}
+
+// update is check with the lock of the message held. It reads the state again after every post,
+// so a state reached while an earlier one was posted is not lost.
+func update(messageID int64) {
+	for conflicts := 0; conflicts < 3; {
+		cb := db.GetStatusCallback(messageID)
+		if cb == nil {
+			return
+		}
+		segments := db.GetMessageSegments(messageID)
+		status := db.MessageStatus(segments)
+		if status == cb.LastStatus {
+			return
+		}
+		if !db.UpdateStatusCallbackStatus(cb.ID, cb.LastStatus, status) {
+			conflicts++
+			continue
+		}
+		post(cb.URL, cb.Format, newEvent(messageID, status, segments))
+	}
+	glog.Warning("[callback] message %d state could not be recorded", messageID)
+}
+
+func newEvent(messageID int64, status string, segments []db.HistoryModel) *Event {
+	e := &Event{MessageID: messageID, Status: status, Segments: make([]Segment, 0, len(segments)), Timestamp: time.Now().Unix()}
+	for i := range segments {
+		e.Phone = segments[i].Phone
+		e.Segments = append(e.Segments, Segment{
+			ID:     segments[i].ID,
+			Device: segments[i].Device,
+			Status: segments[i].Status(),
+			Error:  segments[i].Error,
+		})
+	}
+	return e
+}
+
+// post delivers e, retrying with backoff until the callback answers 2xx. The caller holds the
+// lock of the message.
+func post(u, format string, e *Event) {
+	encode := jsonPayload
+	if format != "" {
+		if encode = formatters[format]; encode == nil {
+			glog.Warning("[callback] message %d has unknown callback format [%s]", e.MessageID, format)
+			return
+		}
+	}
+	retries := config.Global.API.CallbackRetries
+	if retries < 0 {
+		retries = 0
+	}
+	backoff := 5 * time.Second
+	for attempt := 0; ; attempt++ {
+		p := encode(u, e)
+		if p == nil {
+			return
+		}
+		err := send(u, p)
+		if err == nil {
+			glog.Debug("[callback] message %d %s posted to %s", e.MessageID, e.Status, u)
+			return
+		}
+		if attempt >= retries {
+			glog.Warning("[callback] message %d %s to %s failed after %d attempts [%v]", e.MessageID, e.Status, u, attempt+1, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// jsonPayload is the gateway's own format, signed with the timestamp of the attempt. It is
+// skipped when callback_secret was removed after the callback was registered.
+func jsonPayload(u string, e *Event) *Payload {
+	if config.Global.API.CallbackSecret == "" {
+		glog.Warning("[callback] message %d not posted to %s, [api] callback_secret is not set", e.MessageID, u)
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return &Payload{
+		ContentType: "application/json",
+		Body:        body,
+		Header: map[string]string{
+			"X-SMS-Timestamp": timestamp,
+			"X-SMS-Signature": "sha256=" + Sign(timestamp, body),
+		},
+	}
+}
+
+func send(u string, p *Payload) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(p.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", p.ContentType)
+	req.Header.Set("User-Agent", "sms-gateway")
+	for k, v := range p.Header {
+		req.Header.Set(k, v)
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of timestamp "." body with [api] callback_secret, receivers
+// compute the same to verify a callback
+func Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.Global.API.CallbackSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,408 @@
+package campaign
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"io"
+	"sms/apikey"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const senderPrefix = "campaign-"
+
+var (
+	stop     chan struct{}
+	lastSend = make(map[int64]time.Time)
+)
+
+// Campaign is a new campaign as submitted by a user, CSV holds the recipients
+type Campaign struct {
+	Name          string
+	Template      string
+	Device        string
+	RatePerMinute int
+	WindowStart   string
+	WindowEnd     string
+	StartAt       int64
+	CSV           []byte
+	// APIKeyID is the key the campaign was created with, 0 for a login session
+	APIKeyID int64
+}
+
+// EnableCampaigns starts the worker that sends running campaigns, campaigns live in the
+// database so sending resumes after a restart
+func EnableCampaigns() {
+	stop = make(chan struct{})
+	go run(stop)
+}
+
+func KillCampaigns() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+// Create validates a campaign, parses its CSV and stores it as running
+func Create(c *Campaign) (int64, error) {
+	if strings.TrimSpace(c.Name) == "" {
+		return 0, fmt.Errorf("name is required")
+	}
+	tpl, err := template.New("campaign").Option("missingkey=zero").Parse(c.Template)
+	if err != nil {
+		return 0, fmt.Errorf("invalid template: %v", err)
+	}
+	if c.Device == "" || !serial.Exists(c.Device) {
+		return 0, fmt.Errorf("unknown device or pool [%s]", c.Device)
+	}
+	if _, _, err = parseWindow(c.WindowStart, c.WindowEnd); err != nil {
+		return 0, err
+	}
+	if c.RatePerMinute <= 0 {
+		c.RatePerMinute = config.Global.Campaign.RatePerMinute
+	}
+	if c.RatePerMinute <= 0 {
+		c.RatePerMinute = 10
+	}
+
+	columns, recipients, err := parseCSV(c.CSV)
+	if err != nil {
+		return 0, err
+	}
+	max := config.Global.Campaign.MaxRecipients
+	if max <= 0 {
+		max = 5000
+	}
+	if len(recipients) > max {
+		return 0, fmt.Errorf("too many recipients %d, at most %d", len(recipients), max)
+	}
+	for i := range recipients {
+		if _, err = render(tpl, &recipients[i]); err != nil {
+			return 0, fmt.Errorf("row %d: %v", i+2, err)
+		}
+	}
+
+	id := db.InsertCampaign(&db.CampaignModel{
+		Name:          c.Name,
+		Template:      c.Template,
+		Device:        c.Device,
+		Columns:       strings.Join(columns, ","),
+		Status:        db.CampaignRunning,
+		RatePerMinute: c.RatePerMinute,
+		WindowStart:   c.WindowStart,
+		WindowEnd:     c.WindowEnd,
+		StartAt:       c.StartAt,
+		APIKeyID:      c.APIKeyID,
+	}, recipients)
+	if id < 0 {
+		return 0, fmt.Errorf("insert campaign failed")
+	}
+	glog.Info("[campaign] created [%d] %s with %d recipients", id, c.Name, len(recipients))
+	return id, nil
+}
+
+// Pause stops sending a running campaign until it is resumed
+func Pause(id int64) error {
+	return transition(id, db.CampaignPaused, db.CampaignRunning)
+}
+
+// Resume continues a paused campaign
+func Resume(id int64) error {
+	return transition(id, db.CampaignRunning, db.CampaignPaused)
+}
+
+// Cancel stops a campaign for good, recipients that were not sent yet are cancelled
+func Cancel(id int64) error {
+	return transition(id, db.CampaignCancelled, db.CampaignRunning, db.CampaignPaused)
+}
+
+func transition(id int64, to string, from ...string) error {
+	c := db.GetCampaign(id)
+	if c == nil {
+		return fmt.Errorf("campaign not found")
+	}
+	for _, status := range from {
+		if c.Status == status {
+			if !db.UpdateCampaignStatus(id, to) {
+				return fmt.Errorf("update campaign failed")
+			}
+			glog.Info("[campaign] [%d] %s -> %s", id, c.Status, to)
+			return nil
+		}
+	}
+	return fmt.Errorf("campaign is %s", c.Status)
+}
+
+// parseCSV reads recipients from a CSV with a header row, the phone column is required and
+// every other column becomes a template variable
+func parseCSV(data []byte) ([]string, []db.CampaignRecipientModel, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid csv: %v", err)
+	}
+	phoneColumn := -1
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+		if strings.EqualFold(header[i], "phone") {
+			phoneColumn = i
+		}
+	}
+	if phoneColumn < 0 {
+		return nil, nil, fmt.Errorf("csv needs a phone column")
+	}
+
+	recipients := make([]db.CampaignRecipientModel, 0)
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid csv: %v", err)
+		}
+		phone := strings.TrimSpace(row[phoneColumn])
+		if phone == "" {
+			return nil, nil, fmt.Errorf("row %d: empty phone", line)
+		}
+		vars := make(map[string]string, len(header))
+		for i, name := range header {
+			vars[name] = strings.TrimSpace(row[i])
+		}
+		vars["phone"] = phone
+		data, _ := json.Marshal(vars)
+		recipients = append(recipients, db.CampaignRecipientModel{Phone: phone, Vars: string(data)})
+	}
+	if len(recipients) == 0 {
+		return nil, nil, fmt.Errorf("csv has no recipients")
+	}
+	return header, recipients, nil
+}
+
+func render(tpl *template.Template, r *db.CampaignRecipientModel) (string, error) {
+	vars := make(map[string]string)
+	_ = json.Unmarshal([]byte(r.Vars), &vars)
+	buf := strings.Builder{}
+	if err := tpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(buf.String())
+	if text == "" {
+		return "", fmt.Errorf("rendered message is empty")
+	}
+	return text, nil
+}
+
+// parseWindow parses a daily send window "HH:MM"-"HH:MM" into minutes of the day, both empty means all day
+func parseWindow(start, end string) (int, int, error) {
+	if start == "" && end == "" {
+		return 0, 24 * 60, nil
+	}
+	s, err1 := time.Parse("15:04", start)
+	e, err2 := time.Parse("15:04", end)
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("invalid send window, use HH:MM")
+	}
+	return s.Hour()*60 + s.Minute(), e.Hour()*60 + e.Minute(), nil
+}
+
+// inWindow reports whether now is inside the daily window, windows may wrap past midnight
+func inWindow(c *db.CampaignModel, now time.Time) bool {
+	start, end, err := parseWindow(c.WindowStart, c.WindowEnd)
+	if err != nil {
+		return false
+	}
+	m := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+func run(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	syncTicker := time.NewTicker(10 * time.Second)
+	defer syncTicker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tick(time.Now())
+		case <-syncTicker.C:
+			syncAll()
+			resumeQuota()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// tick sends the next recipient of every running campaign whose window is open and whose rate allows it
+func tick(now time.Time) {
+	for _, c := range db.GetAllCampaigns(db.CampaignRunning) {
+		if c.StartAt > now.Unix() || !inWindow(&c, now) {
+			continue
+		}
+		interval := time.Minute / time.Duration(c.RatePerMinute)
+		if now.Sub(lastSend[c.ID]) < interval {
+			continue
+		}
+		r := db.NextCampaignRecipient(c.ID)
+		if r == nil {
+			db.UpdateCampaignStatus(c.ID, db.CampaignDone)
+			delete(lastSend, c.ID)
+			glog.Info("[campaign] [%d] %s finished", c.ID, c.Name)
+			continue
+		}
+		lastSend[c.ID] = now
+		send(&c, r)
+	}
+}
+
+func send(c *db.CampaignModel, r *db.CampaignRecipientModel) {
+	if c.APIKeyID != 0 {
+		if err := apikey.ConsumeID(c.APIKeyID, 1); err != nil {
+			// the recipient stays pending, resumeQuota continues the campaign once the quota of the
+			// key allows it again, a revoked or expired key needs a user to resume or cancel it
+			glog.Warning("[campaign] [%d] paused [%v]", c.ID, err)
+			db.UpdateCampaignStatusReason(c.ID, db.CampaignPaused, err.Error())
+			return
+		}
+	}
+	tpl, err := template.New("campaign").Option("missingkey=zero").Parse(c.Template)
+	if err == nil {
+		r.Message, err = render(tpl, r)
+	}
+	if err == nil {
+		var ids []int64
+		r.Device, ids, err = serial.SendFailover(c.Device, fmt.Sprintf("%s%d", senderPrefix, c.ID), model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(r.Phone, r.Message)))
+		r.HistoryIDs = db.JoinIDs(ids)
+	}
+	if err != nil && c.APIKeyID != 0 {
+		apikey.RefundID(c.APIKeyID, 1)
+	}
+	if errors.Is(err, serial.ErrDeviceOffline) || errors.Is(err, serial.ErrPoolUnhealthy) {
+		// keep the recipient pending until the device is back
+		glog.Warning("[campaign] [%d] waiting for %s [%v]", c.ID, c.Device, err)
+		return
+	}
+	if err != nil {
+		glog.Warning("[campaign] [%d] send to %s failed [%v]", c.ID, r.Phone, err)
+		r.Status = db.RecipientFailed
+		r.Error = err.Error()
+	} else {
+		r.Status = db.RecipientQueued
+		r.QueuedAt = time.Now().Unix()
+	}
+	db.UpdateCampaignRecipient(r)
+}
+
+// resumeQuota continues the campaigns paused by send for the send quota of their key once the
+// key may send a message again
+func resumeQuota() {
+	for _, c := range db.GetAllCampaigns(db.CampaignPaused) {
+		if c.PausedReason != apikey.ErrQuota.Error() || apikey.ConsumeID(c.APIKeyID, 1) != nil {
+			continue
+		}
+		apikey.RefundID(c.APIKeyID, 1)
+		if db.UpdateCampaignStatus(c.ID, db.CampaignRunning) {
+			glog.Info("[campaign] [%d] %s resumed, the key may send again", c.ID, c.Name)
+		}
+	}
+}
+
+// syncAll updates queued and sent recipients from the history of their messages
+func syncAll() {
+	for _, c := range db.GetAllCampaigns("") {
+		finished := c.Status == db.CampaignDone || c.Status == db.CampaignCancelled
+		if finished && time.Now().Unix()-c.UpdatedAt > int64(failAfter()/time.Second)*2 {
+			continue
+		}
+		Sync(c.ID)
+	}
+}
+
+func failAfter() time.Duration {
+	if config.Global.Campaign.AckTimeout > 0 {
+		return time.Duration(config.Global.Campaign.AckTimeout) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// Sync updates the queued and sent recipients of a campaign: a recipient is sent once every
+// segment is written, acked once every segment is ACKed (following reroutes), and failed when
+// it is not acked within [campaign] ack_timeout
+func Sync(id int64) {
+	for _, r := range db.GetCampaignRecipients(id, db.RecipientQueued, db.RecipientSent) {
+		status := recipientStatus(db.SplitIDs(r.HistoryIDs))
+		if status == db.RecipientSent || status == db.RecipientQueued {
+			if time.Since(time.Unix(r.QueuedAt, 0)) > failAfter() {
+				status = db.RecipientFailed
+				r.Error = "no ACK from the module"
+			}
+		}
+		if status != r.Status {
+			r.Status = status
+			db.UpdateCampaignRecipient(&r)
+		}
+	}
+}
+
+// recipientStatus derives the state of a recipient from the logical message its segments belong to
+func recipientStatus(ids []int64) string {
+	if len(ids) == 0 {
+		return db.RecipientQueued
+	}
+	switch db.MessageStatus(db.GetMessageSegments(ids[0])) {
+	case db.MessageFailed:
+		return db.RecipientFailed
+	case db.MessageAcked, db.MessageDelivered:
+		return db.RecipientAcked
+	case db.MessageWritten:
+		return db.RecipientSent
+	}
+	return db.RecipientQueued
+}
+
+// Results writes the recipients of a campaign as CSV, the original columns followed by the outcome
+func Results(id int64, w io.Writer) error {
+	c := db.GetCampaign(id)
+	if c == nil {
+		return fmt.Errorf("campaign not found")
+	}
+	columns := strings.Split(c.Columns, ",")
+	cw := csv.NewWriter(w)
+	header := append(append([]string{}, columns...), "status", "device", "message", "history_ids", "error", "updated_at")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range db.GetCampaignRecipients(id) {
+		vars := make(map[string]string)
+		_ = json.Unmarshal([]byte(r.Vars), &vars)
+		row := make([]string, 0, len(header))
+		for _, column := range columns {
+			row = append(row, vars[column])
+		}
+		updated := ""
+		if r.UpdatedAt != 0 {
+			updated = time.Unix(r.UpdatedAt, 0).Format("2006-01-02 15:04:05")
+		}
+		row = append(row, r.Status, r.Device, r.Message, r.HistoryIDs, r.Error, updated)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
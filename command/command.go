@@ -0,0 +1,290 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sms/config"
+	"sms/model"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	ActionReply = "reply"
+	ActionHTTP  = "http"
+	ActionExec  = "exec"
+)
+
+const defaultReply = "{{if .Error}}[{{.Name}}] failed: {{.Error}}{{else}}[{{.Name}}] done{{end}}"
+
+// Command is an SMS command loaded from a [command-N] section
+type Command struct {
+	cfg     config.Command
+	keyword string
+	re      *regexp.Regexp
+	reply   *template.Template
+	url     *template.Template
+	body    *template.Template
+	headers []*template.Template
+}
+
+// Context is passed to every template of a command
+type Context struct {
+	Name       string
+	Device     string
+	DevicePath string
+	Self       string
+	Sender     string
+	IsSelf     bool
+	Message    string
+	Args       []string
+	Secret     string
+	Output     string
+	Error      string
+}
+
+// NewCommand compiles a command definition
+func NewCommand(cfg config.Command) (*Command, error) {
+	cmd := &Command{cfg: cfg, keyword: strings.ToLower(strings.TrimSpace(cfg.Keyword))}
+	if cfg.Name == "" {
+		cmd.cfg.Name = cmd.keyword
+	}
+	if cmd.keyword == "" && cfg.Regex == "" {
+		return nil, errors.New("missing keyword or regex")
+	}
+
+	var err error
+	if cfg.Regex != "" {
+		cmd.re, err = regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+
+	reply := cfg.Reply
+	switch cfg.Action {
+	case ActionReply:
+		if reply == "" {
+			return nil, errors.New("reply action without reply template")
+		}
+	case ActionHTTP:
+		if cfg.HTTPURL == "" {
+			return nil, errors.New("http action without http_url")
+		}
+		if cmd.url, err = template.New("url").Parse(cfg.HTTPURL); err != nil {
+			return nil, fmt.Errorf("invalid http_url: %v", err)
+		}
+		if cmd.body, err = template.New("body").Parse(cfg.HTTPBody); err != nil {
+			return nil, fmt.Errorf("invalid http_body: %v", err)
+		}
+		for _, h := range cfg.HTTPHeaders {
+			if strings.TrimSpace(h) == "" {
+				continue
+			}
+			t, err := template.New("header").Parse(h)
+			if err != nil {
+				return nil, fmt.Errorf("invalid http header: %v", err)
+			}
+			cmd.headers = append(cmd.headers, t)
+		}
+	case ActionExec:
+		if strings.TrimSpace(cfg.Exec) == "" {
+			return nil, errors.New("exec action without exec")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported action [%s]", cfg.Action)
+	}
+	if cfg.Action != ActionReply && !hasSender(cfg.AllowedSenders) {
+		glog.Warning("command [%s] runs %s but has no allowed_senders, no one may run it; use * to allow anyone", cmd.cfg.Name, cfg.Action)
+	}
+	if cfg.Secret != "" {
+		if _, ok := config.Global.Secrets[cfg.Secret]; !ok {
+			return nil, fmt.Errorf("secret [%s] not found in [secrets]", cfg.Secret)
+		}
+	}
+
+	if reply == "" {
+		reply = defaultReply
+	}
+	if cmd.reply, err = template.New("reply").Parse(reply); err != nil {
+		return nil, fmt.Errorf("invalid reply: %v", err)
+	}
+	return cmd, nil
+}
+
+func (c *Command) Name() string {
+	return c.cfg.Name
+}
+
+// Usage is the line shown for this command in the generated help
+func (c *Command) Usage() string {
+	usage := c.cfg.Keyword
+	if usage == "" {
+		usage = c.cfg.Regex
+	}
+	if c.cfg.Description != "" {
+		usage += " - " + c.cfg.Description
+	}
+	return usage
+}
+
+// Match returns the arguments of message if it invokes this command
+func (c *Command) Match(message string) ([]string, bool) {
+	message = strings.TrimSpace(message)
+	if c.re != nil {
+		m := c.re.FindStringSubmatch(message)
+		if m == nil {
+			return nil, false
+		}
+		return m[1:], true
+	}
+	fields := strings.Fields(message)
+	if len(fields) == 0 || strings.ToLower(fields[0]) != c.keyword {
+		return nil, false
+	}
+	return fields[1:], true
+}
+
+// Allowed reports whether sender may run this command on a device whose own number is self.
+// Without a list a reply command is open to anyone, an http or exec command to no one; "*"
+// opens those up explicitly. Numbers must match in full, see model.EqualPhone.
+func (c *Command) Allowed(sender, self string) bool {
+	listed := false
+	for _, s := range c.cfg.AllowedSenders {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+			continue
+		case s == "*":
+			return true
+		case s == "self":
+			if model.EqualPhone(sender, self) {
+				return true
+			}
+		case model.EqualPhone(sender, s):
+			return true
+		}
+		listed = true
+	}
+	return !listed && c.cfg.Action == ActionReply
+}
+
+// Run executes the action and renders the reply
+func (c *Command) Run(ctx *Context) (string, error) {
+	ctx.Name = c.cfg.Name
+	if c.cfg.Secret != "" {
+		ctx.Secret = config.Global.Secrets[c.cfg.Secret]
+	}
+
+	timeout := time.Duration(c.cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	runCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	switch c.cfg.Action {
+	case ActionHTTP:
+		ctx.Output, err = c.runHTTP(runCtx, ctx)
+	case ActionExec:
+		ctx.Output, err = c.runExec(runCtx, ctx)
+	}
+	if err != nil {
+		ctx.Error = err.Error()
+	}
+	// never leak the secret through a reply
+	ctx.Secret = ""
+
+	reply, rerr := render(c.reply, ctx)
+	if rerr != nil {
+		return "", rerr
+	}
+	return reply, err
+}
+
+func (c *Command) runHTTP(runCtx context.Context, ctx *Context) (string, error) {
+	u, err := render(c.url, ctx)
+	if err != nil {
+		return "", err
+	}
+	body, err := render(c.body, ctx)
+	if err != nil {
+		return "", err
+	}
+	method := strings.ToUpper(c.cfg.HTTPMethod)
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(runCtx, method, u, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for _, t := range c.headers {
+		h, err := render(t, ctx)
+		if err != nil {
+			return "", err
+		}
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			continue
+		}
+		req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	if body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(rsp.Body, 4096))
+	output := strings.TrimSpace(string(data))
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return output, fmt.Errorf("http status %d", rsp.StatusCode)
+	}
+	return output, nil
+}
+
+func (c *Command) runExec(runCtx context.Context, ctx *Context) (string, error) {
+	fields := strings.Fields(c.cfg.Exec)
+	args := fields[1:]
+	if c.cfg.ExecPassArgs {
+		args = append(args, ctx.Args...)
+	}
+	cmd := exec.CommandContext(runCtx, fields[0], args...)
+	if ctx.Secret != "" {
+		cmd.Env = append(cmd.Environ(), "SMS_COMMAND_SECRET="+ctx.Secret)
+	}
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+func render(t *template.Template, ctx *Context) (string, error) {
+	buf := bytes.Buffer{}
+	err := t.Execute(&buf, ctx)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// hasSender reports whether an allowed_senders list has an entry
+func hasSender(list []string) bool {
+	for _, s := range list {
+		if strings.TrimSpace(s) != "" {
+			return true
+		}
+	}
+	return false
+}
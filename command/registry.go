@@ -0,0 +1,111 @@
+package command
+
+import (
+	"fmt"
+	"github.com/Akvicor/glog"
+	"sms/config"
+	"sms/model"
+	"sms/serial"
+	"strings"
+)
+
+const replySenderName = "sms"
+
+var helpKeywords = []string{"help", "帮助"}
+
+var registry = make([]*Command, 0)
+
+// EnableCommands loads the [command-N] sections and answers matching inbound SMS
+func EnableCommands() {
+	for _, cfg := range config.Global.Commands {
+		cmd, err := NewCommand(cfg)
+		if err != nil {
+			glog.Error("invalid sms command [%s]: %v", cfg.Name, err)
+			continue
+		}
+		registry = append(registry, cmd)
+	}
+	serial.OnReceived(handle)
+	glog.Info("Registered %d sms commands", len(registry))
+}
+
+func handle(device string, historyID int64, sms *model.SMS) {
+	dev := deviceConfig(device)
+	ctx := &Context{
+		Device:     device,
+		DevicePath: dev.DevicePath,
+		Self:       dev.SelfPhone,
+		Sender:     sms.Phone,
+		IsSelf:     model.SamePhone(sms.Phone, dev.SelfPhone),
+		Message:    sms.Message,
+	}
+
+	for _, cmd := range registry {
+		args, ok := cmd.Match(sms.Message)
+		if !ok {
+			continue
+		}
+		if !cmd.Allowed(sms.Phone, dev.SelfPhone) {
+			glog.Info("[command] [%s] %s is not allowed to run %s", device, sms.Phone, cmd.Name())
+			return
+		}
+		ctx.Args = args
+		reply, err := cmd.Run(ctx)
+		if err != nil {
+			glog.Warning("[command] [%s] %s from %s failed [%v]", device, cmd.Name(), sms.Phone, err)
+		} else {
+			glog.Info("[command] [%s] %s from %s", device, cmd.Name(), sms.Phone)
+		}
+		sendReply(device, sms.Phone, reply)
+		return
+	}
+
+	if isHelp(sms.Message) {
+		if help := Help(sms.Phone, device, dev.SelfPhone); help != "" {
+			sendReply(device, sms.Phone, help)
+		}
+	}
+}
+
+// Help lists the commands sender may run, empty when there are none
+func Help(sender, device, self string) string {
+	lines := make([]string, 0, len(registry))
+	for _, cmd := range registry {
+		if cmd.Allowed(sender, self) {
+			lines = append(lines, cmd.Usage())
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[SMS][%s][HELP]\n%s", device, strings.Join(lines, "\n"))
+}
+
+func isHelp(message string) bool {
+	message = strings.ToLower(strings.TrimSpace(message))
+	for _, k := range helpKeywords {
+		if message == k {
+			return true
+		}
+	}
+	return false
+}
+
+func sendReply(device, phone, reply string) {
+	if strings.TrimSpace(reply) == "" {
+		return
+	}
+	_, err := serial.Send(device, replySenderName, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(phone, reply)))
+	if err != nil {
+		glog.Warning("[command] [%s] reply to %s failed [%v]", device, phone, err)
+	}
+}
+
+func deviceConfig(name string) config.SerialDevice {
+	for _, dev := range config.Global.SerialDevices {
+		if dev.Name == name {
+			return dev
+		}
+	}
+	return config.SerialDevice{Name: name}
+}
@@ -22,6 +22,11 @@ func Load(path string) {
 	}
 
 	loadSerialDevices()
+	loadOTPPatterns()
+	loadCommands()
+	loadSecrets()
+	loadRoutes()
+	loadPools()
 }
 
 func loadSerialDevices() {
@@ -41,3 +46,85 @@ func loadSerialDevices() {
 
 	glog.Info("Loaded %d serial devices", len(Global.SerialDevices))
 }
+
+func loadOTPPatterns() {
+	Global.OTPPatterns = []OTPPattern{}
+
+	for _, section := range cfg.Sections() {
+		if strings.HasPrefix(section.Name(), "otp-pattern-") {
+			pattern := OTPPattern{}
+			err := section.MapTo(&pattern)
+			if err != nil {
+				glog.Error("unable to parse otp pattern section [%s]: %s", section.Name(), err.Error())
+				continue
+			}
+			Global.OTPPatterns = append(Global.OTPPatterns, pattern)
+		}
+	}
+}
+
+func loadCommands() {
+	Global.Commands = []Command{}
+
+	for _, section := range cfg.Sections() {
+		if strings.HasPrefix(section.Name(), "command-") {
+			command := Command{}
+			err := section.MapTo(&command)
+			if err != nil {
+				glog.Error("unable to parse command section [%s]: %s", section.Name(), err.Error())
+				continue
+			}
+			Global.Commands = append(Global.Commands, command)
+		}
+	}
+
+	glog.Info("Loaded %d sms commands", len(Global.Commands))
+}
+
+// loadSecrets reads [secrets], which commands refer to by key so tokens stay out of command sections
+func loadSecrets() {
+	Global.Secrets = map[string]string{}
+	section, err := cfg.GetSection("secrets")
+	if err != nil {
+		return
+	}
+	for k, v := range section.KeysHash() {
+		Global.Secrets[k] = v
+	}
+}
+
+func loadRoutes() {
+	Global.Routes = []Route{}
+
+	for _, section := range cfg.Sections() {
+		if strings.HasPrefix(section.Name(), "route-") {
+			route := Route{}
+			err := section.MapTo(&route)
+			if err != nil {
+				glog.Error("unable to parse route section [%s]: %s", section.Name(), err.Error())
+				continue
+			}
+			Global.Routes = append(Global.Routes, route)
+		}
+	}
+
+	glog.Info("Loaded %d routes", len(Global.Routes))
+}
+
+func loadPools() {
+	Global.Pools = []Pool{}
+
+	for _, section := range cfg.Sections() {
+		if strings.HasPrefix(section.Name(), "pool-") {
+			pool := Pool{}
+			err := section.MapTo(&pool)
+			if err != nil {
+				glog.Error("unable to parse pool section [%s]: %s", section.Name(), err.Error())
+				continue
+			}
+			Global.Pools = append(Global.Pools, pool)
+		}
+	}
+
+	glog.Info("Loaded %d device pools", len(Global.Pools))
+}
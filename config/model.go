@@ -1,14 +1,31 @@
 package config
 
 type Model struct {
-	BrandName     string          `ini:"brand_name"`
-	Prod          bool            `ini:"prod"`
-	SerialDevices []SerialDevice  `ini:"-"`
-	Server        ServerModel     `ini:"server"`
-	Session       SessionModel    `ini:"session"`
-	Database      DatabaseModel   `ini:"database"`
-	Log           LogModel        `ini:"log"`
-	Security      SecurityModel   `ini:"security"`
+	BrandName     string            `ini:"brand_name"`
+	Prod          bool              `ini:"prod"`
+	SerialDevices []SerialDevice    `ini:"-"`
+	Server        ServerModel       `ini:"server"`
+	Session       SessionModel      `ini:"session"`
+	Database      DatabaseModel     `ini:"database"`
+	Log           LogModel          `ini:"log"`
+	Security      SecurityModel     `ini:"security"`
+	Telegram      TelegramModel     `ini:"telegram"`
+	Forward       ForwardModel      `ini:"forward"`
+	OTP           OTPModel          `ini:"otp"`
+	OTPPatterns   []OTPPattern      `ini:"-"`
+	Commands      []Command         `ini:"-"`
+	MQTT          MQTTModel         `ini:"mqtt"`
+	Filter        FilterModel       `ini:"filter"`
+	Secrets       map[string]string `ini:"-"`
+	Routing       RoutingModel      `ini:"routing"`
+	Routes        []Route           `ini:"-"`
+	Pools         []Pool            `ini:"-"`
+	Campaign      CampaignModel     `ini:"campaign"`
+	API           APIModel          `ini:"api"`
+	RateLimit     RateLimitModel    `ini:"ratelimit"`
+	SMPP          SMPPModel         `ini:"smpp"`
+	Twilio        TwilioModel       `ini:"twilio"`
+	SMTP          SMTPModel         `ini:"smtp"`
 }
 
 type SerialDevice struct {
@@ -28,6 +45,9 @@ type ServerModel struct {
 	EnableHTTPS bool   `ini:"enable_https"`
 	SSLCert     string `ini:"ssl_cert"`
 	SSLKey      string `ini:"ssl_key"`
+	// TrustedProxies are comma separated addresses or CIDRs whose X-Forwarded-For and
+	// X-Real-IP headers are believed, empty uses the peer address of every request
+	TrustedProxies string `ini:"trusted_proxies"`
 }
 
 type SessionModel struct {
@@ -51,3 +71,138 @@ type SecurityModel struct {
 	Password  string `ini:"password"`
 	AccessKey string `ini:"access_key"`
 }
+
+type TelegramModel struct {
+	Enable      bool   `ini:"enable"`
+	APIBase     string `ini:"api_base"`
+	Token       string `ini:"token"`
+	ChatID      int64  `ini:"chat_id"`
+	PollTimeout int    `ini:"poll_timeout"`
+}
+
+type ForwardModel struct {
+	PeerPhones []string `ini:"peer_phones" delim:","`
+	LoopWindow int      `ini:"loop_window"`
+}
+
+type OTPModel struct {
+	Enable         bool `ini:"enable"`
+	DefaultTTL     int  `ini:"default_ttl"`
+	MaxPollTimeout int  `ini:"max_poll_timeout"`
+}
+
+type OTPPattern struct {
+	Regex   string `ini:"regex"`
+	Service string `ini:"service"`
+}
+
+type Command struct {
+	Name           string   `ini:"name"`
+	Keyword        string   `ini:"keyword"`
+	Regex          string   `ini:"regex"`
+	Description    string   `ini:"description"`
+	AllowedSenders []string `ini:"allowed_senders" delim:","`
+	Action         string   `ini:"action"`
+	Reply          string   `ini:"reply"`
+	HTTPMethod     string   `ini:"http_method"`
+	HTTPURL        string   `ini:"http_url"`
+	HTTPBody       string   `ini:"http_body"`
+	HTTPHeaders    []string `ini:"http_headers" delim:"|"`
+	Secret         string   `ini:"secret"`
+	Exec           string   `ini:"exec"`
+	ExecPassArgs   bool     `ini:"exec_pass_args"`
+	Timeout        int      `ini:"timeout"`
+}
+
+type MQTTModel struct {
+	Enable          bool   `ini:"enable"`
+	Broker          string `ini:"broker"`
+	ClientID        string `ini:"client_id"`
+	Username        string `ini:"username"`
+	Password        string `ini:"password"`
+	TopicPrefix     string `ini:"topic_prefix"`
+	QoS             byte   `ini:"qos"`
+	StatusInterval  int    `ini:"status_interval"`
+	Discovery       bool   `ini:"discovery"`
+	DiscoveryPrefix string `ini:"discovery_prefix"`
+}
+
+type FilterModel struct {
+	Enable         bool    `ini:"enable"`
+	Bayes          bool    `ini:"bayes"`
+	BayesThreshold float64 `ini:"bayes_threshold"`
+	BayesMinDocs   int     `ini:"bayes_min_docs"`
+}
+
+type RoutingModel struct {
+	DefaultDevice  string `ini:"default_device"`
+	MaxMissedAcks  int    `ini:"max_missed_acks"`
+	AckCooldown    int    `ini:"ack_cooldown"`
+	HealthInterval int    `ini:"health_interval"`
+}
+
+type Route struct {
+	Prefix string `ini:"prefix"`
+	Device string `ini:"device"`
+}
+
+type Pool struct {
+	Name    string   `ini:"name"`
+	Devices []string `ini:"devices" delim:","`
+}
+
+type CampaignModel struct {
+	RatePerMinute int `ini:"rate_per_minute"`
+	MaxRecipients int `ini:"max_recipients"`
+	AckTimeout    int `ini:"ack_timeout"`
+}
+
+type APIModel struct {
+	IdempotencyRetention int    `ini:"idempotency_retention"`
+	CallbackSecret       string `ini:"callback_secret"`
+	CallbackRetries      int    `ini:"callback_retries"`
+	CallbackAllowPrivate bool   `ini:"callback_allow_private"`
+	EventBuffer          int    `ini:"event_buffer"`
+	SignatureSkew        int    `ini:"signature_skew"`
+	RequireSignature     bool   `ini:"require_signature"`
+	SigningPepper        string `ini:"signing_pepper"`
+}
+
+type RateLimitModel struct {
+	Enable          bool `ini:"enable"`
+	SendPerMinute   int  `ini:"send_per_minute"`
+	SendBurst       int  `ini:"send_burst"`
+	ReadPerMinute   int  `ini:"read_per_minute"`
+	ReadBurst       int  `ini:"read_burst"`
+	IPSendPerMinute int  `ini:"ip_send_per_minute"`
+	IPReadPerMinute int  `ini:"ip_read_per_minute"`
+}
+
+type SMPPModel struct {
+	Enable        bool   `ini:"enable"`
+	Addr          string `ini:"addr"`
+	Port          int    `ini:"port"`
+	Window        int    `ini:"window"`
+	EnquireLink   int    `ini:"enquire_link"`
+	DefaultCoding string `ini:"default_coding"`
+	ReceiptOnAck  bool   `ini:"receipt_on_ack"`
+}
+
+type TwilioModel struct {
+	Enable         bool   `ini:"enable"`
+	AccountSID     string `ini:"account_sid"`
+	AuthToken      string `ini:"auth_token"`
+	InboundWebhook string `ini:"inbound_webhook"`
+}
+
+type SMTPModel struct {
+	Enable          bool     `ini:"enable"`
+	Addr            string   `ini:"addr"`
+	Port            int      `ini:"port"`
+	Hostname        string   `ini:"hostname"`
+	Domain          string   `ini:"domain"`
+	AllowedSenders  []string `ini:"allowed_senders" delim:","`
+	AllowedNetworks []string `ini:"allowed_networks" delim:","`
+	MaxSize         int      `ini:"max_size"`
+	MaxLength       int      `ini:"max_length"`
+}
@@ -0,0 +1,263 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"gorm.io/gorm"
+	"strings"
+	"sync"
+	"time"
+)
+
+var apiKeyLock = sync.RWMutex{}
+
+// APIKeyModel is a named API key, only the SHA-256 of the key is stored and Prefix is kept to
+// recognize it. Scopes, Devices and AllowedIPs are comma separated, empty Devices and
+// AllowedIPs allow all, a quota of 0 is unlimited. DayCount and MonthCount are the messages
+// sent in DayKey (2006-01-02) and MonthKey (2006-01).
+type APIKeyModel struct {
+	ID           int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Name         string `gorm:"column:name" json:"name"`
+	Prefix       string `gorm:"column:prefix" json:"prefix"`
+	Hash         string `gorm:"column:hash;uniqueIndex" json:"-"`
+	Scopes       string `gorm:"column:scopes" json:"scopes"`
+	Devices      string `gorm:"column:devices" json:"devices"`
+	AllowedIPs   string `gorm:"column:allowed_ips" json:"allowed_ips"`
+	DailyQuota   int    `gorm:"column:daily_quota" json:"daily_quota"`
+	MonthlyQuota int    `gorm:"column:monthly_quota" json:"monthly_quota"`
+	DayKey       string `gorm:"column:day_key" json:"day_key"`
+	DayCount     int    `gorm:"column:day_count" json:"day_count"`
+	MonthKey     string `gorm:"column:month_key" json:"month_key"`
+	MonthCount   int    `gorm:"column:month_count" json:"month_count"`
+	ExpiresAt    int64  `gorm:"column:expires_at" json:"expires_at"`
+	LastUsedAt   int64  `gorm:"column:last_used_at" json:"last_used_at"`
+	LastUsedIP   string `gorm:"column:last_used_ip" json:"last_used_ip"`
+	CreatedAt    int64  `gorm:"column:created_at" json:"created_at"`
+	RotatedAt    int64  `gorm:"column:rotated_at" json:"rotated_at"`
+	RevokedAt    int64  `gorm:"column:revoked_at" json:"revoked_at"`
+}
+
+func (APIKeyModel) TableName() string {
+	return "api_keys"
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ScopeList returns the scopes of the key
+func (k *APIKeyModel) ScopeList() []string {
+	return splitList(k.Scopes)
+}
+
+// DeviceList returns the devices and pools the key may use, empty for all
+func (k *APIKeyModel) DeviceList() []string {
+	return splitList(k.Devices)
+}
+
+// IPList returns the addresses and CIDRs the key may be used from, empty for all
+func (k *APIKeyModel) IPList() []string {
+	return splitList(k.AllowedIPs)
+}
+
+func InsertAPIKey(key *APIKeyModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.Lock()
+	defer apiKeyLock.Unlock()
+
+	key.ID = 0
+	key.CreatedAt = time.Now().Unix()
+	res := d.Create(key)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert api key failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return key.ID
+}
+
+// UpdateAPIKey saves the editable settings of a key, the secret and usage stay
+func UpdateAPIKey(key *APIKeyModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.Lock()
+	defer apiKeyLock.Unlock()
+
+	res := d.Where("id = ?", key.ID).Updates(map[string]interface{}{
+		"name":          key.Name,
+		"scopes":        key.Scopes,
+		"devices":       key.Devices,
+		"allowed_ips":   key.AllowedIPs,
+		"daily_quota":   key.DailyQuota,
+		"monthly_quota": key.MonthlyQuota,
+		"expires_at":    key.ExpiresAt,
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update api key [%d] failed [%v] [%v]", key.ID, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+// RotateAPIKey replaces the secret of a key that is not revoked
+func RotateAPIKey(id int64, prefix, hash string) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.Lock()
+	defer apiKeyLock.Unlock()
+
+	res := d.Where("id = ? AND revoked_at = 0", id).Updates(map[string]interface{}{"prefix": prefix, "hash": hash, "rotated_at": time.Now().Unix()})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("rotate api key [%d] failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func RevokeAPIKey(id int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.Lock()
+	defer apiKeyLock.Unlock()
+
+	res := d.Where("id = ? AND revoked_at = 0", id).Update("revoked_at", time.Now().Unix())
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("revoke api key [%d] failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func GetAPIKey(id int64) *APIKeyModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.RLock()
+	defer apiKeyLock.RUnlock()
+
+	key := &APIKeyModel{}
+	res := d.Where("id = ?", id).Limit(1).Find(key)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return key
+}
+
+// GetAPIKeyByHash finds a key by the hash of its secret, revoked keys included
+func GetAPIKeyByHash(hash string) *APIKeyModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.RLock()
+	defer apiKeyLock.RUnlock()
+
+	key := &APIKeyModel{}
+	res := d.Where("hash = ?", hash).Limit(1).Find(key)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return key
+}
+
+func GetAllAPIKeys() []APIKeyModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.RLock()
+	defer apiKeyLock.RUnlock()
+
+	keys := make([]APIKeyModel, 0)
+	res := d.Order("revoked_at > 0, id").Find(&keys)
+	if res.Error != nil {
+		glog.Warning("get api keys failed [%v]", res.Error)
+		return nil
+	}
+	return keys
+}
+
+// TouchAPIKey records that a key was used
+func TouchAPIKey(id int64, ip string) {
+	d := Connect()
+	if d == nil {
+		return
+	}
+	d = d.Model(&APIKeyModel{})
+	apiKeyLock.Lock()
+	defer apiKeyLock.Unlock()
+
+	res := d.Where("id = ?", id).Updates(map[string]interface{}{"last_used_at": time.Now().Unix(), "last_used_ip": ip})
+	if res.Error != nil {
+		glog.Warning("touch api key [%d] failed [%v]", id, res.Error)
+	}
+}
+
+// ConsumeAPIKeyQuota counts n messages against the daily and monthly quota of a key, it
+// returns false without counting when either would be exceeded. A negative n gives them back.
+func ConsumeAPIKeyQuota(id int64, n int) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	apiKeyLock.Lock()
+	defer apiKeyLock.Unlock()
+
+	now := time.Now()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	ok := false
+	err := d.Transaction(func(tx *gorm.DB) error {
+		key := &APIKeyModel{}
+		res := tx.Where("id = ?", id).Limit(1).Find(key)
+		if res.Error != nil || res.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		if key.DayKey != day {
+			key.DayKey, key.DayCount = day, 0
+		}
+		if key.MonthKey != month {
+			key.MonthKey, key.MonthCount = month, 0
+		}
+		if n > 0 && ((key.DailyQuota > 0 && key.DayCount+n > key.DailyQuota) || (key.MonthlyQuota > 0 && key.MonthCount+n > key.MonthlyQuota)) {
+			return nil
+		}
+		key.DayCount, key.MonthCount = maxInt(key.DayCount+n, 0), maxInt(key.MonthCount+n, 0)
+		ok = true
+		return tx.Model(&APIKeyModel{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"day_key": key.DayKey, "day_count": key.DayCount, "month_key": key.MonthKey, "month_count": key.MonthCount,
+		}).Error
+	})
+	if err != nil {
+		glog.Warning("consume api key [%d] quota failed [%v]", id, err)
+		return false
+	}
+	return ok
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+)
+
+var auditLock = sync.RWMutex{}
+
+// AuditModel is one entry of the audit log. Before and After are JSON objects of the changed
+// fields. Hash chains the entry to PrevHash, the hash of the entry before it, so an edited or
+// deleted entry breaks the chain.
+type AuditModel struct {
+	ID        int64  `gorm:"column:id;primaryKey" json:"id"`
+	CreatedAt int64  `gorm:"column:created_at;index" json:"created_at"`
+	Actor     string `gorm:"column:actor;index" json:"actor"`
+	Action    string `gorm:"column:action;index" json:"action"`
+	Target    string `gorm:"column:target" json:"target"`
+	IP        string `gorm:"column:ip" json:"ip"`
+	UserAgent string `gorm:"column:user_agent" json:"user_agent"`
+	Before    string `gorm:"column:before" json:"before"`
+	After     string `gorm:"column:after" json:"after"`
+	PrevHash  string `gorm:"column:prev_hash" json:"prev_hash"`
+	Hash      string `gorm:"column:hash" json:"hash"`
+}
+
+func (AuditModel) TableName() string {
+	return "audit_log"
+}
+
+// AuditSearch filters GetAudits, empty fields match everything
+type AuditSearch struct {
+	Actor  string
+	Action string
+	Since  int64
+	Until  int64
+}
+
+// InsertAudit stores an entry with the ID it was chained with, it returns false when the ID
+// is taken
+func InsertAudit(m *AuditModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&AuditModel{})
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	res := d.Create(m)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert audit entry failed [%v] [%v]", res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+// GetLastAudit returns the newest entry, nil when the log is empty
+func GetLastAudit() *AuditModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&AuditModel{})
+	auditLock.RLock()
+	defer auditLock.RUnlock()
+
+	list := make([]AuditModel, 0, 1)
+	res := d.Order("id DESC").Limit(1).Find(&list)
+	if res.Error != nil || len(list) == 0 {
+		return nil
+	}
+	return &list[0]
+}
+
+// GetAudits returns a page of entries, newest first, and the total count
+func GetAudits(search *AuditSearch, page, size int) ([]AuditModel, int64) {
+	d := Connect()
+	if d == nil {
+		return nil, 0
+	}
+	d = d.Model(&AuditModel{})
+	auditLock.RLock()
+	defer auditLock.RUnlock()
+
+	if search.Actor != "" {
+		d = d.Where("actor LIKE ?", "%"+search.Actor+"%")
+	}
+	if search.Action != "" {
+		d = d.Where("action LIKE ?", search.Action+"%")
+	}
+	if search.Since > 0 {
+		d = d.Where("created_at >= ?", search.Since)
+	}
+	if search.Until > 0 {
+		d = d.Where("created_at < ?", search.Until)
+	}
+	var total int64
+	res := d.Count(&total)
+	if res.Error != nil {
+		glog.Warning("count audit entries failed [%v]", res.Error)
+		return nil, 0
+	}
+
+	list := make([]AuditModel, 0)
+	res = d.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&list)
+	if res.Error != nil {
+		glog.Warning("get audit entries failed [%v]", res.Error)
+		return nil, 0
+	}
+	return list, total
+}
+
+// GetAuditsAfter returns up to limit entries with an ID above afterID in chain order
+func GetAuditsAfter(afterID int64, limit int) []AuditModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&AuditModel{})
+	auditLock.RLock()
+	defer auditLock.RUnlock()
+
+	list := make([]AuditModel, 0, limit)
+	res := d.Where("id > ?", afterID).Order("id ASC").Limit(limit).Find(&list)
+	if res.Error != nil {
+		glog.Warning("get audit entries failed [%v]", res.Error)
+		return nil
+	}
+	return list
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+	"time"
+)
+
+var callbackLock = sync.RWMutex{}
+
+// StatusCallbackModel is the URL a caller wants state changes of a logical message posted to,
+// LastStatus is the last state that was posted. Format is empty for the gateway's JSON events.
+type StatusCallbackModel struct {
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	MessageID  int64  `gorm:"column:message_id;uniqueIndex" json:"message_id"`
+	URL        string `gorm:"column:url" json:"url"`
+	Format     string `gorm:"column:format" json:"format"`
+	LastStatus string `gorm:"column:last_status" json:"last_status"`
+	CreatedAt  int64  `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt  int64  `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (StatusCallbackModel) TableName() string {
+	return "status_callbacks"
+}
+
+func InsertStatusCallback(messageID int64, url, format, status string) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&StatusCallbackModel{})
+	callbackLock.Lock()
+	defer callbackLock.Unlock()
+
+	now := time.Now().Unix()
+	cb := &StatusCallbackModel{MessageID: messageID, URL: url, Format: format, LastStatus: status, CreatedAt: now, UpdatedAt: now}
+	res := d.Create(cb)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert status callback for [%d] failed [%v] [%v]", messageID, res.Error, res.RowsAffected)
+		return -1
+	}
+	return cb.ID
+}
+
+func GetStatusCallback(messageID int64) *StatusCallbackModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&StatusCallbackModel{})
+	callbackLock.RLock()
+	defer callbackLock.RUnlock()
+
+	cb := &StatusCallbackModel{}
+	res := d.Where("message_id = ?", messageID).Limit(1).Find(cb)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return cb
+}
+
+// UpdateStatusCallbackStatus moves a callback from one state to the next, it returns false when
+// another event already moved it so every state is posted once
+func UpdateStatusCallbackStatus(id int64, from, to string) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&StatusCallbackModel{})
+	callbackLock.Lock()
+	defer callbackLock.Unlock()
+
+	res := d.Where("id = ? AND last_status = ?", id, from).Updates(map[string]interface{}{"last_status": to, "updated_at": time.Now().Unix()})
+	if res.Error != nil {
+		glog.Warning("update status callback [%d] failed [%v]", id, res.Error)
+		return false
+	}
+	return res.RowsAffected == 1
+}
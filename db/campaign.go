@@ -0,0 +1,304 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var campaignLock = sync.RWMutex{}
+
+// Campaign states
+const (
+	CampaignRunning   = "running"
+	CampaignPaused    = "paused"
+	CampaignCancelled = "cancelled"
+	CampaignDone      = "done"
+)
+
+// Recipient states, a recipient moves pending -> queued -> sent -> acked, or ends as failed/cancelled
+const (
+	RecipientPending   = "pending"
+	RecipientQueued    = "queued"
+	RecipientSent      = "sent"
+	RecipientAcked     = "acked"
+	RecipientFailed    = "failed"
+	RecipientCancelled = "cancelled"
+)
+
+// CampaignModel is a bulk send of one template to many recipients, the sends of a campaign
+// created with an API key count against APIKeyID
+type CampaignModel struct {
+	ID            int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Name          string `gorm:"column:name" json:"name"`
+	Template      string `gorm:"column:template" json:"template"`
+	Device        string `gorm:"column:device" json:"device"`
+	Columns       string `gorm:"column:columns" json:"columns"`
+	Status        string `gorm:"column:status;index" json:"status"`
+	RatePerMinute int    `gorm:"column:rate_per_minute" json:"rate_per_minute"`
+	WindowStart   string `gorm:"column:window_start" json:"window_start"`
+	WindowEnd     string `gorm:"column:window_end" json:"window_end"`
+	StartAt       int64  `gorm:"column:start_at" json:"start_at"`
+	APIKeyID      int64  `gorm:"column:api_key_id" json:"api_key_id"`
+	// PausedReason tells why the gateway paused the campaign, empty when a user paused it
+	PausedReason string `gorm:"column:paused_reason" json:"paused_reason"`
+	CreatedAt    int64  `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt    int64  `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (CampaignModel) TableName() string {
+	return "campaigns"
+}
+
+// CampaignRecipientModel is one row of a campaign CSV and the outcome of its message
+type CampaignRecipientModel struct {
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	CampaignID int64  `gorm:"column:campaign_id;index" json:"campaign_id"`
+	Phone      string `gorm:"column:phone" json:"phone"`
+	Vars       string `gorm:"column:vars" json:"vars"`
+	Status     string `gorm:"column:status;index" json:"status"`
+	Device     string `gorm:"column:device" json:"device"`
+	Message    string `gorm:"column:message" json:"message"`
+	HistoryIDs string `gorm:"column:history_ids" json:"history_ids"`
+	Error      string `gorm:"column:error_message" json:"error"`
+	QueuedAt   int64  `gorm:"column:queued_at" json:"queued_at"`
+	UpdatedAt  int64  `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (CampaignRecipientModel) TableName() string {
+	return "campaign_recipients"
+}
+
+// CampaignProgressModel counts the recipients of a campaign by state
+type CampaignProgressModel struct {
+	Status string `gorm:"column:status" json:"status"`
+	Count  int64  `gorm:"column:count" json:"count"`
+}
+
+// InsertCampaign stores a campaign and its recipients, all recipients start pending
+func InsertCampaign(campaign *CampaignModel, recipients []CampaignRecipientModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	campaignLock.Lock()
+	defer campaignLock.Unlock()
+
+	now := time.Now().Unix()
+	campaign.ID = 0
+	campaign.CreatedAt = now
+	campaign.UpdatedAt = now
+	err := d.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(campaign).Error; err != nil {
+			return err
+		}
+		for i := range recipients {
+			recipients[i].ID = 0
+			recipients[i].CampaignID = campaign.ID
+			recipients[i].Status = RecipientPending
+			recipients[i].UpdatedAt = now
+		}
+		return tx.CreateInBatches(recipients, 200).Error
+	})
+	if err != nil {
+		glog.Warning("insert campaign failed [%v]", err)
+		return -1
+	}
+	return campaign.ID
+}
+
+func GetCampaign(id int64) *CampaignModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&CampaignModel{})
+	campaignLock.RLock()
+	defer campaignLock.RUnlock()
+
+	campaign := &CampaignModel{}
+	res := d.Where("id = ?", id).Limit(1).Find(campaign)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return campaign
+}
+
+// GetAllCampaigns returns campaigns newest first, status "" matches all
+func GetAllCampaigns(status string) []CampaignModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&CampaignModel{})
+	campaignLock.RLock()
+	defer campaignLock.RUnlock()
+
+	if status != "" {
+		d = d.Where("status = ?", status)
+	}
+	campaigns := make([]CampaignModel, 0)
+	res := d.Order("id DESC").Find(&campaigns)
+	if res.Error != nil {
+		glog.Warning("get campaigns failed [%v]", res.Error)
+		return nil
+	}
+	return campaigns
+}
+
+// UpdateCampaignStatus changes the campaign state, cancelling also cancels every pending recipient
+func UpdateCampaignStatus(id int64, status string) bool {
+	return UpdateCampaignStatusReason(id, status, "")
+}
+
+// UpdateCampaignStatusReason is UpdateCampaignStatus with the reason the gateway changed it
+func UpdateCampaignStatusReason(id int64, status, reason string) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	campaignLock.Lock()
+	defer campaignLock.Unlock()
+
+	now := time.Now().Unix()
+	err := d.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&CampaignModel{}).Where("id = ?", id).Updates(map[string]interface{}{"status": status, "paused_reason": reason, "updated_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		if status != CampaignCancelled {
+			return nil
+		}
+		return tx.Model(&CampaignRecipientModel{}).Where("campaign_id = ? AND status = ?", id, RecipientPending).
+			Updates(map[string]interface{}{"status": RecipientCancelled, "updated_at": now}).Error
+	})
+	if err != nil {
+		glog.Warning("update campaign [%d] status failed [%v]", id, err)
+		return false
+	}
+	return true
+}
+
+// GetCampaignProgress counts the recipients of a campaign by state
+func GetCampaignProgress(id int64) map[string]int64 {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&CampaignRecipientModel{})
+	campaignLock.RLock()
+	defer campaignLock.RUnlock()
+
+	rows := make([]CampaignProgressModel, 0)
+	res := d.Select("status, COUNT(*) AS count").Where("campaign_id = ?", id).Group("status").Scan(&rows)
+	if res.Error != nil {
+		glog.Warning("get campaign [%d] progress failed [%v]", id, res.Error)
+		return nil
+	}
+	progress := map[string]int64{
+		RecipientPending:   0,
+		RecipientQueued:    0,
+		RecipientSent:      0,
+		RecipientAcked:     0,
+		RecipientFailed:    0,
+		RecipientCancelled: 0,
+	}
+	for _, row := range rows {
+		progress[row.Status] = row.Count
+	}
+	return progress
+}
+
+// GetCampaignRecipients returns recipients of a campaign in CSV order, an empty status matches all
+func GetCampaignRecipients(id int64, status ...string) []CampaignRecipientModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&CampaignRecipientModel{})
+	campaignLock.RLock()
+	defer campaignLock.RUnlock()
+
+	d = d.Where("campaign_id = ?", id)
+	if len(status) > 0 {
+		d = d.Where("status IN ?", status)
+	}
+	recipients := make([]CampaignRecipientModel, 0)
+	res := d.Order("id").Find(&recipients)
+	if res.Error != nil {
+		glog.Warning("get campaign [%d] recipients failed [%v]", id, res.Error)
+		return nil
+	}
+	return recipients
+}
+
+// NextCampaignRecipient returns the next pending recipient, nil when there is none
+func NextCampaignRecipient(id int64) *CampaignRecipientModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&CampaignRecipientModel{})
+	campaignLock.RLock()
+	defer campaignLock.RUnlock()
+
+	recipient := &CampaignRecipientModel{}
+	res := d.Where("campaign_id = ? AND status = ?", id, RecipientPending).Order("id").Limit(1).Find(recipient)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return recipient
+}
+
+// UpdateCampaignRecipient saves the state of a recipient
+func UpdateCampaignRecipient(recipient *CampaignRecipientModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&CampaignRecipientModel{})
+	campaignLock.Lock()
+	defer campaignLock.Unlock()
+
+	recipient.UpdatedAt = time.Now().Unix()
+	res := d.Where("id = ?", recipient.ID).Updates(map[string]interface{}{
+		"status":        recipient.Status,
+		"device":        recipient.Device,
+		"message":       recipient.Message,
+		"history_ids":   recipient.HistoryIDs,
+		"error_message": recipient.Error,
+		"queued_at":     recipient.QueuedAt,
+		"updated_at":    recipient.UpdatedAt,
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update campaign recipient [%d] failed [%v] [%v]", recipient.ID, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+// JoinIDs stores a list of ids in a text column
+func JoinIDs(ids []int64) string {
+	s := make([]string, 0, len(ids))
+	for _, id := range ids {
+		s = append(s, strconv.FormatInt(id, 10))
+	}
+	return strings.Join(s, ",")
+}
+
+// SplitIDs reads a list of ids written by JoinIDs
+func SplitIDs(s string) []int64 {
+	ids := make([]int64, 0)
+	for _, v := range strings.Split(s, ",") {
+		if id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
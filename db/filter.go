@@ -0,0 +1,155 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+var filterLock = sync.RWMutex{}
+
+const (
+	FilterListBlock = "block"
+	FilterListAllow = "allow"
+
+	FilterTypeNumber  = "number"
+	FilterTypePrefix  = "prefix"
+	FilterTypeKeyword = "keyword"
+)
+
+// FilterEntryModel is one blocklist or allowlist entry for inbound SMS
+type FilterEntryModel struct {
+	ID        int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	List      string `gorm:"column:list" json:"list"`
+	Type      string `gorm:"column:type" json:"type"`
+	Value     string `gorm:"column:value" json:"value"`
+	Note      string `gorm:"column:note" json:"note"`
+	CreatedAt int64  `gorm:"column:created_at" json:"created_at"`
+}
+
+func (FilterEntryModel) TableName() string {
+	return "filter_entries"
+}
+
+// SpamTokenModel holds the naive Bayes counts of a token, the row with an empty token counts documents
+type SpamTokenModel struct {
+	Token string `gorm:"column:token;primaryKey"`
+	Spam  int64  `gorm:"column:spam"`
+	Ham   int64  `gorm:"column:ham"`
+}
+
+func (SpamTokenModel) TableName() string {
+	return "spam_tokens"
+}
+
+func GetAllFilterEntries() []FilterEntryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&FilterEntryModel{})
+	filterLock.RLock()
+	defer filterLock.RUnlock()
+
+	entries := make([]FilterEntryModel, 0)
+	res := d.Order("id ASC").Find(&entries)
+	if res.Error != nil {
+		glog.Warning("get filter entries failed [%v]", res.Error)
+		return nil
+	}
+	return entries
+}
+
+func InsertFilterEntry(entry *FilterEntryModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&FilterEntryModel{})
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	entry.ID = 0
+	entry.CreatedAt = time.Now().Unix()
+	res := d.Create(entry)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert filter entry failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return entry.ID
+}
+
+func DeleteFilterEntry(id int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&FilterEntryModel{})
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	res := d.Where("id = ?", id).Delete(&FilterEntryModel{})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("delete filter entry [%d] failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func GetAllSpamTokens() []SpamTokenModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&SpamTokenModel{})
+	filterLock.RLock()
+	defer filterLock.RUnlock()
+
+	tokens := make([]SpamTokenModel, 0)
+	res := d.Find(&tokens)
+	if res.Error != nil {
+		glog.Warning("get spam tokens failed [%v]", res.Error)
+		return nil
+	}
+	return tokens
+}
+
+// AddSpamTokens adds the deltas to the stored counts, creating missing tokens
+func AddSpamTokens(tokens []SpamTokenModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	err := d.Transaction(func(tx *gorm.DB) error {
+		for _, t := range tokens {
+			res := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "token"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"spam": gorm.Expr("MAX(spam + ?, 0)", t.Spam),
+					"ham":  gorm.Expr("MAX(ham + ?, 0)", t.Ham),
+				}),
+			}).Create(&SpamTokenModel{Token: t.Token, Spam: max64(t.Spam, 0), Ham: max64(t.Ham, 0)})
+			if res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Warning("add spam tokens failed [%v]", err)
+		return false
+	}
+	return true
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
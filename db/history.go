@@ -10,21 +10,95 @@ import (
 
 var historyLock = sync.RWMutex{}
 
+const (
+	HistoryDirectionIn  = "in"
+	HistoryDirectionOut = "out"
+)
+
+// Message states, written means the gateway handed the message to the module
+const (
+	MessageQueued    = "queued"
+	MessageWritten   = "written"
+	MessageAcked     = "acked"
+	MessageDelivered = "delivered"
+	MessageFailed    = "failed"
+	MessageRerouted  = "rerouted"
+	MessageReceived  = "received"
+	MessageSpam      = "spam"
+)
+
 type HistoryModel struct {
-	ID         int64  `gorm:"column:id;primaryKey;autoIncrement"`
-	Country    string `gorm:"column:country"`
-	Sender     string `gorm:"column:sender"`
-	RecordTime int64  `gorm:"column:record_time"`
-	Phone      string `gorm:"column:phone"`
-	Message    string `gorm:"column:message"`
-	Time       int64  `gorm:"column:time"`
-	SentTime   int64  `gorm:"column:sent_time"`
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Country    string `gorm:"column:country" json:"country"`
+	Device     string `gorm:"column:device;index;default:''" json:"device"`
+	Direction  string `gorm:"column:direction;default:''" json:"direction"`
+	Sender     string `gorm:"column:sender" json:"sender"`
+	RecordTime int64  `gorm:"column:record_time" json:"record_time"`
+	Phone      string `gorm:"column:phone" json:"phone"`
+	Message    string `gorm:"column:message" json:"message"`
+	Time       int64  `gorm:"column:time" json:"time"`
+	SentTime   int64  `gorm:"column:sent_time" json:"sent_time"`
+	Md5        string `gorm:"column:md5;index" json:"-"`
+	AckTime    int64  `gorm:"column:ack_time" json:"ack_time"`
+	Spam       bool   `gorm:"column:spam;index;default:false" json:"spam"`
+	SpamReason string `gorm:"column:spam_reason" json:"spam_reason"`
+	Trained    string `gorm:"column:trained" json:"-"`
+	ReroutedTo string `gorm:"column:rerouted_to" json:"rerouted_to"`
+	ReroutedID int64  `gorm:"column:rerouted_id" json:"rerouted_id"`
+	// MessageID is the id of the first segment of the logical message this row belongs to
+	MessageID     int64  `gorm:"column:message_id;index" json:"message_id"`
+	DeliveredTime int64  `gorm:"column:delivered_time" json:"delivered_time"`
+	FailedTime    int64  `gorm:"column:failed_time" json:"failed_time"`
+	Error         string `gorm:"column:error_message" json:"error"`
 }
 
 func (HistoryModel) TableName() string {
 	return "history"
 }
 
+// Status derives the delivery state of a single row
+func (h *HistoryModel) Status() string {
+	switch {
+	case h.Spam:
+		return MessageSpam
+	case h.Direction == HistoryDirectionIn:
+		return MessageReceived
+	case h.ReroutedID != 0:
+		return MessageRerouted
+	case h.FailedTime != 0:
+		return MessageFailed
+	case h.DeliveredTime != 0:
+		return MessageDelivered
+	case h.AckTime != 0:
+		return MessageAcked
+	case h.SentTime != 0:
+		return MessageWritten
+	}
+	return MessageQueued
+}
+
+// MessageStatus is the state of a logical message: failed when any segment failed,
+// otherwise the least advanced state of its segments
+func MessageStatus(segments []HistoryModel) string {
+	if len(segments) == 0 {
+		return MessageQueued
+	}
+	order := []string{MessageQueued, MessageWritten, MessageAcked, MessageDelivered}
+	least := len(order) - 1
+	for i := range segments {
+		status := segments[i].Status()
+		if status == MessageFailed {
+			return MessageFailed
+		}
+		for j, s := range order {
+			if s == status && j < least {
+				least = j
+			}
+		}
+	}
+	return order[least]
+}
+
 func (h *HistoryModel) Format() HistoryFormatModel {
 	his := HistoryFormatModel{
 		ID:         h.ID,
@@ -59,12 +133,15 @@ type HistoryFormatModel struct {
 	SentTime   string
 }
 
-func GetAllHistories(country string, desc bool) []HistoryModel {
+// GetAllHistories returns the messages of a device, rows stored before devices were recorded match by region
+func GetAllHistories(device, region string, desc bool) []HistoryModel {
 	d := Connect()
 	if d == nil {
 		return nil
 	}
-	d = d.Model(&HistoryModel{}).Where("country = ?", country)
+	d = d.Model(&HistoryModel{}).
+		Where("device = ? OR (device = '' AND LOWER(country) = LOWER(?))", device, region).
+		Where("spam = ?", false)
 	historyLock.RLock()
 	defer historyLock.RUnlock()
 
@@ -81,7 +158,30 @@ func GetAllHistories(country string, desc bool) []HistoryModel {
 	return histories
 }
 
-func InsertHistory(country string, sender string, sms *model.SMS) int64 {
+// InsertReceivedHistory stores an inbound message, spam is kept out of the history lists and shown in the spam folder
+func InsertReceivedHistory(country, device string, sms *model.SMS, spam bool, reason string) int64 {
+	return insertHistory(&HistoryModel{
+		Country:    country,
+		Device:     device,
+		Direction:  HistoryDirectionIn,
+		Sender:     device,
+		Spam:       spam,
+		SpamReason: reason,
+	}, sms)
+}
+
+// InsertSentHistory stores an outbound message, md5 is the key the module acknowledges it with
+func InsertSentHistory(country, device, sender string, sms *model.SMS, md5 string) int64 {
+	return insertHistory(&HistoryModel{
+		Country:   country,
+		Device:    device,
+		Direction: HistoryDirectionOut,
+		Sender:    sender,
+		Md5:       md5,
+	}, sms)
+}
+
+func insertHistory(his *HistoryModel, sms *model.SMS) int64 {
 	if sms == nil {
 		return 0
 	}
@@ -98,16 +198,11 @@ func InsertHistory(country string, sender string, sms *model.SMS) int64 {
 	if err == nil {
 		tu = t.Unix()
 	}
-	now := time.Now().Unix()
-	his := &HistoryModel{
-		Country:    country,
-		Sender:     sender,
-		RecordTime: now,
-		Phone:      sms.Phone,
-		Message:    sms.Message,
-		Time:       tu,
-		SentTime:   0,
-	}
+	his.RecordTime = time.Now().Unix()
+	his.Phone = sms.Phone
+	his.Message = sms.Message
+	his.Time = tu
+	his.SentTime = 0
 	res := d.Create(his)
 	if res.Error != nil || res.RowsAffected != 1 {
 		glog.Warning("insert history failed [%v] [%v]", res.Error, res.RowsAffected)
@@ -133,3 +228,302 @@ func UpdateHistorySent(id int64) bool {
 	}
 	return true
 }
+
+// UpdateHistoryRerouted records that message id was handed over to device, where it is stored as newID
+func UpdateHistoryRerouted(id int64, device string, newID int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	res := d.Where("id = ?", id).Updates(map[string]interface{}{"rerouted_to": device, "rerouted_id": newID})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update [%d] history rerouted failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	// the replacement takes the place of the segment in its logical message
+	sub := Connect().Model(&HistoryModel{}).Select("message_id").Where("id = ?", id)
+	res = Connect().Model(&HistoryModel{}).Where("id = ?", newID).Update("message_id", sub)
+	if res.Error != nil {
+		glog.Warning("update [%d] history message id failed [%v]", newID, res.Error)
+	}
+	return true
+}
+
+// LinkHistorySegments makes ids, the segments of one long message, a logical message
+// identified by the first id
+func LinkHistorySegments(ids []int64) bool {
+	if len(ids) == 0 {
+		return false
+	}
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	res := d.Where("id IN ?", ids).Update("message_id", ids[0])
+	if res.Error != nil {
+		glog.Warning("link history segments %v failed [%v]", ids, res.Error)
+		return false
+	}
+	return true
+}
+
+// GetMessageSegments returns the current segments of a logical message, rows that were
+// rerouted are replaced by their new rows
+func GetMessageSegments(messageID int64) []HistoryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	segments := make([]HistoryModel, 0)
+	res := d.Where("message_id = ? AND rerouted_id = 0", messageID).Order("id").Find(&segments)
+	if res.Error != nil {
+		glog.Warning("get message [%d] segments failed [%v]", messageID, res.Error)
+		return nil
+	}
+	return segments
+}
+
+// UpdateHistoryFailed marks an outbound message as failed unless it was acknowledged meanwhile
+func UpdateHistoryFailed(id int64, reason string) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	res := d.Where("id = ? AND ack_time = 0 AND rerouted_id = 0", id).Updates(map[string]interface{}{"failed_time": time.Now().Unix(), "error_message": reason})
+	if res.Error != nil || res.RowsAffected != 1 {
+		return false
+	}
+	return true
+}
+
+// UpdateHistoryDelivered stores the delivery report for the message acknowledged with md5,
+// a negative report marks it failed. It returns the id of the row, 0 if there is none.
+func UpdateHistoryDelivered(md5 string, delivered bool, reason string) int64 {
+	d := Connect()
+	if d == nil {
+		return 0
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	his := &HistoryModel{}
+	res := d.Where("md5 = ? AND rerouted_id = 0 AND delivered_time = 0 AND failed_time = 0", md5).Order("id DESC").Limit(1).Find(his)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return 0
+	}
+	update := map[string]interface{}{"delivered_time": time.Now().Unix()}
+	if !delivered {
+		update = map[string]interface{}{"failed_time": time.Now().Unix(), "error_message": reason}
+	}
+	res = Connect().Model(&HistoryModel{}).Where("id = ?", his.ID).Updates(update)
+	if res.Error != nil {
+		glog.Warning("update [%d] history delivery failed [%v]", his.ID, res.Error)
+		return 0
+	}
+	return his.ID
+}
+
+// GetLastReceivedHistories returns the latest n inbound messages, which are stored with the device name as sender
+func GetLastReceivedHistories(devices []string, n int) []HistoryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&HistoryModel{}).
+		Where("direction = ? OR (direction = '' AND sender IN ?)", HistoryDirectionIn, devices).
+		Where("spam = ?", false)
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	histories := make([]HistoryModel, 0)
+	res := d.Order("id DESC").Limit(n).Find(&histories)
+	if res.Error != nil {
+		glog.Warning("get last received histories failed [%v]", res.Error)
+		return nil
+	}
+	return histories
+}
+
+func GetHistory(id int64) *HistoryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	his := &HistoryModel{}
+	res := d.Where("id = ?", id).Limit(1).Find(his)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return his
+}
+
+// GetHistories returns the messages with the given ids
+func GetHistories(ids []int64) []HistoryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	histories := make([]HistoryModel, 0, len(ids))
+	if len(ids) == 0 {
+		return histories
+	}
+	res := d.Where("id IN ?", ids).Find(&histories)
+	if res.Error != nil {
+		glog.Warning("get histories failed [%v]", res.Error)
+		return nil
+	}
+	return histories
+}
+
+// GetSpamHistories returns the spam folder, newest first
+func GetSpamHistories(limit int) []HistoryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&HistoryModel{}).Where("spam = ?", true)
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	histories := make([]HistoryModel, 0)
+	res := d.Order("id DESC").Limit(limit).Find(&histories)
+	if res.Error != nil {
+		glog.Warning("get spam histories failed [%v]", res.Error)
+		return nil
+	}
+	return histories
+}
+
+// UpdateHistorySpam moves a message in or out of the spam folder and records the label it was trained with
+func UpdateHistorySpam(id int64, spam bool, reason string, trained string) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	res := d.Where("id = ?", id).Updates(map[string]interface{}{
+		"spam":        spam,
+		"spam_reason": reason,
+		"trained":     trained,
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update [%d] history spam failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+// UpdateHistoryAck marks the newest unacknowledged message sent with md5 as acknowledged by the module
+func UpdateHistoryAck(md5 string) int64 {
+	d := Connect()
+	if d == nil {
+		return 0
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	his := &HistoryModel{}
+	res := d.Where("md5 = ? AND ack_time = 0 AND rerouted_id = 0", md5).Order("id DESC").Limit(1).Find(his)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return 0
+	}
+	// a late ACK overrides a failure recorded when the retries ran out; ack_time = 0 again so
+	// only one of two ACKs for the same message reports it
+	res = Connect().Model(&HistoryModel{}).Where("id = ? AND ack_time = 0", his.ID).Updates(map[string]interface{}{"ack_time": time.Now().Unix(), "failed_time": 0, "error_message": ""})
+	if res.Error != nil || res.RowsAffected != 1 {
+		if res.Error != nil {
+			glog.Warning("update [%d] history ack failed [%v]", his.ID, res.Error)
+		}
+		return 0
+	}
+	return his.ID
+}
+
+// HistorySearch filters SearchHistories, empty fields match everything
+type HistorySearch struct {
+	Device string
+	// Devices limits the search to these devices when not empty
+	Devices   []string
+	Direction string
+	Phone     string
+	Keyword   string
+	Spam      *bool
+	Since     int64
+	Until     int64
+}
+
+// SearchHistories returns up to limit messages older than cursor (a message id, 0 for the newest), newest first
+func SearchHistories(search *HistorySearch, cursor int64, limit int) []HistoryModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&HistoryModel{})
+	historyLock.RLock()
+	defer historyLock.RUnlock()
+
+	if cursor > 0 {
+		d = d.Where("id < ?", cursor)
+	}
+	if search.Device != "" {
+		d = d.Where("device = ?", search.Device)
+	}
+	if len(search.Devices) > 0 {
+		d = d.Where("device IN ?", search.Devices)
+	}
+	if search.Direction != "" {
+		d = d.Where("direction = ?", search.Direction)
+	}
+	if search.Phone != "" {
+		d = d.Where("phone LIKE ?", "%"+search.Phone+"%")
+	}
+	if search.Keyword != "" {
+		d = d.Where("message LIKE ?", "%"+search.Keyword+"%")
+	}
+	if search.Spam != nil {
+		d = d.Where("spam = ?", *search.Spam)
+	}
+	if search.Since > 0 {
+		d = d.Where("record_time >= ?", search.Since)
+	}
+	if search.Until > 0 {
+		d = d.Where("record_time < ?", search.Until)
+	}
+
+	histories := make([]HistoryModel, 0)
+	res := d.Order("id DESC").Limit(limit).Find(&histories)
+	if res.Error != nil {
+		glog.Warning("search histories failed [%v]", res.Error)
+		return nil
+	}
+	return histories
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+	"time"
+)
+
+var idempotencyLock = sync.RWMutex{}
+
+// IdempotencyModel is the response of the first send request made with an Idempotency-Key,
+// RequestHash tells a retry from a different request reusing the key
+type IdempotencyModel struct {
+	ID          int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Key         string `gorm:"column:idempotency_key;uniqueIndex" json:"key"`
+	RequestHash string `gorm:"column:request_hash" json:"request_hash"`
+	Response    string `gorm:"column:response" json:"response"`
+	CreatedAt   int64  `gorm:"column:created_at;index" json:"created_at"`
+}
+
+func (IdempotencyModel) TableName() string {
+	return "idempotency_keys"
+}
+
+// GetIdempotency returns the stored response for key if it was created after since
+func GetIdempotency(key string, since int64) *IdempotencyModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&IdempotencyModel{})
+	idempotencyLock.RLock()
+	defer idempotencyLock.RUnlock()
+
+	m := &IdempotencyModel{}
+	res := d.Where("idempotency_key = ? AND created_at > ?", key, since).Limit(1).Find(m)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return m
+}
+
+// InsertIdempotency stores the response for key, replacing an expired one, and drops
+// every key created before expired
+func InsertIdempotency(key, requestHash, response string, expired int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&IdempotencyModel{})
+	idempotencyLock.Lock()
+	defer idempotencyLock.Unlock()
+
+	if res := d.Where("created_at <= ? OR idempotency_key = ?", expired, key).Delete(&IdempotencyModel{}); res.Error != nil {
+		glog.Warning("delete expired idempotency keys failed [%v]", res.Error)
+	}
+	res := Connect().Create(&IdempotencyModel{
+		Key:         key,
+		RequestHash: requestHash,
+		Response:    response,
+		CreatedAt:   time.Now().Unix(),
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert idempotency key [%s] failed [%v] [%v]", key, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
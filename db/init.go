@@ -3,9 +3,35 @@ package db
 import (
 	"github.com/Akvicor/glog"
 	"github.com/Akvicor/util"
+	"gorm.io/gorm"
 	"sms/config"
 )
 
+// models lists every table managed by the database package
+func models() []interface{} {
+	return []interface{}{
+		&HistoryModel{},
+		&TelegramMapModel{},
+		&RuleModel{},
+		&RuleConditionModel{},
+		&RuleActionModel{},
+		&RuleLogModel{},
+		&OTPModel{},
+		&FilterEntryModel{},
+		&SpamTokenModel{},
+		&CampaignModel{},
+		&CampaignRecipientModel{},
+		&ScheduleModel{},
+		&ScheduleRunModel{},
+		&IdempotencyModel{},
+		&StatusCallbackModel{},
+		&APIKeyModel{},
+		&AuditModel{},
+		&UserModel{},
+		&NonceModel{},
+	}
+}
+
 func CreateDatabase() {
 	if util.FileStat(config.Global.Database.Path).IsExist() {
 		glog.Fatal("database file exist!")
@@ -14,9 +40,57 @@ func CreateDatabase() {
 	if d == nil {
 		glog.Fatal("con not connect to database!")
 	}
-	err := db.AutoMigrate(&HistoryModel{})
+	err := db.AutoMigrate(models()...)
 	if err != nil {
 		glog.Fatal(err.Error())
 	}
 	glog.Info("database create finished")
 }
+
+// Migrate creates tables added after the database was initialized
+func Migrate() {
+	d := Connect()
+	if d == nil {
+		glog.Fatal("con not connect to database!")
+	}
+	err := db.AutoMigrate(models()...)
+	if err != nil {
+		glog.Fatal("database migrate failed [%s]", err.Error())
+	}
+	backfillHistory(d)
+}
+
+// historyDefaults are the values of history columns added after the first release. AutoMigrate
+// adds them as NULL to the existing rows, which no comparison in the queries matches.
+var historyDefaults = map[string]interface{}{
+	"device":         "",
+	"direction":      "",
+	"md5":            "",
+	"ack_time":       0,
+	"spam":           false,
+	"spam_reason":    "",
+	"trained":        "",
+	"rerouted_to":    "",
+	"rerouted_id":    0,
+	"message_id":     0,
+	"delivered_time": 0,
+	"failed_time":    0,
+	"error_message":  "",
+}
+
+// backfillHistory sets the columns of historyDefaults that are still NULL
+func backfillHistory(d *gorm.DB) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	for column, value := range historyDefaults {
+		res := d.Model(&HistoryModel{}).Where(column+" IS NULL").Update(column, value)
+		if res.Error != nil {
+			glog.Warning("backfill history column [%s] failed [%v]", column, res.Error)
+			continue
+		}
+		if res.RowsAffected > 0 {
+			glog.Info("history column [%s] backfilled on %d rows", column, res.RowsAffected)
+		}
+	}
+}
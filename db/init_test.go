@@ -0,0 +1,56 @@
+package db
+
+import (
+	"sms/config"
+	"testing"
+)
+
+// baselineHistory is the history table of the first release
+const baselineHistory = "CREATE TABLE `history` (`id` integer PRIMARY KEY AUTOINCREMENT,`country` text," +
+	"`sender` text,`record_time` integer,`phone` text,`message` text,`time` integer,`sent_time` integer)"
+
+func TestMigrateBaseline(t *testing.T) {
+	config.Global = &config.Model{Database: config.DatabaseModel{Path: t.TempDir() + "/sms.db"}}
+	connected = false
+	d := Connect()
+	if d == nil {
+		t.Fatal("connect failed")
+	}
+	if err := d.Exec(baselineHistory).Error; err != nil {
+		t.Fatal(err)
+	}
+	rows := []string{
+		"INSERT INTO history (country,sender,record_time,phone,message,time,sent_time) VALUES ('CN','web',1,'+8613800138000','out',1,2)",
+		"INSERT INTO history (country,sender,record_time,phone,message,time,sent_time) VALUES ('CN','cn',3,'+8613800138001','in',3,0)",
+	}
+	for _, row := range rows {
+		if err := d.Exec(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Migrate()
+
+	for column := range historyDefaults {
+		var n int64
+		if err := d.Model(&HistoryModel{}).Where(column + " IS NULL").Count(&n).Error; err != nil || n != 0 {
+			t.Errorf("column %s: %d NULL rows [%v]", column, n, err)
+		}
+	}
+	if histories := GetAllHistories("cn", "cn", true); len(histories) != 2 {
+		t.Errorf("GetAllHistories returned %d rows, want 2", len(histories))
+	}
+	received := GetLastReceivedHistories([]string{"cn"}, 10)
+	if len(received) != 1 || received[0].Message != "in" {
+		t.Errorf("GetLastReceivedHistories returned %v, want the inbound row", received)
+	}
+	if his := GetHistory(1); his == nil || his.Status() != MessageWritten {
+		t.Errorf("baseline row %v, want written", his)
+	}
+
+	// a second start must leave the rows alone
+	Migrate()
+	if histories := GetAllHistories("cn", "cn", true); len(histories) != 2 {
+		t.Errorf("GetAllHistories after a second migration returned %d rows, want 2", len(histories))
+	}
+}
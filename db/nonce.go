@@ -0,0 +1,58 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+)
+
+var nonceLock = sync.RWMutex{}
+
+// NonceModel is a nonce of a signed request, kept for the clock skew window so a request cannot
+// be replayed, not even after a restart
+type NonceModel struct {
+	ID        int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Nonce     string `gorm:"column:nonce;uniqueIndex" json:"nonce"`
+	Timestamp int64  `gorm:"column:timestamp;index" json:"timestamp"`
+}
+
+func (NonceModel) TableName() string {
+	return "request_nonces"
+}
+
+// InsertNonce records a nonce, it returns false when the nonce is already known or the insert
+// failed, so a request is refused rather than possibly replayed
+func InsertNonce(nonce string, timestamp int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&NonceModel{})
+	nonceLock.Lock()
+	defer nonceLock.Unlock()
+
+	var count int64
+	if res := d.Where("nonce = ?", nonce).Count(&count); res.Error != nil || count != 0 {
+		return false
+	}
+	res := Connect().Create(&NonceModel{Nonce: nonce, Timestamp: timestamp})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert nonce failed [%v] [%v]", res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+// DeleteNoncesBefore drops the nonces with a timestamp before ts
+func DeleteNoncesBefore(ts int64) {
+	d := Connect()
+	if d == nil {
+		return
+	}
+	d = d.Model(&NonceModel{})
+	nonceLock.Lock()
+	defer nonceLock.Unlock()
+
+	if res := d.Where("timestamp < ?", ts).Delete(&NonceModel{}); res.Error != nil {
+		glog.Warning("delete expired nonces failed [%v]", res.Error)
+	}
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+)
+
+var otpLock = sync.RWMutex{}
+
+// OTPModel is a verification code extracted from an inbound SMS
+type OTPModel struct {
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	HistoryID  int64  `gorm:"column:history_id;index" json:"history_id"`
+	Device     string `gorm:"column:device" json:"device"`
+	Phone      string `gorm:"column:phone" json:"sender"`
+	Code       string `gorm:"column:code" json:"code"`
+	Service    string `gorm:"column:service" json:"service"`
+	ReceivedAt int64  `gorm:"column:received_at;index" json:"received_at"`
+	ExpiresAt  int64  `gorm:"column:expires_at" json:"expires_at"`
+}
+
+func (OTPModel) TableName() string {
+	return "otp"
+}
+
+func InsertOTP(otp *OTPModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&OTPModel{})
+	otpLock.Lock()
+	defer otpLock.Unlock()
+
+	otp.ID = 0
+	res := d.Create(otp)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert otp failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return otp.ID
+}
+
+// GetLatestOTP returns the newest code received at or after since and still valid at now,
+// device and sender are optional filters, sender matches part of the number
+func GetLatestOTP(device, sender string, since, now int64) *OTPModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&OTPModel{})
+	otpLock.RLock()
+	defer otpLock.RUnlock()
+
+	d = d.Where("received_at >= ? AND expires_at >= ?", since, now)
+	if device != "" {
+		d = d.Where("device = ?", device)
+	}
+	if sender != "" {
+		d = d.Where("phone LIKE ?", "%"+sender+"%")
+	}
+	otp := &OTPModel{}
+	res := d.Order("id DESC").Limit(1).Find(otp)
+	if res.Error != nil {
+		glog.Warning("get latest otp failed [%v]", res.Error)
+		return nil
+	}
+	if res.RowsAffected != 1 {
+		return nil
+	}
+	return otp
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var ruleLock = sync.RWMutex{}
+
+const (
+	RuleLogicAnd = "AND"
+	RuleLogicOr  = "OR"
+)
+
+// RuleModel is a forwarding rule evaluated against every inbound SMS
+type RuleModel struct {
+	ID          int64                `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Name        string               `gorm:"column:name;not null" json:"name"`
+	Description string               `gorm:"column:description" json:"description"`
+	Device      string               `gorm:"column:device" json:"device"`
+	Priority    int                  `gorm:"column:priority" json:"priority"`
+	Enabled     bool                 `gorm:"column:enabled" json:"enabled"`
+	CreatedAt   int64                `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	UpdatedAt   int64                `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+	Conditions  []RuleConditionModel `gorm:"foreignKey:RuleID" json:"conditions"`
+	Actions     []RuleActionModel    `gorm:"foreignKey:RuleID" json:"actions"`
+}
+
+func (RuleModel) TableName() string {
+	return "forwarding_rules"
+}
+
+type RuleConditionModel struct {
+	ID       int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	RuleID   int64  `gorm:"column:rule_id;index" json:"rule_id"`
+	Type     string `gorm:"column:type" json:"type"`
+	Operator string `gorm:"column:operator" json:"operator"`
+	Value    string `gorm:"column:value" json:"value"`
+	Logic    string `gorm:"column:logic" json:"logic"`
+}
+
+func (RuleConditionModel) TableName() string {
+	return "rule_conditions"
+}
+
+type RuleActionModel struct {
+	ID      int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	RuleID  int64  `gorm:"column:rule_id;index" json:"rule_id"`
+	Type    string `gorm:"column:type" json:"type"`
+	Config  string `gorm:"column:config" json:"config"`
+	Order   int    `gorm:"column:order_num" json:"order"`
+	Enabled bool   `gorm:"column:enabled" json:"enabled"`
+}
+
+func (RuleActionModel) TableName() string {
+	return "rule_actions"
+}
+
+func preloadRule(d *gorm.DB) *gorm.DB {
+	return d.Preload("Conditions", func(d *gorm.DB) *gorm.DB {
+		return d.Order("id ASC")
+	}).Preload("Actions", func(d *gorm.DB) *gorm.DB {
+		return d.Order("order_num ASC, id ASC")
+	})
+}
+
+// GetAllRules returns rules ordered by priority, lower value first
+func GetAllRules(enabledOnly bool) []RuleModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = preloadRule(d.Model(&RuleModel{}))
+	ruleLock.RLock()
+	defer ruleLock.RUnlock()
+
+	if enabledOnly {
+		d = d.Where("enabled = ?", true)
+	}
+	rules := make([]RuleModel, 0)
+	res := d.Order("priority ASC, id ASC").Find(&rules)
+	if res.Error != nil {
+		glog.Warning("get all rules failed [%v]", res.Error)
+		return nil
+	}
+	return rules
+}
+
+func GetRule(id int64) *RuleModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = preloadRule(d.Model(&RuleModel{}))
+	ruleLock.RLock()
+	defer ruleLock.RUnlock()
+
+	rule := &RuleModel{}
+	res := d.Where("id = ?", id).Limit(1).Find(rule)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return rule
+}
+
+// InsertRule stores a rule together with its conditions and actions
+func InsertRule(rule *RuleModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	rule.ID = 0
+	for i := range rule.Conditions {
+		rule.Conditions[i].ID = 0
+	}
+	for i := range rule.Actions {
+		rule.Actions[i].ID = 0
+	}
+	res := d.Create(rule)
+	if res.Error != nil {
+		glog.Warning("insert rule failed [%v]", res.Error)
+		return -1
+	}
+	return rule.ID
+}
+
+// UpdateRule replaces a rule, its conditions and its actions
+func UpdateRule(rule *RuleModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	err := d.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&RuleModel{}).Where("id = ?", rule.ID).Updates(map[string]interface{}{
+			"name":        rule.Name,
+			"description": rule.Description,
+			"device":      rule.Device,
+			"priority":    rule.Priority,
+			"enabled":     rule.Enabled,
+			"updated_at":  time.Now().Unix(),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Where("rule_id = ?", rule.ID).Delete(&RuleConditionModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("rule_id = ?", rule.ID).Delete(&RuleActionModel{}).Error; err != nil {
+			return err
+		}
+		for i := range rule.Conditions {
+			rule.Conditions[i].ID = 0
+			rule.Conditions[i].RuleID = rule.ID
+		}
+		for i := range rule.Actions {
+			rule.Actions[i].ID = 0
+			rule.Actions[i].RuleID = rule.ID
+		}
+		if len(rule.Conditions) > 0 {
+			if err := tx.Create(&rule.Conditions).Error; err != nil {
+				return err
+			}
+		}
+		if len(rule.Actions) > 0 {
+			if err := tx.Create(&rule.Actions).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Warning("update rule [%d] failed [%v]", rule.ID, err)
+		return false
+	}
+	return true
+}
+
+func UpdateRuleEnabled(id int64, enabled bool) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&RuleModel{})
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	res := d.Where("id = ?", id).Updates(map[string]interface{}{"enabled": enabled, "updated_at": time.Now().Unix()})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update rule [%d] enabled failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func DeleteRule(id int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	ruleLock.Lock()
+	defer ruleLock.Unlock()
+
+	err := d.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rule_id = ?", id).Delete(&RuleConditionModel{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("rule_id = ?", id).Delete(&RuleActionModel{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where("id = ?", id).Delete(&RuleModel{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Warning("delete rule [%d] failed [%v]", id, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+	"time"
+)
+
+var ruleLogLock = sync.RWMutex{}
+
+// RuleLogModel records one evaluation of a rule against an inbound SMS
+type RuleLogModel struct {
+	ID              int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	RuleID          int64  `gorm:"column:rule_id;index" json:"rule_id"`
+	RuleName        string `gorm:"column:rule_name" json:"rule_name"`
+	HistoryID       int64  `gorm:"column:history_id" json:"history_id"`
+	Device          string `gorm:"column:device" json:"device"`
+	Phone           string `gorm:"column:phone" json:"phone"`
+	Matched         bool   `gorm:"column:matched" json:"matched"`
+	ExecutedActions int    `gorm:"column:executed_actions" json:"executed_actions"`
+	SuccessActions  int    `gorm:"column:success_actions" json:"success_actions"`
+	Actions         string `gorm:"column:actions" json:"actions"`
+	Error           string `gorm:"column:error_message" json:"error"`
+	Latency         int64  `gorm:"column:latency_ms" json:"latency_ms"`
+	ExecutionTime   int64  `gorm:"column:execution_time;index" json:"execution_time"`
+}
+
+func (RuleLogModel) TableName() string {
+	return "rule_execution_logs"
+}
+
+// RuleStatModel counts evaluations of a rule in the bucket starting at Bucket,
+// Bucket is 0 for totals over the whole range
+type RuleStatModel struct {
+	RuleID      int64  `gorm:"column:rule_id" json:"rule_id"`
+	RuleName    string `gorm:"column:rule_name" json:"rule_name"`
+	Bucket      int64  `gorm:"column:bucket" json:"bucket"`
+	Evaluations int64  `gorm:"column:evaluations" json:"evaluations"`
+	Matches     int64  `gorm:"column:matches" json:"matches"`
+	Successes   int64  `gorm:"column:successes" json:"successes"`
+	Failures    int64  `gorm:"column:failures" json:"failures"`
+}
+
+func InsertRuleLog(log *RuleLogModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&RuleLogModel{})
+	ruleLogLock.Lock()
+	defer ruleLogLock.Unlock()
+
+	log.ID = 0
+	if log.ExecutionTime == 0 {
+		log.ExecutionTime = time.Now().Unix()
+	}
+	res := d.Create(log)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert rule log failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return log.ID
+}
+
+// GetRuleLogs returns a page of logs, newest first, and the total count; ruleID 0 matches all rules
+func GetRuleLogs(ruleID int64, matched *bool, page, size int) ([]RuleLogModel, int64) {
+	d := Connect()
+	if d == nil {
+		return nil, 0
+	}
+	d = d.Model(&RuleLogModel{})
+	ruleLogLock.RLock()
+	defer ruleLogLock.RUnlock()
+
+	if ruleID > 0 {
+		d = d.Where("rule_id = ?", ruleID)
+	}
+	if matched != nil {
+		d = d.Where("matched = ?", *matched)
+	}
+	var total int64
+	res := d.Count(&total)
+	if res.Error != nil {
+		glog.Warning("count rule logs failed [%v]", res.Error)
+		return nil, 0
+	}
+
+	logs := make([]RuleLogModel, 0)
+	res = d.Order("id DESC").Offset((page - 1) * size).Limit(size).Find(&logs)
+	if res.Error != nil {
+		glog.Warning("get rule logs failed [%v]", res.Error)
+		return nil, 0
+	}
+	return logs, total
+}
+
+// GetRuleStats aggregates logs since the given unix time into buckets of bucket seconds,
+// a bucket of 0 returns one total per rule
+func GetRuleStats(ruleID int64, since int64, bucket int64) []RuleStatModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&RuleLogModel{})
+	ruleLogLock.RLock()
+	defer ruleLogLock.RUnlock()
+
+	bucketExpr := "0"
+	args := make([]interface{}, 0, 2)
+	if bucket > 0 {
+		bucketExpr = "(execution_time / ?) * ?"
+		args = append(args, bucket, bucket)
+	}
+	d = d.Select("rule_id, MAX(rule_name) AS rule_name, "+bucketExpr+" AS bucket, "+
+		"COUNT(*) AS evaluations, "+
+		"SUM(CASE WHEN matched THEN 1 ELSE 0 END) AS matches, "+
+		"SUM(success_actions) AS successes, "+
+		"SUM(executed_actions - success_actions) AS failures", args...).
+		Where("execution_time >= ?", since)
+	if ruleID > 0 {
+		d = d.Where("rule_id = ?", ruleID)
+	}
+
+	stats := make([]RuleStatModel, 0)
+	res := d.Group("rule_id, bucket").Order("rule_id ASC, bucket ASC").Scan(&stats)
+	if res.Error != nil {
+		glog.Warning("get rule stats failed [%v]", res.Error)
+		return nil
+	}
+	return stats
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var scheduleLock = sync.RWMutex{}
+
+// Schedule states, a one-off schedule becomes done after its run
+const (
+	ScheduleActive = "active"
+	SchedulePaused = "paused"
+	ScheduleDone   = "done"
+)
+
+// ScheduleModel is a message held until NextRun, Cron is empty for a one-off send_at message.
+// StatusCallback is registered for every message the schedule sends. The sends of a schedule
+// created with an API key count against APIKeyID.
+type ScheduleModel struct {
+	ID             int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Name           string `gorm:"column:name" json:"name"`
+	Device         string `gorm:"column:device" json:"device"`
+	Sender         string `gorm:"column:sender" json:"sender"`
+	Phone          string `gorm:"column:phone" json:"phone"`
+	Message        string `gorm:"column:message" json:"message"`
+	Cron           string `gorm:"column:cron" json:"cron"`
+	Status         string `gorm:"column:status;index" json:"status"`
+	NextRun        int64  `gorm:"column:next_run;index" json:"next_run"`
+	LastRun        int64  `gorm:"column:last_run" json:"last_run"`
+	RunCount       int64  `gorm:"column:run_count" json:"run_count"`
+	StatusCallback string `gorm:"column:status_callback" json:"status_callback"`
+	APIKeyID       int64  `gorm:"column:api_key_id" json:"api_key_id"`
+	CreatedAt      int64  `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt      int64  `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (ScheduleModel) TableName() string {
+	return "schedules"
+}
+
+// ScheduleRunModel is one run of a schedule and the history rows it created
+type ScheduleRunModel struct {
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	ScheduleID int64  `gorm:"column:schedule_id;index" json:"schedule_id"`
+	RunAt      int64  `gorm:"column:run_at" json:"run_at"`
+	Device     string `gorm:"column:device" json:"device"`
+	HistoryIDs string `gorm:"column:history_ids" json:"history_ids"`
+	Error      string `gorm:"column:error_message" json:"error"`
+}
+
+func (ScheduleRunModel) TableName() string {
+	return "schedule_runs"
+}
+
+func InsertSchedule(schedule *ScheduleModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&ScheduleModel{})
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	now := time.Now().Unix()
+	schedule.ID = 0
+	schedule.CreatedAt = now
+	schedule.UpdatedAt = now
+	res := d.Create(schedule)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert schedule failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return schedule.ID
+}
+
+// UpdateSchedule saves every editable field of a schedule
+func UpdateSchedule(schedule *ScheduleModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&ScheduleModel{})
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	schedule.UpdatedAt = time.Now().Unix()
+	res := d.Where("id = ?", schedule.ID).Updates(map[string]interface{}{
+		"name":            schedule.Name,
+		"device":          schedule.Device,
+		"sender":          schedule.Sender,
+		"phone":           schedule.Phone,
+		"message":         schedule.Message,
+		"cron":            schedule.Cron,
+		"status":          schedule.Status,
+		"next_run":        schedule.NextRun,
+		"last_run":        schedule.LastRun,
+		"run_count":       schedule.RunCount,
+		"updated_at":      schedule.UpdatedAt,
+		"status_callback": schedule.StatusCallback,
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update schedule [%d] failed [%v] [%v]", schedule.ID, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func GetSchedule(id int64) *ScheduleModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&ScheduleModel{})
+	scheduleLock.RLock()
+	defer scheduleLock.RUnlock()
+
+	schedule := &ScheduleModel{}
+	res := d.Where("id = ?", id).Limit(1).Find(schedule)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return schedule
+}
+
+// GetAllSchedules returns schedules by next run, status "" matches all
+func GetAllSchedules(status string) []ScheduleModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&ScheduleModel{})
+	scheduleLock.RLock()
+	defer scheduleLock.RUnlock()
+
+	if status != "" {
+		d = d.Where("status = ?", status)
+	}
+	schedules := make([]ScheduleModel, 0)
+	res := d.Order("status, next_run, id").Find(&schedules)
+	if res.Error != nil {
+		glog.Warning("get schedules failed [%v]", res.Error)
+		return nil
+	}
+	return schedules
+}
+
+// GetDueSchedules returns active schedules whose next run is not after now
+func GetDueSchedules(now int64) []ScheduleModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&ScheduleModel{})
+	scheduleLock.RLock()
+	defer scheduleLock.RUnlock()
+
+	schedules := make([]ScheduleModel, 0)
+	res := d.Where("status = ? AND next_run <= ?", ScheduleActive, now).Order("next_run").Find(&schedules)
+	if res.Error != nil {
+		glog.Warning("get due schedules failed [%v]", res.Error)
+		return nil
+	}
+	return schedules
+}
+
+// DeleteSchedule removes a schedule and its run records, the history rows stay
+func DeleteSchedule(id int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	err := d.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("schedule_id = ?", id).Delete(&ScheduleRunModel{}).Error; err != nil {
+			return err
+		}
+		res := tx.Where("id = ?", id).Delete(&ScheduleModel{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Warning("delete schedule [%d] failed [%v]", id, err)
+		return false
+	}
+	return true
+}
+
+func InsertScheduleRun(run *ScheduleRunModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&ScheduleRunModel{})
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	run.ID = 0
+	res := d.Create(run)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert schedule run failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return run.ID
+}
+
+// GetScheduleRuns returns the latest runs of a schedule, newest first
+func GetScheduleRuns(id int64, limit int) []ScheduleRunModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&ScheduleRunModel{})
+	scheduleLock.RLock()
+	defer scheduleLock.RUnlock()
+
+	runs := make([]ScheduleRunModel, 0)
+	res := d.Where("schedule_id = ?", id).Order("id DESC").Limit(limit).Find(&runs)
+	if res.Error != nil {
+		glog.Warning("get schedule [%d] runs failed [%v]", id, res.Error)
+		return nil
+	}
+	return runs
+}
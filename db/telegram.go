@@ -0,0 +1,70 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+	"time"
+)
+
+var telegramLock = sync.RWMutex{}
+
+// TelegramMapModel maps a message forwarded to Telegram back to the SMS it came from
+type TelegramMapModel struct {
+	ID         int64  `gorm:"column:id;primaryKey;autoIncrement"`
+	ChatID     int64  `gorm:"column:chat_id;uniqueIndex:idx_telegram_chat_message"`
+	MessageID  int64  `gorm:"column:message_id;uniqueIndex:idx_telegram_chat_message"`
+	Device     string `gorm:"column:device"`
+	Phone      string `gorm:"column:phone"`
+	HistoryID  int64  `gorm:"column:history_id"`
+	RecordTime int64  `gorm:"column:record_time"`
+}
+
+func (TelegramMapModel) TableName() string {
+	return "telegram_map"
+}
+
+func InsertTelegramMap(chatID, messageID int64, device, phone string, historyID int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&TelegramMapModel{})
+	telegramLock.Lock()
+	defer telegramLock.Unlock()
+
+	mp := &TelegramMapModel{
+		ChatID:     chatID,
+		MessageID:  messageID,
+		Device:     device,
+		Phone:      phone,
+		HistoryID:  historyID,
+		RecordTime: time.Now().Unix(),
+	}
+	res := d.Create(mp)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert telegram map failed [%v] [%v]", res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func GetTelegramMap(chatID, messageID int64) *TelegramMapModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&TelegramMapModel{})
+	telegramLock.RLock()
+	defer telegramLock.RUnlock()
+
+	mp := &TelegramMapModel{}
+	res := d.Where("chat_id = ? AND message_id = ?", chatID, messageID).Limit(1).Find(mp)
+	if res.Error != nil {
+		glog.Warning("get telegram map failed [%v]", res.Error)
+		return nil
+	}
+	if res.RowsAffected != 1 {
+		return nil
+	}
+	return mp
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"github.com/Akvicor/glog"
+	"sync"
+	"time"
+)
+
+var userLock = sync.RWMutex{}
+
+// UserModel is a login of the web pages and the SMPP server. Only the bcrypt hash of the
+// password is stored. Role is admin, operator or viewer; Devices is comma separated like the
+// devices of an API key, empty allows all.
+type UserModel struct {
+	ID           int64  `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Username     string `gorm:"column:username;uniqueIndex" json:"username"`
+	PasswordHash string `gorm:"column:password_hash" json:"-"`
+	Role         string `gorm:"column:role" json:"role"`
+	Devices      string `gorm:"column:devices" json:"devices"`
+	Disabled     bool   `gorm:"column:disabled" json:"disabled"`
+	CreatedAt    int64  `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt    int64  `gorm:"column:updated_at" json:"updated_at"`
+	LastLoginAt  int64  `gorm:"column:last_login_at" json:"last_login_at"`
+	LastLoginIP  string `gorm:"column:last_login_ip" json:"last_login_ip"`
+}
+
+func (UserModel) TableName() string {
+	return "users"
+}
+
+func InsertUser(user *UserModel) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&UserModel{})
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	user.ID = 0
+	user.CreatedAt = time.Now().Unix()
+	user.UpdatedAt = user.CreatedAt
+	res := d.Create(user)
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("insert user failed [%v] [%v]", res.Error, res.RowsAffected)
+		return -1
+	}
+	return user.ID
+}
+
+// UpdateUser saves the role, devices and disabled flag of a user, the password stays
+func UpdateUser(user *UserModel) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&UserModel{})
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	user.UpdatedAt = time.Now().Unix()
+	res := d.Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"role":       user.Role,
+		"devices":    user.Devices,
+		"disabled":   user.Disabled,
+		"updated_at": user.UpdatedAt,
+	})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update user [%d] failed [%v] [%v]", user.ID, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+// UpdateUserPassword replaces the password hash of a user
+func UpdateUserPassword(id int64, hash string) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&UserModel{})
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	res := d.Where("id = ?", id).Updates(map[string]interface{}{"password_hash": hash, "updated_at": time.Now().Unix()})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("update password of user [%d] failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func DeleteUser(id int64) bool {
+	d := Connect()
+	if d == nil {
+		return false
+	}
+	d = d.Model(&UserModel{})
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	res := d.Where("id = ?", id).Delete(&UserModel{})
+	if res.Error != nil || res.RowsAffected != 1 {
+		glog.Warning("delete user [%d] failed [%v] [%v]", id, res.Error, res.RowsAffected)
+		return false
+	}
+	return true
+}
+
+func GetUser(id int64) *UserModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&UserModel{})
+	userLock.RLock()
+	defer userLock.RUnlock()
+
+	user := &UserModel{}
+	res := d.Where("id = ?", id).Limit(1).Find(user)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return user
+}
+
+func GetUserByName(username string) *UserModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&UserModel{})
+	userLock.RLock()
+	defer userLock.RUnlock()
+
+	user := &UserModel{}
+	res := d.Where("username = ?", username).Limit(1).Find(user)
+	if res.Error != nil || res.RowsAffected != 1 {
+		return nil
+	}
+	return user
+}
+
+func GetAllUsers() []UserModel {
+	d := Connect()
+	if d == nil {
+		return nil
+	}
+	d = d.Model(&UserModel{})
+	userLock.RLock()
+	defer userLock.RUnlock()
+
+	users := make([]UserModel, 0)
+	res := d.Order("id").Find(&users)
+	if res.Error != nil {
+		glog.Warning("get users failed [%v]", res.Error)
+		return nil
+	}
+	return users
+}
+
+// CountUsers counts the users, of role when it is not empty and only enabled ones then.
+// It returns -1 when the count failed.
+func CountUsers(role string) int64 {
+	d := Connect()
+	if d == nil {
+		return -1
+	}
+	d = d.Model(&UserModel{})
+	userLock.RLock()
+	defer userLock.RUnlock()
+
+	if role != "" {
+		d = d.Where("role = ? AND disabled = ?", role, false)
+	}
+	var count int64
+	res := d.Count(&count)
+	if res.Error != nil {
+		glog.Warning("count users failed [%v]", res.Error)
+		return -1
+	}
+	return count
+}
+
+// TouchUserLogin records a successful login of a user
+func TouchUserLogin(id int64, ip string) {
+	d := Connect()
+	if d == nil {
+		return
+	}
+	d = d.Model(&UserModel{})
+	userLock.Lock()
+	defer userLock.Unlock()
+
+	res := d.Where("id = ?", id).Updates(map[string]interface{}{"last_login_at": time.Now().Unix(), "last_login_ip": ip})
+	if res.Error != nil {
+		glog.Warning("touch user [%d] failed [%v]", id, res.Error)
+	}
+}
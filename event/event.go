@@ -0,0 +1,217 @@
+package event
+
+import (
+	"github.com/Akvicor/glog"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types, a filter of "message" matches every message.* type
+const (
+	TypeMessageReceived = "message.received"
+	TypeMessageStatus   = "message.status"
+	TypeDeviceOnline    = "device.online"
+	TypeDeviceOffline   = "device.offline"
+	TypeTelemetry       = "telemetry"
+)
+
+// Event is published to every subscriber whose filter matches. IDs increase and start from
+// the startup time, so a client resuming after a gateway restart does not miss newer events.
+type Event struct {
+	ID     int64       `json:"id"`
+	Type   string      `json:"type"`
+	Device string      `json:"device"`
+	Time   int64       `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+// Filter selects events by device and type, empty lists match everything
+type Filter struct {
+	Devices []string
+	Types   []string
+}
+
+// Subscription receives matching events on C, C is closed when the subscriber falls too far
+// behind or the stream is stopped, the client is expected to reconnect with its last event ID
+type Subscription struct {
+	C      chan *Event
+	filter Filter
+}
+
+var (
+	lock        = sync.Mutex{}
+	lastID      int64
+	buffer      []*Event
+	subscribers = make(map[*Subscription]struct{})
+	stop        chan struct{}
+)
+
+// EnableEvents publishes inbound messages, status changes, telemetry and device state changes
+func EnableEvents() {
+	lastID = time.Now().UnixNano() / int64(time.Millisecond) * 1000
+	stop = make(chan struct{})
+
+	serial.OnReceived(func(device string, historyID int64, sms *model.SMS) {
+		Publish(TypeMessageReceived, device, map[string]interface{}{
+			"history_id": historyID,
+			"phone":      sms.Phone,
+			"message":    sms.Message,
+			"time":       sms.Time,
+		})
+	})
+	serial.OnStatus(func(device string, historyID int64, status string) {
+		data := map[string]interface{}{"history_id": historyID, "status": status}
+		if his := db.GetHistory(historyID); his != nil {
+			data["message_id"] = his.MessageID
+			data["phone"] = his.Phone
+		}
+		Publish(TypeMessageStatus, device, data)
+	})
+	serial.OnTelemetry(func(device string, telemetry *model.Telemetry) {
+		Publish(TypeTelemetry, device, telemetry)
+	})
+	go watchDevices(stop)
+}
+
+// KillEvents closes every subscription so open streams end
+func KillEvents() {
+	lock.Lock()
+	defer lock.Unlock()
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+	for sub := range subscribers {
+		delete(subscribers, sub)
+		close(sub.C)
+	}
+}
+
+func bufferSize() int {
+	if config.Global.API.EventBuffer > 0 {
+		return config.Global.API.EventBuffer
+	}
+	return 1000
+}
+
+// Publish sends an event to the matching subscribers and keeps it for resuming clients
+func Publish(typ, device string, data interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	lastID++
+	e := &Event{ID: lastID, Type: typ, Device: device, Time: time.Now().Unix(), Data: data}
+	buffer = append(buffer, e)
+	if size := bufferSize(); len(buffer) > size {
+		buffer = append(buffer[:0], buffer[len(buffer)-size:]...)
+	}
+	for sub := range subscribers {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+			glog.Warning("[event] subscriber too slow, closing it")
+			delete(subscribers, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// Subscribe starts a subscription, events after lastEventID that are still buffered are
+// delivered first, 0 starts with new events only
+func Subscribe(filter Filter, lastEventID int64) *Subscription {
+	lock.Lock()
+	defer lock.Unlock()
+
+	sub := &Subscription{C: make(chan *Event, bufferSize()+64), filter: filter}
+	if lastEventID > 0 {
+		for _, e := range buffer {
+			if e.ID > lastEventID && filter.match(e) {
+				sub.C <- e
+			}
+		}
+	}
+	if stop == nil {
+		close(sub.C)
+		return sub
+	}
+	subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe ends a subscription, it is safe to call after C was closed
+func Unsubscribe(sub *Subscription) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := subscribers[sub]; ok {
+		delete(subscribers, sub)
+		close(sub.C)
+	}
+}
+
+func (f *Filter) match(e *Event) bool {
+	if len(f.Devices) > 0 {
+		found := false
+		for _, device := range f.Devices {
+			if device == e.Device {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, typ := range f.Types {
+		if typ == e.Type || strings.HasPrefix(e.Type, typ+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// watchDevices publishes device.online and device.offline when the health of a device changes
+func watchDevices(stop chan struct{}) {
+	health := make(map[string]string)
+	for _, dev := range config.Global.SerialDevices {
+		if handler := serial.Manager.GetHandler(dev.Name); handler != nil {
+			health[dev.Name] = handler.Health()
+		}
+	}
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, dev := range config.Global.SerialDevices {
+				handler := serial.Manager.GetHandler(dev.Name)
+				if handler == nil {
+					continue
+				}
+				now := handler.Health()
+				before, known := health[dev.Name]
+				health[dev.Name] = now
+				if known && (before == "") == (now == "") {
+					continue
+				}
+				if now == "" {
+					Publish(TypeDeviceOnline, dev.Name, map[string]interface{}{"health": now})
+				} else {
+					Publish(TypeDeviceOffline, dev.Name, map[string]interface{}{"health": now})
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package filter
+
+import (
+	"math"
+	"sms/db"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// docsToken is the row that counts trained documents
+const docsToken = ""
+
+// Bayes is a naive Bayes spam classifier backed by the spam_tokens table
+type Bayes struct {
+	lock     sync.RWMutex
+	spamDocs int64
+	hamDocs  int64
+	tokens   map[string]*db.SpamTokenModel
+}
+
+func NewBayes() *Bayes {
+	return &Bayes{tokens: make(map[string]*db.SpamTokenModel)}
+}
+
+// Load reads the stored counts
+func (b *Bayes) Load() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = make(map[string]*db.SpamTokenModel)
+	b.spamDocs, b.hamDocs = 0, 0
+	for _, t := range db.GetAllSpamTokens() {
+		t := t
+		if t.Token == docsToken {
+			b.spamDocs, b.hamDocs = t.Spam, t.Ham
+			continue
+		}
+		b.tokens[t.Token] = &t
+	}
+}
+
+// Docs returns how many spam and normal messages were trained
+func (b *Bayes) Docs() (int64, int64) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.spamDocs, b.hamDocs
+}
+
+// Train adds text to the spam or normal class, delta -1 removes a previous training
+func (b *Bayes) Train(text string, spam bool, delta int64) {
+	tokens := tokenize(text)
+	updates := make([]db.SpamTokenModel, 0, len(tokens)+1)
+	doc := db.SpamTokenModel{Token: docsToken}
+	if spam {
+		doc.Spam = delta
+	} else {
+		doc.Ham = delta
+	}
+	updates = append(updates, doc)
+	for token := range tokens {
+		updates = append(updates, db.SpamTokenModel{Token: token, Spam: doc.Spam, Ham: doc.Ham})
+	}
+
+	b.lock.Lock()
+	b.spamDocs = nonNegative(b.spamDocs + doc.Spam)
+	b.hamDocs = nonNegative(b.hamDocs + doc.Ham)
+	for _, u := range updates[1:] {
+		t, ok := b.tokens[u.Token]
+		if !ok {
+			t = &db.SpamTokenModel{Token: u.Token}
+			b.tokens[u.Token] = t
+		}
+		t.Spam = nonNegative(t.Spam + u.Spam)
+		t.Ham = nonNegative(t.Ham + u.Ham)
+	}
+	b.lock.Unlock()
+
+	db.AddSpamTokens(updates)
+}
+
+// Score returns the probability that text is spam
+func (b *Bayes) Score(text string) float64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.spamDocs == 0 || b.hamDocs == 0 {
+		return 0
+	}
+
+	total := float64(b.spamDocs + b.hamDocs)
+	logSpam := math.Log(float64(b.spamDocs) / total)
+	logHam := math.Log(float64(b.hamDocs) / total)
+	for token := range tokenize(text) {
+		t, ok := b.tokens[token]
+		if !ok {
+			continue
+		}
+		// per document token frequency with Laplace smoothing
+		logSpam += math.Log((float64(t.Spam) + 1) / (float64(b.spamDocs) + 2))
+		logHam += math.Log((float64(t.Ham) + 1) / (float64(b.hamDocs) + 2))
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
+
+// tokenize splits text into lower case words, digit runs become <num>,
+// CJK text is split into character bigrams since it has no spaces
+func tokenize(text string) map[string]struct{} {
+	tokens := make(map[string]struct{})
+	word := strings.Builder{}
+	cjk := make([]rune, 0)
+
+	flushWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		w := word.String()
+		word.Reset()
+		if strings.Trim(w, "0123456789") == "" {
+			if len(w) >= 4 {
+				tokens["<num>"] = struct{}{}
+			}
+			return
+		}
+		if strings.HasPrefix(w, "http") || strings.HasPrefix(w, "www") {
+			tokens["<url>"] = struct{}{}
+		}
+		tokens[w] = struct{}{}
+	}
+	flushCJK := func() {
+		if len(cjk) == 1 {
+			tokens[string(cjk)] = struct{}{}
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens[string(cjk[i:i+2])] = struct{}{}
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word.WriteRune(r)
+		default:
+			flushWord()
+			flushCJK()
+			if r == '【' || r == '[' {
+				tokens["<bracket>"] = struct{}{}
+			}
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
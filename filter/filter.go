@@ -0,0 +1,148 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	trainedSpam = "spam"
+	trainedHam  = "ham"
+)
+
+var (
+	entries     = make([]db.FilterEntryModel, 0)
+	entriesLock = sync.RWMutex{}
+	classifier  = NewBayes()
+)
+
+// EnableFilter checks every inbound SMS against the lists and the classifier before it is stored
+func EnableFilter() {
+	if !config.Global.Filter.Enable {
+		return
+	}
+	Reload()
+	classifier.Load()
+	serial.SetFilter(Check)
+	spam, ham := classifier.Docs()
+	glog.Info("Inbound filter started, classifier trained with %d spam and %d normal messages", spam, ham)
+}
+
+// Reload reads the block and allow lists again after they were changed
+func Reload() {
+	list := db.GetAllFilterEntries()
+	entriesLock.Lock()
+	defer entriesLock.Unlock()
+	entries = list
+}
+
+// ValidateEntry checks a list entry before it is stored
+func ValidateEntry(entry *db.FilterEntryModel) error {
+	switch entry.List {
+	case db.FilterListBlock, db.FilterListAllow:
+	default:
+		return fmt.Errorf("unsupported list [%s]", entry.List)
+	}
+	switch entry.Type {
+	case db.FilterTypeNumber, db.FilterTypePrefix, db.FilterTypeKeyword:
+	default:
+		return fmt.Errorf("unsupported type [%s]", entry.Type)
+	}
+	if strings.TrimSpace(entry.Value) == "" {
+		return errors.New("missing value")
+	}
+	return nil
+}
+
+// Check decides whether sms is spam: allow entries win over block entries, then the classifier decides
+func Check(device string, sms *model.SMS) (bool, string) {
+	entriesLock.RLock()
+	list := entries
+	entriesLock.RUnlock()
+
+	for _, e := range list {
+		if e.List == db.FilterListAllow && matchEntry(&e, sms) {
+			return false, ""
+		}
+	}
+	for _, e := range list {
+		if e.List == db.FilterListBlock && matchEntry(&e, sms) {
+			return true, fmt.Sprintf("blocked %s [%s]", e.Type, e.Value)
+		}
+	}
+
+	cfg := config.Global.Filter
+	if !cfg.Bayes {
+		return false, ""
+	}
+	spamDocs, hamDocs := classifier.Docs()
+	minDocs := int64(cfg.BayesMinDocs)
+	if spamDocs < minDocs || hamDocs < minDocs {
+		return false, ""
+	}
+	threshold := cfg.BayesThreshold
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.95
+	}
+	if score := classifier.Score(sms.Message); score >= threshold {
+		return true, fmt.Sprintf("classifier score %.3f", score)
+	}
+	return false, ""
+}
+
+func matchEntry(e *db.FilterEntryModel, sms *model.SMS) bool {
+	switch e.Type {
+	case db.FilterTypeNumber:
+		return model.SamePhone(sms.Phone, e.Value)
+	case db.FilterTypePrefix:
+		phone := strings.TrimPrefix(sms.Phone, "+")
+		value := strings.TrimPrefix(e.Value, "+")
+		// 106 channels arrive as +86106..., match with and without the country code
+		return strings.HasPrefix(phone, value) || strings.HasPrefix(strings.TrimPrefix(phone, "86"), value)
+	case db.FilterTypeKeyword:
+		return strings.Contains(strings.ToLower(sms.Message), strings.ToLower(e.Value))
+	}
+	return false
+}
+
+// Flag labels a stored message as spam or not, trains the classifier with it and moves it
+// between history and the spam folder; a message released from the spam folder runs the rules
+func Flag(historyID int64, spam bool) error {
+	his := db.GetHistory(historyID)
+	if his == nil {
+		return fmt.Errorf("message %d not found", historyID)
+	}
+
+	label := trainedHam
+	reason := ""
+	if spam {
+		label = trainedSpam
+		reason = "flagged"
+	}
+	if his.Trained != label {
+		if his.Trained != "" {
+			classifier.Train(his.Message, his.Trained == trainedSpam, -1)
+		}
+		classifier.Train(his.Message, spam, 1)
+	}
+	if !db.UpdateHistorySpam(historyID, spam, reason, label) {
+		return errors.New("update message failed")
+	}
+
+	if his.Spam && !spam && serial.Manager != nil && serial.Manager.GetHandler(his.Sender) != nil {
+		t := ""
+		if his.Time != 0 {
+			t = time.Unix(his.Time, 0).Format("2006-01-02 15:04:05")
+		}
+		serial.Release(his.Sender, his.ID, &model.SMS{Phone: his.Phone, Message: his.Message, Time: t})
+	}
+	return nil
+}
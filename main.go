@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
@@ -9,10 +10,27 @@ import (
 	"github.com/Akvicor/util"
 	"os"
 	"os/signal"
+	"sms/account"
 	"sms/app"
+	"sms/audit"
+	"sms/callback"
+	"sms/campaign"
+	"sms/command"
 	"sms/config"
 	"sms/db"
+	"sms/event"
+	"sms/filter"
+	"sms/mqtt"
+	"sms/otp"
+	"sms/rule"
+	"sms/schedule"
 	"sms/serial"
+	"sms/smpp"
+	"sms/smtp"
+	"sms/telegram"
+	"sms/twilio"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -22,6 +40,7 @@ func main() {
 
 	isInit := flag.Bool("i", false, "init database")
 	c := flag.String("c", "config.ini", "path to config file")
+	admin := flag.String("admin", "", "create or reset the admin `username` and exit, the password is read from stdin")
 	flag.Parse()
 
 	if util.FileStat(*c).NotFile() {
@@ -37,9 +56,27 @@ func main() {
 	if util.FileStat(config.Global.Database.Path).NotFile() {
 		glog.Fatal("missing database [%s]!", config.Global.Database.Path)
 	}
+	db.Migrate()
+	if *admin != "" {
+		createAdmin(*admin)
+	}
 
 	EnableShutDownListener()
+	account.EnableAccounts()
+	filter.EnableFilter()
 	serial.EnableSerial()
+	command.EnableCommands()
+	otp.EnableOTP()
+	rule.EnableRules()
+	telegram.EnableTelegram()
+	mqtt.EnableMQTT()
+	callback.EnableCallbacks()
+	twilio.EnableTwilio()
+	event.EnableEvents()
+	campaign.EnableCampaigns()
+	schedule.EnableScheduler()
+	smpp.EnableSMPP()
+	smtp.EnableSMTP()
 	initApp()
 
 	addr := fmt.Sprintf("%s:%d", config.Global.Server.HTTPAddr, config.Global.Server.HTTPPort)
@@ -66,6 +103,24 @@ func initDatabase() {
 	os.Exit(0)
 }
 
+// createAdmin reads a password from stdin for an admin of username, an existing user is made
+// an admin with that password
+func createAdmin(username string) {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		glog.Fatal("read password failed [%s]", err.Error())
+	}
+	u, err := account.SetAdmin(username, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		glog.Fatal("create admin [%s] failed [%s]", username, err.Error())
+	}
+	audit.Record(audit.Actor{Name: "cli"}, "user.admin", "user:"+strconv.FormatInt(u.ID, 10), nil, u)
+	glog.Info("admin [%s] saved", username)
+
+	os.Exit(0)
+}
+
 func setGlog() {
 	if config.Global.Log.LogToFile {
 		err := glog.SetLogFile(config.Global.Log.FilePath)
@@ -93,11 +148,32 @@ func EnableShutDownListener() {
 			glog.Fatal("Ticker Finished")
 		}()
 
+		glog.Info("close event streams")
+		event.KillEvents()
+
 		glog.Info("stopping Hertz server")
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		_ = app.StopServer(ctx)
 
+		glog.Info("stop smpp server")
+		smpp.KillSMPP()
+
+		glog.Info("stop smtp listener")
+		smtp.KillSMTP()
+
+		glog.Info("stop scheduler")
+		schedule.KillScheduler()
+
+		glog.Info("stop campaigns")
+		campaign.KillCampaigns()
+
+		glog.Info("stop mqtt bridge")
+		mqtt.KillMQTT()
+
+		glog.Info("stop telegram bridge")
+		telegram.KillTelegram()
+
 		glog.Info("close serial")
 		serial.KillSerial()
 
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// counter is a Prometheus counter, its values are keyed by the rendered labels
+type counter struct {
+	help   string
+	values map[string]uint64
+}
+
+var counters = struct {
+	sync.Mutex
+	m map[string]*counter
+}{m: make(map[string]*counter)}
+
+// Describe sets the help text of a counter, the counter is written even before its first Inc
+func Describe(name, help string) {
+	counters.Lock()
+	defer counters.Unlock()
+	get(name).help = help
+}
+
+// Inc adds one to a counter, labels are name and value pairs
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// Add adds n to a counter, labels are name and value pairs
+func Add(name string, n uint64, labels ...string) {
+	counters.Lock()
+	defer counters.Unlock()
+	get(name).values[render(labels)] += n
+}
+
+// Write writes every counter in the Prometheus text format
+func Write(w io.Writer) error {
+	counters.Lock()
+	defer counters.Unlock()
+	names := make([]string, 0, len(counters.m))
+	for name := range counters.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := counters.m[name]
+		if c.help != "" {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, c.help); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# TYPE %s counter\n", name); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(c.values))
+		for k := range c.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, err := fmt.Fprintf(w, "%s%s %d\n", name, k, c.values[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// get returns the counter of name, creating it, the caller holds the lock
+func get(name string) *counter {
+	c, ok := counters.m[name]
+	if !ok {
+		c = &counter{values: make(map[string]uint64)}
+		counters.m[name] = c
+	}
+	return c
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// render formats label pairs as {a="1",b="2"}, an odd trailing name is dropped
+func render(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -10,6 +10,8 @@ const (
 	MsgTagSmsReceived
 	MsgTagSmsSend
 	MsgTagSmsACK
+	MsgTagTelemetry
+	MsgTagSmsReport
 )
 
 type MSG struct {
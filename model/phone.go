@@ -0,0 +1,40 @@
+package model
+
+import "strings"
+
+// SamePhone compares two numbers ignoring formatting and country prefixes
+func SamePhone(a, b string) bool {
+	a = PhoneDigits(a)
+	b = PhoneDigits(b)
+	if len(a) < 5 || len(b) < 5 {
+		return false
+	}
+	return strings.HasSuffix(a, b) || strings.HasSuffix(b, a)
+}
+
+// EqualPhone compares two numbers in full after InternationalPhone, for checks that grant access
+// where SamePhone would let a number match any number ending with it
+func EqualPhone(a, b string) bool {
+	a = PhoneDigits(InternationalPhone(strings.TrimSpace(a)))
+	b = PhoneDigits(InternationalPhone(strings.TrimSpace(b)))
+	return len(a) > 0 && a == b
+}
+
+// PhoneDigits strips everything but digits from a phone number
+func PhoneDigits(s string) string {
+	buf := strings.Builder{}
+	for _, v := range s {
+		if v >= '0' && v <= '9' {
+			buf.WriteRune(v)
+		}
+	}
+	return buf.String()
+}
+
+// InternationalPhone returns phone in +<country code> form, numbers without a + are treated as Chinese
+func InternationalPhone(phone string) string {
+	if phone != "" && phone[0] != '+' {
+		return "+86" + phone
+	}
+	return phone
+}
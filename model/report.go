@@ -0,0 +1,19 @@
+package model
+
+import "encoding/json"
+
+// Report is the delivery report of a sent message, Key is the md5 it was acknowledged with
+type Report struct {
+	Key       string `json:"key"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error"`
+}
+
+func UnmarshalReport(data []byte) *Report {
+	msg := &Report{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return nil
+	}
+	return msg
+}
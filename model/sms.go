@@ -14,7 +14,7 @@ type SMS struct {
 
 func NewSMSLong(phone, msg string) []*SMS {
 	if phone[0] != '+' {
-		phone = "+86" + phone
+		phone = InternationalPhone(phone)
 	}
 	var smsLen = 0
 	smsArray := make([]string, 0, 2)
@@ -0,0 +1,23 @@
+package model
+
+import "encoding/json"
+
+// Telemetry is the radio status reported periodically by a modem
+type Telemetry struct {
+	CSQ  int `json:"csq"`
+	RSSI int `json:"rssi"`
+	RSRP int `json:"rsrp"`
+	RSRQ int `json:"rsrq"`
+	SNR  int `json:"snr"`
+	// Time is set by the gateway when the report is received
+	Time int64 `json:"time"`
+}
+
+func UnmarshalTelemetry(data []byte) *Telemetry {
+	t := &Telemetry{}
+	err := json.Unmarshal(data, t)
+	if err != nil {
+		return nil
+	}
+	return t
+}
@@ -0,0 +1,87 @@
+package mqtt
+
+import (
+	"sms/config"
+	"strings"
+)
+
+// haDevice groups the entities of one modem in Home Assistant
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type haEntity struct {
+	Name                string    `json:"name"`
+	UniqueID            string    `json:"unique_id"`
+	ObjectID            string    `json:"object_id"`
+	StateTopic          string    `json:"state_topic"`
+	ValueTemplate       string    `json:"value_template"`
+	JSONAttributesTopic string    `json:"json_attributes_topic,omitempty"`
+	AvailabilityTopic   string    `json:"availability_topic"`
+	DeviceClass         string    `json:"device_class,omitempty"`
+	UnitOfMeasurement   string    `json:"unit_of_measurement,omitempty"`
+	StateClass          string    `json:"state_class,omitempty"`
+	PayloadOn           string    `json:"payload_on,omitempty"`
+	PayloadOff          string    `json:"payload_off,omitempty"`
+	Icon                string    `json:"icon,omitempty"`
+	Device              *haDevice `json:"device"`
+}
+
+func discoveryPrefix() string {
+	p := strings.Trim(config.Global.MQTT.DiscoveryPrefix, "/")
+	if p == "" {
+		return "homeassistant"
+	}
+	return p
+}
+
+// publishDiscovery announces signal, online and last SMS entities for every modem
+func publishDiscovery() {
+	for _, dev := range config.Global.SerialDevices {
+		node := prefix() + "_" + dev.Name
+		device := &haDevice{
+			Identifiers:  []string{node},
+			Name:         "SMS " + dev.Name,
+			Manufacturer: "Air780E",
+			Model:        dev.Region,
+		}
+		status := topic(dev.Name, "status")
+
+		entities := map[string]*haEntity{
+			"sensor/" + node + "_signal": {
+				Name:              "Signal",
+				ValueTemplate:     "{{ value_json.signal }}",
+				StateTopic:        status,
+				DeviceClass:       "signal_strength",
+				UnitOfMeasurement: "dBm",
+				StateClass:        "measurement",
+			},
+			"binary_sensor/" + node + "_online": {
+				Name:          "Online",
+				ValueTemplate: "{{ 'ON' if value_json.online else 'OFF' }}",
+				StateTopic:    status,
+				DeviceClass:   "connectivity",
+				PayloadOn:     "ON",
+				PayloadOff:    "OFF",
+			},
+			"sensor/" + node + "_last_sms": {
+				Name:                "Last SMS",
+				ValueTemplate:       "{{ value_json.message[:255] }}",
+				StateTopic:          topic(dev.Name, "last_sms"),
+				JSONAttributesTopic: topic(dev.Name, "last_sms"),
+				Icon:                "mdi:message-text",
+			},
+		}
+		for path, entity := range entities {
+			id := path[strings.Index(path, "/")+1:]
+			entity.UniqueID = id
+			entity.ObjectID = id
+			entity.AvailabilityTopic = availabilityTopic()
+			entity.Device = device
+			publish(discoveryPrefix()+"/"+path+"/config", true, entity)
+		}
+	}
+}
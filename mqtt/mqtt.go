@@ -0,0 +1,242 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Akvicor/glog"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"sms/audit"
+	"sms/config"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const senderName = "mqtt"
+
+var (
+	client  paho.Client
+	running int32
+	stop    chan struct{}
+)
+
+// ReceivedPayload is published for every inbound SMS
+type ReceivedPayload struct {
+	Device    string `json:"device"`
+	HistoryID int64  `json:"history_id"`
+	Phone     string `json:"phone"`
+	Message   string `json:"message"`
+	Time      string `json:"time"`
+}
+
+// StatusPayload is the retained status of a device
+type StatusPayload struct {
+	Device    string           `json:"device"`
+	Online    bool             `json:"online"`
+	Signal    *int             `json:"signal"`
+	Telemetry *model.Telemetry `json:"telemetry"`
+	Time      int64            `json:"time"`
+}
+
+// SendPayload is accepted on the send topics
+type SendPayload struct {
+	Device  string `json:"device"`
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+	Sender  string `json:"sender"`
+}
+
+func prefix() string {
+	p := strings.Trim(config.Global.MQTT.TopicPrefix, "/")
+	if p == "" {
+		return "sms"
+	}
+	return p
+}
+
+func topic(parts ...string) string {
+	return prefix() + "/" + strings.Join(parts, "/")
+}
+
+func availabilityTopic() string {
+	return topic("availability")
+}
+
+// EnableMQTT connects to the broker and bridges SMS and device status
+func EnableMQTT() {
+	cfg := config.Global.MQTT
+	if !cfg.Enable {
+		return
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetWill(availabilityTopic(), "offline", cfg.QoS, true).
+		SetOnConnectHandler(onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			glog.Warning("[mqtt] connection lost [%v]", err)
+		})
+	client = paho.NewClient(opts)
+	client.Connect()
+
+	atomic.StoreInt32(&running, 1)
+	stop = make(chan struct{})
+	serial.OnReceived(publishReceived)
+	serial.OnTelemetry(func(device string, _ *model.Telemetry) {
+		publishStatus(device)
+	})
+	serial.OnAlert(func(text string) {
+		publish(topic("alert"), false, map[string]interface{}{"text": text, "time": time.Now().Unix()})
+	})
+	go statusLoop()
+
+	glog.Info("MQTT bridge started for %s", cfg.Broker)
+}
+
+func KillMQTT() {
+	if !atomic.CompareAndSwapInt32(&running, 1, 0) {
+		return
+	}
+	close(stop)
+	if client.IsConnected() {
+		client.Publish(availabilityTopic(), config.Global.MQTT.QoS, true, "offline").WaitTimeout(time.Second)
+	}
+	client.Disconnect(500)
+}
+
+func isRunning() bool {
+	return atomic.LoadInt32(&running) == 1
+}
+
+// onConnect runs on every (re)connect, subscriptions and retained state are restored here
+func onConnect(c paho.Client) {
+	qos := config.Global.MQTT.QoS
+	glog.Info("[mqtt] connected")
+	c.Publish(availabilityTopic(), qos, true, "online")
+
+	c.Subscribe(topic("send"), qos, func(_ paho.Client, m paho.Message) {
+		handleSend("", m.Payload())
+	})
+	c.Subscribe(topic("+", "send"), qos, func(_ paho.Client, m paho.Message) {
+		parts := strings.Split(m.Topic(), "/")
+		handleSend(parts[len(parts)-2], m.Payload())
+	})
+
+	if config.Global.MQTT.Discovery {
+		publishDiscovery()
+	}
+	publishAllStatus()
+}
+
+func publish(t string, retained bool, payload interface{}) {
+	if !isRunning() || !client.IsConnected() {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	client.Publish(t, config.Global.MQTT.QoS, retained, data)
+}
+
+func publishReceived(device string, historyID int64, sms *model.SMS) {
+	payload := &ReceivedPayload{
+		Device:    device,
+		HistoryID: historyID,
+		Phone:     sms.Phone,
+		Message:   sms.Message,
+		Time:      sms.Time,
+	}
+	publish(topic(device, "received"), false, payload)
+	publish(topic(device, "last_sms"), true, payload)
+}
+
+func publishStatus(device string) {
+	handler := serial.Manager.GetHandler(device)
+	if handler == nil {
+		return
+	}
+	status := &StatusPayload{
+		Device:    device,
+		Online:    handler.IsAlive(),
+		Telemetry: handler.GetTelemetry(),
+		Time:      time.Now().Unix(),
+	}
+	if status.Telemetry != nil {
+		status.Signal = &status.Telemetry.RSSI
+	}
+	publish(topic(device, "status"), true, status)
+}
+
+func publishAllStatus() {
+	for name := range serial.Manager.GetAllHandlers() {
+		publishStatus(name)
+	}
+}
+
+func statusLoop() {
+	interval := time.Duration(config.Global.MQTT.StatusInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			publishAllStatus()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleSend sends an SMS requested on a send topic and publishes the outcome to send/result
+func handleSend(device string, data []byte) {
+	req := &SendPayload{}
+	err := json.Unmarshal(data, req)
+	if err == nil {
+		if device != "" {
+			req.Device = device
+		}
+		err = sendSMS(req)
+	}
+
+	result := map[string]interface{}{"device": req.Device, "phone": req.Phone, "ok": err == nil}
+	if err != nil {
+		glog.Warning("[mqtt] send sms failed [%v]", err)
+		result["error"] = err.Error()
+	}
+	publish(topic("send", "result"), false, result)
+}
+
+func sendSMS(req *SendPayload) error {
+	if req.Device == "" {
+		return fmt.Errorf("missing device")
+	}
+	if req.Phone == "" {
+		return fmt.Errorf("invalid phone number")
+	}
+	if req.Message == "" {
+		return fmt.Errorf("invalid message")
+	}
+	sender := req.Sender
+	if sender == "" {
+		sender = senderName
+	}
+	ids, err := serial.Send(req.Device, sender, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(req.Phone, req.Message)))
+	entry := &audit.Message{Via: "mqtt", Device: req.Device, Sender: sender, Phone: req.Phone, Message: req.Message, IDs: ids}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	audit.RecordSend(audit.Actor{Name: "mqtt"}, entry)
+	return err
+}
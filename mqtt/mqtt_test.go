@@ -0,0 +1,135 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sms/config"
+	"sms/model"
+	"sms/serial"
+	"testing"
+	"time"
+)
+
+// telemetryReport is what air780e/main.lua sends with TAG_TELEMETRY
+const telemetryReport = `{"csq":21,"rssi":-71,"rsrp":-98,"rsrq":-11,"snr":9}`
+
+type testHandler struct {
+	serial.SerialHandlerInterface
+	telemetry *model.Telemetry
+}
+
+func (h *testHandler) IsAlive() bool                  { return true }
+func (h *testHandler) GetTelemetry() *model.Telemetry { return h.telemetry }
+
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+// testBroker is an MQTT 3.1.1 broker just big enough for the bridge: it accepts a client,
+// acknowledges its subscriptions and hands every publish to messages
+func testBroker(t *testing.T) (string, <-chan testMessage) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	messages := make(chan testMessage, 64)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestClient(conn, messages)
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), messages
+}
+
+func serveTestClient(conn net.Conn, messages chan<- testMessage) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return
+		}
+		body := make([]byte, length)
+		if _, err = io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			_, _ = conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			n := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+n]), body[2+n:]
+			if qos := header >> 1 & 3; qos > 0 {
+				_, _ = conn.Write([]byte{0x40, 2, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			select {
+			case messages <- testMessage{topic: topic, payload: rest}:
+			default:
+			}
+		case 8: // SUBSCRIBE
+			_, _ = conn.Write([]byte{0x90, 3, body[0], body[1], 0})
+		case 12: // PINGREQ
+			_, _ = conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func TestTelemetryStatus(t *testing.T) {
+	broker, messages := testBroker(t)
+	config.Global = &config.Model{MQTT: config.MQTTModel{
+		Enable:         true,
+		Broker:         broker,
+		ClientID:       "sms-test",
+		TopicPrefix:    "sms",
+		QoS:            1,
+		StatusInterval: 1,
+	}}
+	telemetry := model.UnmarshalTelemetry([]byte(telemetryReport))
+	if telemetry == nil {
+		t.Fatal("telemetry report does not unmarshal")
+	}
+	serial.Manager = serial.NewSerialManager()
+	serial.Manager.AddHandler("cn", &testHandler{telemetry: telemetry})
+
+	EnableMQTT()
+	defer KillMQTT()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-messages:
+			if m.topic != "sms/cn/status" {
+				continue
+			}
+			status := &StatusPayload{}
+			if err := json.Unmarshal(m.payload, status); err != nil {
+				t.Fatalf("status %s: %v", m.payload, err)
+			}
+			if !status.Online || status.Telemetry == nil || *status.Telemetry != *telemetry {
+				t.Fatalf("status %s", m.payload)
+			}
+			if status.Signal == nil || *status.Signal != -71 {
+				t.Fatalf("signal of status %s", m.payload)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no status published")
+		}
+	}
+}
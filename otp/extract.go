@@ -0,0 +1,158 @@
+package otp
+
+import (
+	"fmt"
+	"regexp"
+	"sms/config"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Result is a verification code found in a message
+type Result struct {
+	Code    string
+	Service string
+	TTL     time.Duration
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	service string
+}
+
+// builtinPatterns cover the common Chinese and English templates, in order of preference
+var builtinPatterns = []string{
+	// 验证码：123456 / 验证码为 AB12CD
+	`(?:验证码|校验码|动态码|确认码|动态密码|登录码|激活码|安全码)(?:是|为)?[\s:：,，]*([0-9A-Za-z]{4,8})`,
+	// 123456是您的验证码 / 123456（登录验证码）
+	`([0-9A-Za-z]{4,8})[\s(（)）]*(?:是|为)?(?:您|你)?(?:的)?(?:本次)?(?:登录|注册|身份)?(?:验证码|校验码|动态码|动态密码)`,
+	// G-123456 is your Google verification code
+	`(?i)(?:^|[^0-9A-Za-z])(?:[A-Z]-)?([0-9]{4,8}) is your\b`,
+	// Your verification code is: 123456 / OTP 1234 / passcode: ab12cd
+	`(?i)\b(?:code|otp|passcode|pin|password)\b(?:\s+is)?[\s:：#-]*([0-9A-Za-z]{4,8})\b`,
+}
+
+var (
+	// 【腾讯科技】 or [Google] at either end of the message
+	serviceBracket = regexp.MustCompile(`^\s*[【\[]([^】\]]{1,20})[】\]]|[【\[]([^】\]]{1,20})[】\]]\s*$`)
+	// Your Google verification code / your Microsoft account code
+	serviceEnglish = regexp.MustCompile(`(?i)\byour ([\w.&-]{2,20})(?: [\w-]+){0,2} (?:code|otp|passcode|pin)\b`)
+	serviceGeneric = map[string]bool{
+		"verification": true, "security": true, "login": true, "sign-in": true, "one-time": true,
+		"account": true, "authentication": true, "access": true, "confirmation": true, "otp": true,
+	}
+	// 5分钟内有效 / 有效期10分钟 / valid for 10 minutes / expires in 5 mins
+	ttlChinese = regexp.MustCompile(`(?:有效期(?:为)?\s*)?([0-9]{1,3})\s*(分钟|小时|秒)(?:内有效|有效)?`)
+	ttlEnglish = regexp.MustCompile(`(?i)(?:valid|expires?|expiring)(?: for| in| within)?\s+([0-9]{1,3})\s*(min|minute|minutes|mins|hour|hours|hr|hrs|sec|second|seconds|s)\b`)
+)
+
+// builtin are the compiled builtinPatterns, patterns is set by EnableOTP with the [otp-pattern-*]
+// sections in front of them
+var (
+	builtin  = compileBuiltin()
+	patterns = builtin
+)
+
+func compileBuiltin() []pattern {
+	ps := make([]pattern, 0, len(builtinPatterns))
+	for _, p := range builtinPatterns {
+		ps = append(ps, pattern{re: regexp.MustCompile(p)})
+	}
+	return ps
+}
+
+// compilePatterns compiles the configured patterns, an invalid regex is an error rather than a
+// pattern that never matches
+func compilePatterns(configured []config.OTPPattern) ([]pattern, error) {
+	ps := make([]pattern, 0, len(configured)+len(builtin))
+	for _, p := range configured {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid otp pattern [%s]: %v", p.Regex, err)
+		}
+		ps = append(ps, pattern{re: re, service: p.Service})
+	}
+	return append(ps, builtin...), nil
+}
+
+// Extract looks for a verification code in content, returns nil if there is none
+func Extract(content string) *Result {
+	for _, p := range patterns {
+		code := match(p.re, content)
+		if code == "" {
+			continue
+		}
+		res := &Result{
+			Code:    code,
+			Service: p.service,
+			TTL:     extractTTL(content),
+		}
+		if res.Service == "" {
+			res.Service = extractService(content)
+		}
+		return res
+	}
+	return nil
+}
+
+func match(re *regexp.Regexp, content string) string {
+	for _, m := range re.FindAllStringSubmatch(content, -1) {
+		code := ""
+		if i := re.SubexpIndex("code"); i > 0 {
+			code = m[i]
+		} else if len(m) > 1 {
+			code = m[1]
+		}
+		if validCode(code) {
+			return code
+		}
+	}
+	return ""
+}
+
+// validCode rejects words such as "your" caught by the alphanumeric patterns, a code needs a digit
+func validCode(code string) bool {
+	if len(code) < 4 || len(code) > 8 {
+		return false
+	}
+	return strings.ContainsAny(code, "0123456789")
+}
+
+func extractService(content string) string {
+	if m := serviceBracket.FindStringSubmatch(content); m != nil {
+		if m[1] != "" {
+			return strings.TrimSpace(m[1])
+		}
+		return strings.TrimSpace(m[2])
+	}
+	if m := serviceEnglish.FindStringSubmatch(content); m != nil && !serviceGeneric[strings.ToLower(m[1])] {
+		return m[1]
+	}
+	return ""
+}
+
+func extractTTL(content string) time.Duration {
+	n, unit := 0, ""
+	if m := ttlChinese.FindStringSubmatch(content); m != nil {
+		n, _ = strconv.Atoi(m[1])
+		unit = m[2]
+	} else if m = ttlEnglish.FindStringSubmatch(content); m != nil {
+		n, _ = strconv.Atoi(m[1])
+		unit = strings.ToLower(m[2])
+	}
+	if n > 0 {
+		switch unit {
+		case "秒", "sec", "second", "seconds", "s":
+			return time.Duration(n) * time.Second
+		case "小时", "hour", "hours", "hr", "hrs":
+			return time.Duration(n) * time.Hour
+		default:
+			return time.Duration(n) * time.Minute
+		}
+	}
+	if config.Global.OTP.DefaultTTL > 0 {
+		return time.Duration(config.Global.OTP.DefaultTTL) * time.Second
+	}
+	return 5 * time.Minute
+}
@@ -0,0 +1,77 @@
+package otp
+
+import (
+	"sms/config"
+	"testing"
+	"time"
+)
+
+func TestExtract(t *testing.T) {
+	config.Global = &config.Model{}
+	patterns = builtin
+	tests := []struct {
+		content string
+		code    string
+		service string
+		ttl     time.Duration
+	}{
+		{"【腾讯科技】验证码：482913，5分钟内有效，请勿泄露。", "482913", "腾讯科技", 5 * time.Minute},
+		{"【支付宝】校验码为 AB12CD，有效期10分钟。", "AB12CD", "支付宝", 10 * time.Minute},
+		{"您的动态码是 7788，请于60秒内输入", "7788", "", 60 * time.Second},
+		{"391827是您的登录验证码，30分钟内有效【京东】", "391827", "京东", 30 * time.Minute},
+		{"5566（登录验证码），请勿告诉他人", "5566", "", 5 * time.Minute},
+		{"G-123456 is your Google verification code.", "123456", "Google", 5 * time.Minute},
+		{"Your Microsoft account code is 908172. It expires in 10 minutes.", "908172", "Microsoft", 10 * time.Minute},
+		{"Your verification code is: 4821", "4821", "", 5 * time.Minute},
+		{"[Acme] OTP 123456, valid for 2 hours", "123456", "Acme", 2 * time.Hour},
+		{"Use passcode: ab12cd to sign in", "ab12cd", "", 5 * time.Minute},
+		{"Your Steam login code: 8F3K2", "8F3K2", "Steam", 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		res := Extract(tt.content)
+		if res == nil {
+			t.Errorf("Extract(%q) found no code", tt.content)
+			continue
+		}
+		if res.Code != tt.code || res.Service != tt.service || res.TTL != tt.ttl {
+			t.Errorf("Extract(%q) = %q %q %v, want %q %q %v", tt.content, res.Code, res.Service, res.TTL, tt.code, tt.service, tt.ttl)
+		}
+	}
+}
+
+func TestExtractNone(t *testing.T) {
+	config.Global = &config.Model{}
+	patterns = builtin
+	for _, content := range []string{
+		"",
+		"明天下午三点开会",
+		"您的快递已到驿站，请凭取件码取件",
+		"Your code is your password",
+		"Meeting moved to room 4012",
+	} {
+		if res := Extract(content); res != nil {
+			t.Errorf("Extract(%q) = %q", content, res.Code)
+		}
+	}
+}
+
+func TestCompilePatterns(t *testing.T) {
+	config.Global = &config.Model{}
+	ps, err := compilePatterns([]config.OTPPattern{{Regex: `ACME login: (?P<code>[0-9]{6})`, Service: "ACME"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != len(builtinPatterns)+1 {
+		t.Fatalf("%d patterns", len(ps))
+	}
+	patterns = ps
+	defer func() { patterns = builtin }()
+	// the configured pattern is tried first and names the service
+	if res := Extract("ACME login: 123456, your code is 654321"); res == nil || res.Code != "123456" || res.Service != "ACME" {
+		t.Fatalf("configured pattern %+v", res)
+	}
+
+	if _, err = compilePatterns([]config.OTPPattern{{Regex: `code: ([0-9]{6}`}}); err == nil {
+		t.Fatal("invalid pattern compiled")
+	}
+}
@@ -0,0 +1,80 @@
+package otp
+
+import (
+	"context"
+	"github.com/Akvicor/glog"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"sync"
+	"time"
+)
+
+var (
+	arrived     = make(chan struct{})
+	arrivedLock = sync.Mutex{}
+)
+
+// EnableOTP extracts verification codes from every inbound SMS
+func EnableOTP() {
+	if !config.Global.OTP.Enable {
+		return
+	}
+	var err error
+	if patterns, err = compilePatterns(config.Global.OTPPatterns); err != nil {
+		glog.Fatal("[otp] %v", err)
+	}
+	serial.OnReceived(receive)
+	glog.Info("OTP extraction started")
+}
+
+func receive(device string, historyID int64, sms *model.SMS) {
+	res := Extract(sms.Message)
+	if res == nil {
+		return
+	}
+	now := time.Now()
+	db.InsertOTP(&db.OTPModel{
+		HistoryID:  historyID,
+		Device:     device,
+		Phone:      sms.Phone,
+		Code:       res.Code,
+		Service:    res.Service,
+		ReceivedAt: now.Unix(),
+		ExpiresAt:  now.Add(res.TTL).Unix(),
+	})
+	glog.Info("[otp] [%s] code from %s [%s]", device, sms.Phone, res.Service)
+	notify()
+}
+
+// notify wakes every waiter by closing the current channel
+func notify() {
+	arrivedLock.Lock()
+	defer arrivedLock.Unlock()
+	close(arrived)
+	arrived = make(chan struct{})
+}
+
+func waitChan() chan struct{} {
+	arrivedLock.Lock()
+	defer arrivedLock.Unlock()
+	return arrived
+}
+
+// Wait returns the newest valid code matching device and sender received at or after since,
+// blocking until one arrives or ctx is done
+func Wait(ctx context.Context, device, sender string, since int64) *db.OTPModel {
+	for {
+		// take the channel before querying so a code stored in between still wakes us
+		ch := waitChan()
+		if otp := db.GetLatestOTP(device, sender, since, time.Now().Unix()); otp != nil {
+			return otp
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
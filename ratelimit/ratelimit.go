@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often buckets that filled up again are dropped
+const pruneInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets of the same rate, one per key
+type Limiter struct {
+	// perSecond is how fast tokens come back, burst is how many a bucket holds
+	perSecond float64
+	burst     float64
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	prune   time.Time
+}
+
+// New returns a limiter of perMinute requests with bursts of burst, nil when perMinute is 0
+// so an unset limit allows everything
+func New(perMinute, burst int) *Limiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &Limiter{
+		perSecond: float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		prune:     time.Now(),
+	}
+}
+
+// Allow takes a token of key. When the bucket is empty it returns false and how long until
+// the next token.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.prune) > pruneInterval {
+		// a bucket idle for longer than it takes to refill is full, a new one is the same
+		full := time.Duration(l.burst / l.perSecond * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.prune = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.perSecond * float64(time.Second))
+	return false, wait
+}
@@ -0,0 +1,45 @@
+package rule
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+const (
+	ActionForwardSMS = "forward_sms"
+)
+
+// Executor performs one type of rule action, config is the JSON stored with the action
+type Executor interface {
+	Validate(config string) error
+	// Render returns the payload Execute would deliver, without sending anything
+	Render(config string, msg *Message) (string, error)
+	Execute(config string, msg *Message) error
+}
+
+var executors = map[string]Executor{
+	ActionForwardSMS: &forwardExecutor{},
+}
+
+func getExecutor(typ string) (Executor, error) {
+	ex, ok := executors[typ]
+	if !ok {
+		return nil, fmt.Errorf("unsupported action type [%s]", typ)
+	}
+	return ex, nil
+}
+
+// renderTemplate renders tpl with the fields of msg, e.g. {{.Device}} {{.Phone}} {{.Content}}
+func renderTemplate(tpl string, msg *Message) (string, error) {
+	t, err := template.New("action").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, msg)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
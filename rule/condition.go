@@ -0,0 +1,158 @@
+package rule
+
+import (
+	"fmt"
+	"regexp"
+	"sms/db"
+	"strings"
+	"time"
+)
+
+const (
+	ConditionSender    = "sender"
+	ConditionContent   = "content"
+	ConditionDevice    = "device"
+	ConditionTimeRange = "time_range"
+)
+
+const (
+	OperatorEquals      = "equals"
+	OperatorContains    = "contains"
+	OperatorNotContains = "not_contains"
+	OperatorPrefix      = "prefix"
+	OperatorSuffix      = "suffix"
+	OperatorRegex       = "regex"
+	OperatorBetween     = "between"
+)
+
+// validateCondition reports whether a condition can be evaluated
+func validateCondition(cond *db.RuleConditionModel) error {
+	switch cond.Type {
+	case ConditionSender, ConditionContent, ConditionDevice:
+		switch cond.Operator {
+		case OperatorEquals, OperatorContains, OperatorNotContains, OperatorPrefix, OperatorSuffix:
+		case OperatorRegex:
+			if _, err := regexp.Compile(cond.Value); err != nil {
+				return fmt.Errorf("invalid regex [%s]: %v", cond.Value, err)
+			}
+		default:
+			return fmt.Errorf("unsupported operator [%s] for %s", cond.Operator, cond.Type)
+		}
+	case ConditionTimeRange:
+		if cond.Operator != OperatorBetween {
+			return fmt.Errorf("unsupported operator [%s] for %s", cond.Operator, cond.Type)
+		}
+		if _, _, err := parseTimeRange(cond.Value); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported condition type [%s]", cond.Type)
+	}
+	switch strings.ToUpper(cond.Logic) {
+	case "", db.RuleLogicAnd, db.RuleLogicOr:
+	default:
+		return fmt.Errorf("unsupported logic [%s]", cond.Logic)
+	}
+	return nil
+}
+
+// ConditionResult is the outcome of a single condition
+type ConditionResult struct {
+	Type     string `json:"type"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+	Logic    string `json:"logic"`
+	Matched  bool   `json:"matched"`
+}
+
+// matchConditions evaluates conditions left to right, each Logic joins a condition with the next one
+func matchConditions(conds []db.RuleConditionModel, msg *Message) (bool, []ConditionResult) {
+	results := make([]ConditionResult, 0, len(conds))
+	if len(conds) == 0 {
+		return true, results
+	}
+	result := false
+	logic := db.RuleLogicAnd
+	for i := range conds {
+		matched := matchCondition(&conds[i], msg)
+		results = append(results, ConditionResult{
+			Type:     conds[i].Type,
+			Operator: conds[i].Operator,
+			Value:    conds[i].Value,
+			Logic:    conds[i].Logic,
+			Matched:  matched,
+		})
+		if i == 0 {
+			result = matched
+		} else if logic == db.RuleLogicOr {
+			result = result || matched
+		} else {
+			result = result && matched
+		}
+		logic = strings.ToUpper(conds[i].Logic)
+	}
+	return result, results
+}
+
+func matchCondition(cond *db.RuleConditionModel, msg *Message) bool {
+	switch cond.Type {
+	case ConditionSender:
+		return matchString(cond.Operator, msg.Phone, cond.Value)
+	case ConditionContent:
+		return matchString(cond.Operator, msg.Content, cond.Value)
+	case ConditionDevice:
+		return matchString(cond.Operator, msg.Device, cond.Value)
+	case ConditionTimeRange:
+		start, end, err := parseTimeRange(cond.Value)
+		if err != nil {
+			return false
+		}
+		t := msg.ReceivedAt
+		minute := t.Hour()*60 + t.Minute()
+		if start <= end {
+			return minute >= start && minute <= end
+		}
+		// range wraps past midnight, e.g. 22:00-06:00
+		return minute >= start || minute <= end
+	}
+	return false
+}
+
+func matchString(operator, s, value string) bool {
+	switch operator {
+	case OperatorEquals:
+		return s == value
+	case OperatorContains:
+		return strings.Contains(s, value)
+	case OperatorNotContains:
+		return !strings.Contains(s, value)
+	case OperatorPrefix:
+		return strings.HasPrefix(s, value)
+	case OperatorSuffix:
+		return strings.HasSuffix(s, value)
+	case OperatorRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(s)
+	}
+	return false
+}
+
+// parseTimeRange parses "09:00-18:00" into minutes of the day
+func parseTimeRange(value string) (int, int, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid time range [%s]", value)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time range [%s]", value)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time range [%s]", value)
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), nil
+}
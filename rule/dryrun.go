@@ -0,0 +1,65 @@
+package rule
+
+import (
+	"fmt"
+	"sms/config"
+	"sms/db"
+	"time"
+)
+
+// TestResult holds the dry run of every tested rule against one message
+type TestResult struct {
+	Message *Message      `json:"message"`
+	Rules   []*RuleResult `json:"rules"`
+}
+
+// TestRule evaluates rule ruleID, or every enabled rule when ruleID is 0,
+// against msgs and renders the actions that would fire without sending anything
+func TestRule(ruleID int64, msgs []*Message) ([]*TestResult, error) {
+	var rules []db.RuleModel
+	if ruleID > 0 {
+		r := db.GetRule(ruleID)
+		if r == nil {
+			return nil, fmt.Errorf("rule %d not found", ruleID)
+		}
+		rules = []db.RuleModel{*r}
+	} else {
+		rules = db.GetAllRules(true)
+	}
+
+	results := make([]*TestResult, 0, len(msgs))
+	for _, msg := range msgs {
+		res := &TestResult{Message: msg, Rules: make([]*RuleResult, 0, len(rules))}
+		for i := range rules {
+			res.Rules = append(res.Rules, evaluate(&rules[i], msg, true))
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// HistoryMessages loads the latest n inbound messages from history as test samples
+func HistoryMessages(n int) []*Message {
+	devices := make([]string, 0, len(config.Global.SerialDevices))
+	for _, device := range config.Global.SerialDevices {
+		devices = append(devices, device.Name)
+	}
+
+	histories := db.GetLastReceivedHistories(devices, n)
+	msgs := make([]*Message, 0, len(histories))
+	for _, his := range histories {
+		t := ""
+		if his.Time != 0 {
+			t = time.Unix(his.Time, 0).Format("2006-01-02 15:04:05")
+		}
+		msgs = append(msgs, &Message{
+			HistoryID:  his.ID,
+			Device:     his.Sender,
+			Phone:      his.Phone,
+			Content:    his.Message,
+			Time:       t,
+			ReceivedAt: time.Unix(his.RecordTime, 0),
+		})
+	}
+	return msgs
+}
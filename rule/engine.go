@@ -0,0 +1,178 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"time"
+)
+
+// Message is an inbound SMS as seen by rule conditions and action templates
+type Message struct {
+	HistoryID  int64     `json:"history_id"`
+	Device     string    `json:"device"`
+	Phone      string    `json:"phone"`
+	Content    string    `json:"content"`
+	Time       string    `json:"time"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+func NewMessage(device string, historyID int64, sms *model.SMS) *Message {
+	return &Message{
+		HistoryID:  historyID,
+		Device:     device,
+		Phone:      sms.Phone,
+		Content:    sms.Message,
+		Time:       sms.Time,
+		ReceivedAt: time.Now(),
+	}
+}
+
+// ActionResult is what an action did, or would do during a dry run
+type ActionResult struct {
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	Payload string `json:"payload"`
+	Success bool   `json:"success"`
+	Latency int64  `json:"latency_ms"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RuleResult is the evaluation of one rule against one message
+type RuleResult struct {
+	RuleID     int64             `json:"rule_id"`
+	RuleName   string            `json:"rule_name"`
+	Matched    bool              `json:"matched"`
+	Reason     string            `json:"reason,omitempty"`
+	Conditions []ConditionResult `json:"conditions"`
+	Actions    []ActionResult    `json:"actions"`
+	Latency    int64             `json:"latency_ms"`
+}
+
+// EnableRules runs the forwarding rules for every inbound SMS
+func EnableRules() {
+	serial.OnReceived(func(device string, historyID int64, sms *model.SMS) {
+		Process(NewMessage(device, historyID, sms))
+	})
+	glog.Info("Rule engine started")
+}
+
+// Process runs every enabled rule bound to the message's device and records each evaluation
+func Process(msg *Message) {
+	for _, r := range db.GetAllRules(true) {
+		res := evaluate(&r, msg, false)
+		record(msg, res)
+		if !res.Matched {
+			continue
+		}
+		glog.Info("[rule] [%d][%s] matched sms from %s on %s", r.ID, r.Name, msg.Phone, msg.Device)
+		for _, action := range res.Actions {
+			if action.Error != "" {
+				glog.Warning("[rule] [%d][%s] action %s failed [%s]", r.ID, r.Name, action.Type, action.Error)
+			}
+		}
+	}
+}
+
+// record stores the outcome of a rule evaluation in the execution log
+func record(msg *Message, res *RuleResult) {
+	success := 0
+	errs := make([]string, 0)
+	for _, action := range res.Actions {
+		if action.Success {
+			success++
+		} else {
+			errs = append(errs, fmt.Sprintf("%s: %s", action.Type, action.Error))
+		}
+	}
+	actions, _ := json.Marshal(res.Actions)
+	db.InsertRuleLog(&db.RuleLogModel{
+		RuleID:          res.RuleID,
+		RuleName:        res.RuleName,
+		HistoryID:       msg.HistoryID,
+		Device:          msg.Device,
+		Phone:           msg.Phone,
+		Matched:         res.Matched,
+		ExecutedActions: len(res.Actions),
+		SuccessActions:  success,
+		Actions:         string(actions),
+		Error:           strings.Join(errs, "; "),
+		Latency:         res.Latency,
+	})
+}
+
+// evaluate matches a rule against msg and runs its enabled actions,
+// with dryRun the actions are only rendered
+func evaluate(r *db.RuleModel, msg *Message, dryRun bool) *RuleResult {
+	start := time.Now()
+	res := &RuleResult{
+		RuleID:     r.ID,
+		RuleName:   r.Name,
+		Conditions: make([]ConditionResult, 0),
+		Actions:    make([]ActionResult, 0),
+	}
+	if r.Device != "" && r.Device != msg.Device {
+		res.Reason = fmt.Sprintf("rule is bound to device %s", r.Device)
+		res.Latency = time.Since(start).Milliseconds()
+		return res
+	}
+	res.Matched, res.Conditions = matchConditions(r.Conditions, msg)
+	if !res.Matched {
+		res.Reason = "conditions not matched"
+		res.Latency = time.Since(start).Milliseconds()
+		return res
+	}
+
+	for _, action := range r.Actions {
+		if !action.Enabled {
+			continue
+		}
+		actionStart := time.Now()
+		ar := ActionResult{ID: action.ID, Type: action.Type}
+		ex, err := getExecutor(action.Type)
+		if err == nil {
+			ar.Payload, err = ex.Render(action.Config, msg)
+			if err == nil && !dryRun {
+				err = ex.Execute(action.Config, msg)
+			}
+		}
+		if err != nil {
+			ar.Error = err.Error()
+		} else {
+			ar.Success = true
+		}
+		ar.Latency = time.Since(actionStart).Milliseconds()
+		res.Actions = append(res.Actions, ar)
+	}
+	res.Latency = time.Since(start).Milliseconds()
+	return res
+}
+
+// Validate checks a rule before it is stored
+func Validate(r *db.RuleModel) error {
+	if strings.TrimSpace(r.Name) == "" {
+		return fmt.Errorf("missing rule name")
+	}
+	if r.Device != "" && serial.Manager != nil && serial.Manager.GetHandler(r.Device) == nil {
+		return fmt.Errorf("device %s not found", r.Device)
+	}
+	for i := range r.Conditions {
+		if err := validateCondition(&r.Conditions[i]); err != nil {
+			return err
+		}
+	}
+	for i := range r.Actions {
+		ex, err := getExecutor(r.Actions[i].Type)
+		if err != nil {
+			return err
+		}
+		if err = ex.Validate(r.Actions[i].Config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package rule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"sms/config"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"time"
+)
+
+const (
+	forwardSenderName      = "forward"
+	forwardDefaultTemplate = "[{{.Device}}] from {{.Phone}}: {{.Content}}"
+)
+
+// ForwardConfig relays an inbound SMS to other phones through Device,
+// which may differ from the device that received it
+type ForwardConfig struct {
+	Device   string   `json:"device"`
+	Phones   []string `json:"phones"`
+	Template string   `json:"template"`
+}
+
+func parseForwardConfig(data string) (*ForwardConfig, error) {
+	cfg := &ForwardConfig{}
+	err := json.Unmarshal([]byte(data), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward_sms config: %v", err)
+	}
+	if cfg.Template == "" {
+		cfg.Template = forwardDefaultTemplate
+	}
+	return cfg, nil
+}
+
+type forwardExecutor struct{}
+
+func (f *forwardExecutor) Validate(data string) error {
+	cfg, err := parseForwardConfig(data)
+	if err != nil {
+		return err
+	}
+	if cfg.Device == "" {
+		return errors.New("forward_sms: missing device")
+	}
+	if serial.Manager != nil && serial.Manager.GetHandler(cfg.Device) == nil {
+		return fmt.Errorf("forward_sms: device %s not found", cfg.Device)
+	}
+	if len(cfg.Phones) == 0 {
+		return errors.New("forward_sms: missing phones")
+	}
+	for _, phone := range cfg.Phones {
+		if strings.TrimSpace(phone) == "" {
+			return errors.New("forward_sms: empty phone")
+		}
+	}
+	_, err = renderTemplate(cfg.Template, &Message{})
+	if err != nil {
+		return fmt.Errorf("forward_sms: invalid template: %v", err)
+	}
+	return nil
+}
+
+func (f *forwardExecutor) Render(data string, msg *Message) (string, error) {
+	cfg, err := parseForwardConfig(data)
+	if err != nil {
+		return "", err
+	}
+	text, err := renderTemplate(cfg.Template, msg)
+	if err != nil {
+		return "", err
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"device":   cfg.Device,
+		"phones":   cfg.Phones,
+		"text":     text,
+		"segments": len(model.NewSMSLong("+0", text)),
+	})
+	if err = loopGuard.check(msg); err != nil {
+		return string(payload), err
+	}
+	return string(payload), nil
+}
+
+func (f *forwardExecutor) Execute(data string, msg *Message) error {
+	cfg, err := parseForwardConfig(data)
+	if err != nil {
+		return err
+	}
+	if err = loopGuard.check(msg); err != nil {
+		return err
+	}
+	text, err := renderTemplate(cfg.Template, msg)
+	if err != nil {
+		return err
+	}
+
+	loopGuard.remember(text)
+	// a failed phone does not stop the others, the rule log lists every failure
+	failed := make([]string, 0)
+	for _, phone := range cfg.Phones {
+		phone = strings.TrimSpace(phone)
+		_, err = serial.Send(cfg.Device, forwardSenderName, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(phone, text)))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("forward to %s via %s: %v", phone, cfg.Device, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// forwardLoopMinLength is the shortest forwarded text the loop guard looks for, a shorter one
+// would match ordinary messages
+const forwardLoopMinLength = 16
+
+// forwardLoopGuard stops gateways from forwarding each other's forwards forever
+type forwardLoopGuard struct {
+	recent *cache.Cache
+}
+
+var loopGuard = &forwardLoopGuard{
+	recent: cache.New(10*time.Minute, 20*time.Minute),
+}
+
+func (g *forwardLoopGuard) window() time.Duration {
+	if config.Global.Forward.LoopWindow > 0 {
+		return time.Duration(config.Global.Forward.LoopWindow) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// check rejects messages sent by a gateway SIM, and messages that carry a text this gateway
+// forwarded recently, with its template around the original content, which is what a forward
+// bounced back by a peer looks like. The original content alone is not enough, people quote it.
+func (g *forwardLoopGuard) check(msg *Message) error {
+	if isGatewayPhone(msg.Phone) {
+		return fmt.Errorf("loop protection: %s is a gateway number", msg.Phone)
+	}
+	for text := range g.recent.Items() {
+		if strings.Contains(msg.Content, text) {
+			return errors.New("loop protection: message is a forward of a recently forwarded message")
+		}
+	}
+	return nil
+}
+
+// remember keeps the rendered text of a forward for check, texts shorter than
+// forwardLoopMinLength are not kept
+func (g *forwardLoopGuard) remember(text string) {
+	text = strings.TrimSpace(text)
+	if len([]rune(text)) < forwardLoopMinLength {
+		return
+	}
+	g.recent.Set(text, struct{}{}, g.window())
+}
+
+// isGatewayPhone reports whether phone belongs to one of our devices or a configured peer gateway
+func isGatewayPhone(phone string) bool {
+	phones := make([]string, 0, len(config.Global.SerialDevices)+len(config.Global.Forward.PeerPhones))
+	for _, device := range config.Global.SerialDevices {
+		phones = append(phones, device.SelfPhone)
+	}
+	phones = append(phones, config.Global.Forward.PeerPhones...)
+	for _, p := range phones {
+		if model.SamePhone(phone, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+		"@never",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) accepted", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", utc(2024, 6, 1, 10, 7).Add(30 * time.Second), utc(2024, 6, 1, 10, 8)},
+		{"step", "*/15 * * * *", utc(2024, 6, 1, 10, 7), utc(2024, 6, 1, 10, 15)},
+		{"step from a value", "5/20 * * * *", utc(2024, 6, 1, 10, 30), utc(2024, 6, 1, 10, 45)},
+		{"range with step", "5-10/2 * * * *", utc(2024, 6, 1, 10, 7), utc(2024, 6, 1, 10, 9)},
+		{"list", "0 8,20 * * *", utc(2024, 6, 1, 10, 0), utc(2024, 6, 1, 20, 0)},
+		{"exact time is not next", "0 9 * * *", utc(2024, 6, 1, 9, 0), utc(2024, 6, 2, 9, 0)},
+		{"weekday names", "0 9 * * mon-fri", utc(2024, 6, 1, 10, 0), utc(2024, 6, 3, 9, 0)},
+		{"month names", "0 0 1 jan,jul *", utc(2024, 2, 1, 0, 0), utc(2024, 7, 1, 0, 0)},
+		{"7 is sunday", "0 0 * * 7", utc(2024, 6, 1, 10, 0), utc(2024, 6, 2, 0, 0)},
+		{"0 is sunday", "0 0 * * 0", utc(2024, 6, 1, 10, 0), utc(2024, 6, 2, 0, 0)},
+		{"day of month or weekday", "0 12 1 * mon", utc(2024, 6, 4, 0, 0), utc(2024, 6, 10, 12, 0)},
+		{"day of month or weekday, day of month first", "0 12 1 * mon", utc(2024, 6, 25, 0, 0), utc(2024, 7, 1, 12, 0)},
+		{"weekday restricts a * day of month", "0 12 * * mon", utc(2024, 6, 4, 0, 0), utc(2024, 6, 10, 12, 0)},
+		{"month without the day", "0 0 31 * *", utc(2024, 4, 1, 0, 0), utc(2024, 5, 31, 0, 0)},
+		{"year rollover", "0 0 1 1 *", utc(2024, 12, 15, 0, 0), utc(2025, 1, 1, 0, 0)},
+		{"leap day", "0 0 29 2 *", utc(2024, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		{"macro", "@hourly", utc(2024, 6, 1, 10, 59), utc(2024, 6, 1, 11, 0)},
+		{"never", "0 0 30 2 *", utc(2024, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%s: ParseCron(%q): %v", tt.name, tt.expr, err)
+			continue
+		}
+		if got := c.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%s: %q after %v = %v, want %v", tt.name, tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	at := func(month time.Month, day, hour, min int, zone string) time.Time {
+		offset := -4 * time.Hour
+		if zone == "EST" {
+			offset = -5 * time.Hour
+		}
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC).Add(-offset).In(ny)
+	}
+	// clocks go from 02:00 EST to 03:00 EDT on 2024-03-10 and from 02:00 EDT back to 01:00 EST on 2024-11-03
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"daily across spring forward", "0 9 * * *", at(3, 9, 12, 0, "EST"), at(3, 10, 9, 0, "EDT")},
+		{"skipped time does not run", "30 2 * * *", at(3, 9, 12, 0, "EST"), at(3, 11, 2, 30, "EDT")},
+		{"hourly across spring forward", "0 * * * *", at(3, 10, 1, 0, "EST"), at(3, 10, 3, 0, "EDT")},
+		{"repeated time runs once", "30 1 * * *", at(11, 3, 1, 30, "EDT"), at(11, 4, 1, 30, "EST")},
+		{"daily across fall back", "0 9 * * *", at(11, 2, 12, 0, "EDT"), at(11, 3, 9, 0, "EST")},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: ParseCron(%q): %v", tt.name, tt.expr, err)
+		}
+		done := make(chan time.Time, 1)
+		go func() { done <- c.Next(tt.from) }()
+		select {
+		case got := <-done:
+			if !got.Equal(tt.want) {
+				t.Errorf("%s: %q after %v = %v, want %v", tt.name, tt.expr, tt.from, got, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: %q after %v does not return", tt.name, tt.expr, tt.from)
+		}
+	}
+}
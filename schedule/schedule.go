@@ -0,0 +1,262 @@
+package schedule
+
+import (
+	"fmt"
+	"github.com/Akvicor/glog"
+	"sms/apikey"
+	"sms/callback"
+	"sms/db"
+	"sms/serial"
+	"strings"
+	"time"
+)
+
+const senderPrefix = "schedule-"
+
+var stop chan struct{}
+
+// Schedule is a scheduled message as submitted by a user. A one-off message sets SendAt,
+// a recurring one sets Cron and runs from SendAt (or now) on.
+type Schedule struct {
+	Name    string
+	Device  string
+	Sender  string
+	Phone   string
+	Message string
+	Cron    string
+	SendAt  int64
+	// StatusCallback is registered for every message the schedule sends
+	StatusCallback string
+	// APIKeyID is the key the schedule was created with, 0 for a login session
+	APIKeyID int64
+}
+
+// EnableScheduler starts the worker that sends due schedules, schedules live in the
+// database so they survive a restart. A run missed while stopped is sent once on start.
+func EnableScheduler() {
+	stop = make(chan struct{})
+	go run(stop)
+}
+
+func KillScheduler() {
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+// validate checks s and returns its first run time
+func validate(s *Schedule, now time.Time) (int64, error) {
+	if strings.TrimSpace(s.Phone) == "" {
+		return 0, fmt.Errorf("phone is required")
+	}
+	if strings.TrimSpace(s.Message) == "" {
+		return 0, fmt.Errorf("message is required")
+	}
+	if s.Device != "" && !serial.Exists(s.Device) {
+		return 0, fmt.Errorf("unknown device or pool [%s]", s.Device)
+	}
+	if s.Device == "" {
+		if _, _, err := serial.Route(s.Phone); err != nil {
+			return 0, err
+		}
+	}
+	if s.StatusCallback != "" {
+		if err := callback.Validate(s.StatusCallback); err != nil {
+			return 0, err
+		}
+	}
+	if s.Cron == "" {
+		if s.SendAt <= now.Unix() {
+			return 0, fmt.Errorf("send_at must be in the future")
+		}
+		return s.SendAt, nil
+	}
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cron: %v", err)
+	}
+	from := now
+	if s.SendAt > now.Unix() {
+		from = time.Unix(s.SendAt, 0).Add(-time.Minute)
+	}
+	next := c.Next(from)
+	if next.IsZero() {
+		return 0, fmt.Errorf("cron never matches")
+	}
+	return next.Unix(), nil
+}
+
+// Create validates a schedule and stores it as active
+func Create(s *Schedule) (int64, error) {
+	next, err := validate(s, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if s.Name == "" {
+		s.Name = s.Phone
+	}
+	id := db.InsertSchedule(&db.ScheduleModel{
+		Name:           s.Name,
+		Device:         s.Device,
+		Sender:         s.Sender,
+		Phone:          s.Phone,
+		Message:        s.Message,
+		Cron:           s.Cron,
+		Status:         db.ScheduleActive,
+		NextRun:        next,
+		StatusCallback: s.StatusCallback,
+		APIKeyID:       s.APIKeyID,
+	})
+	if id < 0 {
+		return 0, fmt.Errorf("insert schedule failed")
+	}
+	glog.Info("[schedule] created [%d] %s next run %s", id, s.Name, time.Unix(next, 0).Format(time.RFC3339))
+	return id, nil
+}
+
+// Update replaces a schedule, a done one-off schedule becomes active again
+func Update(id int64, s *Schedule) error {
+	old := db.GetSchedule(id)
+	if old == nil {
+		return fmt.Errorf("schedule not found")
+	}
+	next, err := validate(s, time.Now())
+	if err != nil {
+		return err
+	}
+	if s.Name == "" {
+		s.Name = s.Phone
+	}
+	old.Name = s.Name
+	old.Device = s.Device
+	old.Sender = s.Sender
+	old.Phone = s.Phone
+	old.Message = s.Message
+	old.Cron = s.Cron
+	old.StatusCallback = s.StatusCallback
+	old.NextRun = next
+	if old.Status == db.ScheduleDone {
+		old.Status = db.ScheduleActive
+	}
+	if !db.UpdateSchedule(old) {
+		return fmt.Errorf("update schedule failed")
+	}
+	return nil
+}
+
+// Pause stops an active schedule until it is resumed
+func Pause(id int64) error {
+	s := db.GetSchedule(id)
+	if s == nil {
+		return fmt.Errorf("schedule not found")
+	}
+	if s.Status != db.ScheduleActive {
+		return fmt.Errorf("schedule is %s", s.Status)
+	}
+	s.Status = db.SchedulePaused
+	if !db.UpdateSchedule(s) {
+		return fmt.Errorf("update schedule failed")
+	}
+	return nil
+}
+
+// Resume continues a paused schedule, a recurring one skips the runs it missed while paused
+func Resume(id int64) error {
+	s := db.GetSchedule(id)
+	if s == nil {
+		return fmt.Errorf("schedule not found")
+	}
+	if s.Status != db.SchedulePaused {
+		return fmt.Errorf("schedule is %s", s.Status)
+	}
+	if s.Cron != "" {
+		c, err := ParseCron(s.Cron)
+		if err != nil {
+			return fmt.Errorf("invalid cron: %v", err)
+		}
+		if now := time.Now(); s.NextRun < now.Unix() {
+			s.NextRun = c.Next(now).Unix()
+		}
+	}
+	s.Status = db.ScheduleActive
+	if !db.UpdateSchedule(s) {
+		return fmt.Errorf("update schedule failed")
+	}
+	return nil
+}
+
+func Delete(id int64) error {
+	if !db.DeleteSchedule(id) {
+		return fmt.Errorf("schedule not found")
+	}
+	return nil
+}
+
+func run(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tick(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// tick sends every due schedule once, however many runs were missed, and moves it to its next run
+func tick(now time.Time) {
+	for _, s := range db.GetDueSchedules(now.Unix()) {
+		s := s
+		send(&s, now)
+		s.LastRun = now.Unix()
+		s.RunCount++
+		if s.Cron == "" {
+			s.Status = db.ScheduleDone
+		} else if c, err := ParseCron(s.Cron); err != nil {
+			glog.Warning("[schedule] [%d] invalid cron [%s] %v", s.ID, s.Cron, err)
+			s.Status = db.SchedulePaused
+		} else if next := c.Next(now); next.IsZero() {
+			s.Status = db.ScheduleDone
+		} else {
+			s.NextRun = next.Unix()
+		}
+		db.UpdateSchedule(&s)
+	}
+}
+
+func send(s *db.ScheduleModel, now time.Time) {
+	sender := s.Sender
+	if sender == "" {
+		sender = fmt.Sprintf("%s%d", senderPrefix, s.ID)
+	}
+	run := &db.ScheduleRunModel{ScheduleID: s.ID, RunAt: now.Unix()}
+	if s.APIKeyID != 0 {
+		if err := apikey.ConsumeID(s.APIKeyID, 1); err != nil {
+			run.Error = err.Error()
+			glog.Warning("[schedule] [%d] skipped send to %s [%v]", s.ID, s.Phone, err)
+			db.InsertScheduleRun(run)
+			return
+		}
+	}
+	device, _, ids, err := serial.SendTo(s.Device, sender, s.Phone, s.Message)
+	if err != nil {
+		if s.APIKeyID != 0 {
+			apikey.RefundID(s.APIKeyID, 1)
+		}
+		run.Error = err.Error()
+		glog.Warning("[schedule] [%d] send to %s failed [%v]", s.ID, s.Phone, err)
+	} else {
+		run.Device = device
+		run.HistoryIDs = db.JoinIDs(ids)
+		if s.StatusCallback != "" && len(ids) > 0 {
+			if err = callback.Register(ids[0], s.StatusCallback); err != nil {
+				glog.Warning("[schedule] [%d] register status callback failed [%v]", s.ID, err)
+			}
+		}
+		glog.Info("[schedule] [%d] sent to %s via %s", s.ID, s.Phone, device)
+	}
+	db.InsertScheduleRun(run)
+}
@@ -0,0 +1,117 @@
+package serial
+
+import (
+	"github.com/Akvicor/glog"
+	"sms/model"
+	"sync"
+)
+
+// ReceivedHandler is called after an inbound SMS has been stored in history
+type ReceivedHandler func(device string, historyID int64, sms *model.SMS)
+
+// TelemetryHandler is called when a device reports its radio status
+type TelemetryHandler func(device string, telemetry *model.Telemetry)
+
+// AlertHandler is called with a human readable alert, e.g. when a pool has no healthy device
+type AlertHandler func(text string)
+
+// StatusHandler is called when an outbound message changes state, status is one of the db.Message* states
+type StatusHandler func(device string, historyID int64, status string)
+
+// FilterHandler decides whether an inbound SMS is spam before it is stored
+type FilterHandler func(device string, sms *model.SMS) (spam bool, reason string)
+
+var (
+	filterHandler     FilterHandler
+	filterLock        = sync.RWMutex{}
+	receivedHandlers  = make([]ReceivedHandler, 0)
+	receivedLock      = sync.RWMutex{}
+	telemetryHandlers = make([]TelemetryHandler, 0)
+	telemetryLock     = sync.RWMutex{}
+	alertHandlers     = make([]AlertHandler, 0)
+	alertLock         = sync.RWMutex{}
+	statusHandlers    = make([]StatusHandler, 0)
+	statusLock        = sync.RWMutex{}
+)
+
+// SetFilter installs the inbound filter, spam is stored in the spam folder and not passed to received handlers
+func SetFilter(handler FilterHandler) {
+	filterLock.Lock()
+	defer filterLock.Unlock()
+	filterHandler = handler
+}
+
+func runFilter(device string, sms *model.SMS) (bool, string) {
+	filterLock.RLock()
+	defer filterLock.RUnlock()
+	if filterHandler == nil {
+		return false, ""
+	}
+	return filterHandler(device, sms)
+}
+
+// Release passes a stored message that was held as spam to the received handlers
+func Release(device string, historyID int64, sms *model.SMS) {
+	notifyReceived(device, historyID, sms)
+}
+
+// OnReceived registers a handler for inbound SMS on every device
+func OnReceived(handler ReceivedHandler) {
+	receivedLock.Lock()
+	defer receivedLock.Unlock()
+	receivedHandlers = append(receivedHandlers, handler)
+}
+
+func notifyReceived(device string, historyID int64, sms *model.SMS) {
+	receivedLock.RLock()
+	defer receivedLock.RUnlock()
+	for _, handler := range receivedHandlers {
+		go handler(device, historyID, sms)
+	}
+}
+
+// OnTelemetry registers a handler for telemetry reports on every device
+func OnTelemetry(handler TelemetryHandler) {
+	telemetryLock.Lock()
+	defer telemetryLock.Unlock()
+	telemetryHandlers = append(telemetryHandlers, handler)
+}
+
+func notifyTelemetry(device string, telemetry *model.Telemetry) {
+	telemetryLock.RLock()
+	defer telemetryLock.RUnlock()
+	for _, handler := range telemetryHandlers {
+		go handler(device, telemetry)
+	}
+}
+
+// OnAlert registers a handler for gateway alerts
+func OnAlert(handler AlertHandler) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+	alertHandlers = append(alertHandlers, handler)
+}
+
+func notifyAlert(text string) {
+	glog.Error("[alert] %s", text)
+	alertLock.RLock()
+	defer alertLock.RUnlock()
+	for _, handler := range alertHandlers {
+		go handler(text)
+	}
+}
+
+// OnStatus registers a handler for state changes of outbound messages on every device
+func OnStatus(handler StatusHandler) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	statusHandlers = append(statusHandlers, handler)
+}
+
+func notifyStatus(device string, historyID int64, status string) {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+	for _, handler := range statusHandlers {
+		go handler(device, historyID, status)
+	}
+}
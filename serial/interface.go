@@ -9,10 +9,12 @@ type SerialHandlerInterface interface {
 	Init() error
 	Start() error
 	Stop() error
-	Send(sender string, msg []*model.MSG) error
+	Send(sender string, msg []*model.MSG) ([]int64, error)
 	GetName() string
 	GetPhone() string
 	IsAlive() bool
+	GetTelemetry() *model.Telemetry
+	Health() string
 }
 
 type SerialConfig struct {
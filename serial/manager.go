@@ -41,9 +41,18 @@ func EnableSerial() {
 	}
 
 	glog.Info("All serial handlers started successfully")
+
+	if len(config.Global.Pools) > 0 {
+		poolMonitorStop = make(chan struct{})
+		go monitorPools(poolMonitorStop)
+	}
 }
 
 func KillSerial() {
+	if poolMonitorStop != nil {
+		close(poolMonitorStop)
+		poolMonitorStop = nil
+	}
 	if Manager != nil {
 		if err := Manager.StopAll(); err != nil {
 			glog.Error("Failed to stop serial handlers: %v", err)
@@ -51,18 +60,15 @@ func KillSerial() {
 	}
 }
 
-func Send(deviceName string, sender string, msg []*model.MSG) error {
-	handler := Manager.GetHandler(deviceName)
-	if handler == nil {
-		return fmt.Errorf("device %s not found", deviceName)
-	}
-
-	return handler.Send(sender, msg)
+// Send queues msg on a device or pool, failing over within its pool, and returns the history id of every message
+func Send(deviceName string, sender string, msg []*model.MSG) ([]int64, error) {
+	_, ids, err := SendFailover(deviceName, sender, msg)
+	return ids, err
 }
 
 func SendToAll(sender string, msg []*model.MSG) {
 	for name, handler := range Manager.GetAllHandlers() {
-		if err := handler.Send(sender, msg); err != nil {
+		if _, err := handler.Send(sender, msg); err != nil {
 			glog.Error("Failed to send to %s: %v", name, err)
 		}
 	}
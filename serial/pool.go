@@ -0,0 +1,174 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"time"
+)
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrDeviceOffline  = errors.New("device offline")
+	ErrPoolUnhealthy  = errors.New("no healthy device in pool")
+	ErrNoRoute        = errors.New("no route")
+)
+
+var poolMonitorStop chan struct{}
+
+// PoolStatus is the health of a pool and its members, an empty health means healthy
+type PoolStatus struct {
+	Name    string            `json:"name"`
+	Healthy bool              `json:"healthy"`
+	Devices map[string]string `json:"devices"`
+}
+
+// GetPool returns the pool called name, nil if there is none
+func GetPool(name string) *config.Pool {
+	for i := range config.Global.Pools {
+		if config.Global.Pools[i].Name == name {
+			return &config.Global.Pools[i]
+		}
+	}
+	return nil
+}
+
+// poolOf returns the first pool device belongs to
+func poolOf(device string) *config.Pool {
+	for i := range config.Global.Pools {
+		for _, member := range config.Global.Pools[i].Devices {
+			if member == device {
+				return &config.Global.Pools[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Exists reports whether name is a device or a pool
+func Exists(name string) bool {
+	return Manager.GetHandler(name) != nil || GetPool(name) != nil
+}
+
+// nextHealthy returns the first healthy pool member after device, wrapping around, nil if none
+func nextHealthy(pool *config.Pool, device string) SerialHandlerInterface {
+	start := 0
+	for i, member := range pool.Devices {
+		if member == device {
+			start = i + 1
+			break
+		}
+	}
+	for i := 0; i < len(pool.Devices); i++ {
+		member := pool.Devices[(start+i)%len(pool.Devices)]
+		if member == device {
+			continue
+		}
+		if handler := Manager.GetHandler(member); handler != nil && handler.Health() == "" {
+			return handler
+		}
+	}
+	return nil
+}
+
+// SendFailover queues msg on name, which is a device or a pool. An unhealthy device is replaced by
+// the next healthy member of its pool. It returns the device used and the history ids.
+func SendFailover(name string, sender string, msg []*model.MSG) (string, []int64, error) {
+	if pool := GetPool(name); pool != nil {
+		handler := nextHealthy(pool, "")
+		if handler == nil {
+			return "", nil, fmt.Errorf("%w [%s]", ErrPoolUnhealthy, name)
+		}
+		ids, err := handler.Send(sender, msg)
+		return handler.GetName(), ids, err
+	}
+
+	handler := Manager.GetHandler(name)
+	if handler == nil {
+		return "", nil, fmt.Errorf("%w [%s]", ErrDeviceNotFound, name)
+	}
+	if health := handler.Health(); health != "" {
+		if pool := poolOf(name); pool != nil {
+			if next := nextHealthy(pool, name); next != nil {
+				glog.Warning("[%s] %s, sending via %s", name, health, next.GetName())
+				ids, err := next.Send(sender, msg)
+				return next.GetName(), ids, err
+			}
+		}
+	}
+	ids, err := handler.Send(sender, msg)
+	return name, ids, err
+}
+
+// reroute moves a pending message from an unhealthy device to the next healthy member of its pool
+// and links the history rows, it returns false when there is nowhere to go
+func reroute(from string, sender string, msg *model.MSG, id int64) bool {
+	pool := poolOf(from)
+	if pool == nil {
+		return false
+	}
+	next := nextHealthy(pool, from)
+	if next == nil {
+		return false
+	}
+	ids, err := next.Send(sender, model.NewMSG(model.MsgTagSmsSend, []*model.SMS{msg.SMS}))
+	if err != nil || len(ids) == 0 {
+		glog.Warning("[%s] reroute message %d to %s failed [%v]", from, id, next.GetName(), err)
+		return false
+	}
+	db.UpdateHistoryRerouted(id, next.GetName(), ids[0])
+	glog.Warning("[%s] message %d rerouted to %s as %d", from, id, next.GetName(), ids[0])
+	return true
+}
+
+// GetPoolStatus returns the health of every configured pool
+func GetPoolStatus() []PoolStatus {
+	status := make([]PoolStatus, 0, len(config.Global.Pools))
+	for _, pool := range config.Global.Pools {
+		ps := PoolStatus{Name: pool.Name, Devices: make(map[string]string)}
+		for _, member := range pool.Devices {
+			handler := Manager.GetHandler(member)
+			if handler == nil {
+				ps.Devices[member] = ErrDeviceNotFound.Error()
+				continue
+			}
+			health := handler.Health()
+			ps.Devices[member] = health
+			if health == "" {
+				ps.Healthy = true
+			}
+		}
+		status = append(status, ps)
+	}
+	return status
+}
+
+// monitorPools alerts once when a pool loses its last healthy member and once when it recovers
+func monitorPools(stop chan struct{}) {
+	interval := time.Duration(config.Global.Routing.HealthInterval) * time.Second
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	down := make(map[string]bool)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, ps := range GetPoolStatus() {
+				if !ps.Healthy && !down[ps.Name] {
+					down[ps.Name] = true
+					notifyAlert(fmt.Sprintf("pool %s has no healthy device %v", ps.Name, ps.Devices))
+				} else if ps.Healthy && down[ps.Name] {
+					down[ps.Name] = false
+					notifyAlert(fmt.Sprintf("pool %s recovered", ps.Name))
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package serial
+
+import (
+	"fmt"
+	"sms/config"
+	"sms/model"
+	"strings"
+)
+
+// How Route picked a device
+const (
+	RouteExplicit = "explicit"
+	RoutePrefix   = "prefix"
+	RouteRegion   = "region"
+	RouteDefault  = "default"
+	RouteFailover = "failover"
+)
+
+// regionCallingCodes maps a device region to the calling code of its SIM
+var regionCallingCodes = map[string]string{
+	"cn": "86",
+	"hk": "852",
+	"mo": "853",
+	"tw": "886",
+	"us": "1",
+	"ca": "1",
+	"jp": "81",
+	"kr": "82",
+	"sg": "65",
+	"my": "60",
+	"th": "66",
+	"vn": "84",
+	"ph": "63",
+	"id": "62",
+	"in": "91",
+	"au": "61",
+	"nz": "64",
+	"gb": "44",
+	"uk": "44",
+	"de": "49",
+	"fr": "33",
+	"it": "39",
+	"es": "34",
+	"nl": "31",
+	"ru": "7",
+	"br": "55",
+	"mx": "52",
+}
+
+// Route picks the device or pool that sends to phone. The longest matching [route-N] prefix wins,
+// then a device whose region calling code matches the number (healthy devices first),
+// then [routing] default_device.
+func Route(phone string) (device string, route string, err error) {
+	digits := model.PhoneDigits(model.InternationalPhone(strings.TrimSpace(phone)))
+	if digits == "" {
+		return "", "", fmt.Errorf("%w: invalid phone number", ErrNoRoute)
+	}
+
+	best := ""
+	for _, r := range config.Global.Routes {
+		prefix := model.PhoneDigits(r.Prefix)
+		if prefix == "" || !strings.HasPrefix(digits, prefix) || len(prefix) <= len(best) {
+			continue
+		}
+		if !Exists(r.Device) {
+			continue
+		}
+		best = prefix
+		device = r.Device
+	}
+	if device != "" {
+		return device, RoutePrefix, nil
+	}
+
+	best = ""
+	online := false
+	for _, dev := range config.Global.SerialDevices {
+		code := regionCallingCodes[strings.ToLower(dev.Region)]
+		if code == "" || !strings.HasPrefix(digits, code) || len(code) < len(best) {
+			continue
+		}
+		handler := Manager.GetHandler(dev.Name)
+		if handler == nil {
+			continue
+		}
+		alive := handler.Health() == ""
+		if len(code) == len(best) && (online || !alive) {
+			continue
+		}
+		best = code
+		online = alive
+		device = dev.Name
+	}
+	if device != "" {
+		return device, RouteRegion, nil
+	}
+
+	device = config.Global.Routing.DefaultDevice
+	if device != "" && Exists(device) {
+		return device, RouteDefault, nil
+	}
+
+	return "", "", fmt.Errorf("%w to %s", ErrNoRoute, phone)
+}
+
+// SendTo queues message for phone on device, routing by phone when device is empty.
+// It returns the device used, how it was picked and the history ids.
+func SendTo(device, sender, phone, message string) (string, string, []int64, error) {
+	route := RouteExplicit
+	if device == "" {
+		var err error
+		device, route, err = Route(phone)
+		if err != nil {
+			return "", "", nil, err
+		}
+	}
+	used, ids, err := SendFailover(device, sender, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(phone, message)))
+	if err != nil {
+		return "", route, nil, err
+	}
+	if used != device && route == RouteExplicit {
+		route = RouteFailover
+	}
+	return used, route, ids, nil
+}
@@ -4,23 +4,30 @@ import (
 	"fmt"
 	"github.com/Akvicor/glog"
 	"github.com/Akvicor/protocol"
-	"github.com/Akvicor/util"
 	"github.com/patrickmn/go-cache"
 	"github.com/tarm/serial"
+	"sms/audit"
+	"sms/config"
 	"sms/db"
 	"sms/model"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // SerialHandler handles communication with an Air780E module via serial port
 type SerialHandler struct {
-	config      *SerialConfig
-	conn        *serial.Port
-	protocol    *protocol.Protocol
-	sentCache   *cache.Cache
-	sentMap     *SyncMap
-	isRunning   bool
+	config            *SerialConfig
+	conn              *serial.Port
+	protocol          *protocol.Protocol
+	sentCache         *cache.Cache
+	sentMap           *SyncMap
+	isRunning         bool
+	telemetry         *model.Telemetry
+	lock              sync.RWMutex
+	heartbeatFailedAt int64
+	missedAcks        int32
+	ackMissedAt       int64
 }
 
 // NewSerialHandler creates a new serial handler
@@ -64,12 +71,13 @@ func (h *SerialHandler) Start() error {
 		return err
 	}
 
-	h.protocol.SetHeartbeatInterval(uint8(h.config.HeartbeatSendInterval))
-	h.protocol.SetHeartbeatTimeout(uint8(h.config.HeartbeatReceiveTimeout))
+	h.protocol.SetHeartbeatInterval(uint8(h.config.HeartbeatSendInterval / time.Second))
+	h.protocol.SetHeartbeatTimeout(uint8(h.config.HeartbeatReceiveTimeout / time.Second))
 	h.protocol.Connect(true)
 	h.isRunning = true
 
 	glog.Info("Serial handler %s started on %s", h.config.Name, h.config.DevicePath)
+	audit.Record(audit.System, "device.start", "device:"+h.config.Name, nil, map[string]string{"path": h.config.DevicePath})
 	return nil
 }
 
@@ -86,69 +94,94 @@ func (h *SerialHandler) Stop() error {
 	h.isRunning = false
 
 	glog.Info("Serial handler %s stopped", h.config.Name)
+	audit.Record(audit.System, "device.stop", "device:"+h.config.Name, nil, nil)
 	return nil
 }
 
-// Send sends messages via serial port
-func (h *SerialHandler) Send(sender string, msgs []*model.MSG) error {
+// Send stores messages in history and sends them via serial port in the background,
+// returning the history id of every message
+func (h *SerialHandler) Send(sender string, msgs []*model.MSG) ([]int64, error) {
 	if !h.isRunning {
-		return fmt.Errorf("serial handler %s is not running", h.config.Name)
+		return nil, fmt.Errorf("%w [%s]", ErrDeviceOffline, h.config.Name)
 	}
 
+	ids := make([]int64, 0, len(msgs))
+	duplicates := make([]bool, 0, len(msgs))
 	for _, msg := range msgs {
-		go h.sendSingle(sender, msg)
-	}
-	return nil
-}
+		// Check for duplicate
+		cacheKey := msg.SMS.Phone + msg.SMS.Message
+		_, isDuplicate := h.sentCache.Get(cacheKey)
+		if isDuplicate {
+			msg.SMS.Time = "D:" + msg.SMS.Time
+			msg.GenerateMd5()
+		} else {
+			h.sentCache.Set(cacheKey, struct{}{}, 5*time.Minute)
+		}
 
-// sendSingle sends a single message with retry logic
-func (h *SerialHandler) sendSingle(sender string, msg *model.MSG) {
-	// Check for duplicate
-	cacheKey := msg.SMS.Phone + msg.SMS.Message
-	_, isDuplicate := h.sentCache.Get(cacheKey)
-	if isDuplicate {
-		msg.SMS.Time = "D:" + msg.SMS.Time
-		msg.GenerateMd5()
-	} else {
-		h.sentCache.Set(cacheKey, struct{}{}, 5*time.Minute)
+		// Insert into history
+		id := db.InsertSentHistory(h.config.Region, h.config.Name, sender, msg.SMS, msg.Md5)
+		ids = append(ids, id)
+		duplicates = append(duplicates, isDuplicate)
 	}
+	// the segments are one logical message, link them before any of them changes state
+	db.LinkHistorySegments(ids)
+	for i, msg := range msgs {
+		notifyStatus(h.config.Name, ids[i], db.MessageQueued)
+		go h.sendSingle(sender, msg, ids[i], duplicates[i])
+	}
+	return ids, nil
+}
 
-	// Insert into history
-	id := db.InsertHistory(h.config.Region, sender, msg.SMS)
-
+// sendSingle writes a message and rewrites it every 30s until the module ACKs it. When the device
+// turns unhealthy while the message is pending, it is rerouted to another member of its pool.
+func (h *SerialHandler) sendSingle(sender string, msg *model.MSG, id int64, isDuplicate bool) {
 	// Send with retry if not duplicate
 	if !isDuplicate {
 		c := h.sentMap.Put(msg.Md5)
-		send := func() {
+		send := func() bool {
 			err := h.protocol.Write(msg.Bytes())
 			for err != nil {
+				if h.Health() != "" && reroute(h.config.Name, sender, msg, id) {
+					h.sentMap.Delete(msg.Md5)
+					return false
+				}
 				time.Sleep(3 * time.Second)
 				err = h.protocol.Write(msg.Bytes())
 			}
+			return true
 		}
 
-		send()
+		if !send() {
+			return
+		}
 
 		// Retry logic
 		go func() {
-			retry := 0
-			for {
+			for retry := 0; retry <= 10; retry++ {
 				select {
 				case <-time.After(30 * time.Second):
-					send()
+					h.missAck()
+					if h.Health() != "" && reroute(h.config.Name, sender, msg, id) {
+						h.sentMap.Delete(msg.Md5)
+						return
+					}
+					if !send() {
+						return
+					}
 				case <-c:
 					return
 				}
-				retry++
-				if retry > 10 {
-					break
-				}
+			}
+			h.sentMap.Delete(msg.Md5)
+			if db.UpdateHistoryFailed(id, "no ACK from module") {
+				notifyStatus(h.config.Name, id, db.MessageFailed)
 			}
 		}()
 	}
 
 	// Update history status
 	db.UpdateHistorySent(id)
+	notifyStatus(h.config.Name, id, db.MessageWritten)
 	glog.Trace("[%s] [Send] Sender:[%s] Message:[%s]", h.config.Name, sender, msg.String())
 }
 
@@ -167,9 +200,46 @@ func (h *SerialHandler) IsAlive() bool {
 	return h.isRunning && h.protocol != nil
 }
 
+// GetTelemetry returns the last radio status reported by the module, nil if none yet
+func (h *SerialHandler) GetTelemetry() *model.Telemetry {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.telemetry
+}
+
+// Health returns why the device should not be used for sending, empty when it is healthy
+func (h *SerialHandler) Health() string {
+	if !h.IsAlive() {
+		return "offline"
+	}
+	if failed := atomic.LoadInt64(&h.heartbeatFailedAt); failed > 0 && h.protocol.GetHeartbeatLastReceived() < failed {
+		return "heartbeat timeout"
+	}
+	max := config.Global.Routing.MaxMissedAcks
+	if max <= 0 {
+		max = 3
+	}
+	cooldown := int64(config.Global.Routing.AckCooldown)
+	if cooldown <= 0 {
+		cooldown = 300
+	}
+	if missed := int(atomic.LoadInt32(&h.missedAcks)); missed >= max && time.Now().Unix()-atomic.LoadInt64(&h.ackMissedAt) < cooldown {
+		return fmt.Sprintf("%d ACKs missed", missed)
+	}
+	return ""
+}
+
+// missAck counts a message that was not ACKed in time, any ACK resets the count
+func (h *SerialHandler) missAck() {
+	missed := atomic.AddInt32(&h.missedAcks, 1)
+	atomic.StoreInt64(&h.ackMissedAt, time.Now().Unix())
+	glog.Debug("[%s] ACK missed, %d in a row", h.config.Name, missed)
+}
+
 // heartbeatFailed handles heartbeat failure
 func (h *SerialHandler) heartbeatFailed(p *protocol.Protocol) bool {
 	glog.Trace("[%s] heartbeat failed", p.GetTag())
+	atomic.StoreInt64(&h.heartbeatFailedAt, time.Now().Unix())
 	return true
 }
 
@@ -186,6 +256,10 @@ func (h *SerialHandler) readCallback(data []byte) {
 		h.handleReceivedSMS(msg)
 	case model.MsgTagSmsACK:
 		h.handleACK(msg)
+	case model.MsgTagTelemetry:
+		h.handleTelemetry(msg)
+	case model.MsgTagSmsReport:
+		h.handleReport(msg)
 	default:
 		glog.Debug("[%s] unknown message tag: %d", h.config.Name, msg.Tag)
 	}
@@ -200,10 +274,13 @@ func (h *SerialHandler) handleReceivedSMS(msg *model.MSG) {
 	}
 
 	glog.Info("[%s] received SMS from %s: %s", h.config.Name, sms.Phone, sms.Message)
-	db.InsertHistory(h.config.Region, h.config.Name, sms)
-
-	// Process commands
-	h.processCommands(sms)
+	if spam, reason := runFilter(h.config.Name, sms); spam {
+		db.InsertReceivedHistory(h.config.Region, h.config.Name, sms, true, reason)
+		glog.Info("[%s] SMS from %s moved to spam [%s]", h.config.Name, sms.Phone, reason)
+		return
+	}
+	id := db.InsertReceivedHistory(h.config.Region, h.config.Name, sms, false, "")
+	notifyReceived(h.config.Name, id, sms)
 }
 
 // handleACK handles acknowledgment messages
@@ -215,42 +292,47 @@ func (h *SerialHandler) handleACK(msg *model.MSG) {
 	}
 
 	h.sentMap.Trick(ack.Key)
+	atomic.StoreInt32(&h.missedAcks, 0)
+	if id := db.UpdateHistoryAck(ack.Key); id > 0 {
+		notifyStatus(h.config.Name, id, db.MessageAcked)
+	}
 	glog.Info("[%s] SMS sent successfully: %s", h.config.Name, ack.Key)
 }
 
-// processCommands processes SMS commands
-func (h *SerialHandler) processCommands(sms *model.SMS) {
-	isSelfPhone := strings.Contains(sms.Phone, h.config.SelfPhone)
-
-	switch sms.Message {
-	case "hello":
-		response := "Hello! This is SMS service."
-		if isSelfPhone {
-			response = fmt.Sprintf("Hello %s! This is SMS service on %s.", h.config.SelfPhone, h.config.Name)
-		}
-		h.Send("sms", model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(sms.Phone, response)))
+// handleReport handles delivery reports, modules that do not send them leave messages acked
+func (h *SerialHandler) handleReport(msg *model.MSG) {
+	report := model.UnmarshalReport([]byte(msg.Data))
+	if report == nil {
+		glog.Warning("[%s] unmarshal report failed", h.config.Name)
+		return
+	}
 
-	case "你好":
-		response := "你好！这里是SMS服务。"
-		if isSelfPhone {
-			response = fmt.Sprintf("你好 %s！这里是%s的SMS服务。", h.config.SelfPhone, h.config.Name)
-		}
-		h.Send("sms", model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(sms.Phone, response)))
+	id := db.UpdateHistoryDelivered(report.Key, report.Delivered, report.Error)
+	if id <= 0 {
+		return
+	}
+	if report.Delivered {
+		notifyStatus(h.config.Name, id, db.MessageDelivered)
+		glog.Info("[%s] SMS delivered: %s", h.config.Name, report.Key)
+	} else {
+		notifyStatus(h.config.Name, id, db.MessageFailed)
+		glog.Warning("[%s] SMS not delivered: %s [%s]", h.config.Name, report.Key, report.Error)
+	}
+}
 
-	case "status":
-		status := fmt.Sprintf("[SMS][%s] Device: %s, Status: Active", h.config.Name, h.config.DevicePath)
-		h.Send("sms", model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(sms.Phone, status)))
+// handleTelemetry stores the radio status reported by the module
+func (h *SerialHandler) handleTelemetry(msg *model.MSG) {
+	telemetry := model.UnmarshalTelemetry([]byte(msg.Data))
+	if telemetry == nil {
+		glog.Warning("[%s] unmarshal telemetry failed", h.config.Name)
+		return
+	}
+	telemetry.Time = time.Now().Unix()
 
-	case "ha.help":
-		if isSelfPhone {
-			h.Send("sms", model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(sms.Phone, "[HA][HELP]\nha.op.reboot - Reboot OP")))
-		}
+	h.lock.Lock()
+	h.telemetry = telemetry
+	h.lock.Unlock()
 
-	case "ha.op.reboot":
-		if isSelfPhone {
-			_, _ = util.HttpPost("http://127.0.0.1/api/services/script/reboot_router", nil,
-				util.HTTPContentTypeJson, map[string]string{"Authorization": "Bearer xxxxxxx"})
-			h.Send("sms", model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(sms.Phone, "Reboot OP")))
-		}
-	}
-}
\ No newline at end of file
+	notifyTelemetry(h.config.Name, telemetry)
+	glog.Debug("[%s] telemetry csq:%d rssi:%d", h.config.Name, telemetry.CSQ, telemetry.RSSI)
+}
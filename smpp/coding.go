@@ -0,0 +1,212 @@
+package smpp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"unicode/utf16"
+)
+
+// Data codings the server understands
+const (
+	CodingDefault byte = 0x00
+	CodingIA5     byte = 0x01
+	CodingLatin1  byte = 0x03
+	CodingUCS2    byte = 0x08
+)
+
+const gsmEscape = 0x1B
+
+// maxParts is the most parts a concatenation UDH can number
+const maxParts = 255
+
+// gsmBasic is the GSM 03.38 default alphabet, SMPP carries it unpacked, one septet per octet
+var gsmBasic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsmExtension are the characters sent as the escape followed by the key
+var gsmExtension = map[byte]rune{
+	0x0A: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2F: '\\',
+	0x3C: '[', 0x3D: '~', 0x3E: ']', 0x40: '|', 0x65: '€',
+}
+
+var (
+	gsmBasicIndex     = make(map[rune]byte)
+	gsmExtensionIndex = make(map[rune]byte)
+)
+
+func init() {
+	for i, r := range gsmBasic {
+		if i != gsmEscape {
+			gsmBasicIndex[r] = byte(i)
+		}
+	}
+	for b, r := range gsmExtension {
+		gsmExtensionIndex[r] = b
+	}
+}
+
+// latin1Default reports whether data_coding 0 is read as Latin-1 rather than the GSM alphabet,
+// many clients send plain ASCII with the default coding
+func latin1Default() bool {
+	return defaultCoding() == "latin1"
+}
+
+// decodeText converts a short message to text
+func decodeText(coding byte, data []byte) (string, error) {
+	switch coding {
+	case CodingDefault:
+		if latin1Default() {
+			return decodeLatin1(data), nil
+		}
+		return decodeGSM(data), nil
+	case CodingIA5, CodingLatin1:
+		return decodeLatin1(data), nil
+	case CodingUCS2:
+		if len(data)%2 != 0 {
+			return "", fmt.Errorf("odd UCS2 length %d", len(data))
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(data[i*2:])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", fmt.Errorf("unsupported data_coding 0x%02X", coding)
+}
+
+func decodeGSM(data []byte) string {
+	runes := make([]rune, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		b := data[i] & 0x7F
+		if b == gsmEscape && i+1 < len(data) {
+			i++
+			if r, ok := gsmExtension[data[i]&0x7F]; ok {
+				runes = append(runes, r)
+				continue
+			}
+			// unknown extension, the spec says to show the basic character
+			b = data[i] & 0x7F
+		}
+		runes = append(runes, gsmBasic[b])
+	}
+	return string(runes)
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// encodeText picks the default coding when every character fits, UCS2 otherwise, and returns
+// the encoding of every character so messages can be split between characters
+func encodeText(text string) (byte, [][]byte) {
+	runes := []rune(text)
+	chars := make([][]byte, 0, len(runes))
+	latin1 := latin1Default()
+	for _, r := range runes {
+		if latin1 {
+			if r > 0xFF {
+				return CodingUCS2, encodeUCS2(runes)
+			}
+			chars = append(chars, []byte{byte(r)})
+		} else if b, ok := gsmBasicIndex[r]; ok {
+			chars = append(chars, []byte{b})
+		} else if b, ok = gsmExtensionIndex[r]; ok {
+			chars = append(chars, []byte{gsmEscape, b})
+		} else {
+			return CodingUCS2, encodeUCS2(runes)
+		}
+	}
+	return CodingDefault, chars
+}
+
+func encodeUCS2(runes []rune) [][]byte {
+	chars := make([][]byte, 0, len(runes))
+	for _, r := range runes {
+		units := utf16.Encode([]rune{r})
+		b := make([]byte, len(units)*2)
+		for i, u := range units {
+			binary.BigEndian.PutUint16(b[i*2:], u)
+		}
+		chars = append(chars, b)
+	}
+	return chars
+}
+
+// splitText encodes text into short messages sized like SMS on the air interface, a text that
+// does not fit one message is split into parts that start with a concatenation UDH. A text
+// longer than maxParts parts is cut.
+func splitText(text string, ref byte) (byte, [][]byte) {
+	coding, chars := encodeText(text)
+	single, part := 160, 153
+	if coding == CodingUCS2 || latin1Default() {
+		single, part = 140, 134
+	}
+	total := 0
+	for _, c := range chars {
+		total += len(c)
+	}
+	if total <= single {
+		message := make([]byte, 0, total)
+		for _, c := range chars {
+			message = append(message, c...)
+		}
+		return coding, [][]byte{message}
+	}
+
+	parts := make([][]byte, 0)
+	current := make([]byte, 0, part)
+	for _, c := range chars {
+		if len(current)+len(c) > part {
+			if len(parts) == maxParts-1 {
+				glog.Warning("[smpp] message of %d octets cut to %d parts", total, maxParts)
+				break
+			}
+			parts = append(parts, current)
+			current = make([]byte, 0, part)
+		}
+		current = append(current, c...)
+	}
+	parts = append(parts, current)
+	for i := range parts {
+		udh := []byte{0x05, 0x00, 0x03, ref, byte(len(parts)), byte(i + 1)}
+		parts[i] = append(udh, parts[i]...)
+	}
+	return coding, parts
+}
+
+// concat is the concatenation info of a message part, from its UDH or the sar_ parameters
+type concat struct {
+	Ref   uint16
+	Total byte
+	Seq   byte
+}
+
+// splitUDH removes the user data header and returns the concatenation info it contains
+func splitUDH(data []byte) ([]byte, *concat, error) {
+	if len(data) < 1 || int(data[0])+1 > len(data) {
+		return nil, nil, fmt.Errorf("invalid user data header")
+	}
+	end := int(data[0]) + 1
+	header := data[1:end]
+	var info *concat
+	for len(header) >= 2 {
+		iei, length := header[0], int(header[1])
+		if len(header) < 2+length {
+			return nil, nil, fmt.Errorf("invalid user data header")
+		}
+		value := header[2 : 2+length]
+		switch {
+		case iei == 0x00 && length == 3:
+			info = &concat{Ref: uint16(value[0]), Total: value[1], Seq: value[2]}
+		case iei == 0x08 && length == 4:
+			info = &concat{Ref: binary.BigEndian.Uint16(value), Total: value[2], Seq: value[3]}
+		}
+		header = header[2+length:]
+	}
+	return data[end:], info, nil
+}
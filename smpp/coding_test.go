@@ -0,0 +1,178 @@
+package smpp
+
+import (
+	"bytes"
+	"sms/config"
+	"strings"
+	"testing"
+)
+
+func setCoding(t *testing.T, coding string) {
+	t.Helper()
+	config.Global = &config.Model{}
+	config.Global.SMPP.DefaultCoding = coding
+}
+
+func TestGSMRoundTrip(t *testing.T) {
+	setCoding(t, "gsm")
+	for _, text := range []string{
+		"Hello @ £ $ ¥ èé",
+		"ÄÖÑÜ§¿äöñüà ΔΦΓΛΩΠΨΣΘΞ",
+		"escaped € [ ] { } ~ ^ | \\\f",
+		"line\nbreak\rreturn",
+	} {
+		coding, chars := encodeText(text)
+		if coding != CodingDefault {
+			t.Errorf("%q encoded as 0x%02X", text, coding)
+			continue
+		}
+		got, err := decodeText(coding, bytes.Join(chars, nil))
+		if err != nil || got != text {
+			t.Errorf("%q decoded as %q, %v", text, got, err)
+		}
+	}
+	if got := decodeGSM([]byte{gsmEscape, 'A'}); got != "A" {
+		t.Errorf("unknown extension decoded as %q", got)
+	}
+	if got := decodeGSM([]byte{'a', gsmEscape}); got != "a\x1b" {
+		t.Errorf("trailing escape decoded as %q", got)
+	}
+}
+
+func TestUCS2RoundTrip(t *testing.T) {
+	setCoding(t, "gsm")
+	for _, text := range []string{"验证码 123456", "emoji 😀 outside the BMP", "latin ÿ is not GSM"} {
+		coding, chars := encodeText(text)
+		if coding != CodingUCS2 {
+			t.Errorf("%q encoded as 0x%02X", text, coding)
+			continue
+		}
+		got, err := decodeText(coding, bytes.Join(chars, nil))
+		if err != nil || got != text {
+			t.Errorf("%q decoded as %q, %v", text, got, err)
+		}
+	}
+	if _, err := decodeText(CodingUCS2, []byte{0x00, 0x41, 0x00}); err == nil {
+		t.Error("odd UCS2 length accepted")
+	}
+	if _, err := decodeText(0x04, []byte{0x00}); err == nil {
+		t.Error("binary data_coding accepted")
+	}
+}
+
+func TestLatin1Default(t *testing.T) {
+	setCoding(t, "latin1")
+	coding, chars := encodeText("café ÿ")
+	if coding != CodingDefault || !bytes.Equal(bytes.Join(chars, nil), []byte("caf\xe9 \xff")) {
+		t.Errorf("latin1 encoded as 0x%02X %q", coding, bytes.Join(chars, nil))
+	}
+	if got, _ := decodeText(CodingDefault, []byte("caf\xe9")); got != "café" {
+		t.Errorf("latin1 decoded as %q", got)
+	}
+	if coding, parts := splitText(strings.Repeat("a", 141), 1); coding != CodingDefault || len(parts) != 2 {
+		t.Errorf("141 latin1 characters split into %d parts", len(parts))
+	}
+}
+
+// join reassembles the parts of splitText like a receiving client
+func join(t *testing.T, coding byte, parts [][]byte) string {
+	t.Helper()
+	text := strings.Builder{}
+	for i, part := range parts {
+		if len(parts) == 1 {
+			s, err := decodeText(coding, part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+		data, info, err := splitUDH(part)
+		if err != nil || info == nil {
+			t.Fatalf("part %d: %v %v", i+1, info, err)
+		}
+		if int(info.Total) != len(parts) || int(info.Seq) != i+1 || info.Ref != 7 {
+			t.Fatalf("part %d has UDH %+v", i+1, info)
+		}
+		s, err := decodeText(coding, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text.WriteString(s)
+	}
+	return text.String()
+}
+
+func TestSplitText(t *testing.T) {
+	setCoding(t, "gsm")
+	tests := []struct {
+		name  string
+		text  string
+		parts int
+		size  int
+	}{
+		{"single gsm", strings.Repeat("a", 160), 1, 160},
+		{"two gsm parts", strings.Repeat("a", 161), 2, 6 + 153},
+		{"escape counts twice", strings.Repeat("€", 80), 1, 160},
+		{"escape is not split", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 10), 2, 6 + 152},
+		{"single ucs2", strings.Repeat("码", 70), 1, 140},
+		{"two ucs2 parts", strings.Repeat("码", 71), 2, 6 + 134},
+		{"surrogate pair is not split", strings.Repeat("码", 66) + "😀" + strings.Repeat("码", 4), 2, 6 + 132},
+	}
+	for _, tt := range tests {
+		coding, parts := splitText(tt.text, 7)
+		if len(parts) != tt.parts || len(parts[0]) != tt.size {
+			t.Errorf("%s: %d parts, first of %d octets, want %d of %d", tt.name, len(parts), len(parts[0]), tt.parts, tt.size)
+			continue
+		}
+		for i, part := range parts {
+			if len(part) > 140 && coding == CodingUCS2 || len(part) > 160 {
+				t.Errorf("%s: part %d has %d octets", tt.name, i+1, len(part))
+			}
+		}
+		if got := join(t, coding, parts); got != tt.text {
+			t.Errorf("%s: reassembled as %q", tt.name, got)
+		}
+	}
+}
+
+func TestSplitTextMaxParts(t *testing.T) {
+	setCoding(t, "gsm")
+	_, parts := splitText(strings.Repeat("a", 153*300), 7)
+	if len(parts) != maxParts {
+		t.Fatalf("%d parts, want %d", len(parts), maxParts)
+	}
+	for i, part := range parts {
+		if _, info, err := splitUDH(part); err != nil || int(info.Total) != maxParts || int(info.Seq) != i+1 {
+			t.Fatalf("part %d has UDH %+v [%v]", i+1, info, err)
+		}
+	}
+}
+
+func TestSplitUDH(t *testing.T) {
+	data, info, err := splitUDH([]byte{0x06, 0x08, 0x04, 0x12, 0x34, 0x03, 0x02, 'h', 'i'})
+	if err != nil || string(data) != "hi" || info == nil || *info != (concat{Ref: 0x1234, Total: 3, Seq: 2}) {
+		t.Errorf("16 bit reference: %q %+v %v", data, info, err)
+	}
+	data, info, err = splitUDH([]byte{0x03, 0x24, 0x01, 0x01, 'x'})
+	if err != nil || string(data) != "x" || info != nil {
+		t.Errorf("other element: %q %+v %v", data, info, err)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		{0x05, 0x00, 0x03, 0x01},
+		{0x05, 0x00, 0x09, 0x01, 0x02, 0x01},
+		{0xFF, 0x00},
+	} {
+		if _, _, err := splitUDH(bad); err == nil {
+			t.Errorf("splitUDH(% X) accepted", bad)
+		}
+	}
+
+	// a message_payload can hold a header of the largest length
+	long := make([]byte, 300)
+	long[0] = 0xFF
+	if data, _, err := splitUDH(long); err != nil || len(data) != 300-256 {
+		t.Errorf("header of 255 octets: %d octets left [%v]", len(data), err)
+	}
+}
@@ -0,0 +1,328 @@
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SMPP 3.4 command ids
+const (
+	GenericNack         uint32 = 0x80000000
+	BindReceiver        uint32 = 0x00000001
+	BindReceiverResp    uint32 = 0x80000001
+	BindTransmitter     uint32 = 0x00000002
+	BindTransmitterResp uint32 = 0x80000002
+	QuerySm             uint32 = 0x00000003
+	QuerySmResp         uint32 = 0x80000003
+	SubmitSm            uint32 = 0x00000004
+	SubmitSmResp        uint32 = 0x80000004
+	DeliverSm           uint32 = 0x00000005
+	DeliverSmResp       uint32 = 0x80000005
+	Unbind              uint32 = 0x00000006
+	UnbindResp          uint32 = 0x80000006
+	BindTransceiver     uint32 = 0x00000009
+	BindTransceiverResp uint32 = 0x80000009
+	EnquireLink         uint32 = 0x00000015
+	EnquireLinkResp     uint32 = 0x80000015
+)
+
+// SMPP 3.4 command status codes used by the server
+const (
+	StatusOK           uint32 = 0x00000000
+	StatusInvMsgLen    uint32 = 0x00000001
+	StatusInvCmdLen    uint32 = 0x00000002
+	StatusInvCmdID     uint32 = 0x00000003
+	StatusInvBndSts    uint32 = 0x00000004
+	StatusAlyBnd       uint32 = 0x00000005
+	StatusSysErr       uint32 = 0x00000008
+	StatusInvDstAdr    uint32 = 0x0000000B
+	StatusInvMsgID     uint32 = 0x0000000C
+	StatusBindFail     uint32 = 0x0000000D
+	StatusInvPaswd     uint32 = 0x0000000E
+	StatusInvSysID     uint32 = 0x0000000F
+	StatusInvSerTyp    uint32 = 0x00000015
+	StatusSubmitFail   uint32 = 0x00000045
+	StatusThrottled    uint32 = 0x00000058
+	StatusInvSched     uint32 = 0x00000061
+	StatusInvOptParam  uint32 = 0x000000C4
+	StatusDeliveryFail uint32 = 0x000000FE
+)
+
+// Optional parameter tags
+const (
+	TagReceiptedMessageID uint16 = 0x001E
+	TagSarMsgRefNum       uint16 = 0x020C
+	TagSarTotalSegments   uint16 = 0x020E
+	TagSarSegmentSeqnum   uint16 = 0x020F
+	TagMessagePayload     uint16 = 0x0424
+	TagMessageState       uint16 = 0x0427
+)
+
+// Message states of query_sm_resp and the message_state parameter of receipts
+const (
+	StateEnroute       byte = 1
+	StateDelivered     byte = 2
+	StateUndeliverable byte = 5
+	StateAccepted      byte = 6
+	StateUnknown       byte = 7
+)
+
+const (
+	headerLen = 16
+	// respBit is set in the command id of every response
+	respBit uint32 = 0x80000000
+	// maxPDULen bounds what a client may send, a submit_sm with a full message_payload fits easily
+	maxPDULen = 64 * 1024
+)
+
+// esm_class bits
+const (
+	esmUDHI          byte = 0x40
+	esmDeliveryRecpt byte = 0x04
+)
+
+var errPDUTooShort = errors.New("pdu body too short")
+
+// PDU is one SMPP packet, Body holds everything after the header
+type PDU struct {
+	CommandID uint32
+	Status    uint32
+	Sequence  uint32
+	Body      []byte
+}
+
+// ReadPDU reads a single PDU, a command_length outside of the allowed range is returned as
+// an error since the stream can not be resynchronized
+func ReadPDU(r io.Reader) (*PDU, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < headerLen || length > maxPDULen {
+		return nil, fmt.Errorf("invalid command_length %d", length)
+	}
+	p := &PDU{
+		CommandID: binary.BigEndian.Uint32(header[4:8]),
+		Status:    binary.BigEndian.Uint32(header[8:12]),
+		Sequence:  binary.BigEndian.Uint32(header[12:16]),
+		Body:      make([]byte, length-headerLen),
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Bytes encodes the PDU including its header
+func (p *PDU) Bytes() []byte {
+	data := make([]byte, headerLen, headerLen+len(p.Body))
+	binary.BigEndian.PutUint32(data[0:4], uint32(headerLen+len(p.Body)))
+	binary.BigEndian.PutUint32(data[4:8], p.CommandID)
+	binary.BigEndian.PutUint32(data[8:12], p.Status)
+	binary.BigEndian.PutUint32(data[12:16], p.Sequence)
+	return append(data, p.Body...)
+}
+
+// bodyReader decodes the mandatory parameters of a PDU body in order
+type bodyReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bodyReader) cString(max int) string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.err = errPDUTooShort
+		return ""
+	}
+	if i >= max {
+		r.err = fmt.Errorf("c-octet string longer than %d", max-1)
+		return ""
+	}
+	s := string(r.data[:i])
+	r.data = r.data[i+1:]
+	return s
+}
+
+func (r *bodyReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 1 {
+		r.err = errPDUTooShort
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *bodyReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errPDUTooShort
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// tlvs decodes the optional parameters that follow the mandatory ones
+func (r *bodyReader) tlvs() map[uint16][]byte {
+	tlvs := make(map[uint16][]byte)
+	for r.err == nil && len(r.data) > 0 {
+		if len(r.data) < 4 {
+			r.err = errPDUTooShort
+			break
+		}
+		tag := binary.BigEndian.Uint16(r.data[0:2])
+		length := int(binary.BigEndian.Uint16(r.data[2:4]))
+		r.data = r.data[4:]
+		tlvs[tag] = r.bytes(length)
+	}
+	return tlvs
+}
+
+// bodyWriter encodes PDU bodies
+type bodyWriter struct {
+	bytes.Buffer
+}
+
+func (w *bodyWriter) cString(s string) {
+	w.WriteString(s)
+	w.WriteByte(0)
+}
+
+func (w *bodyWriter) tlv(tag uint16, value []byte) {
+	_ = binary.Write(w, binary.BigEndian, tag)
+	_ = binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.Write(value)
+}
+
+// Bind is the body of the three bind requests
+type Bind struct {
+	SystemID         string
+	Password         string
+	SystemType       string
+	InterfaceVersion byte
+	AddrTon          byte
+	AddrNpi          byte
+	AddressRange     string
+}
+
+func parseBind(body []byte) (*Bind, error) {
+	r := &bodyReader{data: body}
+	b := &Bind{
+		SystemID: r.cString(16),
+		// SMPP allows 9 octets, longer gateway passwords are accepted as well
+		Password:         r.cString(65),
+		SystemType:       r.cString(13),
+		InterfaceVersion: r.byte(),
+		AddrTon:          r.byte(),
+		AddrNpi:          r.byte(),
+		AddressRange:     r.cString(41),
+	}
+	return b, r.err
+}
+
+// Submit is the body of submit_sm, and of deliver_sm which has the same layout
+type Submit struct {
+	ServiceType          string
+	SourceAddrTon        byte
+	SourceAddrNpi        byte
+	SourceAddr           string
+	DestAddrTon          byte
+	DestAddrNpi          byte
+	DestinationAddr      string
+	EsmClass             byte
+	ProtocolID           byte
+	PriorityFlag         byte
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	RegisteredDelivery   byte
+	ReplaceIfPresentFlag byte
+	DataCoding           byte
+	SmDefaultMsgID       byte
+	ShortMessage         []byte
+	TLVs                 map[uint16][]byte
+}
+
+func parseSubmit(body []byte) (*Submit, error) {
+	r := &bodyReader{data: body}
+	s := &Submit{
+		ServiceType:          r.cString(6),
+		SourceAddrTon:        r.byte(),
+		SourceAddrNpi:        r.byte(),
+		SourceAddr:           r.cString(21),
+		DestAddrTon:          r.byte(),
+		DestAddrNpi:          r.byte(),
+		DestinationAddr:      r.cString(21),
+		EsmClass:             r.byte(),
+		ProtocolID:           r.byte(),
+		PriorityFlag:         r.byte(),
+		ScheduleDeliveryTime: r.cString(17),
+		ValidityPeriod:       r.cString(17),
+		RegisteredDelivery:   r.byte(),
+		ReplaceIfPresentFlag: r.byte(),
+		DataCoding:           r.byte(),
+		SmDefaultMsgID:       r.byte(),
+	}
+	s.ShortMessage = r.bytes(int(r.byte()))
+	s.TLVs = r.tlvs()
+	return s, r.err
+}
+
+func (s *Submit) encode() []byte {
+	w := &bodyWriter{}
+	w.cString(s.ServiceType)
+	w.WriteByte(s.SourceAddrTon)
+	w.WriteByte(s.SourceAddrNpi)
+	w.cString(s.SourceAddr)
+	w.WriteByte(s.DestAddrTon)
+	w.WriteByte(s.DestAddrNpi)
+	w.cString(s.DestinationAddr)
+	w.WriteByte(s.EsmClass)
+	w.WriteByte(s.ProtocolID)
+	w.WriteByte(s.PriorityFlag)
+	w.cString(s.ScheduleDeliveryTime)
+	w.cString(s.ValidityPeriod)
+	w.WriteByte(s.RegisteredDelivery)
+	w.WriteByte(s.ReplaceIfPresentFlag)
+	w.WriteByte(s.DataCoding)
+	w.WriteByte(s.SmDefaultMsgID)
+	w.WriteByte(byte(len(s.ShortMessage)))
+	w.Write(s.ShortMessage)
+	for tag, value := range s.TLVs {
+		w.tlv(tag, value)
+	}
+	return w.Bytes()
+}
+
+// Query is the body of query_sm
+type Query struct {
+	MessageID     string
+	SourceAddrTon byte
+	SourceAddrNpi byte
+	SourceAddr    string
+}
+
+func parseQuery(body []byte) (*Query, error) {
+	r := &bodyReader{data: body}
+	q := &Query{
+		MessageID:     r.cString(65),
+		SourceAddrTon: r.byte(),
+		SourceAddrNpi: r.byte(),
+		SourceAddr:    r.cString(21),
+	}
+	return q, r.err
+}
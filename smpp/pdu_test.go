@@ -0,0 +1,136 @@
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPDURoundTrip(t *testing.T) {
+	p := &PDU{CommandID: SubmitSm, Status: StatusOK, Sequence: 42, Body: []byte("body")}
+	got, err := ReadPDU(bytes.NewReader(p.Bytes()))
+	if err != nil || !reflect.DeepEqual(got, p) {
+		t.Fatalf("ReadPDU = %+v, %v", got, err)
+	}
+}
+
+func TestReadPDUMalformed(t *testing.T) {
+	header := func(length uint32) []byte {
+		b := make([]byte, headerLen)
+		binary.BigEndian.PutUint32(b, length)
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{0, 0, 0, 16, 0, 0}},
+		{"length below the header", header(15)},
+		{"length above the limit", header(maxPDULen + 1)},
+		{"truncated body", append(header(headerLen+4), 'a', 'b')},
+	}
+	for _, tt := range tests {
+		if p, err := ReadPDU(bytes.NewReader(tt.data)); err == nil {
+			t.Errorf("%s: read %+v", tt.name, p)
+		}
+	}
+	if _, err := ReadPDU(bytes.NewReader(header(headerLen))); err != nil {
+		t.Errorf("empty body: %v", err)
+	}
+}
+
+func TestSubmitRoundTrip(t *testing.T) {
+	s := &Submit{
+		ServiceType:        "cn",
+		SourceAddrTon:      1,
+		SourceAddrNpi:      1,
+		SourceAddr:         "8613800138000",
+		DestAddrTon:        1,
+		DestAddrNpi:        1,
+		DestinationAddr:    "8613800138001",
+		EsmClass:           esmUDHI,
+		RegisteredDelivery: 1,
+		DataCoding:         CodingUCS2,
+		ShortMessage:       []byte{0x05, 0x00, 0x03, 0x01, 0x02, 0x01, 0x4F, 0x60},
+		TLVs:               map[uint16][]byte{TagMessagePayload: []byte("payload")},
+	}
+	got, err := parseSubmit(s.encode())
+	if err != nil || !reflect.DeepEqual(got, s) {
+		t.Fatalf("parseSubmit = %+v, %v", got, err)
+	}
+}
+
+// every prefix of a valid body is an error, never a panic
+func TestParseTruncated(t *testing.T) {
+	submit := (&Submit{SourceAddr: "10086", DestinationAddr: "10010", ShortMessage: []byte("hello")}).encode()
+	bind := &bodyWriter{}
+	bind.cString("system")
+	bind.cString("password")
+	bind.cString("")
+	bind.Write([]byte{0x34, 0, 0})
+	bind.cString("")
+	query := &bodyWriter{}
+	query.cString("123")
+	query.Write([]byte{0, 0})
+	query.cString("")
+
+	parsers := map[string]struct {
+		body  []byte
+		parse func([]byte) error
+	}{
+		"submit_sm": {submit, func(b []byte) error { _, err := parseSubmit(b); return err }},
+		"bind":      {bind.Bytes(), func(b []byte) error { _, err := parseBind(b); return err }},
+		"query_sm":  {query.Bytes(), func(b []byte) error { _, err := parseQuery(b); return err }},
+	}
+	for name, p := range parsers {
+		if err := p.parse(p.body); err != nil {
+			t.Errorf("%s: full body: %v", name, err)
+		}
+		for n := 0; n < len(p.body); n++ {
+			if err := p.parse(p.body[:n]); err == nil {
+				t.Errorf("%s: body cut to %d of %d octets accepted", name, n, len(p.body))
+			}
+		}
+	}
+}
+
+func TestParseSubmitMalformed(t *testing.T) {
+	valid := (&Submit{SourceAddr: "10086", DestinationAddr: "10010", ShortMessage: []byte("hi")}).encode()
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"sm_length beyond the body", append(append([]byte{}, valid[:len(valid)-3]...), 0xFF, 'h', 'i')},
+		{"tlv shorter than its header", append(append([]byte{}, valid...), 0x04, 0x24, 0x00)},
+		{"tlv longer than the body", append(append([]byte{}, valid...), 0x04, 0x24, 0x00, 0x10, 'x')},
+		{"source_addr too long", append([]byte{0, 1, 1}, append(bytes.Repeat([]byte{'1'}, 30), 0)...)},
+		{"no terminator", []byte("cn")},
+	}
+	for _, tt := range tests {
+		if s, err := parseSubmit(tt.body); err == nil {
+			t.Errorf("%s: parsed %+v", tt.name, s)
+		}
+	}
+}
+
+func TestReadPDUStream(t *testing.T) {
+	r, w := io.Pipe()
+	go func() {
+		for seq := uint32(1); seq <= 3; seq++ {
+			_, _ = w.Write((&PDU{CommandID: EnquireLink, Sequence: seq}).Bytes())
+		}
+		_ = w.Close()
+	}()
+	for seq := uint32(1); seq <= 3; seq++ {
+		p, err := ReadPDU(r)
+		if err != nil || p.Sequence != seq || p.CommandID != EnquireLink {
+			t.Fatalf("pdu %d: %+v, %v", seq, p, err)
+		}
+	}
+	if _, err := ReadPDU(r); err != io.EOF {
+		t.Fatalf("after the stream: %v", err)
+	}
+}
@@ -0,0 +1,626 @@
+package smpp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"net"
+	"sms/account"
+	"sms/apikey"
+	"sms/audit"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	senderName          = "smpp"
+	serverSystemID      = "sms-gateway"
+	responseTimeout     = 30 * time.Second
+	maxDeliveryAttempts = 3
+	// maxQueue bounds the deliver_sm kept while no receiver is bound, the oldest are dropped
+	maxQueue = 1000
+	// assemblyTimeout drops concatenated submits whose parts did not all arrive
+	assemblyTimeout = time.Minute
+	// receiptRetention drops receipts of messages that never reach a final state
+	receiptRetention = 72 * time.Hour
+)
+
+// delivery is an inbound SMS or a receipt, one deliver_sm per part. device is the device an
+// inbound SMS arrived on, only receivers allowed to read it get it.
+type delivery struct {
+	systemID string
+	device   string
+	bodies   [][]byte
+	sent     int
+	attempts int
+}
+
+// receipt is a delivery receipt requested by registered_delivery, sent once the gateway
+// message reaches a final state
+type receipt struct {
+	id          string
+	systemID    string
+	source      *Submit
+	submitted   time.Time
+	text        string
+	failureOnly bool
+}
+
+// assembly collects the parts of a concatenated submit_sm
+type assembly struct {
+	parts    map[byte]string
+	receipts []*receipt
+	total    byte
+	started  time.Time
+	sm       *Submit
+}
+
+var (
+	listener   net.Listener
+	running    int32
+	stop       chan struct{}
+	lock       = sync.Mutex{}
+	sessions   = make(map[*session]struct{})
+	queue      = make([]*delivery, 0)
+	receipts   = make(map[int64][]*receipt)
+	assemblies = make(map[string]*assembly)
+	wakeUp     = make(chan struct{}, 1)
+	nextRR     int
+	partID     uint64
+	inboundRef uint32
+)
+
+func windowSize() int {
+	if config.Global.SMPP.Window > 0 {
+		return config.Global.SMPP.Window
+	}
+	return 10
+}
+
+func enquireInterval() time.Duration {
+	if config.Global.SMPP.EnquireLink > 0 {
+		return time.Duration(config.Global.SMPP.EnquireLink) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func defaultCoding() string {
+	return strings.ToLower(config.Global.SMPP.DefaultCoding)
+}
+
+// authenticate checks a bind against the users, whose role must allow sending, a user is
+// returned as its access to limit the session to its devices. The [security] username binds
+// with the access key. An API key with the send scope binds with any system_id and is returned
+// to limit the session.
+func authenticate(systemID, password, ip string) (*db.APIKeyModel, uint32) {
+	if k, err := apikey.Verify(password, ip); err == nil && !apikey.IsLegacy(k) {
+		if !apikey.HasScope(k, apikey.ScopeSend) {
+			return nil, StatusInvPaswd
+		}
+		return k, StatusOK
+	}
+	sec := config.Global.Security
+	if sec.AccessKey != "" && subtle.ConstantTimeCompare([]byte(systemID), []byte(sec.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(sec.AccessKey)) == 1 {
+		return nil, StatusOK
+	}
+	u, err := account.Authenticate(systemID, password)
+	if err != nil {
+		return nil, StatusInvPaswd
+	}
+	k := account.Access(u)
+	if !apikey.HasScope(k, apikey.ScopeSend) {
+		return nil, StatusInvPaswd
+	}
+	return k, StatusOK
+}
+
+// EnableSMPP starts the SMPP 3.4 server, ESMEs bind with the gateway username and password
+func EnableSMPP() {
+	cfg := config.Global.SMPP
+	if !cfg.Enable {
+		return
+	}
+	port := cfg.Port
+	if port <= 0 {
+		port = 2775
+	}
+	var err error
+	listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Addr, port))
+	if err != nil {
+		glog.Error("[smpp] listen failed [%v]", err)
+		return
+	}
+
+	atomic.StoreInt32(&running, 1)
+	stop = make(chan struct{})
+	serial.OnReceived(publishReceived)
+	serial.OnStatus(checkReceipt)
+	go accept(listener)
+	go dispatch(stop)
+
+	glog.Info("SMPP server started on %s", listener.Addr())
+}
+
+// KillSMPP stops accepting binds and closes every session
+func KillSMPP() {
+	if !atomic.CompareAndSwapInt32(&running, 1, 0) {
+		return
+	}
+	close(stop)
+	_ = listener.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	for s := range sessions {
+		s.close()
+	}
+}
+
+func isRunning() bool {
+	return atomic.LoadInt32(&running) == 1
+}
+
+func accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if isRunning() {
+				glog.Warning("[smpp] accept failed [%v]", err)
+			}
+			return
+		}
+		s := newSession(conn)
+		lock.Lock()
+		sessions[s] = struct{}{}
+		lock.Unlock()
+		glog.Debug("[smpp] [%s] connected", s)
+		go func() {
+			s.serve()
+			lock.Lock()
+			delete(sessions, s)
+			lock.Unlock()
+			glog.Debug("[smpp] [%s] disconnected", s)
+		}()
+	}
+}
+
+// submit sends a submit_sm through the routed device and returns the message id for the
+// response, the gateway message id of the logical message
+func submit(systemID string, key *db.APIKeyModel, actor audit.Actor, sm *Submit) (string, uint32) {
+	if sm.ScheduleDeliveryTime != "" {
+		return "", StatusInvSched
+	}
+	phone := strings.TrimSpace(sm.DestinationAddr)
+	if phone == "" {
+		return "", StatusInvDstAdr
+	}
+	// international numbers usually come without the +
+	if sm.DestAddrTon == 1 && !strings.HasPrefix(phone, "+") {
+		phone = "+" + phone
+	}
+
+	data := sm.ShortMessage
+	if payload, ok := sm.TLVs[TagMessagePayload]; ok && len(data) == 0 {
+		data = payload
+	}
+	var info *concat
+	if sm.EsmClass&esmUDHI != 0 {
+		var err error
+		if data, info, err = splitUDH(data); err != nil {
+			return "", StatusInvMsgLen
+		}
+	} else if total, ok := sm.TLVs[TagSarTotalSegments]; ok && len(total) == 1 {
+		ref, seq := sm.TLVs[TagSarMsgRefNum], sm.TLVs[TagSarSegmentSeqnum]
+		if len(ref) != 2 || len(seq) != 1 {
+			return "", StatusInvOptParam
+		}
+		info = &concat{Ref: uint16(ref[0])<<8 | uint16(ref[1]), Total: total[0], Seq: seq[0]}
+	}
+	text, err := decodeText(sm.DataCoding, data)
+	if err != nil {
+		glog.Warning("[smpp] submit_sm to %s rejected [%v]", phone, err)
+		return "", StatusSubmitFail
+	}
+
+	sm.DestinationAddr = phone
+	if info != nil && info.Total > 1 {
+		return submitPart(systemID, key, actor, sm, info, text)
+	}
+	if text == "" {
+		return "", StatusInvMsgLen
+	}
+	r := newReceipt(systemID, sm, text, "")
+	messageID, status := send(sm, text, key, actor)
+	if status == StatusOK && r != nil {
+		r.id = strconv.FormatInt(messageID, 10)
+		addReceipts(messageID, r)
+	}
+	return strconv.FormatInt(messageID, 10), status
+}
+
+// submitPart keeps a part of a concatenated message and sends the message once every part
+// arrived. Every part is answered at once with its own id, so clients with a window of one
+// keep going, and a requested receipt is sent for every part.
+func submitPart(systemID string, apiKey *db.APIKeyModel, actor audit.Actor, sm *Submit, info *concat, text string) (string, uint32) {
+	if info.Seq < 1 || info.Seq > info.Total {
+		return "", StatusInvOptParam
+	}
+	key := fmt.Sprintf("%s|%s|%s|%d", systemID, sm.SourceAddr, sm.DestinationAddr, info.Ref)
+	id := fmt.Sprintf("P%d", atomic.AddUint64(&partID, 1))
+
+	lock.Lock()
+	a := assemblies[key]
+	if a == nil || a.total != info.Total {
+		a = &assembly{parts: make(map[byte]string), total: info.Total, started: time.Now(), sm: sm}
+		assemblies[key] = a
+	}
+	a.parts[info.Seq] = text
+	if r := newReceipt(systemID, sm, text, id); r != nil {
+		a.receipts = append(a.receipts, r)
+	}
+	complete := len(a.parts) == int(a.total)
+	if complete {
+		delete(assemblies, key)
+	}
+	lock.Unlock()
+
+	if !complete {
+		return id, StatusOK
+	}
+	full := strings.Builder{}
+	for seq := byte(1); seq <= a.total; seq++ {
+		full.WriteString(a.parts[seq])
+	}
+	messageID, status := send(sm, full.String(), apiKey, actor)
+	if status != StatusOK {
+		// the earlier parts were already accepted, their receipts report the failure
+		for _, r := range a.receipts {
+			if r.id != id {
+				queueReceipt(r, StateUndeliverable, time.Now())
+			}
+		}
+		return "", status
+	}
+	addReceipts(messageID, a.receipts...)
+	return id, StatusOK
+}
+
+func newReceipt(systemID string, sm *Submit, text, id string) *receipt {
+	mode := sm.RegisteredDelivery & 0x03
+	if mode == 0 || mode == 3 {
+		return nil
+	}
+	return &receipt{id: id, systemID: systemID, source: sm, submitted: time.Now(), text: text, failureOnly: mode == 2}
+}
+
+// send queues text on the device named by service_type, or the routed device. A session bound
+// with an API key is held to the devices and send quota of the key, one of a user to its devices.
+func send(sm *Submit, text string, key *db.APIKeyModel, actor audit.Actor) (int64, uint32) {
+	device := ""
+	if sm.ServiceType != "" && serial.Exists(sm.ServiceType) {
+		device = sm.ServiceType
+	}
+	if key != nil {
+		if device == "" && apikey.Restricted(key) {
+			routed, _, err := serial.Route(sm.DestinationAddr)
+			if err != nil {
+				return 0, StatusInvDstAdr
+			}
+			device = routed
+		}
+		if !apikey.AllowsDevice(key, device) {
+			glog.Warning("[smpp] key [%s] may not send on [%s]", key.Name, device)
+			return 0, StatusInvSerTyp
+		}
+		// the access of a user has no quota
+		if !apikey.IsLegacy(key) {
+			if err := apikey.ConsumeID(key.ID, 1); err != nil {
+				glog.Warning("[smpp] key [%s] send to %s rejected [%v]", key.Name, sm.DestinationAddr, err)
+				if errors.Is(err, apikey.ErrQuota) {
+					return 0, StatusThrottled
+				}
+				return 0, StatusSubmitFail
+			}
+		}
+	}
+	used, route, ids, err := serial.SendTo(device, senderName, sm.DestinationAddr, text)
+	entry := &audit.Message{Via: "smpp", Device: used, Route: route, Sender: sm.SourceAddr, Phone: sm.DestinationAddr, Message: text, IDs: ids}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	audit.RecordSend(actor, entry)
+	if err != nil {
+		if key != nil && !apikey.IsLegacy(key) {
+			apikey.RefundID(key.ID, 1)
+		}
+		glog.Warning("[smpp] send to %s failed [%v]", sm.DestinationAddr, err)
+		if errors.Is(err, serial.ErrNoRoute) {
+			return 0, StatusInvDstAdr
+		}
+		return 0, StatusSubmitFail
+	}
+	glog.Info("[smpp] queued message [%d] to %s on %s", ids[0], sm.DestinationAddr, used)
+	return ids[0], StatusOK
+}
+
+func addReceipts(messageID int64, list ...*receipt) {
+	if len(list) == 0 {
+		return
+	}
+	lock.Lock()
+	receipts[messageID] = append(receipts[messageID], list...)
+	lock.Unlock()
+	// the message may have failed before the receipt was registered
+	go checkMessage(messageID)
+}
+
+// messageState maps the state of a gateway message to an SMPP message state, final reports
+// whether it will not change anymore
+func messageState(status string) (state byte, final bool) {
+	switch status {
+	case db.MessageDelivered:
+		return StateDelivered, true
+	case db.MessageFailed:
+		return StateUndeliverable, true
+	case db.MessageAcked:
+		if config.Global.SMPP.ReceiptOnAck {
+			return StateDelivered, true
+		}
+	}
+	return StateEnroute, false
+}
+
+func checkReceipt(device string, historyID int64, status string) {
+	his := db.GetHistory(historyID)
+	if his == nil || his.MessageID == 0 {
+		return
+	}
+	checkMessage(his.MessageID)
+}
+
+func checkMessage(messageID int64) {
+	lock.Lock()
+	_, ok := receipts[messageID]
+	lock.Unlock()
+	if !ok {
+		return
+	}
+	segments := db.GetMessageSegments(messageID)
+	state, final := messageState(db.MessageStatus(segments))
+	if !final {
+		return
+	}
+	lock.Lock()
+	list := receipts[messageID]
+	delete(receipts, messageID)
+	lock.Unlock()
+
+	done := time.Now()
+	for _, r := range list {
+		queueReceipt(r, state, done)
+	}
+}
+
+// queueReceipt formats the receipt in the usual "id:... stat:DELIVRD" text, with the
+// receipted_message_id and message_state parameters for clients that read those instead
+func queueReceipt(r *receipt, state byte, done time.Time) {
+	if r.failureOnly && state == StateDelivered {
+		return
+	}
+	stat, delivered := "UNDELIV", "000"
+	if state == StateDelivered {
+		stat, delivered = "DELIVRD", "001"
+	}
+	text := []rune(r.text)
+	if len(text) > 20 {
+		text = text[:20]
+	}
+	body := fmt.Sprintf("id:%s sub:001 dlvrd:%s submit date:%s done date:%s stat:%s err:000 text:%s",
+		r.id, delivered, r.submitted.Format("0601021504"), done.Format("0601021504"), stat, printableASCII(string(text)))
+
+	sm := &Submit{
+		SourceAddrTon:   r.source.DestAddrTon,
+		SourceAddrNpi:   r.source.DestAddrNpi,
+		SourceAddr:      strings.TrimPrefix(r.source.DestinationAddr, "+"),
+		DestAddrTon:     r.source.SourceAddrTon,
+		DestAddrNpi:     r.source.SourceAddrNpi,
+		DestinationAddr: r.source.SourceAddr,
+		EsmClass:        esmDeliveryRecpt,
+		DataCoding:      CodingIA5,
+		ShortMessage:    []byte(body),
+		TLVs: map[uint16][]byte{
+			TagReceiptedMessageID: append([]byte(r.id), 0),
+			TagMessageState:       {state},
+		},
+	}
+	enqueue(&delivery{systemID: r.systemID, bodies: [][]byte{sm.encode()}})
+}
+
+// printableASCII replaces what is not printable ASCII, receipts are sent as IA5
+func printableASCII(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0x7E || r < 0x20 {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+// query answers query_sm from the history, final_date is empty until the message is final.
+// A key without the history scope or limited to other devices does not see the message.
+func query(id string, key *db.APIKeyModel) (string, byte, bool) {
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	segments := db.GetMessageSegments(messageID)
+	if len(segments) == 0 {
+		return "", 0, false
+	}
+	if key != nil && (!apikey.HasScope(key, apikey.ScopeHistory) || !apikey.AllowsDevice(key, segments[0].Device)) {
+		return "", 0, false
+	}
+	state, final := messageState(db.MessageStatus(segments))
+	if !final {
+		return "", state, true
+	}
+	var done int64
+	for _, seg := range segments {
+		for _, t := range []int64{seg.DeliveredTime, seg.FailedTime, seg.AckTime} {
+			if t > done {
+				done = t
+			}
+		}
+	}
+	return absoluteTime(time.Unix(done, 0)), state, true
+}
+
+// absoluteTime formats t as the SMPP absolute time YYMMDDhhmmsstnnp
+func absoluteTime(t time.Time) string {
+	_, offset := t.Zone()
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("%s0%02d%s", t.Format("060102150405"), offset/900, sign)
+}
+
+// publishReceived passes an inbound SMS to the bound receivers, the device name is the
+// service_type and its own number the destination
+func publishReceived(device string, historyID int64, sms *model.SMS) {
+	self := ""
+	for _, dev := range config.Global.SerialDevices {
+		if dev.Name == device {
+			self = dev.SelfPhone
+		}
+	}
+	coding, parts := splitText(sms.Message, byte(atomic.AddUint32(&inboundRef, 1)))
+	d := &delivery{device: device, bodies: make([][]byte, 0, len(parts))}
+	for _, part := range parts {
+		sm := &Submit{
+			ServiceType:     device,
+			SourceAddrNpi:   1,
+			SourceAddr:      strings.TrimPrefix(sms.Phone, "+"),
+			DestAddrNpi:     1,
+			DestinationAddr: strings.TrimPrefix(self, "+"),
+			DataCoding:      coding,
+			ShortMessage:    part,
+		}
+		if strings.HasPrefix(sms.Phone, "+") {
+			sm.SourceAddrTon = 1
+		}
+		if strings.HasPrefix(self, "+") {
+			sm.DestAddrTon = 1
+		}
+		if len(parts) > 1 {
+			sm.EsmClass = esmUDHI
+		}
+		d.bodies = append(d.bodies, sm.encode())
+	}
+	enqueue(d)
+}
+
+func enqueue(d *delivery) {
+	lock.Lock()
+	queue = append(queue, d)
+	if len(queue) > maxQueue {
+		glog.Warning("[smpp] no receiver bound, dropping the oldest deliver_sm")
+		queue = queue[len(queue)-maxQueue:]
+	}
+	lock.Unlock()
+	wake()
+}
+
+// requeue puts a delivery back at the front so parts and receipts keep their order
+func requeue(d *delivery) {
+	lock.Lock()
+	queue = append([]*delivery{d}, queue...)
+	lock.Unlock()
+}
+
+func wake() {
+	select {
+	case wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands queued deliveries to bound receivers, deliveries wait while none is bound
+func dispatch(stop chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wakeUp:
+		case <-ticker.C:
+			prune(time.Now())
+		case <-stop:
+			return
+		}
+		flush()
+	}
+}
+
+// flush hands out what has a receiver, the rest waits in order
+func flush() {
+	lock.Lock()
+	defer lock.Unlock()
+	waiting := make([]*delivery, 0)
+	for _, d := range queue {
+		s := receiver(d)
+		if s == nil {
+			waiting = append(waiting, d)
+			continue
+		}
+		go s.deliver(d)
+	}
+	queue = waiting
+}
+
+// receiver picks a bound receiver of d round robin, a receipt goes to the client that submitted
+// the message and an inbound SMS to clients that may read its device. The lock must be held.
+func receiver(d *delivery) *session {
+	list := make([]*session, 0, len(sessions))
+	for s := range sessions {
+		if s.canReceive() && (d.systemID == "" || s.systemID == d.systemID) && s.canRead(d.device) {
+			list = append(list, s)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	nextRR++
+	return list[nextRR%len(list)]
+}
+
+// prune drops incomplete concatenated submits and receipts that will not be sent anymore
+func prune(now time.Time) {
+	lock.Lock()
+	expired := make([]*receipt, 0)
+	for key, a := range assemblies {
+		if now.Sub(a.started) > assemblyTimeout {
+			glog.Warning("[smpp] dropping incomplete message to %s, %d of %d parts", a.sm.DestinationAddr, len(a.parts), a.total)
+			expired = append(expired, a.receipts...)
+			delete(assemblies, key)
+		}
+	}
+	for id, list := range receipts {
+		if len(list) > 0 && now.Sub(list[0].submitted) > receiptRetention {
+			delete(receipts, id)
+		}
+	}
+	lock.Unlock()
+	for _, r := range expired {
+		queueReceipt(r, StateUndeliverable, now)
+	}
+}
@@ -0,0 +1,348 @@
+package smpp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"net"
+	"sms/apikey"
+	"sms/audit"
+	"sms/db"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errSessionClosed = errors.New("session closed")
+
+// session is one ESME connection. Requests from the client are handled concurrently up to
+// the window, more are rejected with ESME_RTHROTTLED. deliver_sm sent to the client are
+// limited to the window as well and wait for their deliver_sm_resp.
+type session struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+	sequence  uint32
+	lastRead  int64
+
+	// bind is the bind command id, 0 until the client is bound
+	bind     uint32
+	systemID string
+	// key is the API key the session is bound with, nil for the gateway login
+	key *db.APIKeyModel
+
+	window   chan struct{}
+	outbound chan struct{}
+	pending  map[uint32]chan uint32
+	lock     sync.Mutex
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		window:   make(chan struct{}, windowSize()),
+		outbound: make(chan struct{}, windowSize()),
+		pending:  make(map[uint32]chan uint32),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (s *session) String() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// ip is the client address an API key is checked against
+func (s *session) ip() string {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return s.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// actor names the bound client in the audit log
+func (s *session) actor() audit.Actor {
+	name := "smpp:" + s.systemID
+	switch {
+	case s.key != nil && apikey.IsLegacy(s.key):
+		// the access of a user, named user:<username>
+		name = s.key.Name
+	case s.key != nil:
+		name = fmt.Sprintf("key:%d %s", s.key.ID, s.key.Name)
+	}
+	return audit.Actor{Name: name, IP: s.ip()}
+}
+
+func (s *session) nextSequence() uint32 {
+	for {
+		seq := atomic.AddUint32(&s.sequence, 1) & 0x7FFFFFFF
+		if seq != 0 {
+			return seq
+		}
+	}
+}
+
+func (s *session) canReceive() bool {
+	bind := atomic.LoadUint32(&s.bind)
+	return bind == BindReceiver || bind == BindTransceiver
+}
+
+// canRead reports whether the session may receive the SMS of device, a key needs the history
+// scope and the device
+func (s *session) canRead(device string) bool {
+	if s.key == nil || device == "" {
+		return true
+	}
+	return apikey.HasScope(s.key, apikey.ScopeHistory) && apikey.AllowsDevice(s.key, device)
+}
+
+func (s *session) canTransmit() bool {
+	bind := atomic.LoadUint32(&s.bind)
+	return bind == BindTransmitter || bind == BindTransceiver
+}
+
+func (s *session) write(p *PDU) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := s.conn.Write(p.Bytes())
+	if err != nil {
+		s.close()
+	}
+	return err
+}
+
+func (s *session) respond(req *PDU, status uint32, body []byte) {
+	_ = s.write(&PDU{CommandID: req.CommandID | respBit, Status: status, Sequence: req.Sequence, Body: body})
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.closed)
+		_ = s.conn.Close()
+		s.lock.Lock()
+		for seq, ch := range s.pending {
+			delete(s.pending, seq)
+			close(ch)
+		}
+		s.lock.Unlock()
+	})
+}
+
+// serve reads PDUs until the client unbinds or the connection breaks, a client that stays
+// silent for three enquire_link intervals is dropped
+func (s *session) serve() {
+	defer s.close()
+	go s.keepAlive()
+
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(3 * enquireInterval()))
+		p, err := ReadPDU(s.reader)
+		if err != nil {
+			glog.Debug("[smpp] [%s] read failed [%v]", s, err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+
+		if p.CommandID&respBit != 0 {
+			s.resolve(p)
+			continue
+		}
+		switch p.CommandID {
+		case BindTransmitter, BindReceiver, BindTransceiver:
+			s.handleBind(p)
+		case Unbind:
+			s.respond(p, StatusOK, nil)
+			glog.Info("[smpp] [%s] %s unbound", s, s.systemID)
+			return
+		case EnquireLink:
+			s.respond(p, StatusOK, nil)
+		case SubmitSm, QuerySm:
+			if atomic.LoadUint32(&s.bind) == 0 || (p.CommandID == SubmitSm && !s.canTransmit()) {
+				s.respond(p, StatusInvBndSts, nil)
+				continue
+			}
+			select {
+			case s.window <- struct{}{}:
+				go func() {
+					defer func() { <-s.window }()
+					if p.CommandID == SubmitSm {
+						s.handleSubmit(p)
+					} else {
+						s.handleQuery(p)
+					}
+				}()
+			default:
+				s.respond(p, StatusThrottled, nil)
+			}
+		default:
+			_ = s.write(&PDU{CommandID: GenericNack, Status: StatusInvCmdID, Sequence: p.Sequence})
+		}
+	}
+}
+
+func (s *session) keepAlive() {
+	ticker := time.NewTicker(enquireInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRead))) >= enquireInterval() {
+				_ = s.write(&PDU{CommandID: EnquireLink, Sequence: s.nextSequence()})
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// resolve hands a response to the request waiting for it
+func (s *session) resolve(p *PDU) {
+	s.lock.Lock()
+	ch, ok := s.pending[p.Sequence]
+	delete(s.pending, p.Sequence)
+	s.lock.Unlock()
+	if ok {
+		ch <- p.Status
+		close(ch)
+	}
+}
+
+// request sends a PDU and waits for its response status
+func (s *session) request(commandID uint32, body []byte) (uint32, error) {
+	select {
+	case s.outbound <- struct{}{}:
+		defer func() { <-s.outbound }()
+	case <-s.closed:
+		return 0, errSessionClosed
+	}
+
+	seq := s.nextSequence()
+	ch := make(chan uint32, 1)
+	s.lock.Lock()
+	select {
+	case <-s.closed:
+		s.lock.Unlock()
+		return 0, errSessionClosed
+	default:
+	}
+	s.pending[seq] = ch
+	s.lock.Unlock()
+
+	if err := s.write(&PDU{CommandID: commandID, Sequence: seq, Body: body}); err != nil {
+		return 0, err
+	}
+	select {
+	case status, ok := <-ch:
+		if !ok {
+			return 0, errSessionClosed
+		}
+		return status, nil
+	case <-time.After(responseTimeout):
+		s.lock.Lock()
+		delete(s.pending, seq)
+		s.lock.Unlock()
+		return 0, errors.New("response timeout")
+	}
+}
+
+func (s *session) handleBind(p *PDU) {
+	if atomic.LoadUint32(&s.bind) != 0 {
+		s.respond(p, StatusAlyBnd, nil)
+		return
+	}
+	b, err := parseBind(p.Body)
+	if err != nil {
+		s.respond(p, StatusInvCmdLen, nil)
+		return
+	}
+	key, status := authenticate(b.SystemID, b.Password, s.ip())
+	if status != StatusOK {
+		glog.Warning("[smpp] [%s] bind failed for [%s]", s, b.SystemID)
+		s.respond(p, status, nil)
+		return
+	}
+
+	w := &bodyWriter{}
+	w.cString(serverSystemID)
+	if b.InterfaceVersion >= 0x34 {
+		// sc_interface_version
+		w.tlv(0x0210, []byte{0x34})
+	}
+	s.systemID = b.SystemID
+	s.key = key
+	atomic.StoreUint32(&s.bind, p.CommandID)
+	s.respond(p, StatusOK, w.Bytes())
+	glog.Info("[smpp] [%s] %s bound as %s", s, b.SystemID, bindName(p.CommandID))
+	if s.canReceive() {
+		wake()
+	}
+}
+
+func bindName(commandID uint32) string {
+	switch commandID {
+	case BindTransmitter:
+		return "transmitter"
+	case BindReceiver:
+		return "receiver"
+	}
+	return "transceiver"
+}
+
+func (s *session) handleSubmit(p *PDU) {
+	sm, err := parseSubmit(p.Body)
+	if err != nil {
+		s.respond(p, StatusInvCmdLen, nil)
+		return
+	}
+	id, status := submit(s.systemID, s.key, s.actor(), sm)
+	if status != StatusOK {
+		s.respond(p, status, nil)
+		return
+	}
+	w := &bodyWriter{}
+	w.cString(id)
+	s.respond(p, StatusOK, w.Bytes())
+}
+
+func (s *session) handleQuery(p *PDU) {
+	q, err := parseQuery(p.Body)
+	if err != nil {
+		s.respond(p, StatusInvCmdLen, nil)
+		return
+	}
+	finalDate, state, ok := query(q.MessageID, s.key)
+	if !ok {
+		s.respond(p, StatusInvMsgID, nil)
+		return
+	}
+	w := &bodyWriter{}
+	w.cString(q.MessageID)
+	w.cString(finalDate)
+	w.WriteByte(state)
+	w.WriteByte(0)
+	s.respond(p, StatusOK, w.Bytes())
+}
+
+// deliver sends the remaining deliver_sm of d in order, a failed delivery is queued again
+func (s *session) deliver(d *delivery) {
+	for d.sent < len(d.bodies) {
+		status, err := s.request(DeliverSm, d.bodies[d.sent])
+		if err != nil || status != StatusOK {
+			d.attempts++
+			if err == nil {
+				err = fmt.Errorf("command_status 0x%08X", status)
+			}
+			glog.Warning("[smpp] [%s] deliver_sm failed [%v]", s, err)
+			if d.attempts < maxDeliveryAttempts {
+				requeue(d)
+			}
+			return
+		}
+		d.sent++
+	}
+}
@@ -0,0 +1,230 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDepth bounds nested multipart parts
+const maxDepth = 5
+
+var (
+	errEmpty = errors.New("mail has no text")
+
+	// a reply header line like "On Mon, 1 Jan 2024, Alice <a@b.c> wrote:" or "在 2024年1月1日, 张三 写道:"
+	replyHeader = regexp.MustCompile(`(?i)^(on\s.+\swrote:|.+\s写道[:：]?|-+\s*original message\s*-+|_{20,})$`)
+	// sentFrom are the one line signatures of mobile mail clients
+	sentFrom  = regexp.MustCompile(`(?i)^(sent from my |get outlook for |发自我的)`)
+	htmlBreak = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</tr>|</h[1-6]>`)
+	htmlTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlDrop  = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+	blankRuns = regexp.MustCompile(`\n{3,}`)
+)
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// toSMS turns a mail into the SMS text: the subject, a line break and the body without quoted
+// replies and signatures, cut to max_length characters
+func toSMS(raw []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid mail [%v]", err)
+	}
+	subject, err := wordDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	subject = strings.TrimSpace(subject)
+
+	body, err := textOf(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0)
+	if err != nil && !errors.Is(err, errEmpty) {
+		return "", err
+	}
+	body = clean(body)
+
+	text := subject
+	if body != "" {
+		if text != "" {
+			text += "\n"
+		}
+		text += body
+	}
+	if text == "" {
+		return "", errEmpty
+	}
+	if runes := []rune(text); len(runes) > maxLength() {
+		text = strings.TrimSpace(string(runes[:maxLength()-1])) + "…"
+	}
+	return text, nil
+}
+
+// textOf returns the text of a part, text/plain is preferred over text/html in multipart/alternative
+// and the text parts of a multipart/mixed are joined, attachments are skipped
+func textOf(contentType, encoding string, body io.Reader, depth int) (string, error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	media, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		media, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(media, "multipart/") {
+		if depth >= maxDepth || params["boundary"] == "" {
+			return "", errEmpty
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		plain, htmlText, joined := "", "", make([]string, 0)
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("invalid multipart body [%v]", err)
+			}
+			if disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition")); disposition == "attachment" {
+				continue
+			}
+			partType := part.Header.Get("Content-Type")
+			text, err := textOf(partType, part.Header.Get("Content-Transfer-Encoding"), part, depth+1)
+			if err != nil || text == "" {
+				continue
+			}
+			switch {
+			case media != "multipart/alternative":
+				joined = append(joined, text)
+			case strings.HasPrefix(strings.ToLower(partType), "text/html"):
+				htmlText = text
+			case plain == "":
+				plain = text
+			}
+		}
+		if media != "multipart/alternative" {
+			return strings.Join(joined, "\n"), nil
+		}
+		if plain != "" {
+			return plain, nil
+		}
+		return htmlText, nil
+	}
+
+	if media != "text/plain" && media != "text/html" {
+		return "", errEmpty
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &lineJoiner{r: body})
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s body [%v]", encoding, err)
+	}
+	text, err := decodeCharset(params["charset"], data)
+	if err != nil {
+		return "", err
+	}
+	if media == "text/html" {
+		text = htmlToText(text)
+	}
+	return text, nil
+}
+
+// lineJoiner drops the line breaks of base64 bodies
+type lineJoiner struct {
+	r io.Reader
+}
+
+func (l *lineJoiner) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeCharset(charset, data)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}
+
+// decodeCharset reads the charsets of the WHATWG encoding standard, e.g. GB2312, GBK and
+// GB18030 of Chinese appliances, windows-1252 and Latin-1. Text without a charset or in an
+// unknown one is accepted when it is valid UTF-8.
+func decodeCharset(charset string, data []byte) (string, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	var enc encoding.Encoding
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii":
+	case "iso-8859-1", "latin1":
+		// the encoding standard reads these as windows-1252, mail means what they say
+		enc = charmap.ISO8859_1
+	default:
+		enc, _ = htmlindex.Get(charset)
+	}
+	if enc != nil && enc != encoding.Nop {
+		text, err := enc.NewDecoder().Bytes(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s text [%v]", charset, err)
+		}
+		return string(text), nil
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("unsupported charset [%s], send UTF-8", charset)
+	}
+	return string(data), nil
+}
+
+func htmlToText(s string) string {
+	s = htmlDrop.ReplaceAllString(s, "")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// clean removes quoted replies, everything below a reply header, signatures and blank runs
+func clean(body string) string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	lines := strings.Split(body, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || trimmed == "--" || replyHeader.MatchString(trimmed) || sentFrom.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, strings.TrimRight(line, " \t"))
+	}
+	body = strings.Join(kept, "\n")
+	body = blankRuns.ReplaceAllString(body, "\n\n")
+	return strings.TrimSpace(body)
+}
@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"sms/config"
+	"testing"
+)
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		charset string
+		data    []byte
+		want    string
+	}{
+		{"", []byte("hello"), "hello"},
+		{"UTF-8", []byte("温度过高"), "温度过高"},
+		{"GB2312", []byte{0xce, 0xc2, 0xb6, 0xc8, 0xb9, 0xfd, 0xb8, 0xdf}, "温度过高"},
+		{"gbk", []byte{0xce, 0xc2, 0xb6, 0xc8}, "温度"},
+		{"GB18030", []byte{0xce, 0xc2, 0xb6, 0xc8}, "温度"},
+		{"iso-8859-1", []byte{0x43, 0x80, 0xe9}, "C\u0080é"},
+		{"windows-1252", []byte{0x43, 0x80, 0xe9}, "C€é"},
+		{"x-unknown", []byte("plain"), "plain"},
+	}
+	for _, tt := range tests {
+		got, err := decodeCharset(tt.charset, tt.data)
+		if err != nil || got != tt.want {
+			t.Errorf("decodeCharset(%q) = %q, %v, want %q", tt.charset, got, err, tt.want)
+		}
+	}
+	if _, err := decodeCharset("x-unknown", []byte{0xce, 0xc2}); err == nil {
+		t.Error("invalid UTF-8 in an unknown charset was accepted")
+	}
+}
+
+func TestToSMSGB2312(t *testing.T) {
+	config.Global = &config.Model{}
+	raw := "From: nas@example.com\r\n" +
+		"To: 13800138000@sms.local\r\n" +
+		"Subject: =?gb2312?B?uOa+rw==?=\r\n" +
+		"Content-Type: text/plain; charset=gb2312\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"zsK2yLn9uN8NCg0K1NogMjAyNMTqMdTCMcjVLCDVxcj9INC0tcA6DQo+IG9sZA0K\r\n"
+	text, err := toSMS([]byte(raw))
+	if err != nil || text != "告警\n温度过高" {
+		t.Fatalf("toSMS = %q, %v", text, err)
+	}
+}
@@ -0,0 +1,247 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"net"
+	"sms/audit"
+	"sms/config"
+	"sms/serial"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	senderName = "smtp"
+	// maxSessions bounds concurrent connections, alert mailers rarely need more than one
+	maxSessions = 20
+	// maxRecipients bounds the numbers one mail is sent to
+	maxRecipients = 10
+)
+
+var (
+	listener net.Listener
+	running  int32
+	lock     = sync.Mutex{}
+	sessions = make(map[*session]struct{})
+	networks []*net.IPNet
+)
+
+func hostname() string {
+	if config.Global.SMTP.Hostname != "" {
+		return config.Global.SMTP.Hostname
+	}
+	return "sms-gateway"
+}
+
+func domain() string {
+	if config.Global.SMTP.Domain != "" {
+		return strings.ToLower(config.Global.SMTP.Domain)
+	}
+	return "sms.local"
+}
+
+func maxSize() int {
+	if config.Global.SMTP.MaxSize > 0 {
+		return config.Global.SMTP.MaxSize
+	}
+	return 256 * 1024
+}
+
+func maxLength() int {
+	if config.Global.SMTP.MaxLength > 0 {
+		return config.Global.SMTP.MaxLength
+	}
+	return 480
+}
+
+// parseNetworks reads allowed_networks, a plain address is a single host
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowed_networks entry [%s]", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_networks entry [%s]", s)
+		}
+		parsed = append(parsed, n)
+	}
+	return parsed, nil
+}
+
+// trustedNetwork reports whether mail from addr is accepted from any sender. Without
+// allowed_networks and allowed_senders only the local host may send.
+func trustedNetwork(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if len(networks) == 0 && len(config.Global.SMTP.AllowedSenders) == 0 {
+		return tcp.IP.IsLoopback()
+	}
+	for _, n := range networks {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedSender reports whether the envelope sender is in allowed_senders, entries are
+// addresses or @domain for a whole domain. The envelope sender is not authenticated, list
+// only senders of networks that do not forge them.
+func allowedSender(from string) bool {
+	from = strings.ToLower(from)
+	for _, s := range config.Global.SMTP.AllowedSenders {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		if s == from || (strings.HasPrefix(s, "@") && strings.HasSuffix(from, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientPhone returns the phone number of a recipient address of the configured domain
+func recipientPhone(addr string) (string, bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 1 || strings.ToLower(addr[i+1:]) != domain() {
+		return "", false
+	}
+	local := addr[:i]
+	phone := strings.Builder{}
+	for j, r := range local {
+		switch {
+		case r >= '0' && r <= '9':
+			phone.WriteRune(r)
+		case r == '+' && j == 0:
+			phone.WriteRune(r)
+		case r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", false
+		}
+	}
+	if len(strings.TrimPrefix(phone.String(), "+")) < 3 {
+		return "", false
+	}
+	return phone.String(), true
+}
+
+// EnableSMTP starts the SMTP listener that turns mail to <phone>@domain into SMS
+func EnableSMTP() {
+	cfg := config.Global.SMTP
+	if !cfg.Enable {
+		return
+	}
+	var err error
+	if networks, err = parseNetworks(cfg.AllowedNetworks); err != nil {
+		glog.Fatal("[smtp] %v", err)
+	}
+	port := cfg.Port
+	if port <= 0 {
+		port = 2525
+	}
+	listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Addr, port))
+	if err != nil {
+		glog.Error("[smtp] listen failed [%v]", err)
+		return
+	}
+	atomic.StoreInt32(&running, 1)
+	go accept(listener)
+
+	glog.Info("SMTP listener started on %s for @%s", listener.Addr(), domain())
+}
+
+// KillSMTP stops accepting mail and closes every connection
+func KillSMTP() {
+	if !atomic.CompareAndSwapInt32(&running, 1, 0) {
+		return
+	}
+	_ = listener.Close()
+	lock.Lock()
+	defer lock.Unlock()
+	for s := range sessions {
+		_ = s.conn.Close()
+	}
+}
+
+func isRunning() bool {
+	return atomic.LoadInt32(&running) == 1
+}
+
+func accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if isRunning() {
+				glog.Warning("[smtp] accept failed [%v]", err)
+			}
+			return
+		}
+		s := newSession(conn)
+		lock.Lock()
+		if len(sessions) >= maxSessions {
+			lock.Unlock()
+			s.reply(421, "4.7.0 Too many connections, try again later")
+			_ = conn.Close()
+			continue
+		}
+		sessions[s] = struct{}{}
+		lock.Unlock()
+		go func() {
+			s.serve()
+			lock.Lock()
+			delete(sessions, s)
+			lock.Unlock()
+		}()
+	}
+}
+
+// send texts the message to every recipient through the routed device, it fails only when
+// no recipient could be sent to so the client retries without duplicating any SMS
+func send(actor audit.Actor, from string, phones []string, text string) error {
+	sent := 0
+	var last error
+	for _, phone := range phones {
+		device, route, ids, err := serial.SendTo("", senderName, phone, text)
+		entry := &audit.Message{Via: "smtp", Device: device, Route: route, Sender: from, Phone: phone, Message: text, IDs: ids}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		audit.RecordSend(actor, entry)
+		if err != nil {
+			glog.Warning("[smtp] mail from [%s] to [%s] failed [%v]", from, phone, err)
+			last = err
+			continue
+		}
+		sent++
+		glog.Info("[smtp] mail from [%s] sent to [%s] via [%s] %v", from, phone, device, ids)
+	}
+	if sent == 0 && last != nil {
+		return last
+	}
+	return nil
+}
+
+// temporary reports whether a send error may go away, the client should then retry
+func temporary(err error) bool {
+	return !errors.Is(err, serial.ErrNoRoute) && !errors.Is(err, serial.ErrDeviceNotFound)
+}
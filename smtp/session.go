@@ -0,0 +1,243 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"io"
+	"net"
+	"net/textproto"
+	"sms/audit"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const commandTimeout = 5 * time.Minute
+
+var errTooLarge = errors.New("message too large")
+
+// session is one SMTP connection, a minimal RFC 5321 server without AUTH and STARTTLS
+type session struct {
+	conn    net.Conn
+	text    *textproto.Conn
+	trusted bool
+
+	helo   string
+	from   string
+	phones []string
+	// hasFrom is set by MAIL, the null reverse path <> is a valid sender
+	hasFrom bool
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		conn:    conn,
+		text:    textproto.NewConn(conn),
+		trusted: trustedNetwork(conn.RemoteAddr()),
+	}
+}
+
+func (s *session) String() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// ip is the client address recorded in the audit log
+func (s *session) ip() string {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return s.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (s *session) reply(code int, lines ...string) {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(time.Minute))
+	for i, line := range lines {
+		sep := " "
+		if i < len(lines)-1 {
+			sep = "-"
+		}
+		_ = s.text.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+func (s *session) reset() {
+	s.from = ""
+	s.hasFrom = false
+	s.phones = nil
+}
+
+func (s *session) serve() {
+	defer func() { _ = s.text.Close() }()
+	glog.Debug("[smtp] [%s] connected", s)
+	s.reply(220, hostname()+" ESMTP SMS gateway")
+
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(commandTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			glog.Debug("[smtp] [%s] read failed [%v]", s, err)
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.helo = arg
+			s.reset()
+			s.reply(250, hostname())
+		case "EHLO":
+			s.helo = arg
+			s.reset()
+			s.reply(250, hostname(), "PIPELINING", "8BITMIME", "SIZE "+strconv.Itoa(maxSize()), "ENHANCEDSTATUSCODES")
+		case "MAIL":
+			s.mail(arg)
+		case "RCPT":
+			s.rcpt(arg)
+		case "DATA":
+			s.data()
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 OK")
+		case "NOOP":
+			s.reply(250, "2.0.0 OK")
+		case "VRFY":
+			s.reply(252, "2.5.0 Cannot verify, send some mail")
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+		case "STARTTLS", "AUTH":
+			s.reply(502, "5.5.1 Not supported, access is granted by network and sender")
+		default:
+			s.reply(500, "5.5.2 Unknown command")
+		}
+	}
+}
+
+// path returns the address of a FROM:<addr> or TO:<addr> argument and the parameters after it
+func path(arg, prefix string) (string, string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", "", false
+	}
+	return arg[1:end], strings.TrimSpace(arg[end+1:]), true
+}
+
+func (s *session) mail(arg string) {
+	if s.helo == "" {
+		s.reply(503, "5.5.1 Send HELO or EHLO first")
+		return
+	}
+	if s.hasFrom {
+		s.reply(503, "5.5.1 Sender already given")
+		return
+	}
+	from, params, ok := path(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range strings.Fields(params) {
+		if strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+			if size, err := strconv.Atoi(param[5:]); err == nil && size > maxSize() {
+				s.reply(552, "5.3.4 Message too large")
+				return
+			}
+		}
+	}
+	if !s.trusted && !allowedSender(from) {
+		glog.Warning("[smtp] [%s] rejected sender [%s]", s, from)
+		s.reply(550, "5.7.1 Sender not allowed")
+		return
+	}
+	s.from = from
+	s.hasFrom = true
+	s.reply(250, "2.1.0 OK")
+}
+
+func (s *session) rcpt(arg string) {
+	if !s.hasFrom {
+		s.reply(503, "5.5.1 Send MAIL first")
+		return
+	}
+	to, _, ok := path(arg, "TO:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	phone, ok := recipientPhone(to)
+	if !ok {
+		s.reply(550, fmt.Sprintf("5.1.1 Only <phone>@%s is accepted", domain()))
+		return
+	}
+	if len(s.phones) >= maxRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	s.phones = append(s.phones, phone)
+	s.reply(250, "2.1.5 OK")
+}
+
+func (s *session) data() {
+	if !s.hasFrom || len(s.phones) == 0 {
+		s.reply(503, "5.5.1 Send MAIL and RCPT first")
+		return
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	_ = s.conn.SetReadDeadline(time.Now().Add(commandTimeout))
+	raw, err := readData(s.text.DotReader(), maxSize())
+	if err != nil {
+		if errors.Is(err, errTooLarge) {
+			s.reply(552, "5.3.4 Message too large")
+			s.reset()
+			return
+		}
+		glog.Debug("[smtp] [%s] read data failed [%v]", s, err)
+		_ = s.text.Close()
+		return
+	}
+	from, phones := s.from, s.phones
+	s.reset()
+
+	text, err := toSMS(raw)
+	if err != nil {
+		glog.Warning("[smtp] [%s] invalid mail from [%s] [%v]", s, from, err)
+		s.reply(554, "5.6.0 "+err.Error())
+		return
+	}
+	if err = send(audit.Actor{Name: "smtp:" + from, IP: s.ip()}, from, phones, text); err != nil {
+		if temporary(err) {
+			s.reply(451, "4.3.0 "+err.Error())
+		} else {
+			s.reply(554, "5.1.2 "+err.Error())
+		}
+		return
+	}
+	s.reply(250, "2.0.0 Queued as SMS")
+}
+
+// readData reads the whole DATA section, draining what exceeds max so the session stays usable
+func readData(r io.Reader, max int) ([]byte, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > max {
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+		return nil, errTooLarge
+	}
+	return raw, nil
+}
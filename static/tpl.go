@@ -17,6 +17,15 @@ var Login *template.Template
 var Index *template.Template
 var SendSMS *template.Template
 var History *template.Template
+var RuleTest *template.Template
+var RuleLogs *template.Template
+var Spam *template.Template
+var Campaigns *template.Template
+var Schedules *template.Template
+var Keys *template.Template
+var Audit *template.Template
+var Users *template.Template
+var Help *template.Template
 
 func init() {
 	t := template.Must(template.ParseFS(html, "gohtml/*"))
@@ -37,4 +46,40 @@ func init() {
 	if History == nil {
 		glog.Fatal("missing gohtml template [history.gohtml]")
 	}
+	RuleTest = t.Lookup("rule_test.gohtml")
+	if RuleTest == nil {
+		glog.Fatal("missing gohtml template [rule_test.gohtml]")
+	}
+	RuleLogs = t.Lookup("rule_logs.gohtml")
+	if RuleLogs == nil {
+		glog.Fatal("missing gohtml template [rule_logs.gohtml]")
+	}
+	Spam = t.Lookup("spam.gohtml")
+	if Spam == nil {
+		glog.Fatal("missing gohtml template [spam.gohtml]")
+	}
+	Campaigns = t.Lookup("campaigns.gohtml")
+	if Campaigns == nil {
+		glog.Fatal("missing gohtml template [campaigns.gohtml]")
+	}
+	Schedules = t.Lookup("schedules.gohtml")
+	if Schedules == nil {
+		glog.Fatal("missing gohtml template [schedules.gohtml]")
+	}
+	Keys = t.Lookup("keys.gohtml")
+	if Keys == nil {
+		glog.Fatal("missing gohtml template [keys.gohtml]")
+	}
+	Audit = t.Lookup("audit.gohtml")
+	if Audit == nil {
+		glog.Fatal("missing gohtml template [audit.gohtml]")
+	}
+	Users = t.Lookup("users.gohtml")
+	if Users == nil {
+		glog.Fatal("missing gohtml template [users.gohtml]")
+	}
+	Help = t.Lookup("help.gohtml")
+	if Help == nil {
+		glog.Fatal("missing gohtml template [help.gohtml]")
+	}
 }
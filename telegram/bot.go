@@ -0,0 +1,127 @@
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Bot is a minimal Telegram Bot API client
+type Bot struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+type apiResponse struct {
+	Ok          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+type Chat struct {
+	ID int64 `json:"id"`
+}
+
+type User struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type Message struct {
+	MessageID      int64    `json:"message_id"`
+	From           *User    `json:"from"`
+	Chat           Chat     `json:"chat"`
+	Date           int64    `json:"date"`
+	Text           string   `json:"text"`
+	ReplyToMessage *Message `json:"reply_to_message"`
+}
+
+type Update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *Message `json:"message"`
+}
+
+// NewBot creates a client for the Bot API at base, e.g. https://api.telegram.org
+func NewBot(base, token string, pollTimeout time.Duration) *Bot {
+	return &Bot{
+		base:  strings.TrimRight(base, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout: pollTimeout + 10*time.Second,
+		},
+	}
+}
+
+func (b *Bot) call(method string, args interface{}, result interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/bot%s/%s", b.base, b.token, method)
+	rsp, err := b.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the error of the client quotes the URL, which holds the token
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return fmt.Errorf("%s: %v", method, uerr.Err)
+		}
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	resp := &apiResponse{}
+	err = json.Unmarshal(data, resp)
+	if err != nil {
+		return fmt.Errorf("%s: invalid response [%d]", method, rsp.StatusCode)
+	}
+	if !resp.Ok {
+		return fmt.Errorf("%s: %s", method, resp.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// SendMessage sends text to chatID and returns the id of the new message
+func (b *Bot) SendMessage(chatID int64, text string, replyTo int64) (int64, error) {
+	args := map[string]interface{}{
+		"chat_id": chatID,
+		"text":    text,
+	}
+	if replyTo != 0 {
+		args["reply_to_message_id"] = replyTo
+	}
+	msg := &Message{}
+	err := b.call("sendMessage", args, msg)
+	if err != nil {
+		return 0, err
+	}
+	return msg.MessageID, nil
+}
+
+// GetUpdates long-polls for updates starting at offset
+func (b *Bot) GetUpdates(offset int64, timeout time.Duration) ([]Update, error) {
+	args := map[string]interface{}{
+		"offset":          offset,
+		"timeout":         int(timeout / time.Second),
+		"allowed_updates": []string{"message"},
+	}
+	updates := make([]Update, 0)
+	err := b.call("getUpdates", args, &updates)
+	if err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
@@ -0,0 +1,56 @@
+package telegram
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "123456:secret-token"
+
+func TestSendMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bot"+testToken+"/sendMessage" {
+			t.Errorf("path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		args := map[string]interface{}{}
+		if err := json.Unmarshal(body, &args); err != nil {
+			t.Errorf("body %s: %v", body, err)
+		}
+		if args["text"] != "hello" || args["reply_to_message_id"] != float64(7) {
+			t.Errorf("args %v", args)
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":42,"chat":{"id":1}}}`))
+	}))
+	defer srv.Close()
+
+	bot := NewBot(srv.URL+"/", testToken, time.Second)
+	id, err := bot.SendMessage(1, "hello", 7)
+	if err != nil || id != 42 {
+		t.Fatalf("SendMessage = %d, %v", id, err)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":false,"description":"Bad Request: chat not found"}`))
+	}))
+	bot := NewBot(srv.URL, testToken, time.Second)
+	if _, err := bot.SendMessage(1, "hello", 0); err == nil || err.Error() != "sendMessage: Bad Request: chat not found" {
+		t.Fatalf("api error = %v", err)
+	}
+
+	srv.Close()
+	_, err := bot.GetUpdates(0, time.Second)
+	if err == nil {
+		t.Fatal("no error from a closed server")
+	}
+	if strings.Contains(err.Error(), testToken) {
+		t.Fatalf("error leaks the token: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package telegram
+
+import (
+	"fmt"
+	"github.com/Akvicor/glog"
+	"sms/audit"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const senderName = "telegram"
+
+var (
+	bot     *Bot
+	running int32
+)
+
+// EnableTelegram starts forwarding inbound SMS to Telegram and polling for replies
+func EnableTelegram() {
+	cfg := config.Global.Telegram
+	if !cfg.Enable {
+		return
+	}
+	if cfg.Token == "" || cfg.ChatID == 0 {
+		glog.Error("telegram bridge enabled without token or chat_id")
+		return
+	}
+	base := cfg.APIBase
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	timeout := time.Duration(cfg.PollTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	bot = NewBot(base, cfg.Token, timeout)
+	atomic.StoreInt32(&running, 1)
+	serial.OnReceived(forward)
+	serial.OnAlert(alert)
+	go poll(timeout)
+
+	glog.Info("Telegram bridge started for chat %d", cfg.ChatID)
+}
+
+func KillTelegram() {
+	atomic.StoreInt32(&running, 0)
+}
+
+func isRunning() bool {
+	return atomic.LoadInt32(&running) == 1
+}
+
+// forward posts an inbound SMS to the configured chat and remembers where it came from
+func forward(device string, historyID int64, sms *model.SMS) {
+	if !isRunning() {
+		return
+	}
+	chatID := config.Global.Telegram.ChatID
+	text := fmt.Sprintf("[%s] %s\n%s\n\n%s", device, sms.Phone, sms.Time, sms.Message)
+	messageID, err := bot.SendMessage(chatID, text, 0)
+	if err != nil {
+		glog.Warning("[telegram] forward sms from %s failed [%v]", sms.Phone, err)
+		return
+	}
+	db.InsertTelegramMap(chatID, messageID, device, sms.Phone, historyID)
+}
+
+// alert posts a gateway alert to the configured chat
+func alert(text string) {
+	if !isRunning() {
+		return
+	}
+	if _, err := bot.SendMessage(config.Global.Telegram.ChatID, "[alert] "+text, 0); err != nil {
+		glog.Warning("[telegram] send alert failed [%v]", err)
+	}
+}
+
+func poll(timeout time.Duration) {
+	var offset int64
+	for isRunning() {
+		updates, err := bot.GetUpdates(offset, timeout)
+		if err != nil {
+			glog.Warning("[telegram] get updates failed [%v]", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, update := range updates {
+			if update.UpdateID >= offset {
+				offset = update.UpdateID + 1
+			}
+			if update.Message != nil {
+				handleMessage(update.Message)
+			}
+		}
+	}
+}
+
+// handleMessage sends a reply to a forwarded message back to the original sender
+func handleMessage(msg *Message) {
+	chatID := config.Global.Telegram.ChatID
+	if msg.Chat.ID != chatID || msg.ReplyToMessage == nil {
+		return
+	}
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		return
+	}
+	mp := db.GetTelegramMap(chatID, msg.ReplyToMessage.MessageID)
+	if mp == nil {
+		_, _ = bot.SendMessage(chatID, "unknown message, reply to a forwarded SMS", msg.MessageID)
+		return
+	}
+
+	ids, err := serial.Send(mp.Device, senderName, model.NewMSG(model.MsgTagSmsSend, model.NewSMSLong(mp.Phone, text)))
+	entry := &audit.Message{Via: "telegram", Device: mp.Device, Sender: senderName, Phone: mp.Phone, Message: text, IDs: ids}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	audit.RecordSend(audit.Actor{Name: "telegram:" + chatUser(msg.From)}, entry)
+	if err != nil {
+		glog.Warning("[telegram] reply to %s via %s failed [%v]", mp.Phone, mp.Device, err)
+		_, _ = bot.SendMessage(chatID, fmt.Sprintf("send failed: %v", err), msg.MessageID)
+		return
+	}
+	// replies to the reply go to the same sender
+	db.InsertTelegramMap(chatID, msg.MessageID, mp.Device, mp.Phone, mp.HistoryID)
+	glog.Info("[telegram] reply sent to %s via %s", mp.Phone, mp.Device)
+}
+
+// chatUser names the Telegram user of a message for the audit log
+func chatUser(u *User) string {
+	switch {
+	case u == nil:
+		return "unknown"
+	case u.Username != "":
+		return u.Username
+	}
+	return strconv.FormatInt(u.ID, 10)
+}
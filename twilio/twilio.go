@@ -0,0 +1,264 @@
+package twilio
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sms/config"
+	"sms/db"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIVersion is the Twilio REST API version the gateway imitates
+const APIVersion = "2010-04-01"
+
+const senderName = "twilio"
+
+// dateFormat is how Twilio formats dates in JSON, always in UTC
+const dateFormat = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+// Message is a message resource as Twilio returns it, optional fields are null rather than omitted
+type Message struct {
+	AccountSID          string            `json:"account_sid"`
+	APIVersion          string            `json:"api_version"`
+	Body                string            `json:"body"`
+	DateCreated         string            `json:"date_created"`
+	DateSent            *string           `json:"date_sent"`
+	DateUpdated         string            `json:"date_updated"`
+	Direction           string            `json:"direction"`
+	ErrorCode           *int              `json:"error_code"`
+	ErrorMessage        *string           `json:"error_message"`
+	From                string            `json:"from"`
+	MessagingServiceSID *string           `json:"messaging_service_sid"`
+	NumMedia            string            `json:"num_media"`
+	NumSegments         string            `json:"num_segments"`
+	Price               *string           `json:"price"`
+	PriceUnit           *string           `json:"price_unit"`
+	SID                 string            `json:"sid"`
+	Status              string            `json:"status"`
+	SubresourceURIs     map[string]string `json:"subresource_uris"`
+	To                  string            `json:"to"`
+	URI                 string            `json:"uri"`
+}
+
+// MessagePage is a page of the message list
+type MessagePage struct {
+	Messages        []*Message `json:"messages"`
+	End             int        `json:"end"`
+	FirstPageURI    string     `json:"first_page_uri"`
+	NextPageURI     *string    `json:"next_page_uri"`
+	Page            int        `json:"page"`
+	PageSize        int        `json:"page_size"`
+	PreviousPageURI *string    `json:"previous_page_uri"`
+	Start           int        `json:"start"`
+	URI             string     `json:"uri"`
+}
+
+// Error is the body of Twilio error responses
+type Error struct {
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+	Status   int    `json:"status"`
+}
+
+// Twilio error codes used by the facade
+const (
+	ErrAuthenticate     = 20003
+	ErrNotFound         = 20404
+	ErrTooManyRequests  = 20429
+	ErrUnavailable      = 20503
+	ErrInvalidParameter = 21200
+	ErrInvalidTo        = 21211
+	ErrBodyRequired     = 21602
+	ErrToRequired       = 21604
+	ErrInvalidFrom      = 21606
+	ErrUnreachable      = 21612
+	ErrInvalidCallback  = 21609
+	ErrUnknown          = 30008
+)
+
+func NewError(status, code int, message string) *Error {
+	return &Error{Code: code, Message: message, MoreInfo: fmt.Sprintf("https://www.twilio.com/docs/errors/%d", code), Status: status}
+}
+
+// AccountSID is [twilio] account_sid, or an SID derived from the access key when it is not set
+func AccountSID() string {
+	if config.Global.Twilio.AccountSID != "" {
+		return config.Global.Twilio.AccountSID
+	}
+	sum := md5.Sum([]byte(config.Global.Security.AccessKey))
+	return "AC" + hex.EncodeToString(sum[:])
+}
+
+// AuthToken signs the requests posted to webhooks, [twilio] auth_token or the access key
+func AuthToken() string {
+	if config.Global.Twilio.AuthToken != "" {
+		return config.Global.Twilio.AuthToken
+	}
+	return config.Global.Security.AccessKey
+}
+
+// MessageSID is the Twilio SID of a gateway message id
+func MessageSID(id int64) string {
+	return fmt.Sprintf("SM%032x", id)
+}
+
+// ParseMessageSID returns the gateway message id of an SID made by MessageSID
+func ParseMessageSID(sid string) (int64, bool) {
+	sid = strings.TrimSuffix(sid, ".json")
+	if len(sid) != 34 || !strings.HasPrefix(sid, "SM") {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(strings.TrimLeft(sid[2:], "0"), 16, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// Status maps a gateway message state to the Twilio one
+func Status(status string) string {
+	switch status {
+	case db.MessageQueued:
+		return "queued"
+	case db.MessageWritten, db.MessageRerouted:
+		return "sending"
+	case db.MessageAcked:
+		return "sent"
+	case db.MessageDelivered:
+		return "delivered"
+	case db.MessageFailed:
+		return "failed"
+	}
+	return "received"
+}
+
+// Sign is the X-Twilio-Signature of a form posted to u: the base64 HMAC-SHA1 of the URL
+// followed by every parameter name and value, sorted by name
+func Sign(u string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(AuthToken()))
+	mac.Write([]byte(u))
+	for _, k := range keys {
+		values := append([]string{}, params[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			mac.Write([]byte(k))
+			mac.Write([]byte(v))
+		}
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// selfPhone is the number of a device, its name when the number is not configured
+func selfPhone(device string) string {
+	for _, dev := range config.Global.SerialDevices {
+		if dev.Name == device && dev.SelfPhone != "" {
+			return dev.SelfPhone
+		}
+	}
+	return device
+}
+
+// DeviceOf returns the device or pool a From or MessagingServiceSid names, by name or by number
+func DeviceOf(name string) string {
+	for _, dev := range config.Global.SerialDevices {
+		if name == dev.Name || (dev.SelfPhone != "" && name == dev.SelfPhone) {
+			return dev.Name
+		}
+	}
+	for _, pool := range config.Global.Pools {
+		if name == pool.Name {
+			return pool.Name
+		}
+	}
+	return ""
+}
+
+func date(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(dateFormat)
+}
+
+// MessageURI is the path of a message resource
+func MessageURI(accountSID string, id int64) string {
+	return "/" + APIVersion + "/Accounts/" + accountSID + "/Messages/" + MessageSID(id) + ".json"
+}
+
+// NewMessage builds the resource of the logical message whose first segment is his
+func NewMessage(accountSID string, his *db.HistoryModel) *Message {
+	id := his.ID
+	if his.MessageID != 0 {
+		id = his.MessageID
+	}
+	segments := db.GetMessageSegments(id)
+	if len(segments) == 0 {
+		segments = []db.HistoryModel{*his}
+	}
+	status := db.MessageStatus(segments)
+	if his.Direction == db.HistoryDirectionIn {
+		status = his.Status()
+	}
+
+	body := strings.Builder{}
+	updated, sent := his.RecordTime, int64(0)
+	var errorMessage *string
+	for i := range segments {
+		body.WriteString(segments[i].Message)
+		for _, t := range []int64{segments[i].SentTime, segments[i].AckTime, segments[i].DeliveredTime, segments[i].FailedTime} {
+			if t > updated {
+				updated = t
+			}
+		}
+		if segments[i].SentTime > sent {
+			sent = segments[i].SentTime
+		}
+		if segments[i].Error != "" {
+			errorMessage = &segments[i].Error
+		}
+	}
+
+	uri := MessageURI(accountSID, id)
+	m := &Message{
+		AccountSID:      accountSID,
+		APIVersion:      APIVersion,
+		Body:            body.String(),
+		DateCreated:     date(his.RecordTime),
+		DateUpdated:     date(updated),
+		Direction:       "outbound-api",
+		From:            selfPhone(his.Device),
+		NumMedia:        "0",
+		NumSegments:     strconv.Itoa(len(segments)),
+		SID:             MessageSID(id),
+		Status:          Status(status),
+		SubresourceURIs: map[string]string{"media": strings.TrimSuffix(uri, ".json") + "/Media.json"},
+		To:              his.Phone,
+		URI:             uri,
+	}
+	if his.Direction == db.HistoryDirectionIn {
+		m.Direction = "inbound"
+		m.From, m.To = his.Phone, selfPhone(his.Device)
+		sent = his.RecordTime
+	}
+	if sent > 0 {
+		s := date(sent)
+		m.DateSent = &s
+	}
+	if status == db.MessageFailed {
+		code := ErrUnknown
+		m.ErrorCode = &code
+		m.ErrorMessage = errorMessage
+	}
+	return m
+}
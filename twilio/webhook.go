@@ -0,0 +1,172 @@
+package twilio
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/Akvicor/glog"
+	"io"
+	"net/http"
+	"net/url"
+	"sms/callback"
+	"sms/config"
+	"sms/db"
+	"sms/model"
+	"sms/serial"
+	"strings"
+	"time"
+)
+
+// CallbackFormat is the status callback format of messages sent through the facade
+const CallbackFormat = "twilio"
+
+// maxReply bounds the TwiML read from the inbound webhook
+const maxReply = 64 * 1024
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// twiML is the part of a webhook response the gateway acts on, every <Message> is sent as a reply
+type twiML struct {
+	Messages []struct {
+		To   string `xml:"to,attr"`
+		Body string `xml:"Body"`
+		Text string `xml:",chardata"`
+	} `xml:"Message"`
+}
+
+// EnableTwilio registers the Twilio status callback format and posts inbound SMS to
+// [twilio] inbound_webhook
+func EnableTwilio() {
+	if !config.Global.Twilio.Enable {
+		return
+	}
+	callback.SetFormatter(CallbackFormat, statusPayload)
+	if config.Global.Twilio.InboundWebhook != "" {
+		if err := callback.ValidateURL(config.Global.Twilio.InboundWebhook); err != nil {
+			glog.Fatal("[twilio] %v", err)
+		}
+		serial.OnReceived(postInbound)
+	}
+	glog.Info("[twilio] facade enabled for account %s", AccountSID())
+}
+
+// statusPayload encodes a state change like Twilio's status callbacks
+func statusPayload(u string, e *callback.Event) *callback.Payload {
+	from := ""
+	if len(e.Segments) > 0 {
+		from = selfPhone(e.Segments[len(e.Segments)-1].Device)
+	}
+	status := Status(e.Status)
+	form := url.Values{
+		"AccountSid":    {AccountSID()},
+		"ApiVersion":    {APIVersion},
+		"MessageSid":    {MessageSID(e.MessageID)},
+		"SmsSid":        {MessageSID(e.MessageID)},
+		"MessageStatus": {status},
+		"SmsStatus":     {status},
+		"From":          {from},
+		"To":            {e.Phone},
+	}
+	if e.Status == db.MessageFailed {
+		form.Set("ErrorCode", fmt.Sprint(ErrUnknown))
+	}
+	return formPayload(u, form)
+}
+
+func formPayload(u string, form url.Values) *callback.Payload {
+	return &callback.Payload{
+		ContentType: "application/x-www-form-urlencoded",
+		Body:        []byte(form.Encode()),
+		Header:      map[string]string{"X-Twilio-Signature": Sign(u, form)},
+	}
+}
+
+// postInbound posts an inbound SMS to the webhook like Twilio does for an incoming message,
+// a TwiML response with <Message> is sent back to the sender
+func postInbound(device string, historyID int64, sms *model.SMS) {
+	u := config.Global.Twilio.InboundWebhook
+	form := url.Values{
+		"AccountSid":    {AccountSID()},
+		"ApiVersion":    {APIVersion},
+		"MessageSid":    {MessageSID(historyID)},
+		"SmsSid":        {MessageSID(historyID)},
+		"SmsMessageSid": {MessageSID(historyID)},
+		"SmsStatus":     {"received"},
+		"From":          {sms.Phone},
+		"To":            {selfPhone(device)},
+		"Body":          {sms.Message},
+		"NumMedia":      {"0"},
+		"NumSegments":   {"1"},
+	}
+
+	retries := config.Global.API.CallbackRetries
+	if retries < 0 {
+		retries = 0
+	}
+	backoff := 5 * time.Second
+	for attempt := 0; ; attempt++ {
+		reply, err := post(u, form)
+		if err == nil {
+			glog.Debug("[twilio] inbound %d posted to %s", historyID, u)
+			answer(device, sms.Phone, reply)
+			return
+		}
+		if attempt >= retries {
+			glog.Warning("[twilio] inbound %d to %s failed after %d attempts [%v]", historyID, u, attempt+1, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func post(u string, form url.Values) ([]byte, error) {
+	p := formPayload(u, form)
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(p.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", p.ContentType)
+	req.Header.Set("User-Agent", "TwilioProxy/1.1")
+	for k, v := range p.Header {
+		req.Header.Set(k, v)
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rsp.Body.Close() }()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return nil, fmt.Errorf("status %d", rsp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(rsp.Body, maxReply))
+}
+
+// answer sends the <Message> verbs of a TwiML response, to the sender unless they have a to attribute
+func answer(device, phone string, reply []byte) {
+	reply = bytes.TrimSpace(reply)
+	if len(reply) == 0 || reply[0] != '<' {
+		return
+	}
+	res := &twiML{}
+	if err := xml.Unmarshal(reply, res); err != nil {
+		glog.Warning("[twilio] invalid TwiML from webhook [%v]", err)
+		return
+	}
+	for _, m := range res.Messages {
+		body := strings.TrimSpace(m.Body)
+		if body == "" {
+			body = strings.TrimSpace(m.Text)
+		}
+		if body == "" {
+			continue
+		}
+		to := phone
+		if m.To != "" {
+			to = m.To
+		}
+		if _, _, _, err := serial.SendTo(device, senderName, to, body); err != nil {
+			glog.Warning("[twilio] reply to [%s] via [%s] failed [%v]", to, device, err)
+		}
+	}
+}